@@ -5,16 +5,27 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 )
 
-// Config represents the application configuration
+// Config represents the application configuration. Moodle is the single
+// site of older configs; when Instances lists several sites, Moodle is
+// ignored.
 type Config struct {
 	Server    ServerConfig    `json:"server"`
 	Moodle    MoodleConfig    `json:"moodle"`
+	Instances []MoodleConfig  `json:"instances,omitempty"`
 	Security  SecurityConfig  `json:"security"`
 	Monitoring MonitoringConfig `json:"monitoring"`
 }
 
+// DefaultInstanceName names the Moodle site of a single-instance config
+const DefaultInstanceName = "default"
+
+// instanceNamePattern restricts instance names to what fits in a URL path
+var instanceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
 // ServerConfig contains server configuration
 type ServerConfig struct {
 	Port int    `json:"port"`
@@ -22,11 +33,243 @@ type ServerConfig struct {
 	Debug bool  `json:"debug"`
 }
 
-// MoodleConfig contains Moodle configuration
+// MoodleConfig contains the configuration of a Moodle site. Name tells the
+// sites of a multi-instance config apart.
 type MoodleConfig struct {
-	Path       string `json:"path"`
-	ConfigPath string `json:"config_path"`
-	DataPath   string `json:"data_path"`
+	Name                string              `json:"name,omitempty"`
+	Path                string              `json:"path"`
+	ConfigPath          string              `json:"config_path"`
+	DataPath            string              `json:"data_path"`
+	PHPBinary           string              `json:"php_binary"`
+	WebUser             string              `json:"web_user"`
+	MaintenanceTemplate string              `json:"maintenance_template,omitempty"`
+	ServiceManager      string              `json:"service_manager"`
+	Components          []ComponentConfig   `json:"components"`
+	Cron                CronConfig          `json:"cron"`
+	Upgrade             UpgradeConfig       `json:"upgrade"`
+	Probes              ProbeConfig         `json:"probes"`
+	Storage             StorageConfig       `json:"storage"`
+	Integrity           IntegrityConfig     `json:"integrity"`
+	PHPFPM              PHPFPMConfig        `json:"php_fpm"`
+	WebStatus           WebStatusConfig     `json:"web_status"`
+	AccessLog           AccessLogConfig     `json:"access_log"`
+	ErrorLog            ErrorLogConfig      `json:"error_log"`
+	ConfigHistory       ConfigHistoryConfig `json:"config_history"`
+	TaskHealth          TaskHealthConfig    `json:"task_health"`
+	Usage               UsageConfig         `json:"usage"`
+	UserAdmin           UserAdminConfig     `json:"user_admin"`
+}
+
+// CronConfig contains the built-in Moodle cron runner configuration.
+// Disable the system crontab entry for cron.php when enabling it.
+type CronConfig struct {
+	Enabled          bool `json:"enabled"`
+	Interval         int  `json:"interval"`
+	Timeout          int  `json:"timeout"`
+	FailureThreshold int  `json:"failure_threshold"`
+	StaleAfter       int  `json:"stale_after"`
+}
+
+// UpgradeConfig contains the Moodle core upgrade settings. Release archives
+// are only accepted from ArchivePath, the pre-upgrade backup is written to
+// BackupPath and the whole upgrade is cancelled after Timeout seconds.
+type UpgradeConfig struct {
+	ArchivePath string `json:"archive_path"`
+	BackupPath  string `json:"backup_path"`
+	Timeout     int    `json:"timeout"`
+}
+
+// StorageConfig contains the moodledata storage settings. The breakdown is
+// rescanned in the background once it is older than ScanInterval seconds and
+// cleanup deletes entries older than CleanupAge hours unless told otherwise.
+// Orphaned filedir blobs are moved to QuarantinePath, which defaults to a
+// directory in moodledata so that moving them is a rename.
+type StorageConfig struct {
+	ScanInterval   int    `json:"scan_interval"`
+	CleanupAge     int    `json:"cleanup_age"`
+	QuarantinePath string `json:"quarantine_path,omitempty"`
+}
+
+// IntegrityConfig contains the filedir integrity verifier settings. A full
+// pass re-hashes every blob, reading at most RateLimit KB per second, and a
+// new pass starts Interval hours after the previous one finished. Interrupted
+// passes resume from their checkpoint.
+type IntegrityConfig struct {
+	Enabled   bool `json:"enabled"`
+	Interval  int  `json:"interval"`
+	RateLimit int  `json:"rate_limit"`
+}
+
+// ConfigHistoryConfig contains the config.php drift detection settings.
+// config.php is hashed every Interval seconds and every new content is kept
+// as a version with secrets redacted for Retention days.
+type ConfigHistoryConfig struct {
+	Enabled   bool `json:"enabled"`
+	Interval  int  `json:"interval"`
+	Retention int  `json:"retention"`
+}
+
+// TaskHealthConfig contains the Moodle task health collector settings. A
+// scheduled task is overdue OverdueAfter minutes past its next run time. An
+// adhoc task class is stuck when its oldest due task waited AdhocMaxAge
+// minutes or more than AdhocMaxQueued of its tasks are due.
+type TaskHealthConfig struct {
+	Enabled        bool `json:"enabled"`
+	Interval       int  `json:"interval"`
+	OverdueAfter   int  `json:"overdue_after"`
+	AdhocMaxAge    int  `json:"adhoc_max_age"`
+	AdhocMaxQueued int  `json:"adhoc_max_queued"`
+}
+
+// UsageConfig contains the LMS usage collector settings. The standard log
+// store is read in batches of BatchSize events every Interval seconds, and
+// usage is kept for Retention days.
+type UsageConfig struct {
+	Enabled   bool `json:"enabled"`
+	Interval  int  `json:"interval"`
+	BatchSize int  `json:"batch_size"`
+	Retention int  `json:"retention"`
+}
+
+// UserAdminConfig contains the Moodle user administration settings. Users
+// are searched in the Moodle database, suspended, unsuspended and forced to
+// change their password through the core_user_update_users web service
+// function. WebServiceToken must belong to a Moodle user allowed to update
+// users, WebServiceURL defaults to the REST server under $CFG->wwwroot and
+// Timeout, in seconds, applies to web service requests and PHP runs alike.
+type UserAdminConfig struct {
+	Enabled         bool   `json:"enabled"`
+	WebServiceURL   string `json:"web_service_url,omitempty"`
+	WebServiceToken string `json:"web_service_token"`
+	Timeout         int    `json:"timeout"`
+}
+
+// PHPFPMConfig contains the PHP-FPM status collector settings. The status
+// page of every pool, enabled with pm.status_path in the pool configuration,
+// is requested over FastCGI every Interval seconds.
+type PHPFPMConfig struct {
+	Enabled  bool         `json:"enabled"`
+	Interval int          `json:"interval"`
+	Timeout  int          `json:"timeout"`
+	Pools    []PHPFPMPool `json:"pools"`
+}
+
+// PHPFPMPool is a PHP-FPM pool to collect the status of. Listen is the listen
+// address of the pool, a socket path or host:port. MaxChildren is the
+// pm.max_children of the pool, which the status page does not report.
+type PHPFPMPool struct {
+	Name        string `json:"name"`
+	Listen      string `json:"listen"`
+	StatusPath  string `json:"status_path,omitempty"`
+	MaxChildren int    `json:"max_children,omitempty"`
+}
+
+// WebStatusConfig contains the web server status collector settings. URL is
+// the nginx stub_status or Apache mod_status page, which must be reachable
+// from localhost. Server is "nginx" or "apache", detected from the page when
+// empty.
+type WebStatusConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Server   string `json:"server,omitempty"`
+	URL      string `json:"url"`
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+}
+
+// AccessLogConfig contains the access log analytics settings. Path is the
+// web server access log, followed across rotation and read every Interval
+// seconds. Format is "combined", "common" or a custom nginx log_format using
+// $variables; $request_time is needed for latency percentiles. Retention is
+// the number of minutes of traffic kept in memory.
+type AccessLogConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Path      string `json:"path"`
+	Format    string `json:"format"`
+	Interval  int    `json:"interval"`
+	Retention int    `json:"retention"`
+}
+
+// ErrorLogConfig contains the PHP error log collector settings. Paths are the
+// PHP-FPM error log and the PHP error_log file, read every Interval seconds.
+// An error group counts as new for NewWindow hours after it first appeared.
+type ErrorLogConfig struct {
+	Enabled   bool     `json:"enabled"`
+	Paths     []string `json:"paths"`
+	Interval  int      `json:"interval"`
+	NewWindow int      `json:"new_window"`
+}
+
+// Access log format presets
+const (
+	AccessLogCombined = "combined"
+	AccessLogCommon   = "common"
+)
+
+// Web server status page types
+const (
+	WebServerNginx  = "nginx"
+	WebServerApache = "apache"
+)
+
+// ProbeConfig contains the synthetic HTTP probe settings. The front page and
+// the login page under $CFG->wwwroot are always probed, Targets adds more.
+// A probe failing FailureThreshold times in a row raises a down alert and a
+// 95th percentile latency above SlowThreshold milliseconds a slow alert.
+type ProbeConfig struct {
+	Enabled          bool          `json:"enabled"`
+	Interval         int           `json:"interval"`
+	Timeout          int           `json:"timeout"`
+	FailureThreshold int           `json:"failure_threshold"`
+	SlowThreshold    int           `json:"slow_threshold"`
+	TLSExpiryWarning int           `json:"tls_expiry_warning"`
+	Targets          []ProbeTarget `json:"targets,omitempty"`
+}
+
+// ProbeTarget is an additional URL to probe. Relative URLs are resolved
+// against $CFG->wwwroot. The response must have ExpectedStatus (200 when
+// unset), contain every Contains marker and none of the NotContains markers.
+type ProbeTarget struct {
+	Name           string   `json:"name"`
+	URL            string   `json:"url"`
+	ExpectedStatus int      `json:"expected_status,omitempty"`
+	Contains       []string `json:"contains,omitempty"`
+	NotContains    []string `json:"not_contains,omitempty"`
+}
+
+// Moodle stack component types
+const (
+	ComponentWeb      = "web"
+	ComponentPHPFPM   = "php_fpm"
+	ComponentDatabase = "database"
+	ComponentCache    = "cache"
+)
+
+// Supported service manager backends
+const (
+	ServiceManagerSystemd     = "systemd"
+	ServiceManagerOpenRC      = "openrc"
+	ServiceManagerSysV        = "sysv"
+	ServiceManagerSupervisord = "supervisord"
+	ServiceManagerFake        = "fake"
+)
+
+// ComponentConfig describes a service unit of the Moodle stack.
+// Components without explicit dependencies depend on every component of an
+// earlier tier: database -> cache -> PHP-FPM -> web server.
+type ComponentConfig struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"`
+	Unit      string   `json:"unit"`
+	Order     int      `json:"order"`
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// componentTiers defines the implicit dependency tier of each component type
+var componentTiers = map[string]int{
+	ComponentDatabase: 0,
+	ComponentCache:    1,
+	ComponentPHPFPM:   2,
+	ComponentWeb:      3,
 }
 
 // SecurityConfig contains security configuration
@@ -44,11 +287,22 @@ type MonitoringConfig struct {
 	AlertThresholds AlertThresholdsConfig `json:"alert_thresholds"`
 }
 
-// AlertThresholdsConfig contains alert threshold configuration
+// AlertThresholdsConfig contains alert threshold configuration.
+// DBConnections is a percentage of the database max_connections and
+// DBSlowQueries a number of slow queries per minute. PHPFPMChildren is a
+// percentage of the pm.max_children of a pool and PHPFPMListenQueue a number
+// of requests waiting for a child. HTTP5xxRate is a percentage of the
+// requests in the access log and HTTPLatencyP95 a latency in milliseconds.
 type AlertThresholdsConfig struct {
-	CPU    float64 `json:"cpu"`
-	Memory float64 `json:"memory"`
-	Disk   float64 `json:"disk"`
+	CPU               float64 `json:"cpu"`
+	Memory            float64 `json:"memory"`
+	Disk              float64 `json:"disk"`
+	DBConnections     float64 `json:"db_connections"`
+	DBSlowQueries     float64 `json:"db_slow_queries"`
+	PHPFPMChildren    float64 `json:"php_fpm_children"`
+	PHPFPMListenQueue float64 `json:"php_fpm_listen_queue"`
+	HTTP5xxRate       float64 `json:"http_5xx_rate"`
+	HTTPLatencyP95    float64 `json:"http_latency_p95"`
 }
 
 // DefaultConfig returns default configuration
@@ -60,9 +314,26 @@ func DefaultConfig() *Config {
 			Debug: false,
 		},
 		Moodle: MoodleConfig{
-			Path:       "/var/www/moodle",
-			ConfigPath: "/var/www/moodle/config.php",
-			DataPath:   "/var/www/moodledata",
+			Path:           "/var/www/moodle",
+			ConfigPath:     "/var/www/moodle/config.php",
+			DataPath:       "/var/www/moodledata",
+			PHPBinary:      "php",
+			WebUser:        "www-data",
+			ServiceManager: ServiceManagerSystemd,
+			Components:     DefaultComponents(),
+			Cron:           DefaultCronConfig(),
+			Upgrade:        DefaultUpgradeConfig(),
+			Probes:         DefaultProbeConfig(),
+			Storage:        DefaultStorageConfig(),
+			Integrity:      DefaultIntegrityConfig(),
+			PHPFPM:         DefaultPHPFPMConfig(),
+			WebStatus:      DefaultWebStatusConfig(),
+			AccessLog:      DefaultAccessLogConfig(),
+			ErrorLog:       DefaultErrorLogConfig(),
+			ConfigHistory:  DefaultConfigHistoryConfig(),
+			TaskHealth:     DefaultTaskHealthConfig(),
+			Usage:          DefaultUsageConfig(),
+			UserAdmin:      DefaultUserAdminConfig(),
 		},
 		Security: SecurityConfig{
 			JWTSecret:     "your-secret-key-change-this",
@@ -74,14 +345,391 @@ func DefaultConfig() *Config {
 			UpdateInterval: 30,
 			LogRetention:   7,
 			AlertThresholds: AlertThresholdsConfig{
-				CPU:    80.0,
-				Memory: 85.0,
-				Disk:   90.0,
+				CPU:               80.0,
+				Memory:            85.0,
+				Disk:              90.0,
+				DBConnections:     80.0,
+				DBSlowQueries:     10.0,
+				PHPFPMChildren:    90.0,
+				PHPFPMListenQueue: 10.0,
+				HTTP5xxRate:       5.0,
+				HTTPLatencyP95:    3000.0,
 			},
 		},
 	}
 }
 
+// DefaultComponents returns the default Moodle stack (MariaDB, PHP-FPM, Nginx)
+func DefaultComponents() []ComponentConfig {
+	return []ComponentConfig{
+		{Name: "database", Type: ComponentDatabase, Unit: "mariadb", Order: 10},
+		{Name: "php-fpm", Type: ComponentPHPFPM, Unit: "php8.1-fpm", Order: 20},
+		{Name: "web", Type: ComponentWeb, Unit: "nginx", Order: 30},
+	}
+}
+
+// DefaultCronConfig returns the default cron runner configuration: every
+// minute, killed after 30 minutes, alerting after 3 failures in a row or
+// 10 minutes without a completed run
+func DefaultCronConfig() CronConfig {
+	return CronConfig{
+		Enabled:          false,
+		Interval:         60,
+		Timeout:          1800,
+		FailureThreshold: 3,
+		StaleAfter:       10,
+	}
+}
+
+// applyDefaults fills in cron settings missing from older configs
+func (c *CronConfig) applyDefaults() {
+	defaults := DefaultCronConfig()
+	if c.Interval == 0 {
+		c.Interval = defaults.Interval
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaults.Timeout
+	}
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = defaults.FailureThreshold
+	}
+	if c.StaleAfter == 0 {
+		c.StaleAfter = defaults.StaleAfter
+	}
+}
+
+// DefaultUpgradeConfig returns the default upgrade configuration: backups
+// next to the other Moodle backups, cancelled after two hours
+func DefaultUpgradeConfig() UpgradeConfig {
+	return UpgradeConfig{
+		ArchivePath: "/opt/lms-manager/releases",
+		BackupPath:  "/var/backups/moodle",
+		Timeout:     7200,
+	}
+}
+
+// applyDefaults fills in upgrade settings missing from older configs
+func (u *UpgradeConfig) applyDefaults() {
+	defaults := DefaultUpgradeConfig()
+	if u.ArchivePath == "" {
+		u.ArchivePath = defaults.ArchivePath
+	}
+	if u.BackupPath == "" {
+		u.BackupPath = defaults.BackupPath
+	}
+	if u.Timeout == 0 {
+		u.Timeout = defaults.Timeout
+	}
+}
+
+// DefaultStorageConfig returns the default storage configuration: rescanned
+// hourly, cleaning up entries older than a week like Moodle's own cron does
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		ScanInterval: 3600,
+		CleanupAge:   168,
+	}
+}
+
+// applyDefaults fills in storage settings missing from older configs
+func (s *StorageConfig) applyDefaults() {
+	defaults := DefaultStorageConfig()
+	if s.ScanInterval == 0 {
+		s.ScanInterval = defaults.ScanInterval
+	}
+	if s.CleanupAge == 0 {
+		s.CleanupAge = defaults.CleanupAge
+	}
+}
+
+// DefaultIntegrityConfig returns the default integrity configuration: a
+// weekly pass reading 10 MB per second
+func DefaultIntegrityConfig() IntegrityConfig {
+	return IntegrityConfig{
+		Enabled:   true,
+		Interval:  168,
+		RateLimit: 10240,
+	}
+}
+
+// applyDefaults fills in integrity settings missing from older configs
+func (i *IntegrityConfig) applyDefaults() {
+	defaults := DefaultIntegrityConfig()
+	if i.Interval == 0 {
+		i.Interval = defaults.Interval
+	}
+	if i.RateLimit == 0 {
+		i.RateLimit = defaults.RateLimit
+	}
+}
+
+// DefaultConfigHistoryConfig returns the default config.php history
+// configuration: config.php is checked every minute and versions are kept
+// for a year
+func DefaultConfigHistoryConfig() ConfigHistoryConfig {
+	return ConfigHistoryConfig{
+		Enabled:   true,
+		Interval:  60,
+		Retention: 365,
+	}
+}
+
+// applyDefaults fills in config.php history settings missing from older
+// configs
+func (h *ConfigHistoryConfig) applyDefaults() {
+	defaults := DefaultConfigHistoryConfig()
+	if h.Interval == 0 {
+		h.Interval = defaults.Interval
+	}
+	if h.Retention == 0 {
+		h.Retention = defaults.Retention
+	}
+}
+
+// DefaultTaskHealthConfig returns the default task health configuration:
+// the task tables are read every minute
+func DefaultTaskHealthConfig() TaskHealthConfig {
+	return TaskHealthConfig{
+		Enabled:        true,
+		Interval:       60,
+		OverdueAfter:   60,
+		AdhocMaxAge:    30,
+		AdhocMaxQueued: 1000,
+	}
+}
+
+// applyDefaults fills in task health settings missing from older configs
+func (t *TaskHealthConfig) applyDefaults() {
+	defaults := DefaultTaskHealthConfig()
+	if t.Interval == 0 {
+		t.Interval = defaults.Interval
+	}
+	if t.OverdueAfter == 0 {
+		t.OverdueAfter = defaults.OverdueAfter
+	}
+	if t.AdhocMaxAge == 0 {
+		t.AdhocMaxAge = defaults.AdhocMaxAge
+	}
+	if t.AdhocMaxQueued == 0 {
+		t.AdhocMaxQueued = defaults.AdhocMaxQueued
+	}
+}
+
+// DefaultUsageConfig returns the default usage configuration: new log
+// events are read every minute and usage is kept for 90 days
+func DefaultUsageConfig() UsageConfig {
+	return UsageConfig{
+		Enabled:   true,
+		Interval:  60,
+		BatchSize: 5000,
+		Retention: 90,
+	}
+}
+
+// applyDefaults fills in usage settings missing from older configs
+func (u *UsageConfig) applyDefaults() {
+	defaults := DefaultUsageConfig()
+	if u.Interval == 0 {
+		u.Interval = defaults.Interval
+	}
+	if u.BatchSize == 0 {
+		u.BatchSize = defaults.BatchSize
+	}
+	if u.Retention == 0 {
+		u.Retention = defaults.Retention
+	}
+}
+
+// DefaultUserAdminConfig returns the default user administration
+// configuration. The web service token must be set to change users.
+func DefaultUserAdminConfig() UserAdminConfig {
+	return UserAdminConfig{
+		Enabled: true,
+		Timeout: 30,
+	}
+}
+
+// applyDefaults fills in user administration settings missing from older
+// configs
+func (u *UserAdminConfig) applyDefaults() {
+	if u.Timeout == 0 {
+		u.Timeout = DefaultUserAdminConfig().Timeout
+	}
+}
+
+// DefaultPHPFPMConfig returns the default PHP-FPM configuration: the www
+// pool of the default PHP-FPM unit, collected every 15 seconds. It is
+// disabled until pm.status_path is set in the pool configuration.
+func DefaultPHPFPMConfig() PHPFPMConfig {
+	return PHPFPMConfig{
+		Enabled:  false,
+		Interval: 15,
+		Timeout:  5,
+		Pools: []PHPFPMPool{
+			{Name: "www", Listen: "/run/php/php8.1-fpm.sock", StatusPath: "/status"},
+		},
+	}
+}
+
+// applyDefaults fills in PHP-FPM settings missing from older configs
+func (p *PHPFPMConfig) applyDefaults() {
+	defaults := DefaultPHPFPMConfig()
+	if p.Interval == 0 {
+		p.Interval = defaults.Interval
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaults.Timeout
+	}
+	if p.Pools == nil {
+		p.Pools = defaults.Pools
+	}
+	for i := range p.Pools {
+		if p.Pools[i].StatusPath == "" {
+			p.Pools[i].StatusPath = "/status"
+		}
+	}
+}
+
+// DefaultWebStatusConfig returns the default web status configuration: the
+// nginx stub_status page on localhost, collected every 30 seconds. It is
+// disabled until the status page is set up.
+func DefaultWebStatusConfig() WebStatusConfig {
+	return WebStatusConfig{
+		Enabled:  false,
+		URL:      "http://127.0.0.1/nginx_status",
+		Interval: 30,
+		Timeout:  5,
+	}
+}
+
+// applyDefaults fills in web status settings missing from older configs
+func (w *WebStatusConfig) applyDefaults() {
+	defaults := DefaultWebStatusConfig()
+	if w.URL == "" {
+		w.URL = defaults.URL
+	}
+	if w.Interval == 0 {
+		w.Interval = defaults.Interval
+	}
+	if w.Timeout == 0 {
+		w.Timeout = defaults.Timeout
+	}
+}
+
+// DefaultAccessLogConfig returns the default access log configuration: the
+// nginx access log in the combined format, read every 5 seconds and kept for
+// an hour. It is disabled until enabled for the web server in use.
+func DefaultAccessLogConfig() AccessLogConfig {
+	return AccessLogConfig{
+		Enabled:   false,
+		Path:      "/var/log/nginx/access.log",
+		Format:    AccessLogCombined,
+		Interval:  5,
+		Retention: 60,
+	}
+}
+
+// applyDefaults fills in access log settings missing from older configs
+func (a *AccessLogConfig) applyDefaults() {
+	defaults := DefaultAccessLogConfig()
+	if a.Path == "" {
+		a.Path = defaults.Path
+	}
+	if a.Format == "" {
+		a.Format = defaults.Format
+	}
+	if a.Interval == 0 {
+		a.Interval = defaults.Interval
+	}
+	if a.Retention == 0 {
+		a.Retention = defaults.Retention
+	}
+}
+
+// DefaultErrorLogConfig returns the default error log configuration: the log
+// of the default PHP-FPM unit and the PHP error_log file, read every 10
+// seconds, with groups new for a day. It is disabled until enabled.
+func DefaultErrorLogConfig() ErrorLogConfig {
+	return ErrorLogConfig{
+		Enabled:   false,
+		Paths:     []string{"/var/log/php8.1-fpm.log", "/var/log/php_errors.log"},
+		Interval:  10,
+		NewWindow: 24,
+	}
+}
+
+// applyDefaults fills in error log settings missing from older configs
+func (e *ErrorLogConfig) applyDefaults() {
+	defaults := DefaultErrorLogConfig()
+	if e.Paths == nil {
+		e.Paths = defaults.Paths
+	}
+	if e.Interval == 0 {
+		e.Interval = defaults.Interval
+	}
+	if e.NewWindow == 0 {
+		e.NewWindow = defaults.NewWindow
+	}
+}
+
+// DefaultProbeConfig returns the default probe configuration: every minute
+// with a 10 second timeout, alerting after 3 failures in a row, a p95 latency
+// above 3 seconds or a certificate expiring within 14 days
+func DefaultProbeConfig() ProbeConfig {
+	return ProbeConfig{
+		Enabled:          true,
+		Interval:         60,
+		Timeout:          10,
+		FailureThreshold: 3,
+		SlowThreshold:    3000,
+		TLSExpiryWarning: 14,
+	}
+}
+
+// applyDefaults fills in probe settings missing from older configs
+func (p *ProbeConfig) applyDefaults() {
+	defaults := DefaultProbeConfig()
+	if p.Interval == 0 {
+		p.Interval = defaults.Interval
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaults.Timeout
+	}
+	if p.FailureThreshold == 0 {
+		p.FailureThreshold = defaults.FailureThreshold
+	}
+	if p.SlowThreshold == 0 {
+		p.SlowThreshold = defaults.SlowThreshold
+	}
+	if p.TLSExpiryWarning == 0 {
+		p.TLSExpiryWarning = defaults.TLSExpiryWarning
+	}
+}
+
+// applyDefaults fills in database, PHP-FPM and HTTP thresholds missing from
+// older configs
+func (a *AlertThresholdsConfig) applyDefaults() {
+	defaults := DefaultConfig().Monitoring.AlertThresholds
+	if a.DBConnections == 0 {
+		a.DBConnections = defaults.DBConnections
+	}
+	if a.DBSlowQueries == 0 {
+		a.DBSlowQueries = defaults.DBSlowQueries
+	}
+	if a.PHPFPMChildren == 0 {
+		a.PHPFPMChildren = defaults.PHPFPMChildren
+	}
+	if a.PHPFPMListenQueue == 0 {
+		a.PHPFPMListenQueue = defaults.PHPFPMListenQueue
+	}
+	if a.HTTP5xxRate == 0 {
+		a.HTTP5xxRate = defaults.HTTP5xxRate
+	}
+	if a.HTTPLatencyP95 == 0 {
+		a.HTTPLatencyP95 = defaults.HTTPLatencyP95
+	}
+}
+
 // LoadConfig loads configuration from file
 func LoadConfig(configPath string) (*Config, error) {
 	// Check if config file exists
@@ -106,9 +754,59 @@ func LoadConfig(configPath string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %v", err)
 	}
 
+	config.Moodle.applyDefaults()
+	for i := range config.Instances {
+		config.Instances[i].applyDefaults()
+	}
+	config.Monitoring.AlertThresholds.applyDefaults()
+
 	return &config, nil
 }
 
+// applyDefaults fills in Moodle settings missing from older configs
+func (m *MoodleConfig) applyDefaults() {
+	// Older configs do not declare the stack components
+	if m.ServiceManager == "" {
+		m.ServiceManager = ServiceManagerSystemd
+	}
+	if len(m.Components) == 0 {
+		m.Components = DefaultComponents()
+	}
+	if m.PHPBinary == "" {
+		m.PHPBinary = "php"
+	}
+	if m.WebUser == "" {
+		m.WebUser = "www-data"
+	}
+	m.Cron.applyDefaults()
+	m.Upgrade.applyDefaults()
+	m.Probes.applyDefaults()
+	m.Storage.applyDefaults()
+	m.Integrity.applyDefaults()
+	m.PHPFPM.applyDefaults()
+	m.WebStatus.applyDefaults()
+	m.AccessLog.applyDefaults()
+	m.ErrorLog.applyDefaults()
+	m.ConfigHistory.applyDefaults()
+	m.TaskHealth.applyDefaults()
+	m.Usage.applyDefaults()
+	m.UserAdmin.applyDefaults()
+}
+
+// MoodleInstances returns the Moodle sites to manage: the instances list, or
+// the single Moodle site of older configs under the default name
+func (c *Config) MoodleInstances() []MoodleConfig {
+	if len(c.Instances) > 0 {
+		return c.Instances
+	}
+
+	instance := c.Moodle
+	if instance.Name == "" {
+		instance.Name = DefaultInstanceName
+	}
+	return []MoodleConfig{instance}
+}
+
 // SaveConfig saves configuration to file
 func SaveConfig(config *Config, configPath string) error {
 	// Create directory if it doesn't exist
@@ -137,8 +835,30 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid server port: %d", c.Server.Port)
 	}
 
-	if c.Moodle.Path == "" {
-		return fmt.Errorf("moodle path is required")
+	names := make(map[string]bool)
+	paths := make(map[string]string)
+	for _, instance := range c.MoodleInstances() {
+		if !instanceNamePattern.MatchString(instance.Name) {
+			return fmt.Errorf("invalid moodle instance name: %q", instance.Name)
+		}
+		if names[instance.Name] {
+			return fmt.Errorf("duplicate moodle instance: %s", instance.Name)
+		}
+		names[instance.Name] = true
+
+		if paths[instance.Path] != "" {
+			return fmt.Errorf("moodle instances %s and %s share the path %s", paths[instance.Path], instance.Name, instance.Path)
+		}
+		if instance.Path != "" {
+			paths[instance.Path] = instance.Name
+		}
+
+		if err := instance.validate(); err != nil {
+			if len(c.Instances) > 0 {
+				return fmt.Errorf("moodle instance %s: %v", instance.Name, err)
+			}
+			return err
+		}
 	}
 
 	if c.Security.JWTSecret == "" || c.Security.JWTSecret == "your-secret-key-change-this" {
@@ -159,3 +879,186 @@ func (c *Config) Validate() error {
 
 	return nil
 }
+
+// validate validates the settings of a Moodle site
+func (m *MoodleConfig) validate() error {
+	if m.Path == "" {
+		return fmt.Errorf("moodle path is required")
+	}
+
+	if err := m.validateComponents(); err != nil {
+		return err
+	}
+
+	if m.Cron.Enabled && m.Cron.Interval <= 0 {
+		return fmt.Errorf("cron interval must be positive")
+	}
+
+	if m.Probes.Enabled && m.Probes.Interval <= 0 {
+		return fmt.Errorf("probe interval must be positive")
+	}
+
+	for _, target := range m.Probes.Targets {
+		if target.Name == "" || target.URL == "" {
+			return fmt.Errorf("probe targets need a name and a url")
+		}
+	}
+
+	if m.PHPFPM.Enabled && m.PHPFPM.Interval <= 0 {
+		return fmt.Errorf("php-fpm interval must be positive")
+	}
+
+	for _, pool := range m.PHPFPM.Pools {
+		if pool.Name == "" || pool.Listen == "" {
+			return fmt.Errorf("php-fpm pools need a name and a listen address")
+		}
+	}
+
+	if m.WebStatus.Enabled && m.WebStatus.Interval <= 0 {
+		return fmt.Errorf("web status interval must be positive")
+	}
+
+	switch m.WebStatus.Server {
+	case "", WebServerNginx, WebServerApache:
+	default:
+		return fmt.Errorf("invalid web status server: %s", m.WebStatus.Server)
+	}
+
+	if m.AccessLog.Enabled && (m.AccessLog.Interval <= 0 || m.AccessLog.Retention <= 0) {
+		return fmt.Errorf("access log interval and retention must be positive")
+	}
+
+	if m.ErrorLog.Enabled && (m.ErrorLog.Interval <= 0 || m.ErrorLog.NewWindow <= 0) {
+		return fmt.Errorf("error log interval and new window must be positive")
+	}
+
+	if m.ConfigHistory.Enabled && (m.ConfigHistory.Interval <= 0 || m.ConfigHistory.Retention <= 0) {
+		return fmt.Errorf("config history interval and retention must be positive")
+	}
+
+	if m.TaskHealth.Enabled && (m.TaskHealth.Interval <= 0 || m.TaskHealth.OverdueAfter <= 0 ||
+		m.TaskHealth.AdhocMaxAge <= 0 || m.TaskHealth.AdhocMaxQueued <= 0) {
+		return fmt.Errorf("task health interval and thresholds must be positive")
+	}
+
+	if m.Usage.Enabled && (m.Usage.Interval <= 0 || m.Usage.BatchSize <= 0 || m.Usage.Retention <= 0) {
+		return fmt.Errorf("usage interval, batch size and retention must be positive")
+	}
+
+	if m.UserAdmin.Enabled && m.UserAdmin.Timeout <= 0 {
+		return fmt.Errorf("user admin timeout must be positive")
+	}
+
+	if m.Integrity.Enabled && (m.Integrity.Interval <= 0 || m.Integrity.RateLimit <= 0) {
+		return fmt.Errorf("integrity interval and rate limit must be positive")
+	}
+
+	return nil
+}
+
+// validateComponents validates the service manager and stack components
+func (m *MoodleConfig) validateComponents() error {
+	switch m.ServiceManager {
+	case ServiceManagerSystemd, ServiceManagerOpenRC, ServiceManagerSysV, ServiceManagerSupervisord, ServiceManagerFake:
+	default:
+		return fmt.Errorf("invalid service manager: %s", m.ServiceManager)
+	}
+
+	if len(m.Components) == 0 {
+		return fmt.Errorf("at least one moodle component is required")
+	}
+
+	names := make(map[string]bool)
+	for _, component := range m.Components {
+		if component.Name == "" {
+			return fmt.Errorf("moodle component name is required")
+		}
+		if names[component.Name] {
+			return fmt.Errorf("duplicate moodle component: %s", component.Name)
+		}
+		names[component.Name] = true
+
+		switch component.Type {
+		case ComponentWeb, ComponentPHPFPM, ComponentDatabase, ComponentCache:
+		default:
+			return fmt.Errorf("invalid type for moodle component %s: %s", component.Name, component.Type)
+		}
+
+		if component.Unit == "" {
+			return fmt.Errorf("unit is required for moodle component %s", component.Name)
+		}
+	}
+
+	if _, err := m.StartOrder(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Dependencies returns the names of the components a component depends on
+func (m *MoodleConfig) Dependencies(component ComponentConfig) []string {
+	if component.DependsOn != nil {
+		return component.DependsOn
+	}
+
+	var dependencies []string
+	for _, other := range m.Components {
+		if componentTiers[other.Type] < componentTiers[component.Type] {
+			dependencies = append(dependencies, other.Name)
+		}
+	}
+	return dependencies
+}
+
+// StartOrder returns the components sorted so that every component comes after
+// its dependencies. Independent components are ordered by their Order field.
+func (m *MoodleConfig) StartOrder() ([]ComponentConfig, error) {
+	byName := make(map[string]ComponentConfig)
+	for _, component := range m.Components {
+		byName[component.Name] = component
+	}
+
+	pending := make(map[string]int)
+	dependents := make(map[string][]string)
+	for _, component := range m.Components {
+		for _, dependency := range m.Dependencies(component) {
+			if _, exists := byName[dependency]; !exists {
+				return nil, fmt.Errorf("moodle component %s depends on unknown component %s", component.Name, dependency)
+			}
+			pending[component.Name]++
+			dependents[dependency] = append(dependents[dependency], component.Name)
+		}
+	}
+
+	var ready []ComponentConfig
+	for _, component := range m.Components {
+		if pending[component.Name] == 0 {
+			ready = append(ready, component)
+		}
+	}
+
+	var ordered []ComponentConfig
+	for len(ready) > 0 {
+		sort.SliceStable(ready, func(i, j int) bool {
+			return ready[i].Order < ready[j].Order
+		})
+
+		next := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, next)
+
+		for _, dependent := range dependents[next.Name] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, byName[dependent])
+			}
+		}
+	}
+
+	if len(ordered) != len(m.Components) {
+		return nil, fmt.Errorf("moodle components have a dependency cycle")
+	}
+
+	return ordered, nil
+}
@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"io"
 	"net/http"
 	"strconv"
 
+	"lms-manager/models"
 	"lms-manager/services"
 
 	"github.com/gin-gonic/gin"
@@ -12,8 +14,23 @@ import (
 // APIHandler handles API requests
 type APIHandler struct {
 	monitorService  *services.MonitorService
+	instanceMonitor *services.MonitorService
 	moodleService   *services.MoodleService
 	securityService *services.SecurityService
+	cronService     *services.CronService
+	jobService      *services.JobService
+	dbStatsService  *services.DatabaseStatsService
+	probeService    *services.ProbeService
+	integrity       *services.IntegrityService
+	phpfpmService   *services.PHPFPMService
+	webStatus       *services.WebStatusService
+	accessLog       *services.AccessLogService
+	errorLog        *services.ErrorLogService
+	configHistory   *services.ConfigHistoryService
+	taskHealth      *services.TaskHealthService
+	usage           *services.UsageService
+	moodleUsers     *services.MoodleUserService
+	instances       []*services.Instance
 }
 
 // NewAPIHandler creates a new API handler
@@ -25,12 +42,126 @@ func NewAPIHandler(monitorService *services.MonitorService, moodleService *servi
 	}
 }
 
-// GetStats returns system statistics
+// SetInstance sets the services of the Moodle instance the handler manages
+func (h *APIHandler) SetInstance(instance *services.Instance) {
+	h.instanceMonitor = instance.Monitor
+	h.moodleService = instance.Moodle
+	h.SetCronService(instance.Cron)
+	h.SetJobService(instance.Jobs)
+	h.SetDatabaseStatsService(instance.DBStats)
+	h.SetProbeService(instance.Probes)
+	h.SetIntegrityService(instance.Integrity)
+	h.SetPHPFPMService(instance.PHPFPM)
+	h.SetWebStatusService(instance.WebStatus)
+	h.SetAccessLogService(instance.AccessLog)
+	h.SetErrorLogService(instance.ErrorLog)
+	h.SetConfigHistoryService(instance.Config)
+	h.SetTaskHealthService(instance.Tasks)
+	h.SetUsageService(instance.Usage)
+	h.SetMoodleUserService(instance.Users)
+}
+
+// SetInstances sets the list of managed Moodle instances. The first one is
+// served by the routes without an instance name.
+func (h *APIHandler) SetInstances(instances []*services.Instance) {
+	h.instances = instances
+}
+
+// SetCronService sets the Moodle cron runner
+func (h *APIHandler) SetCronService(cronService *services.CronService) {
+	h.cronService = cronService
+}
+
+// SetJobService sets the background job runner
+func (h *APIHandler) SetJobService(jobService *services.JobService) {
+	h.jobService = jobService
+}
+
+// SetDatabaseStatsService sets the Moodle database statistics collector
+func (h *APIHandler) SetDatabaseStatsService(dbStatsService *services.DatabaseStatsService) {
+	h.dbStatsService = dbStatsService
+}
+
+// SetProbeService sets the Moodle HTTP prober
+func (h *APIHandler) SetProbeService(probeService *services.ProbeService) {
+	h.probeService = probeService
+}
+
+// SetIntegrityService sets the filedir integrity verifier
+func (h *APIHandler) SetIntegrityService(integrity *services.IntegrityService) {
+	h.integrity = integrity
+}
+
+// SetPHPFPMService sets the PHP-FPM status collector
+func (h *APIHandler) SetPHPFPMService(phpfpmService *services.PHPFPMService) {
+	h.phpfpmService = phpfpmService
+}
+
+// SetAccessLogService sets the access log analyzer
+func (h *APIHandler) SetAccessLogService(accessLog *services.AccessLogService) {
+	h.accessLog = accessLog
+}
+
+// SetErrorLogService sets the PHP error log collector
+func (h *APIHandler) SetErrorLogService(errorLog *services.ErrorLogService) {
+	h.errorLog = errorLog
+}
+
+// SetConfigHistoryService sets the config.php history service
+func (h *APIHandler) SetConfigHistoryService(configHistory *services.ConfigHistoryService) {
+	h.configHistory = configHistory
+}
+
+// SetTaskHealthService sets the Moodle task health collector
+func (h *APIHandler) SetTaskHealthService(taskHealth *services.TaskHealthService) {
+	h.taskHealth = taskHealth
+}
+
+// SetUsageService sets the LMS usage collector
+func (h *APIHandler) SetUsageService(usage *services.UsageService) {
+	h.usage = usage
+}
+
+// SetMoodleUserService sets the Moodle user administration service
+func (h *APIHandler) SetMoodleUserService(moodleUsers *services.MoodleUserService) {
+	h.moodleUsers = moodleUsers
+}
+
+// SetWebStatusService sets the web server status collector
+func (h *APIHandler) SetWebStatusService(webStatus *services.WebStatusService) {
+	h.webStatus = webStatus
+}
+
+// GetStats returns system statistics with the PHP-FPM pools and web tier
+// metrics of the Moodle instance
 func (h *APIHandler) GetStats(c *gin.Context) {
 	stats := h.monitorService.GetStats()
+	if h.instanceMonitor != nil {
+		stats = h.instanceMonitor.GetInstanceStats()
+	}
 	c.JSON(http.StatusOK, stats)
 }
 
+// GetInstances returns the managed Moodle instances with their status
+func (h *APIHandler) GetInstances(c *gin.Context) {
+	instances := make([]models.InstanceSummary, 0, len(h.instances))
+	for i, instance := range h.instances {
+		status := instance.Moodle.GetStatus()
+		instances = append(instances, models.InstanceSummary{
+			Name:        instance.Name,
+			Path:        instance.Moodle.Path(),
+			Default:     i == 0,
+			Running:     status.Running,
+			Maintenance: status.Maintenance.Enabled,
+			Error:       status.Error,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"instances": instances,
+	})
+}
+
 // GetUsers returns user information
 func (h *APIHandler) GetUsers(c *gin.Context) {
 	// This would typically get user information from the auth service
@@ -50,6 +181,9 @@ func (h *APIHandler) GetUsers(c *gin.Context) {
 // GetMoodleStatus returns Moodle status
 func (h *APIHandler) GetMoodleStatus(c *gin.Context) {
 	status := h.moodleService.GetStatus()
+	if h.probeService != nil {
+		status.Probes = h.probeService.GetStatus()
+	}
 	c.JSON(http.StatusOK, status)
 }
 
@@ -257,6 +391,926 @@ func (h *APIHandler) GetMoodleInfo(c *gin.Context) {
 	c.JSON(http.StatusOK, info)
 }
 
+// GetMoodleConfig returns the parsed config.php with secrets redacted
+func (h *APIHandler) GetMoodleConfig(c *gin.Context) {
+	site, err := h.moodleService.GetSiteConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to read Moodle config",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, services.RedactMoodleConfig(site))
+}
+
+// GetMoodlePlugins returns the installed Moodle plugins
+func (h *APIHandler) GetMoodlePlugins(c *gin.Context) {
+	inventory, err := h.moodleService.GetPlugins()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get Moodle plugins",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, inventory)
+}
+
+// GetEnvironment checks the PHP runtime against the requirements of the
+// installed Moodle version and of an optional ?target= version
+func (h *APIHandler) GetEnvironment(c *gin.Context) {
+	target := c.Query("target")
+	if target != "" && services.MoodleBranch(target) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unknown target Moodle version",
+		})
+		return
+	}
+
+	report, err := h.moodleService.CheckEnvironment(target)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to check the PHP environment",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetProcesses returns the processes of the Moodle stack and their resource
+// usage
+func (h *APIHandler) GetProcesses(c *gin.Context) {
+	report, err := h.moodleService.GetProcesses()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get Moodle processes",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// GetDatabaseStats returns the Moodle database server statistics
+func (h *APIHandler) GetDatabaseStats(c *gin.Context) {
+	stats, err := h.dbStatsService.GetStats()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Failed to get database statistics",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// GetPHPFPMStats returns the status of every PHP-FPM pool
+func (h *APIHandler) GetPHPFPMStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"pools": h.phpfpmService.GetStats(),
+	})
+}
+
+// GetWebMetrics returns the current web tier metrics and their history
+func (h *APIHandler) GetWebMetrics(c *gin.Context) {
+	limit := 100
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	history, err := h.webStatus.GetHistory(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get web tier history",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	current, err := h.webStatus.GetMetrics()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Failed to get web server status",
+			"details": err.Error(),
+			"history": history,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"current": current,
+		"history": history,
+	})
+}
+
+// GetAccessLogStats returns the traffic of the last ?minutes= minutes in the
+// web server access log
+func (h *APIHandler) GetAccessLogStats(c *gin.Context) {
+	if !h.accessLog.Enabled() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Access log analytics is disabled",
+		})
+		return
+	}
+
+	minutes := 15
+	if minutesStr := c.Query("minutes"); minutesStr != "" {
+		if parsedMinutes, err := strconv.Atoi(minutesStr); err == nil && parsedMinutes > 0 {
+			minutes = parsedMinutes
+		}
+	}
+
+	c.JSON(http.StatusOK, h.accessLog.GetStats(minutes))
+}
+
+// GetErrorGroups returns the PHP error groups seen most recently. ?new=true
+// lists only the groups that appeared recently, ?level= those of a level.
+func (h *APIHandler) GetErrorGroups(c *gin.Context) {
+	limit := 100
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	groups, err := h.errorLog.GetGroups(c.Query("new") == "true", c.Query("level"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get error groups",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": h.errorLog.Enabled(),
+		"groups":  groups,
+	})
+}
+
+// AcknowledgeErrorGroup marks a PHP error group as known
+func (h *APIHandler) AcknowledgeErrorGroup(c *gin.Context) {
+	if err := h.errorLog.Acknowledge(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Failed to acknowledge error group",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Error group acknowledged",
+	})
+}
+
+// GetTaskHealth returns the failing and overdue scheduled tasks and the
+// adhoc task queues
+func (h *APIHandler) GetTaskHealth(c *gin.Context) {
+	health, err := h.taskHealth.GetHealth()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error":   "Failed to get task health",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": h.taskHealth.Enabled(),
+		"health":  health,
+	})
+}
+
+// GetUsage returns the LMS usage of the last ?hours= hours, 24 by default,
+// with the host load of the same time
+func (h *APIHandler) GetUsage(c *gin.Context) {
+	hours := 24
+	if hoursStr := c.Query("hours"); hoursStr != "" {
+		if parsedHours, err := strconv.Atoi(hoursStr); err == nil && parsedHours > 0 {
+			hours = parsedHours
+		}
+	}
+
+	report, err := h.usage.GetUsage(hours)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get LMS usage",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"enabled": h.usage.Enabled(),
+		"usage":   report,
+	})
+}
+
+// SearchMoodleUsers returns the Moodle users whose username or email
+// contains ?q=
+func (h *APIHandler) SearchMoodleUsers(c *gin.Context) {
+	if !h.moodleUsersAllowed(c) {
+		return
+	}
+
+	users, err := h.moodleUsers.Search(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Failed to search Moodle users",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+	})
+}
+
+// SuspendMoodleUser suspends a Moodle user and kills their sessions
+func (h *APIHandler) SuspendMoodleUser(c *gin.Context) {
+	h.runMoodleUserAction(c, h.moodleUsers.Suspend, "Failed to suspend Moodle user", "Moodle user suspended")
+}
+
+// UnsuspendMoodleUser lifts the suspension of a Moodle user
+func (h *APIHandler) UnsuspendMoodleUser(c *gin.Context) {
+	h.runMoodleUserAction(c, h.moodleUsers.Unsuspend, "Failed to unsuspend Moodle user", "Moodle user unsuspended")
+}
+
+// ForceMoodlePasswordChange makes a Moodle user change their password at
+// their next login
+func (h *APIHandler) ForceMoodlePasswordChange(c *gin.Context) {
+	h.runMoodleUserAction(c, h.moodleUsers.ForcePasswordChange, "Failed to force a password change", "Password change forced")
+}
+
+// KillMoodleUserSessions logs a Moodle user out of every session
+func (h *APIHandler) KillMoodleUserSessions(c *gin.Context) {
+	h.runMoodleUserAction(c, h.moodleUsers.KillSessions, "Failed to kill Moodle user sessions", "Moodle user sessions killed")
+}
+
+// ResetMoodlePassword sets the password of a Moodle user and returns it
+func (h *APIHandler) ResetMoodlePassword(c *gin.Context) {
+	if !h.moodleUsersAllowed(c) {
+		return
+	}
+
+	id, ok := moodleUserID(c)
+	if !ok {
+		return
+	}
+
+	var req models.ResetMoodlePasswordRequest
+
+	// The body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request format",
+			})
+			return
+		}
+	}
+
+	password, err := h.moodleUsers.ResetPassword(id, req.Password, moodleOperator(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to reset Moodle password",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Moodle password reset",
+		"password": password,
+	})
+}
+
+// runMoodleUserAction runs an action on the Moodle user of the :id parameter
+func (h *APIHandler) runMoodleUserAction(c *gin.Context, action func(int64, services.Operator) error, failure, success string) {
+	if !h.moodleUsersAllowed(c) {
+		return
+	}
+
+	id, ok := moodleUserID(c)
+	if !ok {
+		return
+	}
+
+	if err := action(id, moodleOperator(c)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   failure,
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": success,
+	})
+}
+
+// moodleUsersAllowed rejects the request when Moodle user administration is
+// disabled or the role of the current user does not allow it
+func (h *APIHandler) moodleUsersAllowed(c *gin.Context) bool {
+	if !h.moodleUsers.Enabled() {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Moodle user administration is disabled",
+		})
+		return false
+	}
+
+	if !models.UserRole(c.GetString("role")).HasPermission("manage_moodle_users") {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Insufficient permissions to administer Moodle users",
+		})
+		return false
+	}
+
+	return true
+}
+
+// hasPermission responds with 403 unless the role of the current user has
+// the permission
+func hasPermission(c *gin.Context, permission string) bool {
+	if models.UserRole(c.GetString("role")).HasPermission(permission) {
+		return true
+	}
+
+	c.JSON(http.StatusForbidden, gin.H{
+		"error": "Insufficient permissions",
+	})
+	return false
+}
+
+// moodleUserID parses the Moodle user id of the :id parameter
+func moodleUserID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid Moodle user id",
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+// moodleOperator returns the current user as the operator of an action
+func moodleOperator(c *gin.Context) services.Operator {
+	return services.Operator{
+		UserID:    c.GetString("user_id"),
+		Username:  c.GetString("username"),
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	}
+}
+
+// GetConfigHistory returns the most recent config.php versions
+func (h *APIHandler) GetConfigHistory(c *gin.Context) {
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	versions, err := h.configHistory.GetVersions(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get config.php history",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"versions": versions,
+	})
+}
+
+// GetConfigDiff returns the redacted diff between two config.php versions.
+// Without ?to= the latest version is shown, without ?from= against the
+// version before it.
+func (h *APIHandler) GetConfigDiff(c *gin.Context) {
+	diff, err := h.configHistory.Diff(c.Query("from"), c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Failed to diff config.php versions",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, diff)
+}
+
+// AcceptConfigChanges records that the operator reviewed the config.php
+// changes made outside lms-manager
+func (h *APIHandler) AcceptConfigChanges(c *gin.Context) {
+	if err := h.configHistory.Accept(c.GetString("username")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to accept config.php changes",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "config.php changes accepted",
+	})
+}
+
+// GetProbes returns the probe health, latency percentiles and recent results
+func (h *APIHandler) GetProbes(c *gin.Context) {
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	history, err := h.probeService.GetHistory(c.Query("name"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get probe history",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"probes":  h.probeService.GetStatus(),
+		"history": history,
+	})
+}
+
+// RunProbes probes the Moodle site immediately
+func (h *APIHandler) RunProbes(c *gin.Context) {
+	results, err := h.probeService.Run()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to run probes",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"results": results,
+		"probes":  h.probeService.GetStatus(),
+	})
+}
+
+// GetStorage returns the moodledata breakdown, rescanning it when asked to
+func (h *APIHandler) GetStorage(c *gin.Context) {
+	refresh, _ := strconv.ParseBool(c.Query("refresh"))
+
+	report, err := h.moodleService.GetStorageReport(refresh)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get Moodle data storage",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// CleanupStorage deletes old temp, trash and cache entries from moodledata.
+// A dry run only needs to view the dashboard.
+func (h *APIHandler) CleanupStorage(c *gin.Context) {
+	var req models.StorageCleanupRequest
+
+	// The body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request format",
+			})
+			return
+		}
+	}
+
+	if !req.DryRun && !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	result, err := h.moodleService.CleanupStorage(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Failed to clean up Moodle data",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// ScanOrphanedFiles starts a comparison of filedir with the files table as a
+// job. Quarantining the orphans needs manage_moodle.
+func (h *APIHandler) ScanOrphanedFiles(c *gin.Context) {
+	var req models.OrphanScanRequest
+
+	// The body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request format",
+			})
+			return
+		}
+	}
+
+	if req.Quarantine && !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	job, err := h.jobService.RunOrphanScan(req, c.GetString("user_id"), c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to start filedir scan",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// GetOrphanedFiles returns the report of the last filedir scan
+func (h *APIHandler) GetOrphanedFiles(c *gin.Context) {
+	report := h.moodleService.GetOrphanReport()
+	if report == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "No filedir scan has run yet",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// PurgeQuarantine deletes old quarantined filedir blobs
+func (h *APIHandler) PurgeQuarantine(c *gin.Context) {
+	if !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	olderThan := 0
+	if olderThanStr := c.Query("older_than"); olderThanStr != "" {
+		parsed, err := strconv.Atoi(olderThanStr)
+		if err != nil || parsed <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid older_than",
+			})
+			return
+		}
+		olderThan = parsed
+	}
+
+	purged, err := h.moodleService.PurgeQuarantine(olderThan)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to purge quarantine",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"purged": purged,
+	})
+}
+
+// GetIntegrityReport returns the progress of the filedir integrity verifier
+// and the corrupt files it found
+func (h *APIHandler) GetIntegrityReport(c *gin.Context) {
+	report, err := h.integrity.GetReport()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to get integrity report",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// StartIntegrityCheck starts or resumes a filedir integrity pass
+func (h *APIHandler) StartIntegrityCheck(c *gin.Context) {
+	var req models.IntegrityCheckRequest
+
+	// The body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request format",
+			})
+			return
+		}
+	}
+
+	if err := h.integrity.Trigger(req.Restart); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Failed to start integrity check",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Filedir integrity check started",
+	})
+}
+
+// StopIntegrityCheck interrupts the integrity pass in progress, which can be
+// resumed later
+func (h *APIHandler) StopIntegrityCheck(c *gin.Context) {
+	if err := h.integrity.Cancel(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Failed to stop integrity check",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Filedir integrity check interrupted",
+	})
+}
+
+// GetMaintenance returns the Moodle maintenance mode status
+func (h *APIHandler) GetMaintenance(c *gin.Context) {
+	status, err := h.moodleService.RefreshMaintenanceStatus()
+	if err != nil {
+		// The file mode is still known without the CLI
+		c.JSON(http.StatusOK, gin.H{
+			"maintenance": status,
+			"warning":     err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"maintenance": status,
+	})
+}
+
+// EnableMaintenance puts Moodle into maintenance mode
+func (h *APIHandler) EnableMaintenance(c *gin.Context) {
+	if !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	var req struct {
+		Mode    string `json:"mode"`
+		Message string `json:"message"`
+	}
+
+	// The body is optional
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid request format",
+			})
+			return
+		}
+	}
+
+	err := h.moodleService.EnableMaintenance(req.Mode, req.Message)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to enable maintenance mode",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Maintenance mode enabled",
+		"maintenance": h.moodleService.GetMaintenanceStatus(),
+	})
+}
+
+// DisableMaintenance takes Moodle out of maintenance mode
+func (h *APIHandler) DisableMaintenance(c *gin.Context) {
+	if !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	err := h.moodleService.DisableMaintenance()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to disable maintenance mode",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":     "Maintenance mode disabled",
+		"maintenance": h.moodleService.GetMaintenanceStatus(),
+	})
+}
+
+// GetCronStatus returns the cron runner status and recent runs
+func (h *APIHandler) GetCronStatus(c *gin.Context) {
+	limit := 20
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	history, err := h.cronService.GetHistory(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get cron history",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":  h.cronService.GetStatus(),
+		"history": history,
+	})
+}
+
+// RunCron starts a Moodle cron run in the background
+func (h *APIHandler) RunCron(c *gin.Context) {
+	if err := h.cronService.Trigger(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Failed to run cron",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message": "Moodle cron started",
+	})
+}
+
+// UpgradeMoodle starts a Moodle core upgrade from a local archive as a job
+func (h *APIHandler) UpgradeMoodle(c *gin.Context) {
+	if !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	var req models.UpgradeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	job, err := h.jobService.RunUpgrade(req, c.GetString("user_id"), c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Failed to start upgrade",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// GetCLIScripts returns the Moodle CLI scripts that can be run as jobs
+func (h *APIHandler) GetCLIScripts(c *gin.Context) {
+	c.JSON(http.StatusOK, services.CLIScripts())
+}
+
+// GetJobs returns the most recent jobs
+func (h *APIHandler) GetJobs(c *gin.Context) {
+	limit := 50
+	if limitStr := c.Query("limit"); limitStr != "" {
+		if parsedLimit, err := strconv.Atoi(limitStr); err == nil && parsedLimit > 0 {
+			limit = parsedLimit
+		}
+	}
+
+	jobs, err := h.jobService.ListJobs(limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to get jobs",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, jobs)
+}
+
+// GetJob returns a job with its output
+func (h *APIHandler) GetJob(c *gin.Context) {
+	job, err := h.jobService.GetJob(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Job not found",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+}
+
+// RunJob starts an allow-listed Moodle CLI script as the current user
+func (h *APIHandler) RunJob(c *gin.Context) {
+	if !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	var req models.RunJobRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request format",
+		})
+		return
+	}
+
+	job, err := h.jobService.RunScript(req.Script, req.Args, c.GetString("user_id"), c.GetString("username"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Failed to start job",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, job)
+}
+
+// CancelJob cancels the running job
+func (h *APIHandler) CancelJob(c *gin.Context) {
+	if !hasPermission(c, "manage_moodle") {
+		return
+	}
+
+	if err := h.jobService.Cancel(c.Param("id")); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Failed to cancel job",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Job cancelled",
+	})
+}
+
+// StreamJob streams the output of a job as server-sent events. Output is sent
+// as "output" events, followed by a "done" event carrying the finished job.
+func (h *APIHandler) StreamJob(c *gin.Context) {
+	stream, err := h.jobService.Subscribe(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error":   "Job not found",
+			"details": err.Error(),
+		})
+		return
+	}
+	defer stream.Close()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	clientGone := c.Stream(func(w io.Writer) bool {
+		select {
+		case chunk, ok := <-stream.Output:
+			if !ok {
+				return false
+			}
+			c.SSEvent("output", chunk)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+	if clientGone || c.Request.Context().Err() != nil {
+		return
+	}
+
+	if job, err := stream.Job(); err == nil {
+		job.Output = ""
+		c.SSEvent("done", job)
+		c.Writer.Flush()
+	}
+}
+
 // BackupMoodle creates a backup of Moodle
 func (h *APIHandler) BackupMoodle(c *gin.Context) {
 	backupPath := c.Query("path")
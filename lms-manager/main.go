@@ -41,13 +41,22 @@ func main() {
 	// Initialize services
 	authService := services.NewAuthService(cfg.Security.JWTSecret, db)
 	monitorService := services.NewMonitorService(cfg.Monitoring)
-	moodleService := services.NewMoodleService(cfg.Moodle)
 	securityService := services.NewSecurityService(cfg.Security)
+	instances := services.NewInstances(cfg.MoodleInstances(), monitorService)
+	defaultInstance := instances[0]
 
-	// Initialize handlers
+	monitorService.SetDatabase(db)
+	for _, instance := range instances {
+		instance.SetDatabase(db)
+	}
+
+	// Initialize handlers. The routes without an instance name manage the
+	// first instance.
 	authHandler := handlers.NewAuthHandler(authService)
-	dashboardHandler := handlers.NewDashboardHandler(monitorService, moodleService)
-	apiHandler := handlers.NewAPIHandler(monitorService, moodleService, securityService)
+	dashboardHandler := handlers.NewDashboardHandler(monitorService, defaultInstance.Moodle)
+	apiHandler := handlers.NewAPIHandler(monitorService, defaultInstance.Moodle, securityService)
+	apiHandler.SetInstance(defaultInstance)
+	apiHandler.SetInstances(instances)
 
 	// Setup Gin router
 	if !cfg.Server.Debug {
@@ -76,15 +85,10 @@ func main() {
 	protected := router.Group("/api")
 	protected.Use(authHandler.AuthMiddleware())
 	{
-		// System stats
-		protected.GET("/stats", apiHandler.GetStats)
 		protected.GET("/users", apiHandler.GetUsers)
-		protected.GET("/moodle/status", apiHandler.GetMoodleStatus)
 
-		// Moodle management
-		protected.POST("/moodle/start", apiHandler.StartMoodle)
-		protected.POST("/moodle/stop", apiHandler.StopMoodle)
-		protected.POST("/moodle/restart", apiHandler.RestartMoodle)
+		// Moodle instances
+		protected.GET("/instances", apiHandler.GetInstances)
 
 		// User management
 		protected.GET("/users/stats", apiHandler.GetUserStats)
@@ -97,6 +101,14 @@ func main() {
 		protected.GET("/security/alerts", apiHandler.GetAlerts)
 	}
 
+	// Instance-scoped routes
+	registerInstanceRoutes(protected, apiHandler)
+	for _, instance := range instances {
+		instanceHandler := handlers.NewAPIHandler(monitorService, instance.Moodle, securityService)
+		instanceHandler.SetInstance(instance)
+		registerInstanceRoutes(protected.Group("/instances/"+instance.Name), instanceHandler)
+	}
+
 	// Health check
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
@@ -109,6 +121,11 @@ func main() {
 	// Start monitoring service
 	go monitorService.Start()
 
+	// Start the collectors and runners of every Moodle instance
+	for _, instance := range instances {
+		instance.Start()
+	}
+
 	// Setup graceful shutdown
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -126,12 +143,81 @@ func main() {
 	<-quit
 	log.Println("Shutting down server...")
 
+	// Stop the Moodle instances, checkpointing integrity passes in progress
+	for _, instance := range instances {
+		instance.Stop()
+	}
+
 	// Stop monitoring service
 	monitorService.Stop()
 
 	log.Println("Server stopped")
 }
 
+// registerInstanceRoutes registers the routes that manage a Moodle instance
+func registerInstanceRoutes(routes gin.IRoutes, apiHandler *handlers.APIHandler) {
+	// System stats
+	routes.GET("/stats", apiHandler.GetStats)
+
+	// Moodle status
+	routes.GET("/moodle/status", apiHandler.GetMoodleStatus)
+	routes.GET("/moodle/info", apiHandler.GetMoodleInfo)
+	routes.GET("/moodle/config", apiHandler.GetMoodleConfig)
+	routes.GET("/moodle/config/history", apiHandler.GetConfigHistory)
+	routes.GET("/moodle/config/history/diff", apiHandler.GetConfigDiff)
+	routes.GET("/moodle/plugins", apiHandler.GetMoodlePlugins)
+	routes.GET("/moodle/environment", apiHandler.GetEnvironment)
+	routes.GET("/moodle/processes", apiHandler.GetProcesses)
+	routes.GET("/moodle/database", apiHandler.GetDatabaseStats)
+	routes.GET("/moodle/tasks", apiHandler.GetTaskHealth)
+	routes.GET("/moodle/usage", apiHandler.GetUsage)
+	routes.GET("/moodle/php-fpm", apiHandler.GetPHPFPMStats)
+	routes.GET("/moodle/web", apiHandler.GetWebMetrics)
+	routes.GET("/moodle/access-log", apiHandler.GetAccessLogStats)
+	routes.GET("/moodle/errors", apiHandler.GetErrorGroups)
+	routes.GET("/moodle/probes", apiHandler.GetProbes)
+	routes.GET("/moodle/storage", apiHandler.GetStorage)
+	routes.GET("/moodle/files/orphans", apiHandler.GetOrphanedFiles)
+
+	// Moodle management
+	routes.POST("/moodle/start", apiHandler.StartMoodle)
+	routes.POST("/moodle/stop", apiHandler.StopMoodle)
+	routes.POST("/moodle/restart", apiHandler.RestartMoodle)
+	routes.GET("/moodle/maintenance", apiHandler.GetMaintenance)
+	routes.POST("/moodle/maintenance/enable", apiHandler.EnableMaintenance)
+	routes.POST("/moodle/maintenance/disable", apiHandler.DisableMaintenance)
+	routes.GET("/moodle/cron", apiHandler.GetCronStatus)
+	routes.POST("/moodle/cron/run", apiHandler.RunCron)
+	routes.POST("/moodle/probes/run", apiHandler.RunProbes)
+	routes.POST("/moodle/storage/cleanup", apiHandler.CleanupStorage)
+	routes.POST("/moodle/files/orphans", apiHandler.ScanOrphanedFiles)
+	routes.POST("/moodle/errors/:id/acknowledge", apiHandler.AcknowledgeErrorGroup)
+	routes.POST("/moodle/config/history/accept", apiHandler.AcceptConfigChanges)
+	routes.DELETE("/moodle/files/quarantine", apiHandler.PurgeQuarantine)
+
+	// Moodle user administration
+	routes.GET("/moodle/users", apiHandler.SearchMoodleUsers)
+	routes.POST("/moodle/users/:id/suspend", apiHandler.SuspendMoodleUser)
+	routes.POST("/moodle/users/:id/unsuspend", apiHandler.UnsuspendMoodleUser)
+	routes.POST("/moodle/users/:id/force-password-change", apiHandler.ForceMoodlePasswordChange)
+	routes.POST("/moodle/users/:id/reset-password", apiHandler.ResetMoodlePassword)
+	routes.POST("/moodle/users/:id/kill-sessions", apiHandler.KillMoodleUserSessions)
+
+	// Filedir integrity
+	routes.GET("/integrity/check", apiHandler.GetIntegrityReport)
+	routes.POST("/integrity/check", apiHandler.StartIntegrityCheck)
+	routes.DELETE("/integrity/check", apiHandler.StopIntegrityCheck)
+	routes.POST("/moodle/upgrade", apiHandler.UpgradeMoodle)
+
+	// Moodle CLI jobs
+	routes.GET("/moodle/cli/scripts", apiHandler.GetCLIScripts)
+	routes.GET("/jobs", apiHandler.GetJobs)
+	routes.POST("/jobs", apiHandler.RunJob)
+	routes.GET("/jobs/:id", apiHandler.GetJob)
+	routes.GET("/jobs/:id/stream", apiHandler.StreamJob)
+	routes.POST("/jobs/:id/cancel", apiHandler.CancelJob)
+}
+
 // initDatabase initializes the SQLite database
 func initDatabase() (*sql.DB, error) {
 	db, err := sql.Open("sqlite3", "lms-manager.db")
@@ -140,7 +226,7 @@ func initDatabase() (*sql.DB, error) {
 	}
 
 	// Create tables
-	if err := createTables(db); err != nil {
+	if err := services.CreateTables(db); err != nil {
 		return nil, fmt.Errorf("failed to create tables: %v", err)
 	}
 
@@ -152,78 +238,6 @@ func initDatabase() (*sql.DB, error) {
 	return db, nil
 }
 
-// createTables creates the necessary database tables
-func createTables(db *sql.DB) error {
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			username TEXT UNIQUE NOT NULL,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			role TEXT NOT NULL,
-			active BOOLEAN DEFAULT 1,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			last_login DATETIME
-		)`,
-		`CREATE TABLE IF NOT EXISTS user_sessions (
-			id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			ip_address TEXT NOT NULL,
-			user_agent TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			expires_at DATETIME NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users (id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS user_activities (
-			id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			action TEXT NOT NULL,
-			resource TEXT,
-			ip_address TEXT,
-			user_agent TEXT,
-			success BOOLEAN DEFAULT 1,
-			message TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users (id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS security_events (
-			id TEXT PRIMARY KEY,
-			type TEXT NOT NULL,
-			message TEXT NOT NULL,
-			ip_address TEXT,
-			user_agent TEXT,
-			severity TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-		`CREATE TABLE IF NOT EXISTS alerts (
-			id TEXT PRIMARY KEY,
-			type TEXT NOT NULL,
-			message TEXT NOT NULL,
-			severity TEXT NOT NULL,
-			resolved BOOLEAN DEFAULT 0,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			resolved_at DATETIME
-		)`,
-		`CREATE TABLE IF NOT EXISTS system_logs (
-			id TEXT PRIMARY KEY,
-			level TEXT NOT NULL,
-			message TEXT NOT NULL,
-			source TEXT,
-			data TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-	}
-
-	for _, query := range queries {
-		if _, err := db.Exec(query); err != nil {
-			return fmt.Errorf("failed to execute query: %v", err)
-		}
-	}
-
-	return nil
-}
-
 // createDefaultAdmin creates a default admin user
 func createDefaultAdmin(db *sql.DB) error {
 	// Check if admin user exists
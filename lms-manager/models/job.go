@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+)
+
+// Job states
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job represents a background task such as a Moodle CLI script run
+type Job struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Command    string            `json:"command"`
+	Args       map[string]string `json:"args,omitempty"`
+	Status     string            `json:"status"`
+	ExitCode   int               `json:"exit_code"`
+	Error      string            `json:"error,omitempty"`
+	Output     string            `json:"output,omitempty"`
+	UserID     string            `json:"user_id"`
+	Username   string            `json:"username"`
+	CreatedAt  time.Time         `json:"created_at"`
+	FinishedAt *time.Time        `json:"finished_at,omitempty"`
+}
+
+// CLIScript describes an allow-listed Moodle CLI script
+type CLIScript struct {
+	Name        string         `json:"name"`
+	Script      string         `json:"script"`
+	Description string         `json:"description"`
+	Args        []CLIScriptArg `json:"args"`
+	FixedArgs   []string       `json:"fixed_args,omitempty"`
+	Timeout     int            `json:"timeout"`
+	Maintenance bool           `json:"maintenance"`
+}
+
+// CLIScriptArg describes an accepted --name or --name=value argument of a CLI
+// script. A Stdin argument answers the prompt of the script on its standard
+// input instead, so that secrets never reach the process arguments, and is not
+// recorded with the job.
+type CLIScriptArg struct {
+	Name        string `json:"name"`
+	Flag        bool   `json:"flag"`
+	Pattern     string `json:"pattern,omitempty"`
+	Required    bool   `json:"required"`
+	Stdin       bool   `json:"stdin"`
+	Description string `json:"description"`
+}
+
+// RunJobRequest represents a request to run a CLI script
+type RunJobRequest struct {
+	Script string            `json:"script" binding:"required"`
+	Args   map[string]string `json:"args"`
+}
@@ -0,0 +1,445 @@
+package models
+
+import (
+	"time"
+)
+
+// MoodleSiteConfig represents the settings parsed from Moodle's config.php
+type MoodleSiteConfig struct {
+	DBType              string                 `json:"dbtype"`
+	DBLibrary           string                 `json:"dblibrary"`
+	DBHost              string                 `json:"dbhost"`
+	DBName              string                 `json:"dbname"`
+	DBUser              string                 `json:"dbuser"`
+	DBPass              string                 `json:"dbpass"`
+	DBPort              int                    `json:"dbport,omitempty"`
+	DBSocket            string                 `json:"dbsocket,omitempty"`
+	Prefix              string                 `json:"prefix"`
+	WWWRoot             string                 `json:"wwwroot"`
+	DataRoot            string                 `json:"dataroot"`
+	Admin               string                 `json:"admin"`
+	SSLProxy            bool                   `json:"sslproxy"`
+	ReverseProxy        bool                   `json:"reverseproxy"`
+	Debug               int                    `json:"debug"`
+	DebugLevel          string                 `json:"debug_level"`
+	DebugDisplay        bool                   `json:"debugdisplay"`
+	SessionHandlerClass string                 `json:"session_handler_class,omitempty"`
+	SessionSavePath     string                 `json:"session_save_path,omitempty"`
+	Settings            map[string]interface{} `json:"settings"`
+}
+
+// config.php version sources
+const (
+	ConfigSourceInitial  = "initial"
+	ConfigSourceExternal = "external"
+)
+
+// ConfigVersion represents a snapshot of config.php. ChangedBy is the owner
+// of the file when the change was seen; AcknowledgedBy is the operator who
+// accepted a change made outside lms-manager.
+type ConfigVersion struct {
+	ID             string     `json:"id"`
+	Hash           string     `json:"hash"`
+	Size           int64      `json:"size"`
+	Source         string     `json:"source"`
+	ChangedBy      string     `json:"changed_by"`
+	DebugDisplay   bool       `json:"debugdisplay"`
+	SecretsChanged bool       `json:"secrets_changed"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Content        string     `json:"-"`
+	SecretsHash    string     `json:"-"`
+}
+
+// ConfigDiff represents the changes between two config.php versions as a
+// unified diff with secrets redacted. A changed secret only shows in
+// SecretsChanged.
+type ConfigDiff struct {
+	From           *ConfigVersion `json:"from"`
+	To             *ConfigVersion `json:"to"`
+	Added          int            `json:"added"`
+	Removed        int            `json:"removed"`
+	SecretsChanged bool           `json:"secrets_changed"`
+	Diff           string         `json:"diff"`
+}
+
+// MoodleVersion represents the core version parsed from version.php
+type MoodleVersion struct {
+	Version  string         `json:"version"`
+	Number   float64        `json:"number"`
+	Release  string         `json:"release"`
+	Branch   string         `json:"branch"`
+	Maturity string         `json:"maturity"`
+	Support  *MoodleSupport `json:"support,omitempty"`
+}
+
+// Moodle support lifecycle states
+const (
+	SupportGeneral  = "supported"
+	SupportSecurity = "security_only"
+	SupportEOL      = "end_of_life"
+	SupportUnknown  = "unknown"
+)
+
+// MoodleSupport represents the support lifecycle of a Moodle branch
+type MoodleSupport struct {
+	Branch             string    `json:"branch"`
+	Name               string    `json:"name"`
+	LTS                bool      `json:"lts"`
+	Released           time.Time `json:"released"`
+	GeneralSupportEnd  time.Time `json:"general_support_end"`
+	SecuritySupportEnd time.Time `json:"security_support_end"`
+	MinPHP             string    `json:"min_php"`
+	MaxPHP             string    `json:"max_php"`
+	Status             string    `json:"status"`
+}
+
+// Maintenance mode mechanisms
+const (
+	MaintenanceModeFile = "file"
+	MaintenanceModeCLI  = "cli"
+)
+
+// MaintenanceStatus represents the Moodle maintenance mode state
+type MaintenanceStatus struct {
+	Enabled bool      `json:"enabled"`
+	Mode    string    `json:"mode,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since"`
+}
+
+// CronRun represents a single run of admin/cli/cron.php
+type CronRun struct {
+	ID         string    `json:"id"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Duration   int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	Success    bool      `json:"success"`
+	Output     string    `json:"output"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// CronStatus represents the state of the built-in cron runner
+type CronStatus struct {
+	Enabled             bool       `json:"enabled"`
+	Running             bool       `json:"running"`
+	RunningSince        *time.Time `json:"running_since,omitempty"`
+	LastRun             *CronRun   `json:"last_run,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Paused              bool       `json:"paused"`
+}
+
+// ScheduledTask represents a row of the Moodle task_scheduled table. A
+// non-zero FailDelay means the last run failed; Overdue is the number of
+// seconds past NextRunTime.
+type ScheduledTask struct {
+	Classname   string     `json:"classname"`
+	Component   string     `json:"component"`
+	LastRunTime *time.Time `json:"last_run_time,omitempty"`
+	NextRunTime time.Time  `json:"next_run_time"`
+	FailDelay   int64      `json:"faildelay"`
+	Disabled    bool       `json:"disabled"`
+	Overdue     int64      `json:"overdue"`
+}
+
+// AdhocTaskQueue represents the adhoc tasks of a class. Due tasks are those
+// whose next run time has passed; OldestDue is the earliest of them.
+type AdhocTaskQueue struct {
+	Classname string     `json:"classname"`
+	Queued    int        `json:"queued"`
+	Due       int        `json:"due"`
+	Failing   int        `json:"failing"`
+	OldestDue *time.Time `json:"oldest_due,omitempty"`
+	OldestAge int64      `json:"oldest_age"`
+	Stuck     bool       `json:"stuck"`
+}
+
+// TaskHealth represents the state of the Moodle task tables
+type TaskHealth struct {
+	Failing        []ScheduledTask  `json:"failing"`
+	Overdue        []ScheduledTask  `json:"overdue"`
+	Adhoc          []AdhocTaskQueue `json:"adhoc"`
+	AdhocQueued    int              `json:"adhoc_queued"`
+	AdhocFailing   int              `json:"adhoc_failing"`
+	OldestAdhocAge int64            `json:"oldest_adhoc_age"`
+	Timestamp      time.Time        `json:"timestamp"`
+}
+
+// UsageBucket represents the LMS usage in a 5-minute bucket. ActiveUsers
+// is the number of users with logged events, OnlineUsers the most users seen
+// with an active session. CPU and Memory are the host usage averaged over
+// the bucket, when it was sampled.
+type UsageBucket struct {
+	Time        time.Time `json:"time"`
+	ActiveUsers int       `json:"active_users"`
+	OnlineUsers int       `json:"online_users"`
+	Events      int       `json:"events"`
+	Logins      int       `json:"logins"`
+	CPU         *float64  `json:"cpu,omitempty"`
+	Memory      *float64  `json:"memory,omitempty"`
+}
+
+// UsageHour represents the logins and the peak of active users in an hour
+type UsageHour struct {
+	Hour        time.Time `json:"hour"`
+	Logins      int       `json:"logins"`
+	ActiveUsers int       `json:"active_users"`
+}
+
+// UsageActivity represents the events logged in a course or course module
+type UsageActivity struct {
+	ID     int64  `json:"id"`
+	Name   string `json:"name"`
+	Events int    `json:"events"`
+}
+
+// UsageReport represents the LMS usage over the last Hours hours
+type UsageReport struct {
+	Hours         int             `json:"hours"`
+	Buckets       []UsageBucket   `json:"buckets"`
+	LoginsPerHour []UsageHour     `json:"logins_per_hour"`
+	TopCourses    []UsageActivity `json:"top_courses"`
+	TopModules    []UsageActivity `json:"top_modules"`
+	PeakUsers     int             `json:"peak_users"`
+	PeakTime      *time.Time      `json:"peak_time,omitempty"`
+	LastID        int64           `json:"last_id"`
+}
+
+// ProbeResult represents a single synthetic HTTP request to the Moodle site
+type ProbeResult struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	URL          string     `json:"url"`
+	StatusCode   int        `json:"status_code"`
+	Success      bool       `json:"success"`
+	Latency      int64      `json:"latency_ms"`
+	Error        string     `json:"error,omitempty"`
+	TLSExpiresAt *time.Time `json:"tls_expires_at,omitempty"`
+	Timestamp    time.Time  `json:"timestamp"`
+}
+
+// ProbeStatus represents the health of a probe over the last hour
+type ProbeStatus struct {
+	Name                string       `json:"name"`
+	URL                 string       `json:"url"`
+	Healthy             bool         `json:"healthy"`
+	LastResult          *ProbeResult `json:"last_result,omitempty"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	Samples             int          `json:"samples"`
+	SuccessRate         float64      `json:"success_rate"`
+	P50                 int64        `json:"p50_ms"`
+	P95                 int64        `json:"p95_ms"`
+	P99                 int64        `json:"p99_ms"`
+}
+
+// StorageArea represents the disk usage of a moodledata directory
+type StorageArea struct {
+	Name       string     `json:"name"`
+	Path       string     `json:"path"`
+	Exists     bool       `json:"exists"`
+	Size       int64      `json:"size"`
+	Files      int64      `json:"files"`
+	OldestFile *time.Time `json:"oldest_file,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// StorageReport represents the moodledata breakdown by area
+type StorageReport struct {
+	DataPath  string        `json:"data_path"`
+	Size      int64         `json:"size"`
+	Files     int64         `json:"files"`
+	Areas     []StorageArea `json:"areas"`
+	ScannedAt *time.Time    `json:"scanned_at,omitempty"`
+	Duration  int64         `json:"duration_ms"`
+	Scanning  bool          `json:"scanning"`
+}
+
+// StorageCleanupRequest selects the moodledata entries to delete. OlderThan
+// is in hours; the configured cleanup age is used when it is zero.
+type StorageCleanupRequest struct {
+	Areas     []string `json:"areas"`
+	OlderThan int      `json:"older_than"`
+	DryRun    bool     `json:"dry_run"`
+}
+
+// StorageCleanupResult represents the entries deleted, or that would be
+// deleted in a dry run
+type StorageCleanupResult struct {
+	DryRun      bool     `json:"dry_run"`
+	Areas       []string `json:"areas"`
+	OlderThan   int      `json:"older_than"`
+	Files       int64    `json:"files"`
+	Directories int64    `json:"directories"`
+	Size        int64    `json:"size"`
+	Entries     []string `json:"entries"`
+	Truncated   bool     `json:"truncated"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// OrphanScanRequest controls a filedir scan. With Quarantine set, orphaned
+// blobs are moved to the quarantine directory.
+type OrphanScanRequest struct {
+	Quarantine bool `json:"quarantine"`
+}
+
+// FileBlob represents a content hash in filedir or in the files table
+type FileBlob struct {
+	ContentHash string `json:"contenthash"`
+	Size        int64  `json:"size"`
+	InTrash     bool   `json:"in_trash,omitempty"`
+}
+
+// OrphanReport represents the result of comparing filedir with the files
+// table. The blob lists are capped; the counts and sizes are complete.
+type OrphanReport struct {
+	StartedAt      time.Time  `json:"started_at"`
+	FinishedAt     time.Time  `json:"finished_at"`
+	Blobs          int64      `json:"blobs"`
+	BlobSize       int64      `json:"blob_size"`
+	Referenced     int64      `json:"referenced"`
+	OrphanCount    int64      `json:"orphan_count"`
+	OrphanSize     int64      `json:"orphan_size"`
+	Orphans        []FileBlob `json:"orphans"`
+	MissingCount   int64      `json:"missing_count"`
+	Missing        []FileBlob `json:"missing"`
+	Recent         int64      `json:"recent"`
+	Unexpected     []string   `json:"unexpected,omitempty"`
+	Truncated      bool       `json:"truncated"`
+	Quarantined    int64      `json:"quarantined"`
+	QuarantinePath string     `json:"quarantine_path,omitempty"`
+	Errors         []string   `json:"errors,omitempty"`
+}
+
+// MoodlePlugin represents an installed plugin parsed from its version.php
+type MoodlePlugin struct {
+	Component    string  `json:"component"`
+	Type         string  `json:"type"`
+	Name         string  `json:"name"`
+	Path         string  `json:"path"`
+	Version      int64   `json:"version"`
+	Requires     float64 `json:"requires,omitempty"`
+	Maturity     string  `json:"maturity,omitempty"`
+	Release      string  `json:"release,omitempty"`
+	AddOn        bool    `json:"addon"`
+	Incompatible bool    `json:"incompatible"`
+	Error        string  `json:"error,omitempty"`
+}
+
+// MoodlePluginInventory represents the plugins found in the Moodle code tree
+type MoodlePluginInventory struct {
+	CoreVersion  string         `json:"core_version"`
+	Plugins      []MoodlePlugin `json:"plugins"`
+	Total        int            `json:"total"`
+	AddOns       int            `json:"addons"`
+	Incompatible int            `json:"incompatible"`
+	Warnings     []string       `json:"warnings,omitempty"`
+}
+
+// UpgradeRequest represents a request to upgrade Moodle core from a local
+// release archive (.tgz or .zip)
+type UpgradeRequest struct {
+	Archive       string `json:"archive" binding:"required"`
+	AllowUnstable bool   `json:"allow_unstable"`
+}
+
+// IntegrityRun represents a pass of the filedir integrity verifier. An
+// interrupted pass resumes after its checkpoint, the last blob it verified.
+type IntegrityRun struct {
+	ID           string     `json:"id"`
+	Status       string     `json:"status"`
+	Checkpoint   string     `json:"checkpoint,omitempty"`
+	FilesChecked int64      `json:"files_checked"`
+	BytesChecked int64      `json:"bytes_checked"`
+	CorruptCount int64      `json:"corrupt_count"`
+	Error        string     `json:"error,omitempty"`
+	StartedAt    time.Time  `json:"started_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+}
+
+// CorruptFile represents a filedir blob whose content does not hash to its
+// name, or that could not be read
+type CorruptFile struct {
+	ContentHash string    `json:"contenthash"`
+	ActualHash  string    `json:"actual_hash,omitempty"`
+	Size        int64     `json:"size"`
+	Error       string    `json:"error,omitempty"`
+	DetectedAt  time.Time `json:"detected_at"`
+}
+
+// IntegrityReport represents the latest integrity pass and the corrupt files
+// it found so far
+type IntegrityReport struct {
+	Running       bool          `json:"running"`
+	Run           *IntegrityRun `json:"run,omitempty"`
+	LastCompleted *IntegrityRun `json:"last_completed,omitempty"`
+	Corrupt       []CorruptFile `json:"corrupt"`
+	Truncated     bool          `json:"truncated"`
+}
+
+// IntegrityCheckRequest represents a request to start an integrity pass
+type IntegrityCheckRequest struct {
+	Restart bool `json:"restart"`
+}
+
+// Environment check results, from best to worst
+const (
+	EnvironmentPass = "pass"
+	EnvironmentWarn = "warn"
+	EnvironmentFail = "fail"
+)
+
+// EnvironmentCheck represents a single PHP requirement of a Moodle branch
+type EnvironmentCheck struct {
+	Category string `json:"category"`
+	Name     string `json:"name"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+}
+
+// EnvironmentResult represents the PHP requirements of a Moodle branch
+// checked against the PHP runtime
+type EnvironmentResult struct {
+	Branch string             `json:"branch"`
+	Name   string             `json:"name"`
+	Status string             `json:"status"`
+	Checks []EnvironmentCheck `json:"checks"`
+}
+
+// EnvironmentReport represents the PHP runtime and how it meets the
+// requirements of the installed and, when given, the target Moodle version
+type EnvironmentReport struct {
+	PHPBinary  string             `json:"php_binary"`
+	PHPVersion string             `json:"php_version"`
+	SAPI       string             `json:"sapi"`
+	IniFile    string             `json:"ini_file,omitempty"`
+	Extensions []string           `json:"extensions"`
+	Settings   map[string]string  `json:"settings"`
+	Installed  *EnvironmentResult `json:"installed,omitempty"`
+	Target     *EnvironmentResult `json:"target,omitempty"`
+	Warnings   []string           `json:"warnings,omitempty"`
+	CheckedAt  time.Time          `json:"checked_at"`
+}
+
+// MoodleUser represents a user account of the Moodle site
+type MoodleUser struct {
+	ID         int64      `json:"id"`
+	Username   string     `json:"username"`
+	Email      string     `json:"email"`
+	FirstName  string     `json:"firstname"`
+	LastName   string     `json:"lastname"`
+	Auth       string     `json:"auth"`
+	Suspended  bool       `json:"suspended"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+}
+
+// ResetMoodlePasswordRequest represents a request to reset the password of a
+// Moodle user. A random password is generated when Password is empty.
+type ResetMoodlePasswordRequest struct {
+	Password string `json:"password"`
+}
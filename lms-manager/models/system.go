@@ -6,13 +6,15 @@ import (
 
 // SystemStats represents system statistics
 type SystemStats struct {
-	CPUUsage    float64       `json:"cpu_usage"`
-	MemoryUsage float64       `json:"memory_usage"`
-	DiskUsage   float64       `json:"disk_usage"`
-	NetworkIO   NetworkStats  `json:"network_io"`
-	Uptime      int64         `json:"uptime"`
-	LoadAvg     LoadAvgStats  `json:"load_avg"`
-	Timestamp   time.Time     `json:"timestamp"`
+	CPUUsage    float64             `json:"cpu_usage"`
+	MemoryUsage float64             `json:"memory_usage"`
+	DiskUsage   float64             `json:"disk_usage"`
+	NetworkIO   NetworkStats        `json:"network_io"`
+	Uptime      int64               `json:"uptime"`
+	LoadAvg     LoadAvgStats        `json:"load_avg"`
+	PHPFPM      []PHPFPMPoolStats   `json:"php_fpm,omitempty"`
+	Web         *PerformanceMetrics `json:"web,omitempty"`
+	Timestamp   time.Time           `json:"timestamp"`
 }
 
 // NetworkStats represents network I/O statistics
@@ -43,12 +45,88 @@ type UserSession struct {
 
 // MoodleStatus represents Moodle service status
 type MoodleStatus struct {
-	Running    bool      `json:"running"`
-	Version    string    `json:"version"`
-	Uptime     int64     `json:"uptime"`
-	LastCheck  time.Time `json:"last_check"`
-	Error      string    `json:"error,omitempty"`
-	ProcessID  int       `json:"process_id,omitempty"`
+	Running     bool              `json:"running"`
+	Version     string            `json:"version"`
+	Uptime      int64             `json:"uptime"`
+	LastCheck   time.Time         `json:"last_check"`
+	Error       string            `json:"error,omitempty"`
+	ProcessID   int               `json:"process_id,omitempty"`
+	Maintenance MaintenanceStatus `json:"maintenance"`
+	Components  []ComponentStatus `json:"components"`
+	Probes      []ProbeStatus     `json:"probes,omitempty"`
+}
+
+// InstanceSummary represents a managed Moodle instance in the instance list
+type InstanceSummary struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	Default     bool   `json:"default"`
+	Running     bool   `json:"running"`
+	Maintenance bool   `json:"maintenance"`
+	Error       string `json:"error,omitempty"`
+}
+
+// Component states
+const (
+	ComponentRunning = "running"
+	ComponentStopped = "stopped"
+	ComponentFailed  = "failed"
+	ComponentUnknown = "unknown"
+)
+
+// ComponentStatus represents the status of a single Moodle stack component
+type ComponentStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Unit      string `json:"unit"`
+	State     string `json:"state"`
+	PID       int    `json:"pid,omitempty"`
+	Uptime    int64  `json:"uptime"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Process roles within a component
+const (
+	ProcessMaster = "master"
+	ProcessWorker = "worker"
+)
+
+// ProcessStats represents the resource usage of a process read from /proc.
+// OpenFDs is -1 when the fd directory of the process is not readable.
+type ProcessStats struct {
+	PID       int       `json:"pid"`
+	PPID      int       `json:"ppid"`
+	Name      string    `json:"name"`
+	Cmdline   string    `json:"cmdline"`
+	State     string    `json:"state"`
+	Role      string    `json:"role"`
+	RSS       int64     `json:"rss"`
+	CPUTime   float64   `json:"cpu_time"`
+	OpenFDs   int       `json:"open_fds"`
+	Threads   int       `json:"threads"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// ComponentProcesses represents the processes of a Moodle stack component,
+// largest RSS first, and their totals
+type ComponentProcesses struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"`
+	Unit      string         `json:"unit,omitempty"`
+	Processes []ProcessStats `json:"processes"`
+	Count     int            `json:"count"`
+	RSS       int64          `json:"rss"`
+	CPUTime   float64        `json:"cpu_time"`
+	OpenFDs   int            `json:"open_fds"`
+	Threads   int            `json:"threads"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// ProcessReport represents the processes of the whole Moodle stack
+type ProcessReport struct {
+	Components []ComponentProcesses `json:"components"`
+	RSS        int64                `json:"rss"`
+	Timestamp  time.Time            `json:"timestamp"`
 }
 
 // SecurityEvent represents a security event
@@ -73,25 +151,135 @@ type Alert struct {
 	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
 }
 
-// PerformanceMetrics represents performance metrics
+// PerformanceMetrics represents performance metrics. For the web tier
+// RequestCount is the number of requests since the previous sample and the
+// connection counts are taken from the server status page.
 type PerformanceMetrics struct {
-	ResponseTime    float64 `json:"response_time"`
-	RequestCount    int64   `json:"request_count"`
-	ErrorCount      int64   `json:"error_count"`
-	ActiveConnections int   `json:"active_connections"`
-	MemoryUsage     float64 `json:"memory_usage"`
-	CPUUsage        float64 `json:"cpu_usage"`
-	Timestamp       time.Time `json:"timestamp"`
+	ResponseTime       float64   `json:"response_time"`
+	RequestCount       int64     `json:"request_count"`
+	ErrorCount         int64     `json:"error_count"`
+	ActiveConnections  int       `json:"active_connections"`
+	MemoryUsage        float64   `json:"memory_usage"`
+	CPUUsage           float64   `json:"cpu_usage"`
+	Server             string    `json:"server,omitempty"`
+	TotalRequests      int64     `json:"total_requests,omitempty"`
+	RequestsPerSec     float64   `json:"requests_per_sec"`
+	ReadingConnections int       `json:"reading_connections"`
+	WritingConnections int       `json:"writing_connections"`
+	WaitingConnections int       `json:"waiting_connections"`
+	Timestamp          time.Time `json:"timestamp"`
+}
+
+// AccessLogCount represents the requests of a Moodle script or client in the
+// access log
+type AccessLogCount struct {
+	Key       string `json:"key"`
+	Requests  int64  `json:"requests"`
+	Status4xx int64  `json:"status_4xx"`
+	Status5xx int64  `json:"status_5xx"`
+}
+
+// AccessLogMinute represents one minute of traffic in the access log
+type AccessLogMinute struct {
+	Minute    time.Time `json:"minute"`
+	Requests  int64     `json:"requests"`
+	Status4xx int64     `json:"status_4xx"`
+	Status5xx int64     `json:"status_5xx"`
+	Bytes     int64     `json:"bytes"`
+	P95       int64     `json:"p95_ms"`
+}
+
+// AccessLogStats represents the traffic of the last Minutes minutes in the
+// access log. The latency percentiles are only set when the log format
+// includes $request_time.
+type AccessLogStats struct {
+	Path           string            `json:"path"`
+	Minutes        int               `json:"minutes"`
+	Requests       int64             `json:"requests"`
+	RequestsPerMin float64           `json:"requests_per_min"`
+	Status4xx      int64             `json:"status_4xx"`
+	Status5xx      int64             `json:"status_5xx"`
+	Rate4xx        float64           `json:"rate_4xx"`
+	Rate5xx        float64           `json:"rate_5xx"`
+	Bytes          int64             `json:"bytes"`
+	HasLatency     bool              `json:"has_latency"`
+	P50            int64             `json:"p50_ms"`
+	P95            int64             `json:"p95_ms"`
+	P99            int64             `json:"p99_ms"`
+	TopScripts     []AccessLogCount  `json:"top_scripts"`
+	TopClients     []AccessLogCount  `json:"top_clients"`
+	Timeline       []AccessLogMinute `json:"timeline"`
+	ParseErrors    int64             `json:"parse_errors"`
+	LastError      string            `json:"last_error,omitempty"`
+	Timestamp      time.Time         `json:"timestamp"`
+}
+
+// PHP error levels of an error group
+const (
+	ErrorLevelFatal      = "fatal"
+	ErrorLevelException  = "exception"
+	ErrorLevelWarning    = "warning"
+	ErrorLevelNotice     = "notice"
+	ErrorLevelDeprecated = "deprecated"
+)
+
+// ErrorGroup represents the occurrences of a PHP error in the error logs,
+// grouped by its normalised message and file:line. Component is the Moodle
+// plugin the file belongs to, or core.
+type ErrorGroup struct {
+	ID           string    `json:"id"`
+	Level        string    `json:"level"`
+	Message      string    `json:"message"`
+	File         string    `json:"file,omitempty"`
+	Line         int       `json:"line,omitempty"`
+	Component    string    `json:"component,omitempty"`
+	Source       string    `json:"source"`
+	Sample       string    `json:"sample"`
+	Count        int64     `json:"count"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+	New          bool      `json:"new"`
+	Acknowledged bool      `json:"acknowledged"`
 }
 
 // DatabaseStats represents database statistics
 type DatabaseStats struct {
-	Connections    int     `json:"connections"`
-	MaxConnections int     `json:"max_connections"`
-	QueriesPerSec  float64 `json:"queries_per_sec"`
-	SlowQueries    int     `json:"slow_queries"`
-	Uptime         int64   `json:"uptime"`
-	Timestamp      time.Time `json:"timestamp"`
+	Type              string    `json:"type"`
+	Connections       int       `json:"connections"`
+	MaxConnections    int       `json:"max_connections"`
+	ConnectionUsage   float64   `json:"connection_usage"`
+	QueriesPerSec     float64   `json:"queries_per_sec"`
+	SlowQueries       int       `json:"slow_queries"`
+	SlowQueriesPerMin float64   `json:"slow_queries_per_min"`
+	Uptime            int64     `json:"uptime"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// PHPFPMPoolStats represents the status page of a PHP-FPM pool. The counters
+// are cumulative since the pool started; the New fields count the increase
+// since the previous sample.
+type PHPFPMPoolStats struct {
+	Name                  string    `json:"name"`
+	Listen                string    `json:"listen"`
+	Pool                  string    `json:"pool,omitempty"`
+	ProcessManager        string    `json:"process_manager,omitempty"`
+	StartSince            int64     `json:"start_since"`
+	AcceptedConn          int64     `json:"accepted_conn"`
+	ListenQueue           int       `json:"listen_queue"`
+	MaxListenQueue        int       `json:"max_listen_queue"`
+	ListenQueueLen        int       `json:"listen_queue_len"`
+	IdleProcesses         int       `json:"idle_processes"`
+	ActiveProcesses       int       `json:"active_processes"`
+	TotalProcesses        int       `json:"total_processes"`
+	MaxActiveProcesses    int       `json:"max_active_processes"`
+	MaxChildren           int       `json:"max_children,omitempty"`
+	ChildrenUsage         float64   `json:"children_usage,omitempty"`
+	MaxChildrenReached    int64     `json:"max_children_reached"`
+	NewMaxChildrenReached int64     `json:"new_max_children_reached"`
+	SlowRequests          int64     `json:"slow_requests"`
+	NewSlowRequests       int64     `json:"new_slow_requests"`
+	Error                 string    `json:"error,omitempty"`
+	Timestamp             time.Time `json:"timestamp"`
 }
 
 // LogEntry represents a log entry
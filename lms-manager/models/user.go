@@ -48,6 +48,7 @@ func (r UserRole) HasPermission(action string) bool {
 			"manage_moodle",
 			"view_logs",
 			"manage_backups",
+			"manage_moodle_users",
 			"view_system_stats",
 		}
 		for _, allowedAction := range operatorActions {
@@ -168,7 +168,94 @@ create_config() {
   "moodle": {
     "path": "/var/www/moodle",
     "config_path": "/var/www/moodle/config.php",
-    "data_path": "/var/www/moodledata"
+    "data_path": "/var/www/moodledata",
+    "php_binary": "php",
+    "web_user": "www-data",
+    "service_manager": "systemd",
+    "components": [
+      {"name": "database", "type": "database", "unit": "mariadb", "order": 10},
+      {"name": "php-fpm", "type": "php_fpm", "unit": "php8.1-fpm", "order": 20},
+      {"name": "web", "type": "web", "unit": "nginx", "order": 30}
+    ],
+    "cron": {
+      "enabled": false,
+      "interval": 60,
+      "timeout": 1800,
+      "failure_threshold": 3,
+      "stale_after": 10
+    },
+    "upgrade": {
+      "archive_path": "$INSTALL_DIR/releases",
+      "backup_path": "/var/backups/moodle",
+      "timeout": 7200
+    },
+    "probes": {
+      "enabled": true,
+      "interval": 60,
+      "timeout": 10,
+      "failure_threshold": 3,
+      "slow_threshold": 3000,
+      "tls_expiry_warning": 14
+    },
+    "storage": {
+      "scan_interval": 3600,
+      "cleanup_age": 168
+    },
+    "integrity": {
+      "enabled": true,
+      "interval": 168,
+      "rate_limit": 10240
+    },
+    "php_fpm": {
+      "enabled": false,
+      "interval": 15,
+      "timeout": 5,
+      "pools": [
+        {"name": "www", "listen": "/run/php/php8.1-fpm.sock", "status_path": "/status"}
+      ]
+    },
+    "web_status": {
+      "enabled": false,
+      "url": "http://127.0.0.1/nginx_status",
+      "interval": 30,
+      "timeout": 5
+    },
+    "access_log": {
+      "enabled": false,
+      "path": "/var/log/nginx/access.log",
+      "format": "combined",
+      "interval": 5,
+      "retention": 60
+    },
+    "error_log": {
+      "enabled": false,
+      "paths": ["/var/log/php8.1-fpm.log", "/var/log/php_errors.log"],
+      "interval": 10,
+      "new_window": 24
+    },
+    "config_history": {
+      "enabled": true,
+      "interval": 60,
+      "retention": 365
+    },
+    "task_health": {
+      "enabled": true,
+      "interval": 60,
+      "overdue_after": 60,
+      "adhoc_max_age": 30,
+      "adhoc_max_queued": 1000
+    },
+    "usage": {
+      "enabled": true,
+      "interval": 60,
+      "batch_size": 5000,
+      "retention": 90
+    },
+    "user_admin": {
+      "enabled": true,
+      "web_service_token": "",
+      "timeout": 30
+    }
   },
   "security": {
     "jwt_secret": "$JWT_SECRET",
@@ -182,7 +269,13 @@ create_config() {
     "alert_thresholds": {
       "cpu": 80.0,
       "memory": 85.0,
-      "disk": 90.0
+      "disk": 90.0,
+      "db_connections": 80.0,
+      "db_slow_queries": 10.0,
+      "php_fpm_children": 90.0,
+      "php_fpm_listen_queue": 10.0,
+      "http_5xx_rate": 5.0,
+      "http_latency_p95": 3000.0
     }
   }
 }
@@ -237,6 +330,7 @@ create_directories() {
     mkdir -p "$INSTALL_DIR/data"
     mkdir -p "$INSTALL_DIR/logs"
     mkdir -p "$INSTALL_DIR/backups"
+    mkdir -p "$INSTALL_DIR/releases"
 
     chown -R "$SERVICE_USER:$SERVICE_GROUP" "$INSTALL_DIR"
 
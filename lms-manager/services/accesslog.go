@@ -0,0 +1,635 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Access log alert types
+const (
+	AlertHTTP5xxRate = "http_5xx_rate"
+	AlertHTTPLatency = "http_latency"
+)
+
+// Alerts are evaluated over the last accessLogAlertWindow minutes, and only
+// when at least accessLogAlertMinRequests requests were logged in them
+const (
+	accessLogAlertWindow      = 5
+	accessLogAlertMinRequests = 20
+)
+
+// accessLogLatencySamples caps the latencies kept per minute; busier minutes
+// keep a uniform sample
+const accessLogLatencySamples = 5000
+
+// accessLogTop is the number of scripts and clients in the top lists
+const accessLogTop = 10
+
+// accessLogFormats are the nginx log_format presets, which Apache's combined
+// and common formats match too
+var accessLogFormats = map[string]string{
+	config.AccessLogCombined: `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	config.AccessLogCommon:   `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+}
+
+// accessLogVariablePattern matches $name and ${name} in a log_format
+var accessLogVariablePattern = regexp.MustCompile(`\$(?:\{([a-z0-9_]+)\}|([a-z0-9_]+))`)
+
+// AccessLogEntry represents a parsed access log line. RequestTime is in
+// seconds and only set when the format includes $request_time.
+type AccessLogEntry struct {
+	Time           time.Time
+	Client         string
+	Method         string
+	Path           string
+	Status         int
+	Bytes          int64
+	RequestTime    float64
+	HasRequestTime bool
+}
+
+// AccessLogFormat parses the lines of an access log format
+type AccessLogFormat struct {
+	pattern   *regexp.Regexp
+	variables []string
+}
+
+// CompileAccessLogFormat compiles a format preset or a custom nginx
+// log_format. The format needs $status and $request or $request_uri.
+func CompileAccessLogFormat(format string) (*AccessLogFormat, error) {
+	if preset, ok := accessLogFormats[format]; ok {
+		format = preset
+	}
+
+	compiled := &AccessLogFormat{}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+
+	matches := accessLogVariablePattern.FindAllStringSubmatchIndex(format, -1)
+	last := 0
+	for i, match := range matches {
+		pattern.WriteString(regexp.QuoteMeta(format[last:match[0]]))
+		last = match[1]
+
+		name := format[match[4]:match[5]]
+		if match[2] >= 0 {
+			name = format[match[2]:match[3]]
+		}
+		compiled.variables = append(compiled.variables, name)
+
+		// A value runs up to the literal that follows it
+		if match[1] < len(format) && (i+1 == len(matches) || matches[i+1][0] > match[1]) {
+			pattern.WriteString("([^" + regexp.QuoteMeta(format[match[1]:match[1]+1]) + "]*)")
+		} else {
+			pattern.WriteString(`(\S*)`)
+		}
+	}
+	pattern.WriteString(regexp.QuoteMeta(format[last:]))
+
+	if !compiled.has("status") || !(compiled.has("request") || compiled.has("request_uri") || compiled.has("uri")) {
+		return nil, fmt.Errorf("access log format needs $status and $request or $request_uri")
+	}
+
+	var err error
+	if compiled.pattern, err = regexp.Compile(pattern.String()); err != nil {
+		return nil, fmt.Errorf("invalid access log format: %v", err)
+	}
+	return compiled, nil
+}
+
+// has reports whether the format includes a variable
+func (f *AccessLogFormat) has(name string) bool {
+	for _, variable := range f.variables {
+		if variable == name {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRequestTime reports whether the format includes $request_time
+func (f *AccessLogFormat) HasRequestTime() bool {
+	return f.has("request_time")
+}
+
+// Parse parses a line of the access log. The client is the first address of
+// $http_x_forwarded_for when the format includes it, $remote_addr otherwise.
+func (f *AccessLogFormat) Parse(line string) (*AccessLogEntry, error) {
+	match := f.pattern.FindStringSubmatch(line)
+	if match == nil {
+		return nil, fmt.Errorf("line does not match the access log format")
+	}
+
+	values := make(map[string]string, len(f.variables))
+	for i, name := range f.variables {
+		values[name] = match[i+1]
+	}
+
+	entry := &AccessLogEntry{}
+	var err error
+	if entry.Status, err = strconv.Atoi(values["status"]); err != nil {
+		return nil, fmt.Errorf("invalid status: %q", values["status"])
+	}
+
+	if request := strings.Fields(values["request"]); len(request) >= 2 {
+		entry.Method, entry.Path = request[0], request[1]
+	} else if uri := values["request_uri"]; uri != "" {
+		entry.Method, entry.Path = values["request_method"], uri
+	} else {
+		entry.Method, entry.Path = values["request_method"], values["uri"]
+	}
+
+	entry.Client = values["remote_addr"]
+	if forwarded := values["http_x_forwarded_for"]; forwarded != "" && forwarded != "-" {
+		entry.Client = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+
+	if bytes, ok := values["body_bytes_sent"]; ok {
+		entry.Bytes, _ = strconv.ParseInt(bytes, 10, 64)
+	} else {
+		entry.Bytes, _ = strconv.ParseInt(values["bytes_sent"], 10, 64)
+	}
+
+	if requestTime, ok := values["request_time"]; ok {
+		if entry.RequestTime, err = strconv.ParseFloat(requestTime, 64); err == nil {
+			entry.HasRequestTime = true
+		}
+	}
+
+	switch {
+	case values["time_local"] != "":
+		entry.Time, err = time.Parse("02/Jan/2006:15:04:05 -0700", values["time_local"])
+	case values["time_iso8601"] != "":
+		entry.Time, err = time.Parse(time.RFC3339, values["time_iso8601"])
+	case values["msec"] != "":
+		var msec float64
+		if msec, err = strconv.ParseFloat(values["msec"], 64); err == nil {
+			entry.Time = time.UnixMilli(int64(msec * 1000))
+		}
+	default:
+		entry.Time = time.Now()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid time: %v", err)
+	}
+
+	return entry, nil
+}
+
+// MoodleScript returns the Moodle script a request path is served by:
+// /mod/quiz/attempt.php for /mod/quiz/attempt.php?attempt=1 and
+// /pluginfile.php for /pluginfile.php/12/mod_resource/content/file.pdf
+func MoodleScript(path string) string {
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	if i := strings.Index(path, ".php"); i >= 0 {
+		return path[:i+len(".php")]
+	}
+	if strings.HasSuffix(path, "/") {
+		return path + "index.php"
+	}
+	return path
+}
+
+// accessLogCounter counts the requests and errors of a script or client
+type accessLogCounter struct {
+	requests, status4xx, status5xx int64
+}
+
+// add counts a request with the given status
+func (c *accessLogCounter) add(status int) {
+	c.requests++
+	switch {
+	case status >= 500:
+		c.status5xx++
+	case status >= 400:
+		c.status4xx++
+	}
+}
+
+// accessLogBucket aggregates a minute of the access log
+type accessLogBucket struct {
+	accessLogCounter
+	bytes     int64
+	scripts   map[string]*accessLogCounter
+	clients   map[string]*accessLogCounter
+	latencies []int64
+	timed     int64
+}
+
+// logTailer follows a log file across rotation. A renamed log is read to its
+// end before the new file is opened, a truncated one is read from the start.
+type logTailer struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial string
+	opened  bool
+}
+
+// read calls fn for every complete line appended since the previous read.
+// The first read starts at the end of the log.
+func (t *logTailer) read(fn func(string)) error {
+	if t.file == nil {
+		if err := t.open(!t.opened); err != nil {
+			return err
+		}
+		t.opened = true
+	}
+
+	if err := t.readLines(fn); err != nil {
+		return err
+	}
+
+	current, err := os.Stat(t.path)
+	if err != nil {
+		// Rotated but not yet recreated, keep the old file
+		return nil
+	}
+
+	switch {
+	case !os.SameFile(current, t.info):
+		t.close()
+		if err := t.open(false); err != nil {
+			return err
+		}
+		return t.readLines(fn)
+	case current.Size() < t.offset:
+		t.offset = 0
+		t.partial = ""
+		return t.readLines(fn)
+	}
+
+	return nil
+}
+
+// open opens the log, at its end or at its start
+func (t *logTailer) open(atEnd bool) error {
+	file, err := os.Open(t.path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", t.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat %s: %v", t.path, err)
+	}
+
+	t.file, t.info, t.offset, t.partial = file, info, 0, ""
+	if atEnd {
+		t.offset = info.Size()
+	}
+	return nil
+}
+
+// readLines reads the open file from the offset to its end. An incomplete
+// last line is kept until the rest of it is written.
+func (t *logTailer) readLines(fn func(string)) error {
+	if _, err := t.file.Seek(t.offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek %s: %v", t.path, err)
+	}
+
+	reader := bufio.NewReader(t.file)
+	for {
+		chunk, err := reader.ReadString('\n')
+		t.offset += int64(len(chunk))
+		if err == io.EOF {
+			t.partial += chunk
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", t.path, err)
+		}
+
+		line := strings.TrimRight(t.partial+chunk, "\r\n")
+		t.partial = ""
+		if line != "" {
+			fn(line)
+		}
+	}
+}
+
+// close closes the open file
+func (t *logTailer) close() {
+	if t.file != nil {
+		t.file.Close()
+		t.file = nil
+	}
+}
+
+// AccessLogService follows the web server access log and aggregates the
+// Moodle traffic per minute
+type AccessLogService struct {
+	config   config.AccessLogConfig
+	monitor  *MonitorService
+	mu       sync.Mutex
+	pollMu   sync.Mutex
+	stopChan chan bool
+	running  bool
+
+	format      *AccessLogFormat
+	formatErr   error
+	tailer      *logTailer
+	buckets     map[int64]*accessLogBucket
+	parseErrors int64
+	lastError   string
+}
+
+// NewAccessLogService creates a new access log analyzer
+func NewAccessLogService(cfg config.AccessLogConfig, monitor *MonitorService) *AccessLogService {
+	format, err := CompileAccessLogFormat(cfg.Format)
+
+	return &AccessLogService{
+		config:    cfg,
+		monitor:   monitor,
+		stopChan:  make(chan bool),
+		format:    format,
+		formatErr: err,
+		tailer:    &logTailer{path: cfg.Path},
+		buckets:   make(map[int64]*accessLogBucket),
+	}
+}
+
+// Enabled reports whether access log analytics is enabled
+func (a *AccessLogService) Enabled() bool {
+	return a.config.Enabled
+}
+
+// Start starts following the access log
+func (a *AccessLogService) Start() {
+	if a.running {
+		return
+	}
+
+	if !a.config.Enabled {
+		utils.Info("Access log analytics is disabled")
+		return
+	}
+
+	if a.formatErr != nil {
+		utils.Error("Access log analytics not started: %v", a.formatErr)
+		return
+	}
+
+	if !a.format.HasRequestTime() {
+		utils.Warn("Access log format has no $request_time, latency percentiles are not available")
+	}
+
+	a.running = true
+	go a.followLoop()
+	utils.Info("Access log analytics started (%s every %ds)", a.config.Path, a.config.Interval)
+}
+
+// Stop stops following the access log
+func (a *AccessLogService) Stop() {
+	if !a.running {
+		return
+	}
+
+	a.running = false
+	a.stopChan <- true
+
+	a.pollMu.Lock()
+	a.tailer.close()
+	a.pollMu.Unlock()
+
+	utils.Info("Access log analytics stopped")
+}
+
+// followLoop reads the log and checks the alert rules on every tick
+func (a *AccessLogService) followLoop() {
+	ticker := time.NewTicker(time.Duration(a.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	a.follow()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.follow()
+		case <-a.stopChan:
+			return
+		}
+	}
+}
+
+// follow reads new lines and hands the recent traffic to the monitor
+func (a *AccessLogService) follow() {
+	a.mu.Lock()
+	previous := a.lastError
+	a.mu.Unlock()
+
+	if err := a.Poll(); err != nil && err.Error() != previous {
+		utils.Warn("Failed to read access log: %v", err)
+	}
+
+	if a.monitor != nil {
+		a.monitor.CheckAccessLogStats(a.GetStats(accessLogAlertWindow))
+	}
+}
+
+// Poll reads the lines appended to the access log since the previous poll
+// and drops the minutes older than the retention
+func (a *AccessLogService) Poll() error {
+	if a.formatErr != nil {
+		return a.formatErr
+	}
+
+	a.pollMu.Lock()
+	defer a.pollMu.Unlock()
+
+	err := a.tailer.read(a.record)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.lastError = ""
+	if err != nil {
+		a.lastError = err.Error()
+	}
+
+	oldest := time.Now().Truncate(time.Minute).Add(-time.Duration(a.config.Retention-1) * time.Minute).Unix()
+	for minute := range a.buckets {
+		if minute < oldest {
+			delete(a.buckets, minute)
+		}
+	}
+
+	return err
+}
+
+// record adds a log line to the bucket of its minute
+func (a *AccessLogService) record(line string) {
+	entry, err := a.format.Parse(line)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err != nil {
+		a.parseErrors++
+		return
+	}
+
+	minute := entry.Time.Truncate(time.Minute)
+	if time.Since(minute) >= time.Duration(a.config.Retention)*time.Minute {
+		return
+	}
+
+	bucket, exists := a.buckets[minute.Unix()]
+	if !exists {
+		bucket = &accessLogBucket{
+			scripts: make(map[string]*accessLogCounter),
+			clients: make(map[string]*accessLogCounter),
+		}
+		a.buckets[minute.Unix()] = bucket
+	}
+
+	bucket.add(entry.Status)
+	bucket.bytes += entry.Bytes
+	countKey(bucket.scripts, MoodleScript(entry.Path)).add(entry.Status)
+	countKey(bucket.clients, entry.Client).add(entry.Status)
+
+	if entry.HasRequestTime {
+		latency := int64(entry.RequestTime * 1000)
+		bucket.timed++
+		if len(bucket.latencies) < accessLogLatencySamples {
+			bucket.latencies = append(bucket.latencies, latency)
+		} else if i := rand.Int63n(bucket.timed); i < accessLogLatencySamples {
+			bucket.latencies[i] = latency
+		}
+	}
+}
+
+// countKey returns the counter of a key, adding it when missing
+func countKey(counters map[string]*accessLogCounter, key string) *accessLogCounter {
+	counter, exists := counters[key]
+	if !exists {
+		counter = &accessLogCounter{}
+		counters[key] = counter
+	}
+	return counter
+}
+
+// GetStats aggregates the traffic of the last minutes minutes, the current
+// one included. It is limited to the retention.
+func (a *AccessLogService) GetStats(minutes int) *models.AccessLogStats {
+	if minutes <= 0 || minutes > a.config.Retention {
+		minutes = a.config.Retention
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := &models.AccessLogStats{
+		Path:        a.config.Path,
+		Minutes:     minutes,
+		HasLatency:  a.format != nil && a.format.HasRequestTime(),
+		ParseErrors: a.parseErrors,
+		LastError:   a.lastError,
+		Timeline:    []models.AccessLogMinute{},
+		Timestamp:   time.Now(),
+	}
+	if a.formatErr != nil {
+		stats.LastError = a.formatErr.Error()
+	}
+
+	oldest := stats.Timestamp.Truncate(time.Minute).Add(-time.Duration(minutes-1) * time.Minute).Unix()
+	scripts := make(map[string]*accessLogCounter)
+	clients := make(map[string]*accessLogCounter)
+	var latencies []int64
+
+	for minute, bucket := range a.buckets {
+		if minute < oldest {
+			continue
+		}
+
+		stats.Requests += bucket.requests
+		stats.Status4xx += bucket.status4xx
+		stats.Status5xx += bucket.status5xx
+		stats.Bytes += bucket.bytes
+		mergeCounters(scripts, bucket.scripts)
+		mergeCounters(clients, bucket.clients)
+		latencies = append(latencies, bucket.latencies...)
+
+		sorted := append([]int64{}, bucket.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		stats.Timeline = append(stats.Timeline, models.AccessLogMinute{
+			Minute:    time.Unix(minute, 0),
+			Requests:  bucket.requests,
+			Status4xx: bucket.status4xx,
+			Status5xx: bucket.status5xx,
+			Bytes:     bucket.bytes,
+			P95:       Percentile(sorted, 95),
+		})
+	}
+
+	sort.Slice(stats.Timeline, func(i, j int) bool {
+		return stats.Timeline[i].Minute.Before(stats.Timeline[j].Minute)
+	})
+
+	stats.RequestsPerMin = float64(stats.Requests) / float64(minutes)
+	if stats.Requests > 0 {
+		stats.Rate4xx = float64(stats.Status4xx) / float64(stats.Requests) * 100
+		stats.Rate5xx = float64(stats.Status5xx) / float64(stats.Requests) * 100
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats.P50 = Percentile(latencies, 50)
+	stats.P95 = Percentile(latencies, 95)
+	stats.P99 = Percentile(latencies, 99)
+
+	stats.TopScripts = topCounters(scripts)
+	stats.TopClients = topCounters(clients)
+
+	return stats
+}
+
+// mergeCounters adds the counters of a bucket to a total
+func mergeCounters(total, counters map[string]*accessLogCounter) {
+	for key, counter := range counters {
+		sum := countKey(total, key)
+		sum.requests += counter.requests
+		sum.status4xx += counter.status4xx
+		sum.status5xx += counter.status5xx
+	}
+}
+
+// topCounters returns the keys with the most requests
+func topCounters(counters map[string]*accessLogCounter) []models.AccessLogCount {
+	top := make([]models.AccessLogCount, 0, len(counters))
+	for key, counter := range counters {
+		top = append(top, models.AccessLogCount{
+			Key:       key,
+			Requests:  counter.requests,
+			Status4xx: counter.status4xx,
+			Status5xx: counter.status5xx,
+		})
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Requests != top[j].Requests {
+			return top[i].Requests > top[j].Requests
+		}
+		return top[i].Key < top[j].Key
+	})
+
+	if len(top) > accessLogTop {
+		top = top[:accessLogTop]
+	}
+	return top
+}
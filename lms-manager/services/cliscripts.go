@@ -0,0 +1,171 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"lms-manager/models"
+)
+
+// cliScripts is the allow-list of Moodle CLI scripts that can be run as jobs
+var cliScripts = []models.CLIScript{
+	{
+		Name:        "purge_caches",
+		Script:      "admin/cli/purge_caches.php",
+		Description: "Purge all or selected Moodle caches",
+		Args: []models.CLIScriptArg{
+			{Name: "muc", Flag: true, Description: "Purge all MUC caches"},
+			{Name: "theme", Flag: true, Description: "Purge theme caches"},
+			{Name: "lang", Flag: true, Description: "Purge language string caches"},
+			{Name: "js", Flag: true, Description: "Purge JavaScript caches"},
+			{Name: "template", Flag: true, Description: "Purge template caches"},
+			{Name: "filter", Flag: true, Description: "Purge text filter caches"},
+			{Name: "other", Flag: true, Description: "Purge all file and miscellaneous caches"},
+		},
+		Timeout: 600,
+	},
+	{
+		Name:        "upgrade",
+		Script:      "admin/cli/upgrade.php",
+		Description: "Run the Moodle database upgrade",
+		Args: []models.CLIScriptArg{
+			{Name: "allow-unstable", Flag: true, Description: "Upgrade even if the version is not marked as stable"},
+		},
+		FixedArgs:   []string{"--non-interactive"},
+		Timeout:     7200,
+		Maintenance: true,
+	},
+	{
+		Name:        "fix_course_sequence",
+		Script:      "admin/cli/fix_course_sequence.php",
+		Description: "Check and fix course section sequences",
+		Args: []models.CLIScriptArg{
+			{Name: "courses", Pattern: `\*|[0-9]+(,[0-9]+)*`, Required: true, Description: "Course IDs separated by commas, or * for all courses"},
+			{Name: "fix", Flag: true, Description: "Fix the mismatches instead of only reporting them"},
+		},
+		Timeout: 3600,
+	},
+	{
+		Name:        "reset_password",
+		Script:      "admin/cli/reset_password.php",
+		Description: "Reset the password of a Moodle user",
+		Args: []models.CLIScriptArg{
+			{Name: "username", Pattern: `[a-zA-Z0-9._@+-]{1,100}`, Required: true, Description: "Username of the account"},
+			{Name: "password", Pattern: `[^\x00-\x1f]{1,100}`, Required: true, Stdin: true, Description: "New password, entered at the prompt of the script"},
+			{Name: "ignore-password-policy", Flag: true, Description: "Do not check the password against the site policy"},
+		},
+		Timeout: 120,
+	},
+	{
+		Name:        "kill_all_sessions",
+		Script:      "admin/cli/kill_all_sessions.php",
+		Description: "Log out all users",
+		Timeout:     120,
+	},
+	{
+		Name:        "scheduled_task",
+		Script:      "admin/cli/scheduled_task.php",
+		Description: "List scheduled tasks or execute one",
+		Args: []models.CLIScriptArg{
+			{Name: "list", Flag: true, Description: "List all scheduled tasks"},
+			{Name: "execute", Pattern: `\\?[a-zA-Z0-9_]+(\\[a-zA-Z0-9_]+)*`, Description: "Class name of the task to execute"},
+		},
+		Timeout: 3600,
+	},
+}
+
+// CLIScripts returns the allow-listed Moodle CLI scripts
+func CLIScripts() []models.CLIScript {
+	return cliScripts
+}
+
+// findCLIScript returns the allow-listed script with the given name
+func findCLIScript(name string) (*models.CLIScript, error) {
+	for i := range cliScripts {
+		if cliScripts[i].Name == name {
+			return &cliScripts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("CLI script is not allowed: %s", name)
+}
+
+// buildCLIArgs validates the arguments of a CLI script. It returns the
+// command line arguments, a copy of the arguments to record with the job and
+// the input answering the prompts of the script.
+func buildCLIArgs(script *models.CLIScript, args map[string]string) ([]string, map[string]string, string, error) {
+	known := make(map[string]bool)
+	for _, arg := range script.Args {
+		known[arg.Name] = true
+	}
+
+	for name := range args {
+		if !known[name] {
+			return nil, nil, "", fmt.Errorf("unknown argument for %s: %s", script.Name, name)
+		}
+	}
+
+	cmdArgs := append([]string{}, script.FixedArgs...)
+	values := make(map[string]string)
+	var input strings.Builder
+
+	for _, arg := range script.Args {
+		value, ok := args[arg.Name]
+		if !ok || (arg.Flag && value == "false") {
+			if arg.Required {
+				return nil, nil, "", fmt.Errorf("missing required argument for %s: %s", script.Name, arg.Name)
+			}
+			continue
+		}
+
+		if arg.Flag {
+			if value != "" && value != "true" {
+				return nil, nil, "", fmt.Errorf("argument %s is a flag and takes no value", arg.Name)
+			}
+			cmdArgs = append(cmdArgs, "--"+arg.Name)
+			values[arg.Name] = "true"
+			continue
+		}
+
+		if arg.Pattern != "" && !regexp.MustCompile(`^(?:`+arg.Pattern+`)$`).MatchString(value) {
+			return nil, nil, "", fmt.Errorf("invalid value for argument %s", arg.Name)
+		}
+
+		if arg.Stdin {
+			input.WriteString(value + "\n")
+			continue
+		}
+
+		cmdArgs = append(cmdArgs, fmt.Sprintf("--%s=%s", arg.Name, value))
+		values[arg.Name] = value
+	}
+
+	return cmdArgs, values, input.String(), nil
+}
+
+// cliCommandLine returns a printable command line
+func cliCommandLine(script *models.CLIScript, values map[string]string) string {
+	parts := append([]string{script.Script}, script.FixedArgs...)
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	flags := make(map[string]bool)
+	for _, arg := range script.Args {
+		flags[arg.Name] = arg.Flag
+	}
+
+	for _, name := range names {
+		if flags[name] {
+			parts = append(parts, "--"+name)
+		} else {
+			parts = append(parts, fmt.Sprintf("--%s=%s", name, values[name]))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
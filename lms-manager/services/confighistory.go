@@ -0,0 +1,535 @@
+package services
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Alerts raised for config.php changes made outside lms-manager
+const (
+	AlertConfigChanged      = "config_php_changed"
+	AlertConfigDebugDisplay = "config_php_debugdisplay"
+)
+
+// configDiffContext is the number of unchanged lines shown around a change
+const configDiffContext = 3
+
+// phpScalarPattern matches a quoted PHP string or a bare value up to the end
+// of the statement or array element
+const phpScalarPattern = `'(?:[^'\\\n]|\\.)*'|"(?:[^"\\\n]|\\.)*"|[^;,\s()\]]+`
+
+// configAssignmentPattern matches the value assigned to a $CFG setting
+var configAssignmentPattern = regexp.MustCompile(`(\$CFG->(\w+)\s*=\s*)(` + phpScalarPattern + `)`)
+
+// configArrayPattern matches a value in an array, e.g. in $CFG->dboptions
+var configArrayPattern = regexp.MustCompile(`(['"](\w+)['"]\s*=>\s*)(` + phpScalarPattern + `)`)
+
+// RedactConfigSource masks the values of secret settings in config.php
+// source, keeping every other line as it is
+func RedactConfigSource(content string) string {
+	redact := func(pattern *regexp.Regexp) func(string) string {
+		return func(match string) string {
+			parts := pattern.FindStringSubmatch(match)
+			if !IsSecretSetting(parts[2]) {
+				return match
+			}
+			return parts[1] + "'" + redactedValue + "'"
+		}
+	}
+
+	content = configAssignmentPattern.ReplaceAllStringFunc(content, redact(configAssignmentPattern))
+	return configArrayPattern.ReplaceAllStringFunc(content, redact(configArrayPattern))
+}
+
+// configSecretsHash hashes the values of the secret settings in config.php
+// source, so a changed secret is noticed without keeping it
+func configSecretsHash(content string) string {
+	hash := sha256.New()
+	for _, pattern := range []*regexp.Regexp{configAssignmentPattern, configArrayPattern} {
+		for _, parts := range pattern.FindAllStringSubmatch(content, -1) {
+			if IsSecretSetting(parts[2]) {
+				fmt.Fprintf(hash, "%s=%s\n", parts[2], parts[3])
+			}
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// ConfigHistoryService snapshots config.php into the database whenever its
+// content changes and alerts on changes made outside lms-manager. Versions
+// are stored with secrets redacted; the hash of the whole file and of the
+// secrets tell when a secret changed.
+type ConfigHistoryService struct {
+	config    config.ConfigHistoryConfig
+	moodle    *MoodleService
+	monitor   *MonitorService
+	db        *sql.DB
+	mu        sync.Mutex
+	stopChan  chan bool
+	running   bool
+	lastError string
+}
+
+// NewConfigHistoryService creates a new config.php history service
+func NewConfigHistoryService(cfg config.ConfigHistoryConfig, moodle *MoodleService, monitor *MonitorService) *ConfigHistoryService {
+	return &ConfigHistoryService{
+		config:   cfg,
+		moodle:   moodle,
+		monitor:  monitor,
+		stopChan: make(chan bool),
+	}
+}
+
+// SetDatabase sets the database connection
+func (c *ConfigHistoryService) SetDatabase(db *sql.DB) {
+	c.db = db
+}
+
+// Start starts watching config.php
+func (c *ConfigHistoryService) Start() {
+	if c.running {
+		return
+	}
+
+	if !c.config.Enabled {
+		utils.Info("config.php history is disabled")
+		return
+	}
+
+	c.running = true
+	go c.watchLoop()
+	utils.Info("config.php history started (%s every %ds)", c.moodle.config.ConfigPath, c.config.Interval)
+}
+
+// Stop stops watching config.php
+func (c *ConfigHistoryService) Stop() {
+	if !c.running {
+		return
+	}
+
+	c.running = false
+	c.stopChan <- true
+	utils.Info("config.php history stopped")
+}
+
+// watchLoop checks config.php on every tick
+func (c *ConfigHistoryService) watchLoop() {
+	ticker := time.NewTicker(time.Duration(c.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	c.watch()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.watch()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// watch checks config.php, logging a failure once until it changes
+func (c *ConfigHistoryService) watch() {
+	message := ""
+	if err := c.Check(); err != nil {
+		message = err.Error()
+	}
+	if message != "" && message != c.lastError {
+		utils.Warn("Failed to check config.php: %s", message)
+	}
+	c.lastError = message
+}
+
+// Check hashes config.php and stores its redacted content as a new version
+// when it differs from the latest one. The first version is the initial
+// snapshot; later versions were made outside lms-manager and stay pending
+// until accepted. Versions past the retention are pruned.
+func (c *ConfigHistoryService) Check() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	path := c.moodle.config.ConfigPath
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("Moodle config file does not exist: %s", path)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config.php: %v", err)
+	}
+
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	latest, err := c.latestVersion()
+	if err != nil {
+		return err
+	}
+
+	if latest == nil || latest.Hash != hash {
+		version := models.ConfigVersion{
+			ID:           utils.GenerateID(),
+			Hash:         hash,
+			Size:         int64(len(content)),
+			Source:       models.ConfigSourceExternal,
+			ChangedBy:    fileOwner(info),
+			DebugDisplay: configDebugDisplay(string(content), filepath.Dir(path)),
+			SecretsHash:  configSecretsHash(string(content)),
+			CreatedAt:    time.Now(),
+			Content:      RedactConfigSource(string(content)),
+		}
+		if latest == nil {
+			version.Source = models.ConfigSourceInitial
+		} else {
+			version.SecretsChanged = version.SecretsHash != latest.SecretsHash
+		}
+
+		if _, err := c.db.Exec(`
+			INSERT INTO config_versions (id, instance, hash, content, size, source, changed_by, debugdisplay,
+				secrets_hash, secrets_changed, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, version.ID, c.moodle.Name(), version.Hash, version.Content, version.Size, version.Source,
+			version.ChangedBy, version.DebugDisplay, version.SecretsHash, version.SecretsChanged, version.CreatedAt); err != nil {
+			return fmt.Errorf("failed to save config.php version: %v", err)
+		}
+
+		if latest != nil {
+			utils.Warn("config.php of %s changed outside lms-manager", c.moodle.Name())
+		}
+		latest = &version
+	}
+
+	if err := c.prune(latest.ID); err != nil {
+		return err
+	}
+	return c.checkAlerts()
+}
+
+// prune drops the versions past the retention. The latest version and the
+// changes still pending are kept.
+func (c *ConfigHistoryService) prune(latestID string) error {
+	_, err := c.db.Exec(`
+		DELETE FROM config_versions
+		WHERE instance = ? AND created_at < ? AND id != ?
+		AND NOT (source = ? AND acknowledged_at IS NULL)
+	`, c.moodle.Name(), time.Now().AddDate(0, 0, -c.config.Retention), latestID, models.ConfigSourceExternal)
+	if err != nil {
+		return fmt.Errorf("failed to prune config.php versions: %v", err)
+	}
+	return nil
+}
+
+// checkAlerts hands the latest pending change and the latest version to the
+// monitor
+func (c *ConfigHistoryService) checkAlerts() error {
+	if c.monitor == nil {
+		return nil
+	}
+
+	pending, err := c.queryVersion(`source = ? AND acknowledged_at IS NULL`, models.ConfigSourceExternal)
+	if err != nil {
+		return err
+	}
+	latest, err := c.latestVersion()
+	if err != nil {
+		return err
+	}
+
+	c.monitor.CheckConfigVersion(pending, latest)
+	return nil
+}
+
+// Accept records that an operator reviewed the pending config.php changes,
+// including one made since the last check, and resolves their alert. The
+// debugdisplay alert stays until config.php no longer enables it.
+func (c *ConfigHistoryService) Accept(username string) error {
+	if err := c.Check(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := c.db.Exec(`
+		UPDATE config_versions SET acknowledged_by = ?, acknowledged_at = ?
+		WHERE instance = ? AND source = ? AND acknowledged_at IS NULL
+	`, username, time.Now(), c.moodle.Name(), models.ConfigSourceExternal); err != nil {
+		return fmt.Errorf("failed to accept config.php changes: %v", err)
+	}
+
+	return c.checkAlerts()
+}
+
+// GetVersions returns the most recent config.php versions without their
+// content
+func (c *ConfigHistoryService) GetVersions(limit int) ([]models.ConfigVersion, error) {
+	if c.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := c.db.Query(`
+		SELECT id, hash, size, source, changed_by, debugdisplay, secrets_changed, acknowledged_by, acknowledged_at, created_at
+		FROM config_versions
+		WHERE instance = ?
+		ORDER BY created_at DESC LIMIT ?
+	`, c.moodle.Name(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query config.php versions: %v", err)
+	}
+	defer rows.Close()
+
+	versions := []models.ConfigVersion{}
+	for rows.Next() {
+		var version models.ConfigVersion
+		var acknowledgedBy sql.NullString
+		var acknowledgedAt sql.NullTime
+		if err := rows.Scan(&version.ID, &version.Hash, &version.Size, &version.Source, &version.ChangedBy,
+			&version.DebugDisplay, &version.SecretsChanged, &acknowledgedBy, &acknowledgedAt, &version.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan config.php version: %v", err)
+		}
+		version.AcknowledgedBy = acknowledgedBy.String
+		if acknowledgedAt.Valid {
+			version.AcknowledgedAt = &acknowledgedAt.Time
+		}
+		versions = append(versions, version)
+	}
+
+	return versions, rows.Err()
+}
+
+// Diff returns the changes between two versions, which are stored with
+// secrets redacted. An empty to compares against the latest version, an
+// empty from against the version before to.
+func (c *ConfigHistoryService) Diff(fromID, toID string) (*models.ConfigDiff, error) {
+	if c.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	var to *models.ConfigVersion
+	var err error
+	if toID == "" {
+		to, err = c.latestVersion()
+	} else {
+		to, err = c.queryVersion(`id = ?`, toID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if to == nil {
+		return nil, fmt.Errorf("config.php version not found: %s", toID)
+	}
+
+	var from *models.ConfigVersion
+	if fromID == "" {
+		from, err = c.queryVersion(`created_at < ?`, to.CreatedAt)
+	} else {
+		from, err = c.queryVersion(`id = ?`, fromID)
+		if err == nil && from == nil {
+			err = fmt.Errorf("config.php version not found: %s", fromID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &models.ConfigDiff{To: to}
+	fromContent := ""
+	if from != nil {
+		diff.From = from
+		diff.SecretsChanged = from.SecretsHash != to.SecretsHash
+		fromContent = from.Content
+	}
+	diff.Diff, diff.Added, diff.Removed = unifiedConfigDiff(fromContent, to.Content)
+	return diff, nil
+}
+
+// latestVersion returns the latest config.php version, or nil before the
+// first snapshot
+func (c *ConfigHistoryService) latestVersion() (*models.ConfigVersion, error) {
+	return c.queryVersion(`1 = 1`)
+}
+
+// queryVersion returns the most recent version of the instance matching a
+// condition, or nil when there is none
+func (c *ConfigHistoryService) queryVersion(condition string, args ...interface{}) (*models.ConfigVersion, error) {
+	var version models.ConfigVersion
+	var acknowledgedBy sql.NullString
+	var acknowledgedAt sql.NullTime
+
+	err := c.db.QueryRow(`
+		SELECT id, hash, content, size, source, changed_by, debugdisplay, secrets_hash, secrets_changed,
+			acknowledged_by, acknowledged_at, created_at
+		FROM config_versions
+		WHERE instance = ? AND (`+condition+`)
+		ORDER BY created_at DESC LIMIT 1
+	`, append([]interface{}{c.moodle.Name()}, args...)...).Scan(&version.ID, &version.Hash, &version.Content, &version.Size,
+		&version.Source, &version.ChangedBy, &version.DebugDisplay, &version.SecretsHash, &version.SecretsChanged,
+		&acknowledgedBy, &acknowledgedAt, &version.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config.php version: %v", err)
+	}
+
+	version.AcknowledgedBy = acknowledgedBy.String
+	if acknowledgedAt.Valid {
+		version.AcknowledgedAt = &acknowledgedAt.Time
+	}
+	return &version, nil
+}
+
+// configDebugDisplay reports whether config.php shows debug messages to
+// users
+func configDebugDisplay(content, dir string) bool {
+	settings, err := parsePHPAssignments(content, "CFG", dir)
+	if err != nil {
+		return false
+	}
+	return phpBool(settings["debugdisplay"])
+}
+
+// fileOwner returns the name of the user owning a file. Editors keep the
+// owner, so it tells which account the change was made with at best.
+func fileOwner(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+
+	uid := strconv.FormatUint(uint64(stat.Uid), 10)
+	if owner, err := user.LookupId(uid); err == nil {
+		return owner.Username
+	}
+	return uid
+}
+
+// unifiedConfigDiff returns the unified diff of two config.php contents and
+// the number of added and removed lines
+func unifiedConfigDiff(from, to string) (string, int, int) {
+	fromLines, toLines := splitLines(from), splitLines(to)
+
+	// Longest common subsequence lengths of the suffixes
+	lcs := make([][]int, len(fromLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(toLines)+1)
+	}
+	for i := len(fromLines) - 1; i >= 0; i-- {
+		for j := len(toLines) - 1; j >= 0; j-- {
+			if fromLines[i] == toLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type diffLine struct {
+		op       byte
+		text     string
+		from, to int
+	}
+	var lines []diffLine
+	added, removed := 0, 0
+	i, j := 0, 0
+	for i < len(fromLines) || j < len(toLines) {
+		switch {
+		case i < len(fromLines) && j < len(toLines) && fromLines[i] == toLines[j]:
+			lines = append(lines, diffLine{' ', toLines[j], i, j})
+			i++
+			j++
+		case j == len(toLines) || (i < len(fromLines) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', fromLines[i], i, j})
+			removed++
+			i++
+		default:
+			lines = append(lines, diffLine{'+', toLines[j], i, j})
+			added++
+			j++
+		}
+	}
+
+	var diff strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+
+		// Extend the hunk while the next change is within the context
+		end := start
+		for k := start; k < len(lines) && k <= end+2*configDiffContext; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+
+		first := start - configDiffContext
+		if first < 0 {
+			first = 0
+		}
+		last := end + configDiffContext + 1
+		if last > len(lines) {
+			last = len(lines)
+		}
+
+		fromCount, toCount := 0, 0
+		for _, line := range lines[first:last] {
+			if line.op != '+' {
+				fromCount++
+			}
+			if line.op != '-' {
+				toCount++
+			}
+		}
+		fromStart, toStart := lines[first].from, lines[first].to
+		if fromCount > 0 {
+			fromStart++
+		}
+		if toCount > 0 {
+			toStart++
+		}
+
+		fmt.Fprintf(&diff, "@@ -%d,%d +%d,%d @@\n", fromStart, fromCount, toStart, toCount)
+		for _, line := range lines[first:last] {
+			diff.WriteByte(line.op)
+			diff.WriteString(line.text)
+			diff.WriteByte('\n')
+		}
+
+		start = last
+	}
+
+	return diff.String(), added, removed
+}
+
+// splitLines splits content into lines without the trailing newline
+func splitLines(content string) []string {
+	content = strings.TrimSuffix(content, "\n")
+	if content == "" {
+		return nil
+	}
+	return strings.Split(content, "\n")
+}
@@ -0,0 +1,454 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Cron alert types
+const (
+	AlertCronFailing = "moodle_cron_failing"
+	AlertCronStale   = "moodle_cron_stale"
+)
+
+// cronOutputTail is the number of output bytes kept for each cron run
+const cronOutputTail = 8192
+
+// cronPausePoll is how often Pause checks whether the run in progress has
+// finished
+const cronPausePoll = 100 * time.Millisecond
+
+// CronService runs Moodle's admin/cli/cron.php and watches its health
+type CronService struct {
+	config   config.CronConfig
+	moodle   *MoodleService
+	monitor  *MonitorService
+	db       *sql.DB
+	mu       sync.RWMutex
+	stopChan chan bool
+	running  bool
+
+	startedAt    time.Time
+	active       bool
+	activeSince  time.Time
+	lastRun      *models.CronRun
+	lastSuccess  time.Time
+	failures     int
+	staleAlerted bool
+	paused       bool
+}
+
+// NewCronService creates a new cron service
+func NewCronService(cfg config.CronConfig, moodle *MoodleService, monitor *MonitorService) *CronService {
+	return &CronService{
+		config:    cfg,
+		moodle:    moodle,
+		monitor:   monitor,
+		stopChan:  make(chan bool),
+		startedAt: time.Now(),
+	}
+}
+
+// SetDatabase sets the database connection
+func (c *CronService) SetDatabase(db *sql.DB) {
+	c.db = db
+}
+
+// Start starts running cron on the configured interval
+func (c *CronService) Start() {
+	if c.running {
+		return
+	}
+
+	if !c.config.Enabled {
+		utils.Info("Moodle cron runner is disabled")
+		return
+	}
+
+	c.loadLastRun()
+
+	c.running = true
+	c.startedAt = time.Now()
+	go c.cronLoop()
+	utils.Info("Moodle cron runner started (every %ds)", c.config.Interval)
+}
+
+// Stop stops the cron loop. A cron run in progress is left to finish.
+func (c *CronService) Stop() {
+	if !c.running {
+		return
+	}
+
+	c.running = false
+	c.stopChan <- true
+	utils.Info("Moodle cron runner stopped")
+}
+
+// cronLoop triggers cron on every tick
+func (c *CronService) cronLoop() {
+	ticker := time.NewTicker(time.Duration(c.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	c.Trigger()
+
+	for {
+		select {
+		case <-ticker.C:
+			if c.isPaused() {
+				continue
+			}
+			c.checkStale()
+			c.Trigger()
+		case <-c.stopChan:
+			return
+		}
+	}
+}
+
+// Pause stops cron from being run until Resume is called, e.g. while Moodle
+// is being upgraded. It waits up to timeout for a cron run in progress to
+// finish; if the run is still going, cron is left running and an error is
+// returned.
+func (c *CronService) Pause(timeout time.Duration) error {
+	c.mu.Lock()
+	c.paused = true
+	c.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		c.mu.Lock()
+		if !c.active {
+			c.mu.Unlock()
+			utils.Info("Moodle cron runner paused")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			c.paused = false
+			c.mu.Unlock()
+			return fmt.Errorf("a Moodle cron run is still in progress after %s", timeout)
+		}
+		c.mu.Unlock()
+
+		time.Sleep(cronPausePoll)
+	}
+}
+
+// Resume lets cron run again after Pause. The stale check starts over, so
+// the pause itself does not raise an alert.
+func (c *CronService) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.paused {
+		return
+	}
+	c.paused = false
+	c.startedAt = time.Now()
+	utils.Info("Moodle cron runner resumed")
+}
+
+// isPaused reports whether cron is paused
+func (c *CronService) isPaused() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.paused
+}
+
+// Trigger starts a cron run in the background unless one is in progress
+func (c *CronService) Trigger() error {
+	if err := c.begin(); err != nil {
+		utils.Warn("Skipping Moodle cron run: %v", err)
+		return err
+	}
+
+	go func() {
+		defer c.end()
+		c.record(c.execute())
+	}()
+
+	return nil
+}
+
+// Run runs cron and waits for it to finish
+func (c *CronService) Run() (*models.CronRun, error) {
+	if err := c.begin(); err != nil {
+		return nil, err
+	}
+	defer c.end()
+
+	run := c.execute()
+	c.record(run)
+	return run, nil
+}
+
+// begin marks a cron run as in progress, failing if one already is or cron
+// is paused
+func (c *CronService) begin() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused {
+		return fmt.Errorf("Moodle cron is paused")
+	}
+	if c.active {
+		return fmt.Errorf("Moodle cron is already running")
+	}
+
+	c.active = true
+	c.activeSince = time.Now()
+	return nil
+}
+
+// end marks the cron run as finished
+func (c *CronService) end() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = false
+}
+
+// execute runs admin/cli/cron.php and returns the result
+func (c *CronService) execute() *models.CronRun {
+	run := &models.CronRun{
+		ID:        utils.GenerateID(),
+		StartedAt: time.Now(),
+	}
+
+	cmd, err := c.moodle.moodleCLICommand("admin/cli/cron.php")
+	if err == nil {
+		output := &tailBuffer{max: cronOutputTail}
+		cmd.Stdout = output
+		cmd.Stderr = output
+
+		err = c.wait(cmd)
+		run.Output = strings.ToValidUTF8(output.String(), "")
+	}
+
+	run.FinishedAt = time.Now()
+	run.Duration = run.FinishedAt.Sub(run.StartedAt).Milliseconds()
+	run.Success = err == nil
+	if err != nil {
+		run.ExitCode = exitCode(err)
+		run.Error = err.Error()
+	}
+
+	return run
+}
+
+// wait runs the command, killing it when the timeout expires
+func (c *CronService) wait(cmd *exec.Cmd) error {
+	ctx := context.Background()
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(c.config.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	err := runCommand(ctx, cmd)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("cron timed out after %ds", c.config.Timeout)
+	}
+	return err
+}
+
+// record stores a cron run and raises or resolves alerts
+func (c *CronService) record(run *models.CronRun) {
+	c.mu.Lock()
+	c.lastRun = run
+	recovered := false
+	if run.Success {
+		recovered = c.failures >= c.config.FailureThreshold || c.staleAlerted
+		c.failures = 0
+		c.lastSuccess = run.FinishedAt
+		c.staleAlerted = false
+	} else {
+		c.failures++
+	}
+	failures := c.failures
+	c.mu.Unlock()
+
+	c.saveRun(run)
+
+	if run.Success {
+		if recovered && c.monitor != nil {
+			c.monitor.ResolveAlerts(AlertCronFailing)
+			c.monitor.ResolveAlerts(AlertCronStale)
+			utils.Info("Moodle cron recovered")
+		}
+		return
+	}
+
+	utils.Warn("Moodle cron failed (exit code %d): %s", run.ExitCode, run.Error)
+
+	if c.config.FailureThreshold > 0 && failures >= c.config.FailureThreshold && c.monitor != nil {
+		c.monitor.RaiseAlert(AlertCronFailing, "critical", fmt.Sprintf("Moodle cron failed %d times in a row: %s", failures, run.Error))
+	}
+}
+
+// checkStale raises an alert when cron has not completed successfully within
+// the configured number of minutes
+func (c *CronService) checkStale() {
+	if c.config.StaleAfter <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	since := c.lastSuccess
+	if since.Before(c.startedAt) {
+		since = c.startedAt
+	}
+
+	stale := time.Since(since) > time.Duration(c.config.StaleAfter)*time.Minute
+	alert := stale && !c.staleAlerted
+	if alert {
+		c.staleAlerted = true
+	}
+	c.mu.Unlock()
+
+	if alert && c.monitor != nil {
+		c.monitor.RaiseAlert(AlertCronStale, "warning", fmt.Sprintf("Moodle cron has not completed since %s", since.Format("2006-01-02 15:04:05")))
+	}
+}
+
+// GetStatus returns the state of the cron runner
+func (c *CronService) GetStatus() *models.CronStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	status := &models.CronStatus{
+		Enabled:             c.config.Enabled,
+		Running:             c.active,
+		LastRun:             c.lastRun,
+		ConsecutiveFailures: c.failures,
+		Paused:              c.paused,
+	}
+
+	if c.active {
+		since := c.activeSince
+		status.RunningSince = &since
+	}
+
+	if !c.lastSuccess.IsZero() {
+		lastSuccess := c.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+
+	return status
+}
+
+// GetHistory returns the most recent cron runs
+func (c *CronService) GetHistory(limit int) ([]models.CronRun, error) {
+	if c.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	if limit <= 0 {
+		limit = 50
+	}
+
+	rows, err := c.db.Query(`
+		SELECT id, started_at, finished_at, duration_ms, exit_code, success, output, error
+		FROM cron_runs
+		WHERE instance = ?
+		ORDER BY started_at DESC
+		LIMIT ?
+	`, c.moodle.Name(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []models.CronRun
+	for rows.Next() {
+		var run models.CronRun
+		var runError sql.NullString
+
+		err := rows.Scan(
+			&run.ID,
+			&run.StartedAt,
+			&run.FinishedAt,
+			&run.Duration,
+			&run.ExitCode,
+			&run.Success,
+			&run.Output,
+			&runError,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		run.Error = runError.String
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// saveRun saves a cron run to the database
+func (c *CronService) saveRun(run *models.CronRun) {
+	if c.db == nil {
+		return
+	}
+
+	_, err := c.db.Exec(`
+		INSERT INTO cron_runs (id, instance, started_at, finished_at, duration_ms, exit_code, success, output, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, run.ID, c.moodle.Name(), run.StartedAt, run.FinishedAt, run.Duration, run.ExitCode, run.Success, run.Output, run.Error)
+
+	if err != nil {
+		utils.Error("Failed to save cron run: %v", err)
+	}
+}
+
+// loadLastRun restores the last run and last success from the database
+func (c *CronService) loadLastRun() {
+	runs, err := c.GetHistory(1)
+	if err != nil || len(runs) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRun = &runs[0]
+
+	var lastSuccess time.Time
+	err = c.db.QueryRow(`
+		SELECT finished_at FROM cron_runs
+		WHERE instance = ? AND success = 1
+		ORDER BY finished_at DESC
+		LIMIT 1
+	`, c.moodle.Name()).Scan(&lastSuccess)
+	if err == nil {
+		c.lastSuccess = lastSuccess
+	}
+}
+
+// tailBuffer is an io.Writer that keeps only the last max bytes written
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+// Write appends to the buffer, dropping the oldest bytes beyond max
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+// String returns the buffered output
+func (t *tailBuffer) String() string {
+	return string(t.buf)
+}
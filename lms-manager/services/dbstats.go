@@ -0,0 +1,472 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Database alert types
+const (
+	AlertDBConnectionsHigh = "db_connections_high"
+	AlertDBSlowQueries     = "db_slow_queries"
+)
+
+// databaseQueryTimeout bounds connecting and every statistics query
+const databaseQueryTimeout = 5 * time.Second
+
+// slowQueryDuration is how long a PostgreSQL statement must run to count as
+// slow, matching the MySQL long_query_time default
+const slowQueryDuration = 10 * time.Second
+
+// DatabaseSample holds the counters read from the database server in one
+// sample. Queries and SlowQueries are cumulative.
+type DatabaseSample struct {
+	Type           string
+	Connections    int
+	MaxConnections int
+	Queries        int64
+	SlowQueries    int64
+	Uptime         int64
+	Timestamp      time.Time
+}
+
+// DatabaseStatsService samples the statistics of the Moodle database server
+// with the credentials of config.php
+type DatabaseStatsService struct {
+	config   config.MonitoringConfig
+	moodle   *MoodleService
+	monitor  *MonitorService
+	mu       sync.RWMutex
+	sampleMu sync.Mutex
+	stopChan chan bool
+	running  bool
+
+	conn     *sql.DB
+	dsn      string
+	previous *DatabaseSample
+	stats    *models.DatabaseStats
+	failing  bool
+
+	// PostgreSQL has no slow query counter, so statements seen running
+	// longer than slowQueryDuration are counted by the collector
+	slowSeen  map[string]bool
+	slowTotal int64
+}
+
+// NewDatabaseStatsService creates a new database statistics collector
+func NewDatabaseStatsService(cfg config.MonitoringConfig, moodle *MoodleService, monitor *MonitorService) *DatabaseStatsService {
+	return &DatabaseStatsService{
+		config:   cfg,
+		moodle:   moodle,
+		monitor:  monitor,
+		stopChan: make(chan bool),
+	}
+}
+
+// Start starts sampling on the monitoring interval
+func (d *DatabaseStatsService) Start() {
+	if d.running {
+		return
+	}
+
+	d.running = true
+	go d.sampleLoop()
+	utils.Info("Database statistics collector started")
+}
+
+// Stop stops sampling and closes the database connection
+func (d *DatabaseStatsService) Stop() {
+	if !d.running {
+		return
+	}
+
+	d.running = false
+	d.stopChan <- true
+
+	d.sampleMu.Lock()
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+	d.sampleMu.Unlock()
+	utils.Info("Database statistics collector stopped")
+}
+
+// sampleLoop samples the database and checks the alert thresholds on every tick
+func (d *DatabaseStatsService) sampleLoop() {
+	ticker := time.NewTicker(time.Duration(d.config.UpdateInterval) * time.Second)
+	defer ticker.Stop()
+
+	d.collect()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.collect()
+		case <-d.stopChan:
+			return
+		}
+	}
+}
+
+// collect takes a sample and hands it to the alert engine
+func (d *DatabaseStatsService) collect() {
+	stats, err := d.Sample()
+
+	d.mu.Lock()
+	changed := d.failing != (err != nil)
+	d.failing = err != nil
+	d.mu.Unlock()
+
+	if err != nil {
+		if changed {
+			utils.Warn("Failed to collect database statistics: %v", err)
+		}
+		return
+	}
+
+	if changed {
+		utils.Info("Collecting database statistics from %s", stats.Type)
+	}
+	if d.monitor != nil {
+		d.monitor.CheckDatabaseStats(stats)
+	}
+}
+
+// GetStats returns the latest statistics, sampling the database when they
+// are older than the monitoring interval
+func (d *DatabaseStatsService) GetStats() (*models.DatabaseStats, error) {
+	d.mu.RLock()
+	stats := d.stats
+	d.mu.RUnlock()
+
+	maxAge := time.Duration(d.config.UpdateInterval) * time.Second
+	if stats != nil && time.Since(stats.Timestamp) < maxAge {
+		return stats, nil
+	}
+
+	return d.Sample()
+}
+
+// Sample reads the database server counters and computes the rates since
+// the previous sample
+func (d *DatabaseStatsService) Sample() (*models.DatabaseStats, error) {
+	d.sampleMu.Lock()
+	defer d.sampleMu.Unlock()
+
+	site, err := d.moodle.GetSiteConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.connect(site)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+	defer cancel()
+
+	var sample *DatabaseSample
+	switch site.DBType {
+	case "mysqli", "mariadb", "auroramysql":
+		sample, err = sampleMySQL(ctx, conn)
+	case "pgsql":
+		sample, err = d.samplePostgres(ctx, conn)
+	default:
+		err = fmt.Errorf("unsupported database type: %s", site.DBType)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sample database statistics: %v", err)
+	}
+	sample.Type = site.DBType
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := NewDatabaseStats(d.previous, sample)
+	d.previous = sample
+	d.stats = stats
+	return stats, nil
+}
+
+// connect returns the connection to the Moodle database, reopening it when
+// the credentials in config.php change
+func (d *DatabaseStatsService) connect(site *models.MoodleSiteConfig) (*sql.DB, error) {
+	driver, dsn, err := DatabaseDSN(site)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.conn != nil && d.dsn == dsn {
+		return d.conn, nil
+	}
+
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database connection: %v", err)
+	}
+	conn.SetMaxOpenConns(1)
+	conn.SetMaxIdleConns(1)
+
+	d.conn = conn
+	d.dsn = dsn
+	d.previous = nil
+	d.slowSeen = nil
+	d.slowTotal = 0
+	return conn, nil
+}
+
+// mysqlDefaultSockets are the default MySQL and MariaDB socket paths of the
+// distributions, the first one existing is used
+var mysqlDefaultSockets = []string{"/var/run/mysqld/mysqld.sock", "/var/lib/mysql/mysql.sock", "/tmp/mysql.sock"}
+
+// mysqlDefaultSocket returns the socket PHP's mysqli uses when none is given
+func mysqlDefaultSocket() string {
+	for _, socket := range mysqlDefaultSockets {
+		if utils.FileExists(socket) {
+			return socket
+		}
+	}
+	return mysqlDefaultSockets[0]
+}
+
+// DatabaseDSN returns the driver name and data source name for the database
+// configured in config.php
+func DatabaseDSN(site *models.MoodleSiteConfig) (string, string, error) {
+	switch site.DBType {
+	case "mysqli", "mariadb", "auroramysql":
+		cfg := mysql.NewConfig()
+		cfg.User = site.DBUser
+		cfg.Passwd = site.DBPass
+		cfg.DBName = site.DBName
+		cfg.Timeout = databaseQueryTimeout
+
+		// mysqli connects to localhost through the default socket, also
+		// when dbsocket is set without a path
+		if strings.HasPrefix(site.DBSocket, "/") {
+			cfg.Net = "unix"
+			cfg.Addr = site.DBSocket
+		} else if site.DBHost == "" || site.DBHost == "localhost" {
+			cfg.Net = "unix"
+			cfg.Addr = mysqlDefaultSocket()
+		} else {
+			host, port := site.DBHost, site.DBPort
+			if host == "" {
+				host = "localhost"
+			}
+			if port <= 0 {
+				port = 3306
+			}
+			cfg.Net = "tcp"
+			cfg.Addr = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		return "mysql", cfg.FormatDSN(), nil
+
+	case "pgsql":
+		// An empty host or dbsocket without a path connects through the
+		// default socket directory, like libpq does for Moodle
+		host := site.DBHost
+		if strings.HasPrefix(site.DBSocket, "/") {
+			host = site.DBSocket
+		} else if host == "" || site.DBSocket != "" {
+			host = "/var/run/postgresql"
+		}
+
+		port := site.DBPort
+		if port <= 0 {
+			port = 5432
+		}
+
+		// lib/pq has no sslmode=prefer, so local servers are expected
+		// without SSL and remote ones with it
+		sslMode := "require"
+		if strings.HasPrefix(host, "/") || host == "localhost" || net.ParseIP(host).IsLoopback() {
+			sslMode = "disable"
+		}
+
+		params := []string{
+			"host=" + postgresQuote(host),
+			"port=" + strconv.Itoa(port),
+			"user=" + postgresQuote(site.DBUser),
+			"password=" + postgresQuote(site.DBPass),
+			"dbname=" + postgresQuote(site.DBName),
+			"sslmode=" + sslMode,
+			"connect_timeout=" + strconv.Itoa(int(databaseQueryTimeout.Seconds())),
+		}
+		return "postgres", strings.Join(params, " "), nil
+	}
+
+	return "", "", fmt.Errorf("unsupported database type: %s", site.DBType)
+}
+
+// openMoodleDatabase opens a connection pool to the database configured in
+// config.php, small enough to run lookups while a query streams its rows.
+// Queries are bounded by their context.
+func openMoodleDatabase(site *models.MoodleSiteConfig) (*sql.DB, error) {
+	driver, dsn, err := DatabaseDSN(site)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database connection: %v", err)
+	}
+	conn.SetMaxOpenConns(2)
+	return conn, nil
+}
+
+// moodleTable returns the name of a Moodle table with the $CFG->prefix
+func moodleTable(site *models.MoodleSiteConfig, name string) (string, error) {
+	if !moodlePrefixPattern.MatchString(site.Prefix) {
+		return "", fmt.Errorf("invalid table prefix in config.php: %q", site.Prefix)
+	}
+	return site.Prefix + name, nil
+}
+
+// postgresQuote quotes a connection string value for lib/pq
+func postgresQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// NewDatabaseStats computes database statistics from a sample. Rates are
+// computed against the previous sample, or averaged over the server uptime
+// for the first sample and after the counters were reset.
+func NewDatabaseStats(previous, current *DatabaseSample) *models.DatabaseStats {
+	stats := &models.DatabaseStats{
+		Type:           current.Type,
+		Connections:    current.Connections,
+		MaxConnections: current.MaxConnections,
+		SlowQueries:    int(current.SlowQueries),
+		Uptime:         current.Uptime,
+		Timestamp:      current.Timestamp,
+	}
+
+	if current.MaxConnections > 0 {
+		stats.ConnectionUsage = float64(current.Connections) / float64(current.MaxConnections) * 100
+	}
+
+	queries, slowQueries := current.Queries, current.SlowQueries
+	elapsed := float64(current.Uptime)
+
+	if previous != nil && previous.Type == current.Type &&
+		current.Queries >= previous.Queries &&
+		current.SlowQueries >= previous.SlowQueries &&
+		current.Uptime >= previous.Uptime {
+		queries -= previous.Queries
+		slowQueries -= previous.SlowQueries
+		elapsed = current.Timestamp.Sub(previous.Timestamp).Seconds()
+	}
+
+	if elapsed > 0 {
+		stats.QueriesPerSec = float64(queries) / elapsed
+		stats.SlowQueriesPerMin = float64(slowQueries) / elapsed * 60
+	}
+
+	return stats
+}
+
+// sampleMySQL reads SHOW GLOBAL STATUS and max_connections
+func sampleMySQL(ctx context.Context, conn *sql.DB) (*DatabaseSample, error) {
+	rows, err := conn.QueryContext(ctx, `SHOW GLOBAL STATUS WHERE Variable_name IN ('Threads_connected', 'Questions', 'Slow_queries', 'Uptime')`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	status := make(map[string]int64)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		status[strings.ToLower(name)], _ = strconv.ParseInt(value, 10, 64)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sample := &DatabaseSample{
+		Connections: int(status["threads_connected"]),
+		Queries:     status["questions"],
+		SlowQueries: status["slow_queries"],
+		Uptime:      status["uptime"],
+		Timestamp:   time.Now(),
+	}
+
+	if err := conn.QueryRowContext(ctx, `SELECT @@GLOBAL.max_connections`).Scan(&sample.MaxConnections); err != nil {
+		return nil, err
+	}
+
+	return sample, nil
+}
+
+// samplePostgres reads pg_stat_activity and pg_stat_database. Transactions
+// stand in for queries, as PostgreSQL does not count statements.
+func (d *DatabaseStatsService) samplePostgres(ctx context.Context, conn *sql.DB) (*DatabaseSample, error) {
+	sample := &DatabaseSample{}
+	err := conn.QueryRowContext(ctx, `
+		SELECT
+			(SELECT count(*) FROM pg_stat_activity WHERE backend_type = 'client backend'),
+			current_setting('max_connections')::int,
+			(SELECT coalesce(sum(xact_commit + xact_rollback), 0) FROM pg_stat_database),
+			extract(epoch FROM now() - pg_postmaster_start_time())::bigint
+	`).Scan(&sample.Connections, &sample.MaxConnections, &sample.Queries, &sample.Uptime)
+	if err != nil {
+		return nil, err
+	}
+	sample.Timestamp = time.Now()
+
+	rows, err := conn.QueryContext(ctx, `
+		SELECT pid, query_start FROM pg_stat_activity
+		WHERE state = 'active' AND backend_type = 'client backend'
+			AND query_start < now() - $1::interval
+	`, fmt.Sprintf("%d seconds", int(slowQueryDuration.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	running := make(map[string]bool)
+	for rows.Next() {
+		var pid int
+		var started time.Time
+		if err := rows.Scan(&pid, &started); err != nil {
+			return nil, err
+		}
+
+		key := fmt.Sprintf("%d:%d", pid, started.UnixNano())
+		running[key] = true
+		if !d.slowSeen[key] {
+			d.slowTotal++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	d.slowSeen = running
+	sample.SlowQueries = d.slowTotal
+	return sample, nil
+}
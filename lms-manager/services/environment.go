@@ -0,0 +1,424 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lms-manager/models"
+)
+
+// PHP ini value kinds
+const (
+	iniSize = iota
+	iniNumber
+	iniFlag
+)
+
+// iniRequirement is a PHP ini setting Moodle depends on. A value below
+// required fails the check, a value below recommended only warns.
+type iniRequirement struct {
+	name        string
+	kind        int
+	required    string
+	recommended string
+}
+
+// phpRequirements lists the PHP extensions and settings of the Moodle
+// branches from since onwards
+type phpRequirements struct {
+	since       string
+	extensions  []string
+	recommended []string
+	settings    []iniRequirement
+}
+
+// phpRequirementMatrix holds the requirements listed in the README for each
+// Moodle generation, oldest first. The supported PHP versions are taken from
+// moodleSupportMatrix.
+var phpRequirementMatrix = []phpRequirements{
+	{
+		since: "311",
+		extensions: []string{
+			"ctype", "curl", "dom", "fileinfo", "gd", "iconv", "intl", "json", "mbstring", "openssl",
+			"pcre", "simplexml", "spl", "tokenizer", "xml", "xmlreader", "zip", "zlib",
+		},
+		recommended: []string{"bcmath", "exif", "imagick", "ldap", "opcache", "soap", "xmlrpc", "xmlwriter"},
+		settings: []iniRequirement{
+			{name: "memory_limit", kind: iniSize, required: "96M", recommended: "256M"},
+			{name: "max_input_vars", kind: iniNumber, recommended: "5000"},
+			{name: "upload_max_filesize", kind: iniSize, recommended: "100M"},
+			{name: "post_max_size", kind: iniSize, recommended: "100M"},
+			{name: "opcache.enable", kind: iniFlag, recommended: "1"},
+		},
+	},
+	{
+		since: "400",
+		extensions: []string{
+			"ctype", "curl", "dom", "fileinfo", "gd", "iconv", "intl", "json", "mbstring", "openssl",
+			"pcre", "simplexml", "spl", "tokenizer", "xml", "xmlreader", "zip", "zlib",
+		},
+		recommended: []string{"bcmath", "exif", "ftp", "gettext", "imagick", "ldap", "opcache", "redis", "soap", "sodium", "xmlwriter"},
+		settings: []iniRequirement{
+			{name: "memory_limit", kind: iniSize, required: "96M", recommended: "512M"},
+			{name: "max_input_vars", kind: iniNumber, required: "5000"},
+			{name: "upload_max_filesize", kind: iniSize, recommended: "200M"},
+			{name: "post_max_size", kind: iniSize, recommended: "200M"},
+			{name: "opcache.enable", kind: iniFlag, recommended: "1"},
+			{name: "opcache.memory_consumption", kind: iniNumber, recommended: "256"},
+			{name: "opcache.max_accelerated_files", kind: iniNumber, recommended: "10000"},
+		},
+	},
+	{
+		since: "500",
+		extensions: []string{
+			"ctype", "curl", "dom", "fileinfo", "filter", "gd", "hash", "iconv", "intl", "json", "mbstring",
+			"openssl", "pcre", "simplexml", "sodium", "spl", "tokenizer", "xml", "xmlreader", "zip", "zlib",
+		},
+		recommended: []string{"bcmath", "exif", "ftp", "gettext", "imagick", "ldap", "opcache", "redis", "soap", "xmlwriter"},
+		settings: []iniRequirement{
+			{name: "memory_limit", kind: iniSize, required: "96M", recommended: "1G"},
+			{name: "max_input_vars", kind: iniNumber, required: "5000"},
+			{name: "upload_max_filesize", kind: iniSize, recommended: "500M"},
+			{name: "post_max_size", kind: iniSize, recommended: "500M"},
+			{name: "opcache.enable", kind: iniFlag, recommended: "1"},
+			{name: "opcache.memory_consumption", kind: iniNumber, recommended: "512"},
+			{name: "opcache.max_accelerated_files", kind: iniNumber, recommended: "20000"},
+		},
+	},
+}
+
+// inspectedSettings are the ini settings dumped from the PHP runtime
+var inspectedSettings = []string{
+	"memory_limit", "max_input_vars", "upload_max_filesize", "post_max_size", "max_execution_time",
+	"opcache.enable", "opcache.enable_cli", "opcache.memory_consumption", "opcache.max_accelerated_files",
+}
+
+// extensionAliases maps the extension names of the matrix to the names PHP
+// reports them by
+var extensionAliases = map[string]string{
+	"opcache": "zend opcache",
+}
+
+// databaseExtensions maps the Moodle dbtype to the PHP extension of its driver
+var databaseExtensions = map[string]string{
+	"mysqli":      "mysqli",
+	"mariadb":     "mysqli",
+	"auroramysql": "mysqli",
+	"pgsql":       "pgsql",
+	"sqlsrv":      "sqlsrv",
+}
+
+// phpRuntime is the PHP runtime information dumped by the PHP CLI
+type phpRuntime struct {
+	Version    string             `json:"version"`
+	SAPI       string             `json:"sapi"`
+	IniFile    string             `json:"ini_file"`
+	Extensions []string           `json:"extensions"`
+	Ini        map[string]*string `json:"ini"`
+}
+
+// CheckEnvironment runs the configured PHP CLI and checks its version,
+// extensions and ini settings against the requirements of the installed
+// Moodle branch and, when target is set, of the branch to upgrade to. The
+// CLI may read a different php.ini than PHP-FPM; the loaded file is part of
+// the report.
+func (m *MoodleService) CheckEnvironment(target string) (*models.EnvironmentReport, error) {
+	runtime, err := m.inspectPHP()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.EnvironmentReport{
+		PHPBinary:  m.phpBinary(),
+		PHPVersion: runtime.Version,
+		SAPI:       runtime.SAPI,
+		IniFile:    runtime.IniFile,
+		Extensions: runtime.Extensions,
+		Settings:   make(map[string]string),
+		CheckedAt:  time.Now(),
+	}
+	sort.Strings(report.Extensions)
+	for name, value := range runtime.Ini {
+		if value != nil {
+			report.Settings[name] = *value
+		}
+	}
+
+	var databaseExtension string
+	if site, err := m.GetSiteConfig(); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("Database driver not checked: %v", err))
+	} else {
+		databaseExtension = databaseExtensions[site.DBType]
+	}
+
+	if version, err := m.GetVersion(); err != nil {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("Installed Moodle version not checked: %v", err))
+	} else if MoodleBranch(version.Branch) == "" {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("Moodle branch %s is not in the requirements matrix", version.Branch))
+	} else {
+		report.Installed = checkPHPRequirements(runtime, version.Branch, databaseExtension)
+	}
+
+	if target != "" {
+		branch := MoodleBranch(target)
+		if branch == "" {
+			return nil, fmt.Errorf("Moodle %s is not in the requirements matrix", target)
+		}
+		report.Target = checkPHPRequirements(runtime, branch, databaseExtension)
+	}
+
+	return report, nil
+}
+
+// MoodleBranch returns the branch of a Moodle version given as a branch
+// (405), a version (4.5) or a release (4.5.2), or "" when the branch is not
+// in the support matrix
+func MoodleBranch(version string) string {
+	number := releaseNumber(version)
+	for _, entry := range moodleSupportMatrix {
+		if version == entry.Branch || number == entry.Name || strings.HasPrefix(number, entry.Name+".") {
+			return entry.Branch
+		}
+	}
+	return ""
+}
+
+// inspectPHP dumps the version, loaded extensions and ini settings of the
+// configured PHP binary
+func (m *MoodleService) inspectPHP() (*phpRuntime, error) {
+	names, err := json.Marshal(inspectedSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	// A JSON array of strings is also a PHP array literal
+	script := fmt.Sprintf(`$ini = [];
+foreach (%s as $name) { $value = ini_get($name); $ini[$name] = $value === false ? null : $value; }
+echo json_encode(['version' => PHP_VERSION, 'sapi' => PHP_SAPI, 'ini_file' => php_ini_loaded_file() ?: '',
+    'extensions' => get_loaded_extensions(), 'ini' => $ini]);`, names)
+
+	output, err := exec.Command(m.phpBinary(), "-r", script).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect PHP: %v", err)
+	}
+
+	var runtime phpRuntime
+	if err := json.Unmarshal(output, &runtime); err != nil {
+		return nil, fmt.Errorf("failed to parse PHP runtime information: %v", err)
+	}
+	if runtime.Version == "" {
+		return nil, fmt.Errorf("PHP did not report its version")
+	}
+
+	return &runtime, nil
+}
+
+// checkPHPRequirements checks the PHP runtime against the requirements of a
+// branch in the matrix
+func checkPHPRequirements(runtime *phpRuntime, branch, databaseExtension string) *models.EnvironmentResult {
+	support := LookupMoodleSupport(branch, time.Now())
+	result := &models.EnvironmentResult{
+		Branch: branch,
+		Name:   support.Name,
+		Status: models.EnvironmentPass,
+	}
+
+	add := func(check models.EnvironmentCheck) {
+		result.Checks = append(result.Checks, check)
+		if environmentSeverity(check.Status) > environmentSeverity(result.Status) {
+			result.Status = check.Status
+		}
+	}
+
+	add(checkPHPVersion(runtime.Version, support))
+
+	var requirements phpRequirements
+	for _, tier := range phpRequirementMatrix {
+		if branch >= tier.since {
+			requirements = tier
+		}
+	}
+
+	loaded := make(map[string]bool, len(runtime.Extensions))
+	for _, extension := range runtime.Extensions {
+		loaded[strings.ToLower(extension)] = true
+	}
+
+	extensions := requirements.extensions
+	if databaseExtension != "" {
+		extensions = append(append([]string{}, extensions...), databaseExtension)
+	}
+	for _, extension := range extensions {
+		add(checkExtension(loaded, extension, true))
+	}
+	for _, extension := range requirements.recommended {
+		add(checkExtension(loaded, extension, false))
+	}
+
+	for _, setting := range requirements.settings {
+		add(checkIniSetting(runtime.Ini[setting.name], setting))
+	}
+
+	return result
+}
+
+// checkPHPVersion checks the PHP version against the range supported by a
+// branch
+func checkPHPVersion(version string, support *models.MoodleSupport) models.EnvironmentCheck {
+	check := models.EnvironmentCheck{
+		Category: "php",
+		Name:     "PHP version",
+		Expected: fmt.Sprintf("%s - %s.x", support.MinPHP, support.MaxPHP),
+		Actual:   version,
+		Status:   models.EnvironmentPass,
+	}
+
+	switch {
+	case compareVersions(version, support.MinPHP) < 0:
+		check.Status = models.EnvironmentFail
+		check.Message = fmt.Sprintf("Moodle %s requires PHP %s or later", support.Name, support.MinPHP)
+	case compareVersions(version, support.MaxPHP+".99") > 0:
+		check.Status = models.EnvironmentFail
+		check.Message = fmt.Sprintf("Moodle %s does not support PHP newer than %s", support.Name, support.MaxPHP)
+	}
+
+	return check
+}
+
+// checkExtension checks that an extension is loaded. A missing required
+// extension fails the check, a missing recommended one warns.
+func checkExtension(loaded map[string]bool, extension string, required bool) models.EnvironmentCheck {
+	check := models.EnvironmentCheck{
+		Category: "extension",
+		Name:     extension,
+		Expected: "recommended",
+		Actual:   "loaded",
+		Status:   models.EnvironmentPass,
+	}
+	if required {
+		check.Expected = "required"
+	}
+
+	if loaded[extension] || loaded[extensionAliases[extension]] {
+		return check
+	}
+
+	check.Actual = "missing"
+	if required {
+		check.Status = models.EnvironmentFail
+		check.Message = fmt.Sprintf("The %s extension is required", extension)
+	} else {
+		check.Status = models.EnvironmentWarn
+		check.Message = fmt.Sprintf("The %s extension is recommended", extension)
+	}
+	return check
+}
+
+// checkIniSetting compares an ini setting with its required and recommended
+// values. A nil value means the setting does not exist, usually because its
+// extension is not loaded.
+func checkIniSetting(value *string, setting iniRequirement) models.EnvironmentCheck {
+	check := models.EnvironmentCheck{
+		Category: "setting",
+		Name:     setting.name,
+		Expected: setting.recommended,
+		Status:   models.EnvironmentPass,
+	}
+	if setting.required != "" {
+		check.Expected = setting.required
+		if setting.recommended != "" {
+			check.Expected += " (" + setting.recommended + " recommended)"
+		}
+	}
+
+	if value == nil {
+		check.Status = models.EnvironmentWarn
+		if setting.required != "" {
+			check.Status = models.EnvironmentFail
+		}
+		check.Message = fmt.Sprintf("%s is not available", setting.name)
+		return check
+	}
+	check.Actual = *value
+
+	switch {
+	case setting.required != "" && !iniAtLeast(*value, setting.required, setting.kind):
+		check.Status = models.EnvironmentFail
+		check.Message = fmt.Sprintf("%s must be at least %s", setting.name, setting.required)
+	case setting.recommended != "" && !iniAtLeast(*value, setting.recommended, setting.kind):
+		check.Status = models.EnvironmentWarn
+		if setting.kind == iniFlag {
+			check.Message = fmt.Sprintf("%s should be enabled", setting.name)
+		} else {
+			check.Message = fmt.Sprintf("%s should be at least %s", setting.name, setting.recommended)
+		}
+	}
+
+	return check
+}
+
+// iniAtLeast reports whether an ini value meets a minimum
+func iniAtLeast(value, minimum string, kind int) bool {
+	switch kind {
+	case iniSize:
+		size := parsePHPSize(value)
+		// -1 and, for post_max_size, 0 disable the limit
+		return size <= 0 || size >= parsePHPSize(minimum)
+	case iniFlag:
+		return !parsePHPFlag(minimum) || parsePHPFlag(value)
+	default:
+		number, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		required, _ := strconv.ParseInt(minimum, 10, 64)
+		return number >= required
+	}
+}
+
+// parsePHPSize parses a PHP shorthand byte value such as 512M or 1G
+func parsePHPSize(value string) int64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	multiplier := int64(1)
+	switch value[len(value)-1] {
+	case 'k', 'K':
+		multiplier = 1024
+	case 'm', 'M':
+		multiplier = 1024 * 1024
+	case 'g', 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	size, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	return size * multiplier
+}
+
+// parsePHPFlag parses a PHP boolean ini value
+func parsePHPFlag(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "on", "yes", "true":
+		return true
+	}
+	return false
+}
+
+// environmentSeverity orders the check results
+func environmentSeverity(status string) int {
+	switch status {
+	case models.EnvironmentFail:
+		return 2
+	case models.EnvironmentWarn:
+		return 1
+	default:
+		return 0
+	}
+}
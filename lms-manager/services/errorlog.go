@@ -0,0 +1,569 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// AlertPHPFatalError is raised when a fatal error shows up in the error logs
+// that was not seen before
+const AlertPHPFatalError = "php_fatal_error"
+
+// errorGroupAlert returns the alert type of a fatal error group
+func errorGroupAlert(id string) string {
+	return AlertPHPFatalError + ":" + id
+}
+
+// errorLogSampleLength caps the log line kept as the sample of a group
+const errorLogSampleLength = 2000
+
+// errorLogHeaderPattern matches the timestamp PHP and PHP-FPM put in front of
+// every message
+var errorLogHeaderPattern = regexp.MustCompile(`^\[(\d{2}-[A-Za-z]{3}-\d{4} \d{2}:\d{2}:\d{2})(?:\.\d+)?(?: ([^\]]+))?\] (.*)$`)
+
+// phpMessagePattern matches a PHP error message, e.g. "PHP Warning:  ...",
+// and messages Moodle writes to the error log, e.g. "Default exception
+// handler: ..."
+var phpMessagePattern = regexp.MustCompile(`^(?:PHP )?([A-Za-z][A-Za-z ]*?):\s*(.*)$`)
+
+// phpLocationPattern matches the file and line PHP appends to a message,
+// either "in /file.php on line 12" or "in /file.php:12"
+var phpLocationPattern = regexp.MustCompile(` in (/\S+?)(?: on line |:)(\d+)\b`)
+
+// moodleTracePattern matches the first backtrace line of a Moodle exception
+var moodleTracePattern = regexp.MustCompile(`^\* line (\d+) of (/\S+): `)
+
+// fpmMessagePattern matches a message of PHP-FPM itself
+var fpmMessagePattern = regexp.MustCompile(`^(DEBUG|NOTICE|WARNING|ERROR|ALERT): (.*)$`)
+
+// fpmStderrPattern matches the output of a PHP-FPM worker, which holds the
+// PHP messages when catch_workers_output is enabled
+var fpmStderrPattern = regexp.MustCompile(`^\[pool [^\]]+\] child \d+ said into std(?:err|out): "(.*?)"?(?: \.\.\.)?$`)
+
+// errorFingerprintPatterns replace the parts of a message that vary between
+// occurrences of the same error
+var errorFingerprintPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	{regexp.MustCompile(`"[^"]*"`), `"?"`},
+	{regexp.MustCompile(`'[^']*'`), `'?'`},
+	{regexp.MustCompile(`0x[0-9a-fA-F]+`), `0x?`},
+	{regexp.MustCompile(`\d+`), `N`},
+}
+
+// phpErrorLevels maps the PHP error labels to error levels
+var phpErrorLevels = map[string]string{
+	"fatal error":               models.ErrorLevelFatal,
+	"parse error":               models.ErrorLevelFatal,
+	"core error":                models.ErrorLevelFatal,
+	"compile error":             models.ErrorLevelFatal,
+	"recoverable fatal error":   models.ErrorLevelFatal,
+	"catchable fatal error":     models.ErrorLevelFatal,
+	"default exception handler": models.ErrorLevelException,
+	"warning":                   models.ErrorLevelWarning,
+	"core warning":              models.ErrorLevelWarning,
+	"compile warning":           models.ErrorLevelWarning,
+	"notice":                    models.ErrorLevelNotice,
+	"strict standards":          models.ErrorLevelNotice,
+	"deprecated":                models.ErrorLevelDeprecated,
+}
+
+// ErrorLogEntry represents a PHP error read from an error log. File and Line
+// are empty for errors of PHP-FPM itself.
+type ErrorLogEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+	File    string
+	Line    int
+	Source  string
+	Raw     string
+}
+
+// Fingerprint identifies the group of an error: its level, its message with
+// numbers and quoted values left out, and its file:line
+func (e *ErrorLogEntry) Fingerprint() string {
+	message := e.Message
+	for _, replace := range errorFingerprintPatterns {
+		message = replace.pattern.ReplaceAllString(message, replace.replacement)
+	}
+	return utils.HashString(fmt.Sprintf("%s|%s|%s:%d", e.Level, message, e.File, e.Line))[:16]
+}
+
+// errorLogParser parses the lines of an error log. Lines without a timestamp
+// continue the previous message: stack traces are skipped, but the first
+// backtrace line of a Moodle exception gives its file:line.
+type errorLogParser struct {
+	pending *ErrorLogEntry
+}
+
+// feed parses a line and returns the previous message when the line starts a
+// new one
+func (p *errorLogParser) feed(line string) *ErrorLogEntry {
+	match := errorLogHeaderPattern.FindStringSubmatch(line)
+	if match == nil {
+		p.continuation(line)
+		return nil
+	}
+
+	timestamp := parseErrorLogTime(match[1], match[2])
+	body := match[3]
+
+	var entry *ErrorLogEntry
+	if fpm := fpmMessagePattern.FindStringSubmatch(body); fpm != nil {
+		if output := fpmStderrPattern.FindStringSubmatch(fpm[2]); output != nil {
+			message := output[1]
+			if _, rest, found := strings.Cut(message, "PHP message: "); found {
+				message = rest
+			}
+			entry = parsePHPMessage(message)
+			if entry == nil {
+				// Every line of a multi-line message is a stderr line
+				p.continuation(message)
+				return nil
+			}
+		} else {
+			entry = parseFPMMessage(fpm[1], fpm[2])
+		}
+	} else {
+		entry = parsePHPMessage(body)
+	}
+
+	finished := p.flush()
+	if entry != nil {
+		entry.Time = timestamp
+		entry.Raw = line
+		p.pending = entry
+	}
+	return finished
+}
+
+// continuation applies a continuation line to the pending message
+func (p *errorLogParser) continuation(line string) {
+	if p.pending == nil || p.pending.File != "" {
+		return
+	}
+
+	if match := moodleTracePattern.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+		p.pending.File = match[2]
+		p.pending.Line, _ = strconv.Atoi(match[1])
+	}
+}
+
+// flush returns the pending message
+func (p *errorLogParser) flush() *ErrorLogEntry {
+	entry := p.pending
+	p.pending = nil
+	return entry
+}
+
+// ParseErrorLog parses the messages of a PHP or PHP-FPM error log
+func ParseErrorLog(content string) []ErrorLogEntry {
+	var parser errorLogParser
+	var entries []ErrorLogEntry
+
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimRight(line, "\r"); line == "" {
+			continue
+		}
+		if entry := parser.feed(line); entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	if entry := parser.flush(); entry != nil {
+		entries = append(entries, *entry)
+	}
+
+	return entries
+}
+
+// parsePHPMessage parses a PHP error message without its timestamp. Stack
+// traces and messages that are not errors give nil.
+func parsePHPMessage(body string) *ErrorLogEntry {
+	match := phpMessagePattern.FindStringSubmatch(body)
+	if match == nil {
+		return nil
+	}
+
+	level, ok := phpErrorLevels[strings.ToLower(match[1])]
+	if !ok {
+		return nil
+	}
+
+	entry := &ErrorLogEntry{Level: level, Message: match[2]}
+	if location := phpLocationPattern.FindStringSubmatchIndex(entry.Message); location != nil {
+		entry.File = entry.Message[location[2]:location[3]]
+		entry.Line, _ = strconv.Atoi(entry.Message[location[4]:location[5]])
+		entry.Message = entry.Message[:location[0]]
+	}
+	entry.Message = strings.TrimSpace(entry.Message)
+
+	return entry
+}
+
+// parseFPMMessage parses a message of PHP-FPM itself. Notices are routine;
+// errors and workers killed by a signal are fatal.
+func parseFPMMessage(severity, message string) *ErrorLogEntry {
+	switch {
+	case severity == "ERROR" || severity == "ALERT" || strings.Contains(message, "exited on signal"):
+		return &ErrorLogEntry{Level: models.ErrorLevelFatal, Message: message}
+	case severity == "WARNING":
+		return &ErrorLogEntry{Level: models.ErrorLevelWarning, Message: message}
+	}
+	return nil
+}
+
+// parseErrorLogTime parses the timestamp of an error log line. PHP adds the
+// time zone name, PHP-FPM logs in local time.
+func parseErrorLogTime(value, zone string) time.Time {
+	location := time.Local
+	if zone != "" {
+		if loaded, err := time.LoadLocation(zone); err == nil {
+			location = loaded
+		}
+	}
+
+	timestamp, err := time.ParseInLocation("02-Jan-2006 15:04:05", value, location)
+	if err != nil {
+		return time.Now()
+	}
+	return timestamp.Local()
+}
+
+// errorLogSource is an error log and the state of its parser
+type errorLogSource struct {
+	tailer    *logTailer
+	parser    errorLogParser
+	lastError string
+}
+
+// ErrorLogService follows the PHP and PHP-FPM error logs and groups their
+// errors in the database
+type ErrorLogService struct {
+	config   config.ErrorLogConfig
+	moodle   *MoodleService
+	monitor  *MonitorService
+	db       *sql.DB
+	mu       sync.Mutex
+	stopChan chan bool
+	running  bool
+	sources  []*errorLogSource
+}
+
+// NewErrorLogService creates a new error log collector
+func NewErrorLogService(cfg config.ErrorLogConfig, moodle *MoodleService, monitor *MonitorService) *ErrorLogService {
+	sources := make([]*errorLogSource, 0, len(cfg.Paths))
+	for _, path := range cfg.Paths {
+		sources = append(sources, &errorLogSource{tailer: &logTailer{path: path}})
+	}
+
+	return &ErrorLogService{
+		config:   cfg,
+		moodle:   moodle,
+		monitor:  monitor,
+		stopChan: make(chan bool),
+		sources:  sources,
+	}
+}
+
+// SetDatabase sets the database connection
+func (e *ErrorLogService) SetDatabase(db *sql.DB) {
+	e.db = db
+}
+
+// Enabled reports whether the error log collector is enabled
+func (e *ErrorLogService) Enabled() bool {
+	return e.config.Enabled
+}
+
+// Start starts following the error logs
+func (e *ErrorLogService) Start() {
+	if e.running {
+		return
+	}
+
+	if !e.config.Enabled {
+		utils.Info("Error log collector is disabled")
+		return
+	}
+
+	e.running = true
+	go e.followLoop()
+	utils.Info("Error log collector started (%s every %ds)", strings.Join(e.config.Paths, ", "), e.config.Interval)
+}
+
+// Stop stops following the error logs
+func (e *ErrorLogService) Stop() {
+	if !e.running {
+		return
+	}
+
+	e.running = false
+	e.stopChan <- true
+
+	e.mu.Lock()
+	for _, source := range e.sources {
+		source.tailer.close()
+	}
+	e.mu.Unlock()
+
+	utils.Info("Error log collector stopped")
+}
+
+// followLoop reads the logs on every tick
+func (e *ErrorLogService) followLoop() {
+	ticker := time.NewTicker(time.Duration(e.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	e.follow()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.follow()
+		case <-e.stopChan:
+			return
+		}
+	}
+}
+
+// follow reads new errors
+func (e *ErrorLogService) follow() {
+	if err := e.Poll(); err != nil {
+		utils.Error("Failed to record PHP errors: %v", err)
+	}
+}
+
+// Poll reads the errors appended to the logs since the previous poll and
+// records them in their groups. The first poll starts at the end of the
+// logs. A log that cannot be read does not stop the others.
+func (e *ErrorLogService) Poll() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var entries []ErrorLogEntry
+	for _, source := range e.sources {
+		add := func(entry *ErrorLogEntry) {
+			if entry != nil {
+				entry.Source = source.tailer.path
+				entries = append(entries, *entry)
+			}
+		}
+		err := source.tailer.read(func(line string) {
+			add(source.parser.feed(line))
+		})
+		add(source.parser.flush())
+
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		if message != "" && message != source.lastError {
+			utils.Warn("Failed to read error log: %v", err)
+		}
+		source.lastError = message
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	created, err := e.record(entries)
+	if err != nil {
+		return err
+	}
+	if e.monitor != nil {
+		e.monitor.CheckErrorGroups(created)
+	}
+	return nil
+}
+
+// record adds errors to their groups and returns the groups seen for the
+// first time
+func (e *ErrorLogService) record(entries []ErrorLogEntry) ([]models.ErrorGroup, error) {
+	if e.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	root := e.moodle.config.Path
+	pluginTypes, err := loadPluginTypes(root)
+	if err != nil {
+		pluginTypes = defaultPluginTypes
+	}
+
+	var order []string
+	groups := make(map[string]*models.ErrorGroup)
+	for _, entry := range entries {
+		// Instances may log the same error
+		id := utils.HashString(e.moodle.Name() + "|" + entry.Fingerprint())[:16]
+		group, exists := groups[id]
+		if !exists {
+			group = &models.ErrorGroup{
+				ID:        id,
+				Level:     entry.Level,
+				Message:   entry.Message,
+				File:      entry.File,
+				Line:      entry.Line,
+				Component: errorComponent(root, pluginTypes, entry.File),
+				Source:    entry.Source,
+				FirstSeen: entry.Time,
+			}
+			groups[id] = group
+			order = append(order, id)
+		}
+		group.Count++
+		group.LastSeen = entry.Time
+		group.Sample = entry.Raw
+		if len(group.Sample) > errorLogSampleLength {
+			group.Sample = group.Sample[:errorLogSampleLength]
+		}
+	}
+
+	tx, err := e.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var created []models.ErrorGroup
+	for _, id := range order {
+		group := groups[id]
+
+		var count int64
+		err := tx.QueryRow(`SELECT count FROM error_groups WHERE id = ?`, id).Scan(&count)
+		switch {
+		case err == sql.ErrNoRows:
+			_, err = tx.Exec(`
+				INSERT INTO error_groups (id, instance, level, message, file, line, component, source, sample, count, first_seen, last_seen, acknowledged)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0)
+			`, group.ID, e.moodle.Name(), group.Level, group.Message, group.File, group.Line, group.Component, group.Source, group.Sample, group.Count, group.FirstSeen, group.LastSeen)
+			group.New = true
+			created = append(created, *group)
+		case err == nil:
+			_, err = tx.Exec(`
+				UPDATE error_groups SET count = count + ?, source = ?, sample = ?, last_seen = MAX(last_seen, ?)
+				WHERE id = ?
+			`, group.Count, group.Source, group.Sample, group.LastSeen, id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to save error group: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit error groups: %v", err)
+	}
+
+	return created, nil
+}
+
+// newSince returns the time after which a group counts as new
+func (e *ErrorLogService) newSince() time.Time {
+	return time.Now().Add(-time.Duration(e.config.NewWindow) * time.Hour)
+}
+
+// GetGroups returns the error groups seen most recently, optionally only the
+// new ones or those of a level
+func (e *ErrorLogService) GetGroups(newOnly bool, level string, limit int) ([]models.ErrorGroup, error) {
+	if e.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	since := e.newSince()
+	query := `
+		SELECT id, level, message, file, line, component, source, sample, count, first_seen, last_seen, acknowledged
+		FROM error_groups
+		WHERE instance = ?`
+	args := []interface{}{e.moodle.Name()}
+	if newOnly {
+		query += ` AND first_seen >= ?`
+		args = append(args, since)
+	}
+	if level != "" {
+		query += ` AND level = ?`
+		args = append(args, level)
+	}
+	query += ` ORDER BY last_seen DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := e.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query error groups: %v", err)
+	}
+	defer rows.Close()
+
+	groups := []models.ErrorGroup{}
+	for rows.Next() {
+		var group models.ErrorGroup
+		if err := rows.Scan(&group.ID, &group.Level, &group.Message, &group.File, &group.Line, &group.Component,
+			&group.Source, &group.Sample, &group.Count, &group.FirstSeen, &group.LastSeen, &group.Acknowledged); err != nil {
+			return nil, fmt.Errorf("failed to scan error group: %v", err)
+		}
+		group.New = !group.FirstSeen.Before(since)
+		groups = append(groups, group)
+	}
+
+	return groups, rows.Err()
+}
+
+// Acknowledge marks an error group as known and resolves its fatal error
+// alert
+func (e *ErrorLogService) Acknowledge(id string) error {
+	if e.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	result, err := e.db.Exec(`UPDATE error_groups SET acknowledged = 1 WHERE id = ? AND instance = ?`, id, e.moodle.Name())
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge error group: %v", err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return fmt.Errorf("error group not found: %s", id)
+	}
+
+	if e.monitor != nil {
+		return e.monitor.ResolveErrorGroup(id)
+	}
+	return nil
+}
+
+// errorComponent returns the Moodle component a file belongs to: the plugin
+// under whose directory it is, or core for the rest of the Moodle tree.
+// Moodle backtraces give paths relative to the Moodle root.
+func errorComponent(root string, pluginTypes map[string]string, file string) string {
+	if file == "" {
+		return ""
+	}
+
+	relative := strings.TrimPrefix(file, root+"/")
+	if relative == file {
+		if !utils.FileExists(filepath.Join(root, file)) {
+			return ""
+		}
+		relative = strings.TrimPrefix(file, "/")
+	}
+
+	component, longest := "core", 0
+	for pluginType, dir := range pluginTypes {
+		rest := strings.TrimPrefix(relative, dir+"/")
+		if rest == relative || len(dir) <= longest {
+			continue
+		}
+		if name, _, found := strings.Cut(rest, "/"); found {
+			component, longest = pluginType+"_"+name, len(dir)
+		}
+	}
+
+	return component
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FastCGI record types and roles used by the client
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+	fcgiResponder    = 1
+	fcgiRequestID    = 1
+	fcgiMaxContent   = 65535
+)
+
+// fastcgiResponseLimit caps the response body read from a FastCGI server
+const fastcgiResponseLimit = 1 << 20
+
+// fastcgiResponse is the CGI response of a FastCGI request
+type fastcgiResponse struct {
+	StatusCode int
+	Header     textproto.MIMEHeader
+	Body       []byte
+	Stderr     string
+}
+
+// fastcgiAddress returns the network and address of a PHP-FPM listen
+// directive: a socket path, optionally prefixed with unix:, host:port or a
+// bare port on localhost
+func fastcgiAddress(listen string) (string, string) {
+	switch {
+	case strings.HasPrefix(listen, "unix:"):
+		return "unix", strings.TrimPrefix(listen, "unix:")
+	case strings.HasPrefix(listen, "/"):
+		return "unix", listen
+	case !strings.Contains(listen, ":"):
+		return "tcp", net.JoinHostPort("127.0.0.1", listen)
+	default:
+		return "tcp", listen
+	}
+}
+
+// fastcgiGet sends a GET request with the given CGI parameters to a FastCGI
+// responder, as a web server would, and returns its response
+func fastcgiGet(listen string, params map[string]string, timeout time.Duration) (*fastcgiResponse, error) {
+	network, address := fastcgiAddress(listen)
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+
+	// Role and flags, the connection is closed after the request
+	if err := writeFastCGIRecord(w, fcgiBeginRequest, []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	var encoded bytes.Buffer
+	for name, value := range params {
+		writeFastCGILength(&encoded, len(name))
+		writeFastCGILength(&encoded, len(value))
+		encoded.WriteString(name)
+		encoded.WriteString(value)
+	}
+	for content := encoded.Bytes(); len(content) > 0; {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		if err := writeFastCGIRecord(w, fcgiParams, content[:n]); err != nil {
+			return nil, err
+		}
+		content = content[n:]
+	}
+
+	// Empty records end the parameters and the request body
+	if err := writeFastCGIRecord(w, fcgiParams, nil); err != nil {
+		return nil, err
+	}
+	if err := writeFastCGIRecord(w, fcgiStdin, nil); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return readFastCGIResponse(bufio.NewReader(conn))
+}
+
+// writeFastCGIRecord writes a record of the request
+func writeFastCGIRecord(w io.Writer, recordType byte, content []byte) error {
+	header := []byte{fcgiVersion, recordType, 0, fcgiRequestID, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(content)
+	return err
+}
+
+// writeFastCGILength writes the length of a parameter name or value, in one
+// byte when it is short and four bytes otherwise
+func writeFastCGILength(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(n)|1<<31)
+	buf.Write(length[:])
+}
+
+// readFastCGIResponse reads records until the end of the request and parses
+// the CGI headers of the output
+func readFastCGIResponse(r *bufio.Reader) (*fastcgiResponse, error) {
+	var stdout, stderr bytes.Buffer
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, fmt.Errorf("failed to read FastCGI response: %v", err)
+		}
+		if header[0] != fcgiVersion {
+			return nil, fmt.Errorf("unsupported FastCGI version: %d", header[0])
+		}
+
+		content := make([]byte, int(binary.BigEndian.Uint16(header[4:6]))+int(header[6]))
+		if _, err := io.ReadFull(r, content); err != nil {
+			return nil, fmt.Errorf("failed to read FastCGI response: %v", err)
+		}
+		content = content[:binary.BigEndian.Uint16(header[4:6])]
+
+		switch header[1] {
+		case fcgiStdout:
+			if stdout.Len() > fastcgiResponseLimit {
+				return nil, fmt.Errorf("FastCGI response is larger than %d bytes", fastcgiResponseLimit)
+			}
+			stdout.Write(content)
+		case fcgiStderr:
+			stderr.Write(content)
+		case fcgiEndRequest:
+			if len(content) >= 5 && content[4] != 0 {
+				return nil, fmt.Errorf("FastCGI request rejected (protocol status %d)", content[4])
+			}
+			return parseCGIResponse(stdout.Bytes(), stderr.String())
+		}
+	}
+}
+
+// parseCGIResponse splits CGI output into its status, headers and body
+func parseCGIResponse(output []byte, stderr string) (*fastcgiResponse, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(output)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid CGI response headers: %v", err)
+	}
+
+	body, err := io.ReadAll(reader.R)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &fastcgiResponse{
+		StatusCode: 200,
+		Header:     header,
+		Body:       body,
+		Stderr:     strings.TrimSpace(stderr),
+	}
+
+	if status := header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.Fields(status)[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid CGI status: %q", status)
+		}
+		response.StatusCode = code
+	}
+
+	return response, nil
+}
@@ -0,0 +1,443 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// orphanGracePeriod protects recently written blobs, as Moodle writes a blob
+// to filedir before inserting its files record
+const orphanGracePeriod = 24 * time.Hour
+
+// orphanListLimit caps the blob lists of an orphan report
+const orphanListLimit = 1000
+
+// orphanProgressInterval is the number of blobs between progress lines
+const orphanProgressInterval = 10000
+
+// quarantineDir is the default quarantine directory in moodledata
+const quarantineDir = "lms-manager-quarantine"
+
+// quarantineBatchFormat names the quarantine directory of each scan
+const quarantineBatchFormat = "2006-01-02-15-04-05"
+
+// emptyContentHash is the SHA-1 of empty content, used by directory records
+const emptyContentHash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+// contentHashPattern matches the SHA-1 content hashes of the file pool
+var contentHashPattern = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// filedirHashDir matches the two-character directories of filedir
+var filedirHashDir = regexp.MustCompile(`^[0-9a-f]{2}$`)
+
+// filedirIgnored are the files Moodle itself keeps in filedir
+var filedirIgnored = map[string]bool{
+	"warning.txt": true,
+}
+
+// FiledirScan compares the blobs of filedir with the content hashes of the
+// files table. Both are read in content hash order, so they are merged
+// without holding either list in memory.
+type FiledirScan struct {
+	// Filedir and Trashdir are the moodledata pool directories
+	Filedir  string
+	Trashdir string
+
+	// Hashes yields contenthash, the file size and the number of records
+	// that are not references, sorted by contenthash
+	Hashes *sql.Rows
+
+	// Referenced re-checks a blob just before it is quarantined
+	Referenced func(hash string) (bool, error)
+
+	// Quarantine is the directory orphans are moved to; empty to only report
+	Quarantine string
+
+	// Output receives progress and every orphaned and missing blob
+	Output io.Writer
+
+	report  *models.OrphanReport
+	current string
+	size    int64
+	local   int64
+	valid   bool
+}
+
+// Run walks filedir and returns the orphaned and missing blobs
+func (s *FiledirScan) Run(ctx context.Context) (*models.OrphanReport, error) {
+	if s.Output == nil {
+		s.Output = io.Discard
+	}
+
+	s.report = &models.OrphanReport{
+		StartedAt:      time.Now(),
+		Orphans:        []models.FileBlob{},
+		Missing:        []models.FileBlob{},
+		QuarantinePath: s.Quarantine,
+	}
+
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+
+	if err := s.walk(ctx); err != nil {
+		return nil, err
+	}
+
+	// Whatever the database has left is missing from filedir
+	for s.valid {
+		s.missing()
+		if err := s.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	s.report.FinishedAt = time.Now()
+	return s.report, nil
+}
+
+// walk visits the blobs of filedir in content hash order
+func (s *FiledirScan) walk(ctx context.Context) error {
+	first, err := os.ReadDir(s.Filedir)
+	if err != nil {
+		return fmt.Errorf("failed to read filedir: %v", err)
+	}
+
+	for _, l1 := range first {
+		if !l1.IsDir() || !filedirHashDir.MatchString(l1.Name()) {
+			s.unexpected(l1.Name())
+			continue
+		}
+
+		second, err := os.ReadDir(filepath.Join(s.Filedir, l1.Name()))
+		if err != nil {
+			s.report.Errors = append(s.report.Errors, err.Error())
+			continue
+		}
+
+		for _, l2 := range second {
+			prefix := l1.Name() + "/" + l2.Name()
+			if !l2.IsDir() || !filedirHashDir.MatchString(l2.Name()) {
+				s.unexpected(prefix)
+				continue
+			}
+
+			blobs, err := os.ReadDir(filepath.Join(s.Filedir, l1.Name(), l2.Name()))
+			if err != nil {
+				s.report.Errors = append(s.report.Errors, err.Error())
+				continue
+			}
+
+			for _, blob := range blobs {
+				hash := blob.Name()
+				if !blob.Type().IsRegular() || !contentHashPattern.MatchString(hash) || hash[:4] != l1.Name()+l2.Name() {
+					s.unexpected(prefix + "/" + hash)
+					continue
+				}
+
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+
+				info, err := blob.Info()
+				if err != nil {
+					s.report.Errors = append(s.report.Errors, err.Error())
+					continue
+				}
+
+				if err := s.visit(hash, info); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// visit merges a filedir blob with the database hashes
+func (s *FiledirScan) visit(hash string, info os.FileInfo) error {
+	s.report.Blobs++
+	s.report.BlobSize += info.Size()
+	if s.report.Blobs%orphanProgressInterval == 0 {
+		fmt.Fprintf(s.Output, "Scanned %d blobs, %d orphaned\n", s.report.Blobs, s.report.OrphanCount)
+	}
+
+	// Database hashes sorting before this blob are missing from filedir
+	for s.valid && s.current < hash {
+		s.missing()
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+
+	if s.valid && s.current == hash {
+		s.report.Referenced++
+		return s.next()
+	}
+
+	if time.Since(info.ModTime()) < orphanGracePeriod {
+		s.report.Recent++
+		return nil
+	}
+
+	s.report.OrphanCount++
+	s.report.OrphanSize += info.Size()
+	s.list(&s.report.Orphans, models.FileBlob{ContentHash: hash, Size: info.Size()})
+	fmt.Fprintf(s.Output, "orphan %s %d\n", hash, info.Size())
+
+	if s.Quarantine != "" {
+		s.quarantine(hash)
+	}
+	return nil
+}
+
+// quarantine moves an orphaned blob to the quarantine directory, keeping the
+// filedir layout so that it can be moved back
+func (s *FiledirScan) quarantine(hash string) {
+	if s.Referenced != nil {
+		referenced, err := s.Referenced(hash)
+		if err != nil || referenced {
+			if err != nil {
+				s.report.Errors = append(s.report.Errors, err.Error())
+			}
+			return
+		}
+	}
+
+	relative := filepath.Join(hash[:2], hash[2:4], hash)
+	target := filepath.Join(s.Quarantine, relative)
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		s.report.Errors = append(s.report.Errors, err.Error())
+		return
+	}
+
+	if err := os.Rename(filepath.Join(s.Filedir, relative), target); err != nil {
+		s.report.Errors = append(s.report.Errors, err.Error())
+		return
+	}
+	s.report.Quarantined++
+}
+
+// missing records the current database hash as missing from filedir.
+// Directory records and references have no blob of their own.
+func (s *FiledirScan) missing() {
+	if s.current == emptyContentHash || s.local == 0 {
+		return
+	}
+
+	blob := models.FileBlob{ContentHash: s.current, Size: s.size}
+	if utils.FileExists(filepath.Join(s.Trashdir, s.current[:2], s.current[2:4], s.current)) {
+		blob.InTrash = true
+	}
+
+	s.report.MissingCount++
+	s.list(&s.report.Missing, blob)
+	fmt.Fprintf(s.Output, "missing %s %d\n", blob.ContentHash, blob.Size)
+}
+
+// next advances to the next database hash, failing when the hashes are not
+// sorted, as the merge would then report referenced blobs as orphaned
+func (s *FiledirScan) next() error {
+	for s.Hashes.Next() {
+		var hash string
+		var size, local sql.NullInt64
+		if err := s.Hashes.Scan(&hash, &size, &local); err != nil {
+			return err
+		}
+
+		if !contentHashPattern.MatchString(hash) {
+			s.report.Errors = append(s.report.Errors, fmt.Sprintf("invalid contenthash in the files table: %q", hash))
+			continue
+		}
+
+		if s.valid && hash <= s.current {
+			return fmt.Errorf("content hashes are not sorted by the database (%s after %s)", hash, s.current)
+		}
+
+		s.current, s.size, s.local, s.valid = hash, size.Int64, local.Int64, true
+		return nil
+	}
+
+	s.valid = false
+	return s.Hashes.Err()
+}
+
+// unexpected records an entry that does not belong in filedir
+func (s *FiledirScan) unexpected(name string) {
+	if filedirIgnored[name] {
+		return
+	}
+
+	if len(s.report.Unexpected) < orphanListLimit {
+		s.report.Unexpected = append(s.report.Unexpected, name)
+	} else {
+		s.report.Truncated = true
+	}
+}
+
+// list appends a blob to a capped report list
+func (s *FiledirScan) list(blobs *[]models.FileBlob, blob models.FileBlob) {
+	if len(*blobs) < orphanListLimit {
+		*blobs = append(*blobs, blob)
+	} else {
+		s.report.Truncated = true
+	}
+}
+
+// ScanOrphanedFiles compares filedir with the files table of the Moodle
+// database, optionally quarantining the orphaned blobs
+func (m *MoodleService) ScanOrphanedFiles(ctx context.Context, w io.Writer, req models.OrphanScanRequest) (*models.OrphanReport, error) {
+	dataPath, err := m.storageDataPath()
+	if err != nil {
+		return nil, err
+	}
+
+	site, err := m.GetSiteConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	table, err := moodleTable(site, "files")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := openMoodleDatabase(site)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// PostgreSQL sorts by the database locale unless told otherwise
+	order := "contenthash"
+	if site.DBType == "pgsql" {
+		order = `contenthash COLLATE "C"`
+	}
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`
+		SELECT contenthash, MAX(filesize), SUM(CASE WHEN referencefileid IS NULL THEN 1 ELSE 0 END)
+		FROM %s
+		GROUP BY contenthash
+		ORDER BY %s
+	`, table, order))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	scan := &FiledirScan{
+		Filedir:  filepath.Join(dataPath, "filedir"),
+		Trashdir: filepath.Join(dataPath, "trashdir"),
+		Hashes:   rows,
+		Output:   w,
+	}
+
+	if req.Quarantine {
+		root := m.config.Storage.QuarantinePath
+		if root == "" {
+			root = filepath.Join(dataPath, quarantineDir)
+		}
+		scan.Quarantine = filepath.Join(root, time.Now().Format(quarantineBatchFormat))
+
+		lookup := fmt.Sprintf(`SELECT COUNT(1) FROM %s WHERE contenthash = `, table)
+		if site.DBType == "pgsql" {
+			lookup += "$1"
+		} else {
+			lookup += "?"
+		}
+		scan.Referenced = func(hash string) (bool, error) {
+			var count int
+			err := conn.QueryRowContext(ctx, lookup, hash).Scan(&count)
+			return count > 0, err
+		}
+	}
+
+	fmt.Fprintf(w, "Comparing %s with %s\n", scan.Filedir, table)
+	report, err := scan.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(w, "%d blobs (%s), %d referenced, %d orphaned (%s), %d missing, %d too recent to judge\n",
+		report.Blobs, utils.FormatBytes(report.BlobSize), report.Referenced,
+		report.OrphanCount, utils.FormatBytes(report.OrphanSize), report.MissingCount, report.Recent)
+	if req.Quarantine {
+		fmt.Fprintf(w, "%d orphaned blobs moved to %s\n", report.Quarantined, scan.Quarantine)
+	}
+
+	m.mu.Lock()
+	m.orphanReport = report
+	m.mu.Unlock()
+
+	if report.Quarantined > 0 {
+		m.storage.mu.Lock()
+		m.storage.stale = true
+		m.storage.mu.Unlock()
+	}
+
+	return report, nil
+}
+
+// GetOrphanReport returns the report of the last filedir scan
+func (m *MoodleService) GetOrphanReport() *models.OrphanReport {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.orphanReport
+}
+
+// PurgeQuarantine deletes the quarantined batches older than olderThan hours,
+// the storage cleanup age when zero, and returns the number of batches deleted
+func (m *MoodleService) PurgeQuarantine(olderThan int) (int, error) {
+	if olderThan == 0 {
+		olderThan = m.config.Storage.CleanupAge
+	}
+	if olderThan <= 0 {
+		return 0, fmt.Errorf("quarantine age must be positive")
+	}
+
+	root := m.config.Storage.QuarantinePath
+	if root == "" {
+		dataPath, err := m.storageDataPath()
+		if err != nil {
+			return 0, err
+		}
+		root = filepath.Join(dataPath, quarantineDir)
+	}
+
+	batches, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	cutoff := time.Now().Add(-time.Duration(olderThan) * time.Hour)
+	for _, batch := range batches {
+		created, err := time.ParseInLocation(quarantineBatchFormat, batch.Name(), time.Local)
+		if err != nil || !batch.IsDir() || !created.Before(cutoff) {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(root, batch.Name())); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	if purged > 0 {
+		utils.Info("Purged %d quarantined filedir batches from %s", purged, root)
+	}
+	return purged, nil
+}
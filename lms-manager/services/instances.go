@@ -0,0 +1,119 @@
+package services
+
+import (
+	"database/sql"
+
+	"lms-manager/config"
+	"lms-manager/utils"
+)
+
+// Instance holds the services of one Moodle site. Every instance has its own
+// paths, stack components, PHP-FPM pools and Moodle database.
+type Instance struct {
+	Name      string
+	Monitor   *MonitorService
+	Moodle    *MoodleService
+	Cron      *CronService
+	Jobs      *JobService
+	DBStats   *DatabaseStatsService
+	Probes    *ProbeService
+	Integrity *IntegrityService
+	PHPFPM    *PHPFPMService
+	WebStatus *WebStatusService
+	AccessLog *AccessLogService
+	ErrorLog  *ErrorLogService
+	Config    *ConfigHistoryService
+	Tasks     *TaskHealthService
+	Usage     *UsageService
+	Users     *MoodleUserService
+}
+
+// NewInstance creates the services of a Moodle site, reporting to monitor
+func NewInstance(cfg config.MoodleConfig, monitor *MonitorService) *Instance {
+	moodle := NewMoodleService(cfg)
+
+	instance := &Instance{
+		Name:      moodle.Name(),
+		Monitor:   monitor,
+		Moodle:    moodle,
+		Cron:      NewCronService(cfg.Cron, moodle, monitor),
+		Jobs:      NewJobService(moodle),
+		DBStats:   NewDatabaseStatsService(monitor.config, moodle, monitor),
+		Probes:    NewProbeService(cfg.Probes, moodle, monitor),
+		Integrity: NewIntegrityService(cfg.Integrity, moodle, monitor),
+		PHPFPM:    NewPHPFPMService(cfg.PHPFPM, monitor),
+		WebStatus: NewWebStatusService(cfg.WebStatus, monitor),
+		AccessLog: NewAccessLogService(cfg.AccessLog, monitor),
+		ErrorLog:  NewErrorLogService(cfg.ErrorLog, moodle, monitor),
+		Config:    NewConfigHistoryService(cfg.ConfigHistory, moodle, monitor),
+		Tasks:     NewTaskHealthService(cfg.TaskHealth, moodle, monitor),
+		Usage:     NewUsageService(cfg.Usage, moodle, monitor),
+		Users:     NewMoodleUserService(cfg.UserAdmin, moodle),
+	}
+	moodle.SetCronService(instance.Cron)
+
+	return instance
+}
+
+// NewInstances creates the services of every Moodle site. A single site
+// reports to monitor as before; several sites each get a monitor that tags
+// their alerts with the instance name.
+func NewInstances(instances []config.MoodleConfig, monitor *MonitorService) []*Instance {
+	created := make([]*Instance, 0, len(instances))
+	for _, cfg := range instances {
+		instanceMonitor := monitor
+		if len(instances) > 1 {
+			instanceMonitor = monitor.ForInstance(cfg.Name)
+		}
+		created = append(created, NewInstance(cfg, instanceMonitor))
+	}
+	return created
+}
+
+// SetDatabase sets the database connection of every service
+func (i *Instance) SetDatabase(db *sql.DB) {
+	i.Monitor.SetDatabase(db)
+	i.Moodle.SetDatabase(db)
+	i.Cron.SetDatabase(db)
+	i.Jobs.SetDatabase(db)
+	i.Probes.SetDatabase(db)
+	i.Integrity.SetDatabase(db)
+	i.ErrorLog.SetDatabase(db)
+	i.Config.SetDatabase(db)
+	i.Usage.SetDatabase(db)
+	i.Users.SetDatabase(db)
+}
+
+// Start starts the background collectors and runners of the instance
+func (i *Instance) Start() {
+	utils.Info("Starting Moodle instance %s (%s)", i.Name, i.Moodle.Path())
+
+	i.Jobs.Start()
+	i.Cron.Start()
+	i.DBStats.Start()
+	i.Tasks.Start()
+	i.Usage.Start()
+	i.PHPFPM.Start()
+	i.WebStatus.Start()
+	i.AccessLog.Start()
+	i.ErrorLog.Start()
+	i.Probes.Start()
+	i.Integrity.Start()
+	i.Config.Start()
+}
+
+// Stop stops the background collectors and runners of the instance. The
+// integrity verifier checkpoints the pass in progress.
+func (i *Instance) Stop() {
+	i.Cron.Stop()
+	i.DBStats.Stop()
+	i.Tasks.Stop()
+	i.Usage.Stop()
+	i.PHPFPM.Stop()
+	i.WebStatus.Stop()
+	i.AccessLog.Stop()
+	i.ErrorLog.Stop()
+	i.Probes.Stop()
+	i.Integrity.Stop()
+	i.Config.Stop()
+}
@@ -0,0 +1,572 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Integrity alert types
+const (
+	AlertFiledirCorrupt = "filedir_corrupt"
+)
+
+// Integrity run statuses
+const (
+	IntegrityRunning     = "running"
+	IntegrityInterrupted = "interrupted"
+	IntegrityCompleted   = "completed"
+	IntegrityFailed      = "failed"
+	IntegrityAbandoned   = "abandoned"
+)
+
+// integrityPollInterval is how often the verifier checks whether a pass is due
+const integrityPollInterval = time.Hour
+
+// integrityCheckpointInterval is how often the progress of a pass is saved
+const integrityCheckpointInterval = 30 * time.Second
+
+// integrityChunkSize is the number of bytes read between rate limit checks
+const integrityChunkSize = 256 * 1024
+
+// IntegrityService re-hashes the blobs of filedir in the background and
+// records those whose content does not match their SHA-1 name
+type IntegrityService struct {
+	config   config.IntegrityConfig
+	moodle   *MoodleService
+	monitor  *MonitorService
+	db       *sql.DB
+	mu       sync.RWMutex
+	stopChan chan bool
+	running  bool
+
+	current *models.IntegrityRun
+	cancel  context.CancelFunc
+	passes  sync.WaitGroup
+}
+
+// NewIntegrityService creates a new integrity service
+func NewIntegrityService(cfg config.IntegrityConfig, moodle *MoodleService, monitor *MonitorService) *IntegrityService {
+	return &IntegrityService{
+		config:   cfg,
+		moodle:   moodle,
+		monitor:  monitor,
+		stopChan: make(chan bool),
+	}
+}
+
+// SetDatabase sets the database connection
+func (i *IntegrityService) SetDatabase(db *sql.DB) {
+	i.db = db
+}
+
+// Start starts verifying filedir on the configured interval
+func (i *IntegrityService) Start() {
+	if i.running {
+		return
+	}
+
+	if !i.config.Enabled {
+		utils.Info("Filedir integrity verifier is disabled")
+		return
+	}
+
+	i.running = true
+	go i.integrityLoop()
+	utils.Info("Filedir integrity verifier started (every %dh at %d KB/s)", i.config.Interval, i.config.RateLimit)
+}
+
+// Stop stops the verifier loop and interrupts the pass in progress, which
+// resumes from its checkpoint on the next start
+func (i *IntegrityService) Stop() {
+	if !i.running {
+		return
+	}
+
+	i.running = false
+	i.stopChan <- true
+	i.Cancel()
+	i.passes.Wait()
+	utils.Info("Filedir integrity verifier stopped")
+}
+
+// integrityLoop starts a pass whenever one is due
+func (i *IntegrityService) integrityLoop() {
+	ticker := time.NewTicker(integrityPollInterval)
+	defer ticker.Stop()
+
+	i.startIfDue()
+
+	for {
+		select {
+		case <-ticker.C:
+			i.startIfDue()
+		case <-i.stopChan:
+			return
+		}
+	}
+}
+
+// startIfDue resumes an interrupted pass, or starts a new one once the last
+// completed pass is older than the interval
+func (i *IntegrityService) startIfDue() {
+	resumable, err := i.loadRun(`status IN (?, ?)`, IntegrityRunning, IntegrityInterrupted)
+	if err != nil {
+		utils.Error("Failed to load integrity runs: %v", err)
+		return
+	}
+
+	if resumable == nil {
+		last, err := i.loadRun(`status = ?`, IntegrityCompleted)
+		if err != nil {
+			utils.Error("Failed to load integrity runs: %v", err)
+			return
+		}
+		if last != nil && time.Since(*last.FinishedAt) < time.Duration(i.config.Interval)*time.Hour {
+			return
+		}
+	}
+
+	if err := i.Trigger(false); err != nil {
+		utils.Warn("Skipping filedir integrity pass: %v", err)
+	}
+}
+
+// Trigger starts a pass in the background unless one is in progress. An
+// interrupted pass is resumed unless restart is set.
+func (i *IntegrityService) Trigger(restart bool) error {
+	run, ctx, err := i.begin(restart)
+	if err != nil {
+		return err
+	}
+
+	go i.verify(ctx, run)
+	return nil
+}
+
+// Verify runs a pass and waits for it to finish
+func (i *IntegrityService) Verify(ctx context.Context, restart bool) (*models.IntegrityRun, error) {
+	run, ctx, err := i.begin(restart)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.verify(ctx, run); err != nil {
+		return run, err
+	}
+	return run, nil
+}
+
+// Cancel interrupts the pass in progress, keeping its checkpoint
+func (i *IntegrityService) Cancel() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.cancel == nil {
+		return fmt.Errorf("no integrity pass is running")
+	}
+	i.cancel()
+	return nil
+}
+
+// begin claims the verifier and loads or creates the run to work on
+func (i *IntegrityService) begin(restart bool) (*models.IntegrityRun, context.Context, error) {
+	if i.db == nil {
+		return nil, nil, fmt.Errorf("database not initialized")
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.current != nil {
+		return nil, nil, fmt.Errorf("an integrity pass is already running")
+	}
+
+	run, err := i.loadRun(`status IN (?, ?)`, IntegrityRunning, IntegrityInterrupted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if run != nil && restart {
+		if _, err := i.db.Exec(`UPDATE integrity_runs SET status = ?, updated_at = ? WHERE id = ?`, IntegrityAbandoned, now, run.ID); err != nil {
+			return nil, nil, fmt.Errorf("failed to save integrity run: %v", err)
+		}
+		run = nil
+	}
+
+	if run == nil {
+		run = &models.IntegrityRun{ID: utils.GenerateID(), StartedAt: now}
+		if _, err := i.db.Exec(`
+			INSERT INTO integrity_runs (id, instance, status, checkpoint, started_at, updated_at)
+			VALUES (?, ?, ?, '', ?, ?)
+		`, run.ID, i.moodle.Name(), IntegrityRunning, now, now); err != nil {
+			return nil, nil, fmt.Errorf("failed to save integrity run: %v", err)
+		}
+	} else {
+		utils.Info("Resuming filedir integrity pass %s after %s", run.ID, run.Checkpoint)
+	}
+	run.Status = IntegrityRunning
+
+	ctx, cancel := context.WithCancel(context.Background())
+	i.current = run
+	i.cancel = cancel
+	i.passes.Add(1)
+	return run, ctx, nil
+}
+
+// verify walks filedir from the checkpoint of run and saves its progress
+func (i *IntegrityService) verify(ctx context.Context, run *models.IntegrityRun) error {
+	defer func() {
+		i.mu.Lock()
+		i.cancel()
+		i.current = nil
+		i.cancel = nil
+		i.mu.Unlock()
+		i.passes.Done()
+	}()
+
+	err := i.walk(ctx, run)
+
+	i.mu.Lock()
+	switch {
+	case err == nil:
+		finishedAt := time.Now()
+		run.Status = IntegrityCompleted
+		run.FinishedAt = &finishedAt
+	case ctx.Err() != nil:
+		run.Status = IntegrityInterrupted
+	default:
+		run.Status = IntegrityFailed
+		run.Error = err.Error()
+	}
+	i.mu.Unlock()
+
+	if saveErr := i.saveRun(run); saveErr != nil {
+		utils.Error("Failed to save integrity run: %v", saveErr)
+	}
+
+	switch run.Status {
+	case IntegrityCompleted:
+		utils.Info("Filedir integrity pass finished: %d files (%s) checked, %d corrupt",
+			run.FilesChecked, utils.FormatBytes(run.BytesChecked), run.CorruptCount)
+		if run.CorruptCount == 0 {
+			i.monitor.ResolveAlerts(AlertFiledirCorrupt)
+		}
+	case IntegrityInterrupted:
+		utils.Info("Filedir integrity pass interrupted after %s", run.Checkpoint)
+	default:
+		utils.Error("Filedir integrity pass failed: %v", err)
+	}
+
+	return err
+}
+
+// walk hashes the blobs of filedir sorting after the checkpoint
+func (i *IntegrityService) walk(ctx context.Context, run *models.IntegrityRun) error {
+	dataPath, err := i.moodle.storageDataPath()
+	if err != nil {
+		return err
+	}
+	filedir := filepath.Join(dataPath, "filedir")
+
+	first, err := os.ReadDir(filedir)
+	if err != nil {
+		return fmt.Errorf("failed to read filedir: %v", err)
+	}
+
+	limiter := &rateLimiter{rate: float64(i.config.RateLimit) * 1024, start: time.Now()}
+	saved := time.Now()
+
+	for _, l1 := range first {
+		if !l1.IsDir() || !filedirHashDir.MatchString(l1.Name()) || l1.Name() < prefixOf(run.Checkpoint, 2) {
+			continue
+		}
+
+		second, err := os.ReadDir(filepath.Join(filedir, l1.Name()))
+		if err != nil {
+			utils.Warn("Failed to read %s: %v", l1.Name(), err)
+			continue
+		}
+
+		for _, l2 := range second {
+			if !l2.IsDir() || !filedirHashDir.MatchString(l2.Name()) || l1.Name()+l2.Name() < prefixOf(run.Checkpoint, 4) {
+				continue
+			}
+
+			blobs, err := os.ReadDir(filepath.Join(filedir, l1.Name(), l2.Name()))
+			if err != nil {
+				utils.Warn("Failed to read %s/%s: %v", l1.Name(), l2.Name(), err)
+				continue
+			}
+
+			for _, blob := range blobs {
+				hash := blob.Name()
+				if !blob.Type().IsRegular() || !contentHashPattern.MatchString(hash) || hash[:4] != l1.Name()+l2.Name() || hash <= run.Checkpoint {
+					continue
+				}
+
+				if err := i.check(ctx, run, filepath.Join(filedir, l1.Name(), l2.Name(), hash), hash, limiter); err != nil {
+					return err
+				}
+
+				if time.Since(saved) > integrityCheckpointInterval {
+					if err := i.saveRun(run); err != nil {
+						utils.Error("Failed to save integrity checkpoint: %v", err)
+					}
+					saved = time.Now()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// check hashes a blob and records it when its content does not match its
+// name. Blobs deleted by Moodle in the meantime are skipped.
+func (i *IntegrityService) check(ctx context.Context, run *models.IntegrityRun, path, hash string, limiter *rateLimiter) error {
+	actual, size, err := hashFile(ctx, path, limiter)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	i.mu.Lock()
+	run.Checkpoint = hash
+	run.FilesChecked++
+	run.BytesChecked += size
+	i.mu.Unlock()
+
+	if os.IsNotExist(err) || (err == nil && actual == hash) {
+		return nil
+	}
+
+	corrupt := models.CorruptFile{
+		ContentHash: hash,
+		ActualHash:  actual,
+		Size:        size,
+		DetectedAt:  time.Now(),
+	}
+	if err != nil {
+		corrupt.ActualHash = ""
+		corrupt.Error = err.Error()
+		utils.Warn("Unreadable filedir blob %s: %v", hash, err)
+	} else {
+		utils.Warn("Corrupt filedir blob %s, its content hashes to %s", hash, actual)
+	}
+
+	i.mu.Lock()
+	run.CorruptCount++
+	i.mu.Unlock()
+
+	// Blobs after the last checkpoint are hashed again when a pass resumes
+	// after a crash, so a blob may already be recorded
+	if _, err := i.db.Exec(`
+		INSERT OR IGNORE INTO integrity_corrupt (id, run_id, contenthash, actual_hash, size, error, detected_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, utils.GenerateID(), run.ID, corrupt.ContentHash, corrupt.ActualHash, corrupt.Size, corrupt.Error, corrupt.DetectedAt); err != nil {
+		utils.Error("Failed to save corrupt file: %v", err)
+	}
+
+	i.monitor.RaiseAlert(AlertFiledirCorrupt, "critical",
+		fmt.Sprintf("Filedir blob %s does not match its content hash, course files may be damaged", hash))
+	return nil
+}
+
+// hashFile returns the SHA-1 and size of a file, reading it at the pace of
+// the limiter
+func hashFile(ctx context.Context, path string, limiter *rateLimiter) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hasher := sha1.New()
+	buf := make([]byte, integrityChunkSize)
+	var size int64
+	for {
+		if err := limiter.wait(ctx); err != nil {
+			return "", size, err
+		}
+
+		n, err := file.Read(buf)
+		hasher.Write(buf[:n])
+		size += int64(n)
+		limiter.bytes += int64(n)
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", size, err
+		}
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// prefixOf returns the first n characters of a checkpoint
+func prefixOf(checkpoint string, n int) string {
+	if len(checkpoint) < n {
+		return checkpoint
+	}
+	return checkpoint[:n]
+}
+
+// rateLimiter paces reads to rate bytes per second on average
+type rateLimiter struct {
+	rate  float64
+	start time.Time
+	bytes int64
+}
+
+// wait sleeps until the bytes read so far fit the rate
+func (r *rateLimiter) wait(ctx context.Context) error {
+	if r.rate <= 0 {
+		return ctx.Err()
+	}
+
+	due := r.start.Add(time.Duration(float64(r.bytes) / r.rate * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetReport returns the latest pass, the last completed pass and the corrupt
+// files found by the latest pass
+func (i *IntegrityService) GetReport() (*models.IntegrityReport, error) {
+	if i.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	report := &models.IntegrityReport{Corrupt: []models.CorruptFile{}}
+
+	i.mu.RLock()
+	if i.current != nil {
+		copied := *i.current
+		report.Run = &copied
+		report.Running = true
+	}
+	i.mu.RUnlock()
+
+	var err error
+	if report.Run == nil {
+		report.Run, err = i.loadRun(`1 = 1`)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.LastCompleted, err = i.loadRun(`status = ?`, IntegrityCompleted)
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Run == nil {
+		return report, nil
+	}
+
+	rows, err := i.db.Query(`
+		SELECT contenthash, actual_hash, size, error, detected_at
+		FROM integrity_corrupt
+		WHERE run_id = ?
+		ORDER BY contenthash
+		LIMIT ?
+	`, report.Run.ID, orphanListLimit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load corrupt files: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var corrupt models.CorruptFile
+		var actualHash, corruptError sql.NullString
+		if err := rows.Scan(&corrupt.ContentHash, &actualHash, &corrupt.Size, &corruptError, &corrupt.DetectedAt); err != nil {
+			return nil, fmt.Errorf("failed to load corrupt files: %v", err)
+		}
+		corrupt.ActualHash = actualHash.String
+		corrupt.Error = corruptError.String
+
+		if len(report.Corrupt) == orphanListLimit {
+			report.Truncated = true
+			break
+		}
+		report.Corrupt = append(report.Corrupt, corrupt)
+	}
+
+	return report, rows.Err()
+}
+
+// loadRun returns the most recent run of the instance matching the
+// condition, or nil
+func (i *IntegrityService) loadRun(condition string, args ...interface{}) (*models.IntegrityRun, error) {
+	if i.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	var run models.IntegrityRun
+	var runError sql.NullString
+	var finishedAt sql.NullTime
+
+	err := i.db.QueryRow(`
+		SELECT id, status, checkpoint, files_checked, bytes_checked, corrupt_count, error, started_at, updated_at, finished_at
+		FROM integrity_runs
+		WHERE instance = ? AND (`+condition+`)
+		ORDER BY started_at DESC
+		LIMIT 1
+	`, append([]interface{}{i.moodle.Name()}, args...)...).Scan(&run.ID, &run.Status, &run.Checkpoint, &run.FilesChecked, &run.BytesChecked, &run.CorruptCount,
+		&runError, &run.StartedAt, &run.UpdatedAt, &finishedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load integrity run: %v", err)
+	}
+
+	run.Error = runError.String
+	if finishedAt.Valid {
+		run.FinishedAt = &finishedAt.Time
+	}
+	return &run, nil
+}
+
+// saveRun stores the progress of a run
+func (i *IntegrityService) saveRun(run *models.IntegrityRun) error {
+	i.mu.Lock()
+	run.UpdatedAt = time.Now()
+	saved := *run
+	i.mu.Unlock()
+
+	_, err := i.db.Exec(`
+		UPDATE integrity_runs
+		SET status = ?, checkpoint = ?, files_checked = ?, bytes_checked = ?, corrupt_count = ?, error = ?, updated_at = ?, finished_at = ?
+		WHERE id = ?
+	`, saved.Status, saved.Checkpoint, saved.FilesChecked, saved.BytesChecked, saved.CorruptCount, saved.Error, saved.UpdatedAt, saved.FinishedAt, saved.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save integrity run: %v", err)
+	}
+	return nil
+}
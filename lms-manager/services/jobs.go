@@ -0,0 +1,569 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// jobOutputLimit is the number of output bytes kept for each job
+const jobOutputLimit = 1 << 20
+
+// JobFunc is the work of a job. Output written to w is streamed to
+// subscribers and stored with the job; the context is cancelled when the job
+// times out or is cancelled.
+type JobFunc func(ctx context.Context, w io.Writer) error
+
+// JobService runs Moodle CLI scripts and other long running tasks in the
+// background, one at a time
+type JobService struct {
+	moodle *MoodleService
+	db     *sql.DB
+	mu     sync.RWMutex
+	active *jobRun
+}
+
+// jobRun holds the live state of the running job
+type jobRun struct {
+	mu      sync.Mutex
+	job     models.Job
+	output  []byte
+	dropped int
+	notify  map[chan struct{}]bool
+	done    chan struct{}
+	cancel  context.CancelFunc
+}
+
+// NewJobService creates a new job service
+func NewJobService(moodle *MoodleService) *JobService {
+	return &JobService{
+		moodle: moodle,
+	}
+}
+
+// SetDatabase sets the database connection
+func (j *JobService) SetDatabase(db *sql.DB) {
+	j.db = db
+}
+
+// Start marks the jobs of the instance a previous lms-manager process left
+// running as failed. Their commands died with that process.
+func (j *JobService) Start() {
+	if j.db == nil {
+		return
+	}
+
+	activeID := ""
+	j.mu.RLock()
+	if j.active != nil {
+		activeID = j.active.snapshot().ID
+	}
+	j.mu.RUnlock()
+
+	result, err := j.db.Exec(`
+		UPDATE jobs
+		SET status = ?, exit_code = -1, error = ?, finished_at = ?
+		WHERE instance = ? AND status = ? AND id != ?
+	`, models.JobFailed, "interrupted by a restart of lms-manager", time.Now(), j.moodle.Name(), models.JobRunning, activeID)
+	if err != nil {
+		utils.Error("Failed to mark interrupted jobs: %v", err)
+		return
+	}
+
+	if interrupted, _ := result.RowsAffected(); interrupted > 0 {
+		utils.Warn("Marked %d interrupted jobs of %s as failed", interrupted, j.moodle.Name())
+	}
+}
+
+// RunScript starts an allow-listed Moodle CLI script as a job
+func (j *JobService) RunScript(name string, args map[string]string, userID, username string) (*models.Job, error) {
+	script, err := findCLIScript(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdArgs, values, input, err := buildCLIArgs(script, args)
+	if err != nil {
+		return nil, err
+	}
+
+	job := models.Job{
+		Name:     script.Name,
+		Command:  cliCommandLine(script, values),
+		Args:     values,
+		UserID:   userID,
+		Username: username,
+	}
+
+	run := func(ctx context.Context, w io.Writer) error {
+		cmd, err := j.moodle.moodleCLICommand(script.Script, cmdArgs...)
+		if err != nil {
+			return err
+		}
+		cmd.Stdin = strings.NewReader(input)
+		cmd.Stdout = w
+		cmd.Stderr = w
+		return runCommand(ctx, cmd)
+	}
+
+	fn := run
+	if script.Maintenance {
+		fn = func(ctx context.Context, w io.Writer) error {
+			return j.moodle.withMaintenance("", func() error {
+				return run(ctx, w)
+			})
+		}
+	}
+
+	return j.start(job, time.Duration(script.Timeout)*time.Second, fn)
+}
+
+// RunUpgrade starts a Moodle core upgrade from a local archive as a job
+func (j *JobService) RunUpgrade(req models.UpgradeRequest, userID, username string) (*models.Job, error) {
+	if err := j.moodle.checkUpgradeArchive(req.Archive); err != nil {
+		return nil, err
+	}
+
+	job := models.Job{
+		Name:     "core_upgrade",
+		Command:  "upgrade Moodle from " + req.Archive,
+		Args:     map[string]string{"archive": req.Archive},
+		UserID:   userID,
+		Username: username,
+	}
+	if req.AllowUnstable {
+		job.Args["allow_unstable"] = "true"
+	}
+
+	timeout := time.Duration(j.moodle.config.Upgrade.Timeout) * time.Second
+	return j.start(job, timeout, func(ctx context.Context, w io.Writer) error {
+		return j.moodle.Upgrade(ctx, w, req)
+	})
+}
+
+// RunOrphanScan compares filedir with the files table as a job
+func (j *JobService) RunOrphanScan(req models.OrphanScanRequest, userID, username string) (*models.Job, error) {
+	job := models.Job{
+		Name:     "filedir_orphans",
+		Command:  "scan filedir for orphaned blobs",
+		Args:     map[string]string{},
+		UserID:   userID,
+		Username: username,
+	}
+	if req.Quarantine {
+		job.Command = "scan filedir and quarantine orphaned blobs"
+		job.Args["quarantine"] = "true"
+	}
+
+	return j.start(job, 0, func(ctx context.Context, w io.Writer) error {
+		_, err := j.moodle.ScanOrphanedFiles(ctx, w, req)
+		return err
+	})
+}
+
+// start runs the job in the background unless another job is running
+func (j *JobService) start(job models.Job, timeout time.Duration, fn JobFunc) (*models.Job, error) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	job.ID = utils.GenerateID()
+	job.Status = models.JobRunning
+	job.CreatedAt = time.Now()
+
+	run := &jobRun{
+		job:    job,
+		notify: make(map[chan struct{}]bool),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	j.mu.Lock()
+	if j.active != nil {
+		active := j.active.snapshot()
+		j.mu.Unlock()
+		cancel()
+		return nil, fmt.Errorf("job %s (%s) is still running", active.ID, active.Name)
+	}
+	j.active = run
+	j.mu.Unlock()
+
+	j.saveJob(&job)
+	utils.Info("Job %s started by %s: %s", job.ID, job.Username, job.Command)
+
+	go func() {
+		err := fn(ctx, run)
+		cancel()
+		j.finish(run, ctx, err, timeout)
+	}()
+
+	return &job, nil
+}
+
+// finish records the result of a job and releases the job slot
+func (j *JobService) finish(run *jobRun, ctx context.Context, err error, timeout time.Duration) {
+	run.mu.Lock()
+	finishedAt := time.Now()
+	run.job.FinishedAt = &finishedAt
+	run.job.Output = strings.ToValidUTF8(string(run.output), "")
+
+	switch {
+	case err == nil:
+		run.job.Status = models.JobSucceeded
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		run.job.Status = models.JobFailed
+		run.job.ExitCode = -1
+		run.job.Error = fmt.Sprintf("timed out after %s", timeout)
+	case errors.Is(ctx.Err(), context.Canceled) && errors.Is(err, context.Canceled):
+		run.job.Status = models.JobCancelled
+		run.job.ExitCode = -1
+		run.job.Error = "cancelled"
+	default:
+		run.job.Status = models.JobFailed
+		run.job.ExitCode = exitCode(err)
+		run.job.Error = err.Error()
+	}
+	job := run.job
+	run.mu.Unlock()
+
+	j.updateJob(&job)
+
+	j.mu.Lock()
+	j.active = nil
+	j.mu.Unlock()
+
+	close(run.done)
+
+	if job.Status == models.JobSucceeded {
+		utils.Info("Job %s (%s) succeeded", job.ID, job.Name)
+	} else {
+		utils.Warn("Job %s (%s) %s: %s", job.ID, job.Name, job.Status, job.Error)
+	}
+}
+
+// Cancel cancels the running job
+func (j *JobService) Cancel(id string) error {
+	j.mu.RLock()
+	run := j.active
+	j.mu.RUnlock()
+
+	if run == nil || run.snapshot().ID != id {
+		return fmt.Errorf("job %s is not running", id)
+	}
+
+	run.cancel()
+	return nil
+}
+
+// GetJob returns a job, including the output written so far if it is running
+func (j *JobService) GetJob(id string) (*models.Job, error) {
+	j.mu.RLock()
+	run := j.active
+	j.mu.RUnlock()
+
+	if run != nil {
+		if job := run.snapshot(); job.ID == id {
+			return &job, nil
+		}
+	}
+
+	return j.loadJob(id)
+}
+
+// ListJobs returns the most recent jobs without their output
+func (j *JobService) ListJobs(limit int) ([]models.Job, error) {
+	if j.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	if limit <= 0 {
+		limit = 50
+	}
+
+	rows, err := j.db.Query(`
+		SELECT id, name, command, args, status, exit_code, error, user_id, username, created_at, finished_at
+		FROM jobs
+		WHERE instance = ?
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, j.moodle.Name(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []models.Job
+	for rows.Next() {
+		job, err := scanJob(rows, false)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+
+	return jobs, nil
+}
+
+// JobStream delivers the output of a job as it is written
+type JobStream struct {
+	Output <-chan string
+	quit   chan struct{}
+	once   sync.Once
+	final  func() (*models.Job, error)
+}
+
+// Close stops the stream
+func (s *JobStream) Close() {
+	s.once.Do(func() {
+		close(s.quit)
+	})
+}
+
+// Job returns the job once the output channel is closed
+func (s *JobStream) Job() (*models.Job, error) {
+	return s.final()
+}
+
+// Subscribe streams the output of a job from the start. Output of finished
+// jobs is sent at once.
+func (j *JobService) Subscribe(id string) (*JobStream, error) {
+	output := make(chan string)
+	stream := &JobStream{
+		Output: output,
+		quit:   make(chan struct{}),
+		final: func() (*models.Job, error) {
+			return j.GetJob(id)
+		},
+	}
+
+	j.mu.RLock()
+	run := j.active
+	j.mu.RUnlock()
+
+	if run == nil || run.snapshot().ID != id {
+		job, err := j.loadJob(id)
+		if err != nil {
+			return nil, err
+		}
+
+		go func() {
+			defer close(output)
+			if job.Output != "" {
+				select {
+				case output <- job.Output:
+				case <-stream.quit:
+				}
+			}
+		}()
+		return stream, nil
+	}
+
+	notify := run.subscribe()
+	go func() {
+		defer close(output)
+		defer run.unsubscribe(notify)
+
+		offset := 0
+		for {
+			chunk, next, finished := run.read(offset)
+			offset = next
+
+			if chunk != "" {
+				select {
+				case output <- chunk:
+				case <-stream.quit:
+					return
+				}
+			}
+
+			if finished {
+				return
+			}
+
+			select {
+			case <-notify:
+			case <-run.done:
+			case <-stream.quit:
+				return
+			}
+		}
+	}()
+
+	return stream, nil
+}
+
+// Write appends job output and wakes up subscribers
+func (r *jobRun) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.output = append(r.output, p...)
+	if len(r.output) > jobOutputLimit {
+		drop := len(r.output) - jobOutputLimit
+		r.output = r.output[drop:]
+		r.dropped += drop
+	}
+
+	for notify := range r.notify {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return len(p), nil
+}
+
+// read returns the output after offset, the next offset and whether the job
+// has finished and all output has been read
+func (r *jobRun) read(offset int) (string, int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if offset < r.dropped {
+		offset = r.dropped
+	}
+
+	chunk := string(r.output[offset-r.dropped:])
+	next := r.dropped + len(r.output)
+	return chunk, next, r.job.FinishedAt != nil
+}
+
+// subscribe registers a channel that is signalled when output is written
+func (r *jobRun) subscribe() chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	notify := make(chan struct{}, 1)
+	r.notify[notify] = true
+	return notify
+}
+
+// unsubscribe removes an output notification channel
+func (r *jobRun) unsubscribe(notify chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.notify, notify)
+}
+
+// snapshot returns a copy of the job with the output written so far
+func (r *jobRun) snapshot() models.Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job := r.job
+	if job.FinishedAt == nil {
+		job.Output = strings.ToValidUTF8(string(r.output), "")
+	}
+	return job
+}
+
+// saveJob inserts a new job into the database
+func (j *JobService) saveJob(job *models.Job) {
+	if j.db == nil {
+		return
+	}
+
+	args, _ := json.Marshal(job.Args)
+	_, err := j.db.Exec(`
+		INSERT INTO jobs (id, instance, name, command, args, status, exit_code, user_id, username, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, j.moodle.Name(), job.Name, job.Command, string(args), job.Status, job.ExitCode, job.UserID, job.Username, job.CreatedAt)
+
+	if err != nil {
+		utils.Error("Failed to save job: %v", err)
+	}
+}
+
+// updateJob stores the result of a finished job
+func (j *JobService) updateJob(job *models.Job) {
+	if j.db == nil {
+		return
+	}
+
+	_, err := j.db.Exec(`
+		UPDATE jobs
+		SET status = ?, exit_code = ?, error = ?, output = ?, finished_at = ?
+		WHERE id = ?
+	`, job.Status, job.ExitCode, job.Error, job.Output, job.FinishedAt, job.ID)
+
+	if err != nil {
+		utils.Error("Failed to update job: %v", err)
+	}
+}
+
+// loadJob reads a job from the database
+func (j *JobService) loadJob(id string) (*models.Job, error) {
+	if j.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	row := j.db.QueryRow(`
+		SELECT id, name, command, args, status, exit_code, error, user_id, username, created_at, finished_at, output
+		FROM jobs
+		WHERE id = ? AND instance = ?
+	`, id, j.moodle.Name())
+
+	job, err := scanJob(row, true)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("job not found: %s", id)
+	}
+	return job, err
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanJob scans a jobs row, optionally followed by the output column
+func scanJob(row rowScanner, withOutput bool) (*models.Job, error) {
+	var job models.Job
+	var args, jobError, output sql.NullString
+	var finishedAt sql.NullTime
+
+	dest := []interface{}{
+		&job.ID,
+		&job.Name,
+		&job.Command,
+		&args,
+		&job.Status,
+		&job.ExitCode,
+		&jobError,
+		&job.UserID,
+		&job.Username,
+		&job.CreatedAt,
+		&finishedAt,
+	}
+	if withOutput {
+		dest = append(dest, &output)
+	}
+
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	if args.Valid {
+		json.Unmarshal([]byte(args.String), &job.Args)
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	job.Error = jobError.String
+	job.Output = output.String
+
+	return &job, nil
+}
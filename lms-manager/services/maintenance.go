@@ -0,0 +1,266 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// climaintenanceFile is the file in $CFG->dataroot that makes Moodle serve
+// its contents instead of the site
+const climaintenanceFile = "climaintenance.html"
+
+// DefaultMaintenanceMessage is shown when no maintenance message is given
+const DefaultMaintenanceMessage = "This site is currently being upgraded and is not available. Please try again later."
+
+// defaultMaintenanceTemplate renders climaintenance.html when no custom
+// template is configured
+const defaultMaintenanceTemplate = `<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <title>Maintenance</title>
+    <style>
+        body { font-family: sans-serif; background: #f5f5f5; color: #333; }
+        .maintenance { max-width: 600px; margin: 15% auto; padding: 2em; background: #fff; border-radius: 8px; text-align: center; }
+    </style>
+</head>
+<body>
+    <div class="maintenance">
+        <h1>Site under maintenance</h1>
+        <p>{{.Message}}</p>
+        <p><small>Since {{.Since.Format "2006-01-02 15:04 MST"}}</small></p>
+    </div>
+</body>
+</html>
+`
+
+// maintenancePage is the data passed to the maintenance template
+type maintenancePage struct {
+	Message string
+	Site    string
+	Since   time.Time
+}
+
+// GetMaintenanceStatus returns the maintenance mode state. The
+// climaintenance.html file is checked on disk; the CLI mode is tracked from
+// the last enable, disable or refresh.
+func (m *MoodleService) GetMaintenanceStatus() models.MaintenanceStatus {
+	m.mu.RLock()
+	known := m.maintenance
+	m.mu.RUnlock()
+
+	if path := m.maintenanceFile(); path != "" {
+		if info, err := os.Stat(path); err == nil {
+			status := models.MaintenanceStatus{
+				Enabled: true,
+				Mode:    models.MaintenanceModeFile,
+				Since:   info.ModTime(),
+			}
+			if known.Mode == models.MaintenanceModeFile {
+				status.Message = known.Message
+			}
+			return status
+		}
+	}
+
+	if known.Mode == models.MaintenanceModeCLI {
+		return known
+	}
+
+	return models.MaintenanceStatus{}
+}
+
+// RefreshMaintenanceStatus asks admin/cli/maintenance.php for the CLI
+// maintenance state and returns the current maintenance status
+func (m *MoodleService) RefreshMaintenanceStatus() (models.MaintenanceStatus, error) {
+	output, err := m.runMoodleCLI("admin/cli/maintenance.php")
+	if err != nil {
+		return m.GetMaintenanceStatus(), err
+	}
+
+	// Prints "Status: enabled" or "Status: disabled"
+	enabled := strings.Contains(strings.ToLower(output), "enabled")
+
+	// The script also reports climaintenance.html as enabled, which then
+	// tells nothing about the CLI mode
+	path := m.maintenanceFile()
+	fileEnabled := path != "" && utils.FileExists(path)
+
+	m.mu.Lock()
+	switch {
+	case fileEnabled:
+	case enabled && m.maintenance.Mode != models.MaintenanceModeCLI:
+		m.maintenance = models.MaintenanceStatus{Enabled: true, Mode: models.MaintenanceModeCLI}
+	case !enabled && m.maintenance.Mode == models.MaintenanceModeCLI:
+		m.maintenance = models.MaintenanceStatus{}
+	}
+	m.mu.Unlock()
+
+	return m.GetMaintenanceStatus(), nil
+}
+
+// EnableMaintenance puts Moodle into maintenance mode. The file mode writes
+// climaintenance.html from the maintenance template and works while the
+// database is down; the CLI mode uses admin/cli/maintenance.php and lets
+// site administrators keep logging in.
+func (m *MoodleService) EnableMaintenance(mode, message string) error {
+	if message == "" {
+		message = DefaultMaintenanceMessage
+	}
+
+	switch mode {
+	case models.MaintenanceModeFile, "":
+		mode = models.MaintenanceModeFile
+		if err := m.writeMaintenanceFile(message); err != nil {
+			return err
+		}
+	case models.MaintenanceModeCLI:
+		if _, err := m.runMoodleCLI("admin/cli/cfg.php", "--name=maintenance_message", "--set="+message); err != nil {
+			utils.Warn("Failed to set maintenance message: %v", err)
+		}
+		if _, err := m.runMoodleCLI("admin/cli/maintenance.php", "--enable"); err != nil {
+			return fmt.Errorf("failed to enable maintenance mode: %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid maintenance mode: %s", mode)
+	}
+
+	m.mu.Lock()
+	m.maintenance = models.MaintenanceStatus{
+		Enabled: true,
+		Mode:    mode,
+		Message: message,
+		Since:   time.Now(),
+	}
+	m.mu.Unlock()
+
+	utils.Info("Moodle maintenance mode enabled (%s)", mode)
+	return nil
+}
+
+// DisableMaintenance takes Moodle out of maintenance mode
+func (m *MoodleService) DisableMaintenance() error {
+	removedFile := false
+	if path := m.maintenanceFile(); path != "" && utils.FileExists(path) {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", climaintenanceFile, err)
+		}
+		removedFile = true
+	}
+
+	m.mu.RLock()
+	cliEnabled := m.maintenance.Mode == models.MaintenanceModeCLI
+	m.mu.RUnlock()
+
+	// Without a maintenance file, only the CLI mode can be left on
+	if cliEnabled || !removedFile {
+		if _, err := m.runMoodleCLI("admin/cli/maintenance.php", "--disable"); err != nil {
+			return fmt.Errorf("failed to disable maintenance mode: %v", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.maintenance = models.MaintenanceStatus{}
+	m.mu.Unlock()
+
+	utils.Info("Moodle maintenance mode disabled")
+	return nil
+}
+
+// withMaintenance runs fn with maintenance mode enabled. Maintenance mode is
+// left on when fn fails so that users do not reach a broken site, and is not
+// touched when it was already enabled.
+func (m *MoodleService) withMaintenance(message string, fn func() error) error {
+	if m.GetMaintenanceStatus().Enabled {
+		return fn()
+	}
+
+	enabled := true
+	if err := m.EnableMaintenance(models.MaintenanceModeFile, message); err != nil {
+		utils.Warn("Failed to enable maintenance mode: %v", err)
+		enabled = false
+	}
+
+	if err := fn(); err != nil {
+		if enabled {
+			utils.Warn("Leaving maintenance mode enabled after failure")
+		}
+		return err
+	}
+
+	if enabled {
+		if err := m.DisableMaintenance(); err != nil {
+			utils.Warn("Failed to disable maintenance mode: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// maintenanceFile returns the path of climaintenance.html
+func (m *MoodleService) maintenanceFile() string {
+	dataPath := m.dataPath()
+	if dataPath == "" {
+		return ""
+	}
+	return filepath.Join(dataPath, climaintenanceFile)
+}
+
+// writeMaintenanceFile renders the maintenance template to climaintenance.html
+func (m *MoodleService) writeMaintenanceFile(message string) error {
+	path := m.maintenanceFile()
+	if path == "" {
+		return fmt.Errorf("Moodle data directory is not configured")
+	}
+
+	tmpl, err := m.maintenanceTemplate()
+	if err != nil {
+		return err
+	}
+
+	page := maintenancePage{
+		Message: message,
+		Since:   time.Now(),
+	}
+	if site, err := m.GetSiteConfig(); err == nil {
+		page.Site = site.WWWRoot
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, page); err != nil {
+		return fmt.Errorf("failed to render maintenance template: %v", err)
+	}
+
+	// Write to a temporary file first so Moodle never serves a partial page
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", climaintenanceFile, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write %s: %v", climaintenanceFile, err)
+	}
+
+	return nil
+}
+
+// maintenanceTemplate returns the configured maintenance template or the default one
+func (m *MoodleService) maintenanceTemplate() (*template.Template, error) {
+	if m.config.MaintenanceTemplate == "" {
+		return template.New("climaintenance").Parse(defaultMaintenanceTemplate)
+	}
+
+	tmpl, err := template.ParseFiles(m.config.MaintenanceTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load maintenance template: %v", err)
+	}
+	return tmpl, nil
+}
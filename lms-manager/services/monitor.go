@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,11 +13,22 @@ import (
 	"lms-manager/utils"
 )
 
-// MonitorService handles system monitoring
+// webMetricsSource is the system log source of the web tier metrics
+const webMetricsSource = "web"
+
+// systemStatsSource is the system log source of the host stats
+const systemStatsSource = "monitor"
+
+// MonitorService handles system monitoring. A monitor of a Moodle instance
+// only checks the alerts of that instance and tags them with its name.
 type MonitorService struct {
 	config     config.MonitoringConfig
 	db         *sql.DB
+	instance   string
+	parent     *MonitorService
 	stats      *models.SystemStats
+	phpfpm     []models.PHPFPMPoolStats
+	web        *models.PerformanceMetrics
 	mu         sync.RWMutex
 	stopChan   chan bool
 	running    bool
@@ -37,6 +49,26 @@ func (m *MonitorService) SetDatabase(db *sql.DB) {
 	m.db = db
 }
 
+// ForInstance returns a monitor for the alerts of a Moodle instance. Its
+// alert types and web metrics are prefixed with the instance name, so the
+// same alert can be raised for several instances. The host stats are only
+// collected by m.
+func (m *MonitorService) ForInstance(name string) *MonitorService {
+	monitor := NewMonitorService(m.config)
+	monitor.db = m.db
+	monitor.instance = name
+	monitor.parent = m
+	return monitor
+}
+
+// scoped prefixes an alert type or log source with the instance name
+func (m *MonitorService) scoped(name string) string {
+	if m.instance == "" {
+		return name
+	}
+	return m.instance + ":" + name
+}
+
 // Start starts the monitoring service
 func (m *MonitorService) Start() {
 	if m.running {
@@ -66,6 +98,21 @@ func (m *MonitorService) GetStats() *models.SystemStats {
 	return m.stats
 }
 
+// GetInstanceStats returns the host stats with the PHP-FPM pools and web
+// tier metrics of the Moodle instance of the monitor
+func (m *MonitorService) GetInstanceStats() *models.SystemStats {
+	if m.parent == nil {
+		return m.GetStats()
+	}
+
+	stats := *m.parent.GetStats()
+	m.mu.RLock()
+	stats.PHPFPM = m.phpfpm
+	stats.Web = m.web
+	m.mu.RUnlock()
+	return &stats
+}
+
 // monitorLoop runs the monitoring loop
 func (m *MonitorService) monitorLoop() {
 	ticker := time.NewTicker(time.Duration(m.config.UpdateInterval) * time.Second)
@@ -131,6 +178,8 @@ func (m *MonitorService) updateStats() {
 
 	// Update stats
 	m.mu.Lock()
+	stats.PHPFPM = m.phpfpm
+	stats.Web = m.web
 	m.stats = stats
 	m.mu.Unlock()
 
@@ -187,6 +236,296 @@ func (m *MonitorService) checkAlerts(stats *models.SystemStats) {
 	}
 }
 
+// CheckDatabaseStats raises or resolves the database alerts
+func (m *MonitorService) CheckDatabaseStats(stats *models.DatabaseStats) {
+	thresholds := m.config.AlertThresholds
+
+	// Connection usage alert
+	if thresholds.DBConnections > 0 && stats.ConnectionUsage > thresholds.DBConnections {
+		m.RaiseAlert(AlertDBConnectionsHigh, "warning", fmt.Sprintf("Database connections are high: %d of %d (%.1f%%)", stats.Connections, stats.MaxConnections, stats.ConnectionUsage))
+	} else {
+		m.ResolveAlerts(AlertDBConnectionsHigh)
+	}
+
+	// Slow query alert
+	if thresholds.DBSlowQueries > 0 && stats.SlowQueriesPerMin > thresholds.DBSlowQueries {
+		m.RaiseAlert(AlertDBSlowQueries, "warning", fmt.Sprintf("Database slow queries are high: %.1f per minute", stats.SlowQueriesPerMin))
+	} else {
+		m.ResolveAlerts(AlertDBSlowQueries)
+	}
+}
+
+// CheckPHPFPMStats attaches the PHP-FPM pools to the system stats and raises
+// or resolves the PHP-FPM alerts
+func (m *MonitorService) CheckPHPFPMStats(pools []models.PHPFPMPoolStats) {
+	m.mu.Lock()
+	m.phpfpm = pools
+	stats := *m.stats
+	stats.PHPFPM = pools
+	m.stats = &stats
+	m.mu.Unlock()
+
+	thresholds := m.config.AlertThresholds
+	var saturated, queued, unreachable []string
+	for _, pool := range pools {
+		if pool.Error != "" {
+			unreachable = append(unreachable, fmt.Sprintf("%s (%s)", pool.Name, pool.Error))
+			continue
+		}
+
+		// Requests were refused a child since the previous sample
+		if pool.NewMaxChildrenReached > 0 {
+			saturated = append(saturated, fmt.Sprintf("%s reached pm.max_children %d times", pool.Name, pool.NewMaxChildrenReached))
+		} else if thresholds.PHPFPMChildren > 0 && pool.ChildrenUsage > thresholds.PHPFPMChildren {
+			saturated = append(saturated, fmt.Sprintf("%s has %d of %d children busy", pool.Name, pool.ActiveProcesses, pool.MaxChildren))
+		}
+
+		if thresholds.PHPFPMListenQueue > 0 && float64(pool.ListenQueue) > thresholds.PHPFPMListenQueue {
+			queued = append(queued, fmt.Sprintf("%s has %d requests waiting", pool.Name, pool.ListenQueue))
+		}
+	}
+
+	// Saturation alert
+	if len(saturated) > 0 {
+		m.RaiseAlert(AlertPHPFPMSaturated, "critical", "PHP-FPM is saturated: "+strings.Join(saturated, ", "))
+	} else {
+		m.ResolveAlerts(AlertPHPFPMSaturated)
+	}
+
+	// Listen queue alert
+	if len(queued) > 0 {
+		m.RaiseAlert(AlertPHPFPMListenQueue, "warning", "PHP-FPM listen queue is high: "+strings.Join(queued, ", "))
+	} else {
+		m.ResolveAlerts(AlertPHPFPMListenQueue)
+	}
+
+	// Status page alert
+	if len(unreachable) > 0 {
+		m.RaiseAlert(AlertPHPFPMUnreachable, "warning", "PHP-FPM status unavailable: "+strings.Join(unreachable, ", "))
+	} else {
+		m.ResolveAlerts(AlertPHPFPMUnreachable)
+	}
+}
+
+// CheckAccessLogStats raises alerts when the 5xx rate or the 95th percentile
+// latency of the recent traffic in the access log exceeds its threshold.
+// Minutes with too little traffic leave the alerts as they are.
+func (m *MonitorService) CheckAccessLogStats(stats *models.AccessLogStats) {
+	if stats.Requests < accessLogAlertMinRequests {
+		return
+	}
+
+	thresholds := m.config.AlertThresholds
+
+	// 5xx rate alert
+	if thresholds.HTTP5xxRate > 0 && stats.Rate5xx > thresholds.HTTP5xxRate {
+		m.RaiseAlert(AlertHTTP5xxRate, "critical", fmt.Sprintf("%.1f%% of requests failed with 5xx in the last %d minutes (%d of %d)", stats.Rate5xx, stats.Minutes, stats.Status5xx, stats.Requests))
+	} else {
+		m.ResolveAlerts(AlertHTTP5xxRate)
+	}
+
+	// Latency alert
+	if stats.HasLatency && thresholds.HTTPLatencyP95 > 0 && float64(stats.P95) > thresholds.HTTPLatencyP95 {
+		m.RaiseAlert(AlertHTTPLatency, "warning", fmt.Sprintf("95th percentile request time is %dms in the last %d minutes", stats.P95, stats.Minutes))
+	} else {
+		m.ResolveAlerts(AlertHTTPLatency)
+	}
+}
+
+// CheckErrorGroups raises an alert for every fatal error group that shows up
+// for the first time. Each group gets its own alert, so a second broken plugin
+// is not hidden behind the alert of the first.
+func (m *MonitorService) CheckErrorGroups(created []models.ErrorGroup) {
+	for _, group := range created {
+		if group.Level != models.ErrorLevelFatal {
+			continue
+		}
+
+		location := group.Source
+		if group.File != "" {
+			location = fmt.Sprintf("%s:%d", group.File, group.Line)
+		}
+		if group.Component != "" {
+			location = fmt.Sprintf("%s (%s)", location, group.Component)
+		}
+		m.RaiseAlert(errorGroupAlert(group.ID), "critical", fmt.Sprintf("New PHP fatal error in %s: %s", location, group.Message))
+	}
+}
+
+// ResolveErrorGroup resolves the alert of an error group once it is
+// acknowledged
+func (m *MonitorService) ResolveErrorGroup(id string) error {
+	return m.ResolveAlerts(errorGroupAlert(id))
+}
+
+// CheckConfigVersion raises an alert while a config.php change made outside
+// lms-manager is pending, resolved once the change is accepted, and a
+// critical one for as long as the latest version shows debug messages to
+// users, whether accepted or not.
+func (m *MonitorService) CheckConfigVersion(pending, latest *models.ConfigVersion) {
+	if pending == nil {
+		m.ResolveAlerts(AlertConfigChanged)
+	} else {
+		message := fmt.Sprintf("config.php changed outside lms-manager at %s", pending.CreatedAt.Format("2006-01-02 15:04:05"))
+		if pending.ChangedBy != "" {
+			message += fmt.Sprintf(" (file owned by %s)", pending.ChangedBy)
+		}
+		m.RaiseAlert(AlertConfigChanged, "warning", message)
+	}
+
+	if latest != nil && latest.DebugDisplay {
+		m.RaiseAlert(AlertConfigDebugDisplay, "critical", "$CFG->debugdisplay is enabled in config.php: debug messages are shown to users")
+	} else {
+		m.ResolveAlerts(AlertConfigDebugDisplay)
+	}
+}
+
+// CheckTaskHealth raises or resolves the alerts for failing and overdue
+// scheduled tasks and stuck adhoc task queues
+func (m *MonitorService) CheckTaskHealth(health *models.TaskHealth) {
+	var failing, overdue, stuck []string
+	for _, task := range health.Failing {
+		failing = append(failing, fmt.Sprintf("%s (retry in %s)", task.Classname, utils.FormatDuration(task.FailDelay)))
+	}
+	for _, queue := range health.Adhoc {
+		if queue.Failing > 0 {
+			failing = append(failing, fmt.Sprintf("%s (%d adhoc)", queue.Classname, queue.Failing))
+		}
+		if queue.Stuck {
+			stuck = append(stuck, fmt.Sprintf("%s has %d due, oldest waiting %s", queue.Classname, queue.Due, utils.FormatDuration(queue.OldestAge)))
+		}
+	}
+	for _, task := range health.Overdue {
+		overdue = append(overdue, fmt.Sprintf("%s (%s late)", task.Classname, utils.FormatDuration(task.Overdue)))
+	}
+
+	// Failing task alert
+	if len(failing) > 0 {
+		m.RaiseAlert(AlertTaskFailing, "warning", "Moodle tasks are failing: "+joinTasks(failing))
+	} else {
+		m.ResolveAlerts(AlertTaskFailing)
+	}
+
+	// Overdue task alert
+	if len(overdue) > 0 {
+		m.RaiseAlert(AlertTaskOverdue, "warning", "Moodle scheduled tasks are overdue: "+joinTasks(overdue))
+	} else {
+		m.ResolveAlerts(AlertTaskOverdue)
+	}
+
+	// Adhoc queue alert
+	if len(stuck) > 0 {
+		m.RaiseAlert(AlertAdhocQueueStuck, "critical", "Moodle adhoc task queue is stuck: "+joinTasks(stuck))
+	} else {
+		m.ResolveAlerts(AlertAdhocQueueStuck)
+	}
+}
+
+// RecordWebMetrics attaches the web tier metrics to the system stats and
+// stores them in the monitoring history
+func (m *MonitorService) RecordWebMetrics(metrics *models.PerformanceMetrics) {
+	m.mu.Lock()
+	m.web = metrics
+	stats := *m.stats
+	stats.Web = metrics
+	m.stats = &stats
+	m.mu.Unlock()
+
+	if m.db == nil {
+		return
+	}
+
+	metricsJSON, err := json.Marshal(metrics)
+	if err != nil {
+		utils.Error("Failed to marshal web metrics: %v", err)
+		return
+	}
+
+	_, err = m.db.Exec(`
+		INSERT INTO system_logs (id, level, message, source, data, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, utils.GenerateID(), "INFO", "Web tier metrics updated", m.scoped(webMetricsSource), string(metricsJSON), metrics.Timestamp)
+	if err != nil {
+		utils.Error("Failed to log web metrics: %v", err)
+	}
+}
+
+// GetWebMetricsHistory returns the most recent web tier metrics, newest first
+func (m *MonitorService) GetWebMetricsHistory(limit int) ([]models.PerformanceMetrics, error) {
+	if m.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	if limit <= 0 {
+		limit = 100
+	}
+
+	rows, err := m.db.Query(`
+		SELECT data
+		FROM system_logs
+		WHERE source = ?
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, m.scoped(webMetricsSource), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []models.PerformanceMetrics{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var metrics models.PerformanceMetrics
+		if err := json.Unmarshal([]byte(data), &metrics); err != nil {
+			continue
+		}
+		history = append(history, metrics)
+	}
+
+	return history, rows.Err()
+}
+
+// GetSystemStatsHistory returns the host stats logged since a time, oldest
+// first
+func (m *MonitorService) GetSystemStatsHistory(since time.Time) ([]models.SystemStats, error) {
+	if m.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	rows, err := m.db.Query(`
+		SELECT data, created_at
+		FROM system_logs
+		WHERE source = ? AND created_at >= ?
+		ORDER BY created_at
+	`, systemStatsSource, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []models.SystemStats{}
+	for rows.Next() {
+		var data string
+		var createdAt time.Time
+		if err := rows.Scan(&data, &createdAt); err != nil {
+			return nil, err
+		}
+
+		var stats models.SystemStats
+		if err := json.Unmarshal([]byte(data), &stats); err != nil {
+			continue
+		}
+		stats.Timestamp = createdAt
+		history = append(history, stats)
+	}
+
+	return history, rows.Err()
+}
+
 // logStats logs system stats to database
 func (m *MonitorService) logStats(stats *models.SystemStats) {
 	if m.db == nil {
@@ -204,7 +543,7 @@ func (m *MonitorService) logStats(stats *models.SystemStats) {
 	_, err = m.db.Exec(`
 		INSERT INTO system_logs (id, level, message, source, data, created_at)
 		VALUES (?, ?, ?, ?, ?, ?)
-	`, utils.GenerateID(), "INFO", "System stats updated", "monitor", string(statsJSON), time.Now())
+	`, utils.GenerateID(), "INFO", "System stats updated", systemStatsSource, string(statsJSON), time.Now())
 
 	if err != nil {
 		utils.Error("Failed to log stats: %v", err)
@@ -244,6 +583,37 @@ func (m *MonitorService) saveAlert(alert models.Alert) {
 	}
 }
 
+// RaiseAlert records an alert unless one of the same type is still unresolved
+func (m *MonitorService) RaiseAlert(alertType, severity, message string) {
+	if m.instance != "" {
+		message = fmt.Sprintf("[%s] %s", m.instance, message)
+	}
+
+	m.saveAlert(models.Alert{
+		ID:        utils.GenerateID(),
+		Type:      m.scoped(alertType),
+		Message:   message,
+		Severity:  severity,
+		Timestamp: time.Now(),
+		Resolved:  false,
+	})
+}
+
+// ResolveAlerts resolves all unresolved alerts of a type
+func (m *MonitorService) ResolveAlerts(alertType string) error {
+	if m.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	_, err := m.db.Exec(`
+		UPDATE alerts 
+		SET resolved = 1, resolved_at = ?
+		WHERE type = ? AND resolved = 0
+	`, time.Now(), m.scoped(alertType))
+
+	return err
+}
+
 // GetAlerts returns active alerts
 func (m *MonitorService) GetAlerts() ([]models.Alert, error) {
 	if m.db == nil {
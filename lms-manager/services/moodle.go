@@ -1,12 +1,20 @@
 package services
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"database/sql"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"lms-manager/config"
@@ -14,18 +22,44 @@ import (
 	"lms-manager/utils"
 )
 
+// moodlePrefixPattern matches valid $CFG->prefix values
+var moodlePrefixPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
 // MoodleService handles Moodle management
 type MoodleService struct {
-	config config.MoodleConfig
-	db     *sql.DB
-	status *models.MoodleStatus
+	config     config.MoodleConfig
+	db         *sql.DB
+	manager    ServiceManager
+	status     *models.MoodleStatus
+	lastErrors map[string]string
+	mu         sync.RWMutex
+
+	maintenance models.MaintenanceStatus
+
+	siteConfig        *models.MoodleSiteConfig
+	siteConfigModTime time.Time
+
+	storage      storageScanner
+	orphanReport *models.OrphanReport
+
+	procRoot string
+
+	cron *CronService
 }
 
 // NewMoodleService creates a new Moodle service
 func NewMoodleService(cfg config.MoodleConfig) *MoodleService {
+	manager, err := NewServiceManager(cfg.ServiceManager)
+	if err != nil {
+		utils.Warn("Falling back to systemd: %v", err)
+		manager = NewSystemdManager()
+	}
+
 	return &MoodleService{
-		config: cfg,
-		status: &models.MoodleStatus{},
+		config:     cfg,
+		manager:    manager,
+		status:     &models.MoodleStatus{},
+		lastErrors: make(map[string]string),
 	}
 }
 
@@ -34,51 +68,112 @@ func (m *MoodleService) SetDatabase(db *sql.DB) {
 	m.db = db
 }
 
+// Name returns the name of the Moodle instance
+func (m *MoodleService) Name() string {
+	if m.config.Name == "" {
+		return config.DefaultInstanceName
+	}
+	return m.config.Name
+}
+
+// Path returns the Moodle code directory of the instance
+func (m *MoodleService) Path() string {
+	return m.config.Path
+}
+
+// SetCronService sets the cron runner that is paused while Moodle is
+// upgraded
+func (m *MoodleService) SetCronService(cron *CronService) {
+	m.cron = cron
+}
+
+// SetServiceManager replaces the service manager backend
+func (m *MoodleService) SetServiceManager(manager ServiceManager) {
+	m.manager = manager
+}
+
 // GetStatus returns the current Moodle status
 func (m *MoodleService) GetStatus() *models.MoodleStatus {
 	status := &models.MoodleStatus{
-		LastCheck: time.Now(),
+		LastCheck:   time.Now(),
+		Maintenance: m.GetMaintenanceStatus(),
 	}
 
-	// Check if Moodle is running
-	running, err := m.isMoodleRunning()
+	components, err := m.components()
 	if err != nil {
 		status.Error = err.Error()
 		return status
 	}
 
-	status.Running = running
+	// Moodle is running only when every component is up
+	status.Running = len(components) > 0
+	for _, component := range components {
+		componentStatus := m.getComponentStatus(component)
+		status.Components = append(status.Components, componentStatus)
+
+		if componentStatus.State != models.ComponentRunning {
+			status.Running = false
+			if status.Error == "" && componentStatus.LastError != "" {
+				status.Error = fmt.Sprintf("%s: %s", component.Name, componentStatus.LastError)
+			}
+		}
+	}
 
-	if running {
+	if status.Running {
 		// Get version
-		version, err := m.getMoodleVersion()
+		version, err := m.GetVersion()
 		if err != nil {
 			status.Error = err.Error()
 		} else {
-			status.Version = version
+			status.Version = version.Release
 		}
 
-		// Get process ID
-		pid, err := m.getMoodlePID()
-		if err != nil {
-			status.Error = err.Error()
-		} else {
-			status.ProcessID = pid
+		// The web server stands for the stack's process ID and uptime
+		for _, componentStatus := range status.Components {
+			if componentStatus.Type == config.ComponentWeb {
+				status.ProcessID = componentStatus.PID
+				status.Uptime = componentStatus.Uptime
+				break
+			}
 		}
+	}
 
-		// Get uptime
-		uptime, err := m.getMoodleUptime()
-		if err != nil {
-			status.Error = err.Error()
-		} else {
-			status.Uptime = uptime
+	return status
+}
+
+// getComponentStatus returns the state, PID, uptime and last error of a component
+func (m *MoodleService) getComponentStatus(component config.ComponentConfig) models.ComponentStatus {
+	status := models.ComponentStatus{
+		Name:      component.Name,
+		Type:      component.Type,
+		Unit:      component.Unit,
+		State:     models.ComponentUnknown,
+		LastError: m.getLastError(component.Name),
+	}
+
+	unitStatus, err := m.manager.Status(component.Unit)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+
+	switch {
+	case unitStatus.Active:
+		status.State = models.ComponentRunning
+		status.PID = unitStatus.PID
+		if !unitStatus.Since.IsZero() {
+			status.Uptime = int64(time.Since(unitStatus.Since).Seconds())
 		}
+	case unitStatus.State == "failed" || status.LastError != "":
+		status.State = models.ComponentFailed
+	default:
+		status.State = models.ComponentStopped
 	}
 
 	return status
 }
 
-// Start starts Moodle
+// Start starts the Moodle stack in dependency order, rolling back on failure
 func (m *MoodleService) Start() error {
 	// Check if Moodle is already running
 	if running, _ := m.isMoodleRunning(); running {
@@ -95,68 +190,102 @@ func (m *MoodleService) Start() error {
 		return fmt.Errorf("Moodle config file does not exist: %s", m.config.ConfigPath)
 	}
 
-	// Start web server (assuming Nginx)
-	cmd := exec.Command("systemctl", "start", "nginx")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to start Nginx: %v", err)
+	components, err := m.components()
+	if err != nil {
+		return err
 	}
 
-	// Start PHP-FPM
-	cmd = exec.Command("systemctl", "start", "php8.1-fpm")
-	if err := cmd.Run(); err != nil {
-		// Try different PHP versions
-		cmd = exec.Command("systemctl", "start", "php8.0-fpm")
-		if err := cmd.Run(); err != nil {
-			cmd = exec.Command("systemctl", "start", "php7.4-fpm")
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("failed to start PHP-FPM: %v", err)
-			}
+	var started []config.ComponentConfig
+	for _, component := range components {
+		// Leave components that are already up alone
+		if active, err := m.manager.IsActive(component.Unit); err == nil && active {
+			continue
 		}
-	}
 
-	// Start MariaDB/MySQL
-	cmd = exec.Command("systemctl", "start", "mariadb")
-	if err := cmd.Run(); err != nil {
-		cmd = exec.Command("systemctl", "start", "mysql")
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to start database: %v", err)
+		if err := m.manager.Start(component.Unit); err != nil {
+			m.setLastError(component.Name, err)
+			m.rollback(started)
+			return fmt.Errorf("failed to start %s (%s): %v", component.Name, component.Unit, err)
 		}
+
+		m.setLastError(component.Name, nil)
+		started = append(started, component)
 	}
 
 	utils.Info("Moodle started successfully")
 	return nil
 }
 
-// Stop stops Moodle
-func (m *MoodleService) Stop() error {
-	// Check if Moodle is running
-	if running, _ := m.isMoodleRunning(); !running {
-		return fmt.Errorf("Moodle is not running")
+// rollback stops the components started by a failed start in reverse order
+func (m *MoodleService) rollback(started []config.ComponentConfig) {
+	for i := len(started) - 1; i >= 0; i-- {
+		component := started[i]
+		if err := m.manager.Stop(component.Unit); err != nil {
+			m.setLastError(component.Name, err)
+			utils.Error("Failed to roll back %s (%s): %v", component.Name, component.Unit, err)
+			continue
+		}
+		utils.Warn("Rolled back %s (%s)", component.Name, component.Unit)
 	}
+}
 
-	// Stop web server
-	cmd := exec.Command("systemctl", "stop", "nginx")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to stop Nginx: %v", err)
+// Stop stops the Moodle stack in reverse dependency order. A component is
+// kept running while anything that depends on it failed to stop.
+func (m *MoodleService) Stop() error {
+	components, err := m.components()
+	if err != nil {
+		return err
 	}
 
-	// Stop PHP-FPM
-	cmd = exec.Command("systemctl", "stop", "php8.1-fpm")
-	if err := cmd.Run(); err != nil {
-		// Try different PHP versions
-		cmd = exec.Command("systemctl", "stop", "php8.0-fpm")
-		if err := cmd.Run(); err != nil {
-			cmd = exec.Command("systemctl", "stop", "php7.4-fpm")
-			if err := cmd.Run(); err != nil {
-				return fmt.Errorf("failed to stop PHP-FPM: %v", err)
-			}
+	var errs []string
+	stopped := 0
+	blocked := make(map[string]string)
+
+	for i := len(components) - 1; i >= 0; i-- {
+		component := components[i]
+
+		if dependent, isBlocked := blocked[component.Name]; isBlocked {
+			errs = append(errs, fmt.Sprintf("%s: skipped because %s is still running", component.Name, dependent))
+			m.blockDependencies(blocked, component)
+			continue
 		}
+
+		if active, err := m.manager.IsActive(component.Unit); err == nil && !active {
+			continue
+		}
+
+		if err := m.manager.Stop(component.Unit); err != nil {
+			m.setLastError(component.Name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", component.Name, err))
+			m.blockDependencies(blocked, component)
+			continue
+		}
+
+		m.setLastError(component.Name, nil)
+		stopped++
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to stop Moodle: %s", strings.Join(errs, "; "))
+	}
+
+	if stopped == 0 {
+		return fmt.Errorf("Moodle is not running")
 	}
 
 	utils.Info("Moodle stopped successfully")
 	return nil
 }
 
+// blockDependencies marks the dependencies of a still running component
+func (m *MoodleService) blockDependencies(blocked map[string]string, component config.ComponentConfig) {
+	for _, dependency := range m.config.Dependencies(component) {
+		if _, exists := blocked[dependency]; !exists {
+			blocked[dependency] = component.Name
+		}
+	}
+}
+
 // Restart restarts Moodle
 func (m *MoodleService) Restart() error {
 	// Stop first
@@ -176,145 +305,107 @@ func (m *MoodleService) Restart() error {
 	return nil
 }
 
-// isMoodleRunning checks if Moodle is running
-func (m *MoodleService) isMoodleRunning() (bool, error) {
-	// Check if Nginx is running
-	cmd := exec.Command("systemctl", "is-active", "nginx")
-	output, err := cmd.Output()
+// components returns the stack components in dependency order
+func (m *MoodleService) components() ([]config.ComponentConfig, error) {
+	components, err := m.config.StartOrder()
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
-	if strings.TrimSpace(string(output)) != "active" {
-		return false, nil
+	if len(components) == 0 {
+		return nil, fmt.Errorf("no Moodle components configured")
 	}
 
-	// Check if PHP-FPM is running
-	cmd = exec.Command("systemctl", "is-active", "php8.1-fpm")
-	output, err = cmd.Output()
-	if err != nil {
-		// Try different PHP versions
-		cmd = exec.Command("systemctl", "is-active", "php8.0-fpm")
-		output, err = cmd.Output()
-		if err != nil {
-			cmd = exec.Command("systemctl", "is-active", "php7.4-fpm")
-			output, err = cmd.Output()
-			if err != nil {
-				return false, err
-			}
-		}
-	}
+	return components, nil
+}
 
-	if strings.TrimSpace(string(output)) != "active" {
-		return false, nil
-	}
+// getLastError returns the last start/stop error of a component
+func (m *MoodleService) getLastError(name string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastErrors[name]
+}
 
-	// Check if database is running
-	cmd = exec.Command("systemctl", "is-active", "mariadb")
-	output, err = cmd.Output()
-	if err != nil {
-		cmd = exec.Command("systemctl", "is-active", "mysql")
-		output, err = cmd.Output()
-		if err != nil {
-			return false, err
-		}
-	}
+// setLastError records or clears the last start/stop error of a component
+func (m *MoodleService) setLastError(name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	if strings.TrimSpace(string(output)) != "active" {
-		return false, nil
+	if err == nil {
+		delete(m.lastErrors, name)
+		return
 	}
-
-	return true, nil
+	m.lastErrors[name] = err.Error()
 }
 
-// getMoodleVersion gets the Moodle version
-func (m *MoodleService) getMoodleVersion() (string, error) {
-	// Read version.php file
-	versionFile := filepath.Join(m.config.Path, "version.php")
-	if !utils.FileExists(versionFile) {
-		return "", fmt.Errorf("version.php not found")
-	}
-
-	// Read file content
-	content, err := os.ReadFile(versionFile)
+// isMoodleRunning checks if every stack component is active
+func (m *MoodleService) isMoodleRunning() (bool, error) {
+	components, err := m.components()
 	if err != nil {
-		return "", err
+		return false, err
 	}
 
-	// Parse version
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "$version") {
-			// Extract version number
-			parts := strings.Split(line, "=")
-			if len(parts) >= 2 {
-				version := strings.TrimSpace(parts[1])
-				version = strings.Trim(version, ";")
-				version = strings.Trim(version, " ")
-				return version, nil
-			}
+	for _, component := range components {
+		active, err := m.manager.IsActive(component.Unit)
+		if err != nil {
+			return false, fmt.Errorf("failed to check %s (%s): %v", component.Name, component.Unit, err)
+		}
+		if !active {
+			return false, nil
 		}
 	}
 
-	return "", fmt.Errorf("version not found in version.php")
+	return true, nil
 }
 
-// getMoodlePID gets the Moodle process ID
-func (m *MoodleService) getMoodlePID() (int, error) {
-	// Get Nginx PID
-	cmd := exec.Command("pgrep", "nginx")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, err
+// GetVersion parses version.php and looks up the branch support lifecycle
+func (m *MoodleService) GetVersion() (*models.MoodleVersion, error) {
+	versionFile := filepath.Join(m.config.Path, "version.php")
+	if !utils.FileExists(versionFile) {
+		return nil, fmt.Errorf("version.php not found")
 	}
 
-	pidStr := strings.TrimSpace(string(output))
-	pid, err := utils.ParseInt(pidStr)
+	version, err := ParseMoodleVersion(versionFile)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return pid, nil
+	version.Support = LookupMoodleSupport(version.Branch, time.Now())
+	return version, nil
 }
 
-// getMoodleUptime gets the Moodle uptime
-func (m *MoodleService) getMoodleUptime() (int64, error) {
-	// Get Nginx uptime
-	cmd := exec.Command("systemctl", "show", "nginx", "--property=ActiveEnterTimestamp")
-	output, err := cmd.Output()
+// GetPlugins returns the installed plugins and flags those requiring a newer
+// core version
+func (m *MoodleService) GetPlugins() (*models.MoodlePluginInventory, error) {
+	inventory, err := ScanMoodlePlugins(m.config.Path)
 	if err != nil {
-		return 0, err
-	}
-
-	// Parse timestamp
-	line := strings.TrimSpace(string(output))
-	if !strings.HasPrefix(line, "ActiveEnterTimestamp=") {
-		return 0, fmt.Errorf("invalid timestamp format")
+		return nil, err
 	}
 
-	timestampStr := strings.TrimPrefix(line, "ActiveEnterTimestamp=")
-	timestamp, err := time.Parse("Mon 2006-01-02 15:04:05 MST", timestampStr)
+	version, err := m.GetVersion()
 	if err != nil {
-		return 0, err
+		inventory.Warnings = append(inventory.Warnings, fmt.Sprintf("Plugin requirements not checked: %v", err))
+		return inventory, nil
 	}
 
-	uptime := time.Since(timestamp)
-	return int64(uptime.Seconds()), nil
+	CheckPluginRequirements(inventory, version)
+	return inventory, nil
 }
 
 // GetMoodleInfo gets detailed Moodle information
 func (m *MoodleService) GetMoodleInfo() (map[string]interface{}, error) {
 	info := make(map[string]interface{})
+	dataPath := m.dataPath()
 
 	// Basic info
 	info["path"] = m.config.Path
 	info["config_path"] = m.config.ConfigPath
-	info["data_path"] = m.config.DataPath
+	info["data_path"] = dataPath
 
 	// Check if directories exist
 	info["path_exists"] = utils.FileExists(m.config.Path)
 	info["config_exists"] = utils.FileExists(m.config.ConfigPath)
-	info["data_exists"] = utils.FileExists(m.config.DataPath)
+	info["data_exists"] = dataPath != "" && utils.FileExists(dataPath)
 
 	// Get sizes
 	if utils.FileExists(m.config.Path) {
@@ -324,16 +415,25 @@ func (m *MoodleService) GetMoodleInfo() (map[string]interface{}, error) {
 		}
 	}
 
-	if utils.FileExists(m.config.DataPath) {
-		size, err := utils.GetDirectorySize(m.config.DataPath)
-		if err == nil {
-			info["data_size"] = utils.FormatBytes(size)
+	// moodledata can be too large to walk on every request
+	if dataPath != "" && utils.FileExists(dataPath) {
+		if report, err := m.GetStorageReport(false); err == nil && report.ScannedAt != nil {
+			info["data_size"] = utils.FormatBytes(report.Size)
 		}
 	}
 
-	// Get version
-	if version, err := m.getMoodleVersion(); err == nil {
-		info["version"] = version
+	// Get site settings from config.php
+	if site, err := m.GetSiteConfig(); err == nil {
+		info["wwwroot"] = site.WWWRoot
+		info["dbtype"] = site.DBType
+		info["debug_level"] = site.DebugLevel
+	}
+
+	// Get version and support lifecycle
+	if version, err := m.GetVersion(); err == nil {
+		info["version"] = version.Release
+		info["version_info"] = version
+		info["warnings"] = MoodleVersionWarnings(version)
 	}
 
 	// Get status
@@ -345,58 +445,403 @@ func (m *MoodleService) GetMoodleInfo() (map[string]interface{}, error) {
 	return info, nil
 }
 
-// BackupMoodle creates a backup of Moodle
+// GetSiteConfig returns the parsed config.php, re-reading it when it changes
+func (m *MoodleService) GetSiteConfig() (*models.MoodleSiteConfig, error) {
+	fileInfo, err := os.Stat(m.config.ConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("Moodle config file does not exist: %s", m.config.ConfigPath)
+	}
+
+	m.mu.RLock()
+	cached, cachedModTime := m.siteConfig, m.siteConfigModTime
+	m.mu.RUnlock()
+
+	if cached != nil && cachedModTime.Equal(fileInfo.ModTime()) {
+		return cached, nil
+	}
+
+	site, err := ParseMoodleConfig(m.config.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.siteConfig = site
+	m.siteConfigModTime = fileInfo.ModTime()
+	m.mu.Unlock()
+
+	return site, nil
+}
+
+// dataPath returns the configured moodledata path, falling back to $CFG->dataroot
+func (m *MoodleService) dataPath() string {
+	if m.config.DataPath != "" {
+		return m.config.DataPath
+	}
+
+	if site, err := m.GetSiteConfig(); err == nil {
+		return site.DataRoot
+	}
+
+	return ""
+}
+
+// BackupMoodle creates a backup of the Moodle code and database
 func (m *MoodleService) BackupMoodle(backupPath string) error {
+	_, _, err := m.backup(backupPath, false)
+	return err
+}
+
+// backup writes a code archive and, when config.php can be read, a database
+// dump to backupPath. It returns the paths of both files; the database dump
+// is mandatory when requireDatabase is set.
+func (m *MoodleService) backup(backupPath string, requireDatabase bool) (string, string, error) {
 	if !utils.FileExists(m.config.Path) {
-		return fmt.Errorf("Moodle directory does not exist")
+		return "", "", fmt.Errorf("Moodle directory does not exist")
 	}
 
 	// Create backup directory
 	if err := os.MkdirAll(backupPath, 0755); err != nil {
-		return fmt.Errorf("failed to create backup directory: %v", err)
+		return "", "", fmt.Errorf("failed to create backup directory: %v", err)
 	}
 
 	// Create tar backup
-	backupFile := filepath.Join(backupPath, fmt.Sprintf("moodle-backup-%s.tar.gz", time.Now().Format("2006-01-02-15-04-05")))
-	
+	timestamp := time.Now().Format("2006-01-02-15-04-05")
+	backupFile := filepath.Join(backupPath, fmt.Sprintf("moodle-backup-%s.tar.gz", timestamp))
+
 	cmd := exec.Command("tar", "-czf", backupFile, "-C", filepath.Dir(m.config.Path), filepath.Base(m.config.Path))
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create backup: %v", err)
+		return "", "", fmt.Errorf("failed to create backup: %v", err)
 	}
 
 	utils.Info("Moodle backup created: %s", backupFile)
+
+	// Dump the database with the credentials from config.php
+	site, err := m.GetSiteConfig()
+	if err != nil {
+		if requireDatabase {
+			return backupFile, "", fmt.Errorf("failed to back up database: %v", err)
+		}
+		utils.Warn("Skipping database backup: %v", err)
+		return backupFile, "", nil
+	}
+
+	dumpFile := filepath.Join(backupPath, fmt.Sprintf("moodle-db-%s.sql.gz", timestamp))
+	if err := dumpDatabase(site, dumpFile); err != nil {
+		return backupFile, "", fmt.Errorf("failed to back up database: %v", err)
+	}
+
+	utils.Info("Moodle database backup created: %s", dumpFile)
+	return backupFile, dumpFile, nil
+}
+
+// dumpDatabase writes a gzipped SQL dump of the Moodle database
+func dumpDatabase(site *models.MoodleSiteConfig, dumpFile string) error {
+	var cmd *exec.Cmd
+
+	switch site.DBType {
+	case "mysqli", "mariadb", "auroramysql":
+		args := []string{"--single-transaction", "--skip-lock-tables", "--default-character-set=utf8mb4", "-h", site.DBHost, "-u", site.DBUser}
+		if site.DBPort > 0 {
+			args = append(args, "-P", strconv.Itoa(site.DBPort))
+		}
+		if site.DBSocket != "" {
+			args = append(args, "-S", site.DBSocket)
+		}
+		cmd = exec.Command("mysqldump", append(args, site.DBName)...)
+		cmd.Env = append(os.Environ(), "MYSQL_PWD="+site.DBPass)
+	case "pgsql":
+		args := []string{"--no-owner", "-h", site.DBHost, "-U", site.DBUser, "-d", site.DBName}
+		if site.DBPort > 0 {
+			args = append(args, "-p", strconv.Itoa(site.DBPort))
+		}
+		cmd = exec.Command("pg_dump", args...)
+		cmd.Env = append(os.Environ(), "PGPASSWORD="+site.DBPass)
+	default:
+		return fmt.Errorf("unsupported database type: %s", site.DBType)
+	}
+
+	file, err := os.OpenFile(dumpFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := gzip.NewWriter(file)
+	var stderr strings.Builder
+	cmd.Stdout = writer
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(dumpFile)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return writer.Close()
+}
+
+// restoreDatabase replaces the Moodle tables with a gzipped SQL dump written
+// by dumpDatabase. Tables with the Moodle prefix are dropped first so that
+// tables created after the dump do not survive the restore.
+func restoreDatabase(site *models.MoodleSiteConfig, dumpFile string) error {
+	if !moodlePrefixPattern.MatchString(site.Prefix) {
+		return fmt.Errorf("invalid table prefix: %q", site.Prefix)
+	}
+
+	// Underscores are LIKE wildcards
+	pattern := strings.ReplaceAll(site.Prefix, "_", `\_`) + "%"
+
+	var listQuery, dropQuery string
+	switch site.DBType {
+	case "mysqli", "mariadb", "auroramysql":
+		listQuery = fmt.Sprintf("SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name LIKE '%s'", pattern)
+		dropQuery = "SET FOREIGN_KEY_CHECKS = 0; DROP TABLE IF EXISTS %s;"
+	case "pgsql":
+		listQuery = fmt.Sprintf("SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename LIKE '%s'", pattern)
+		dropQuery = "DROP TABLE IF EXISTS %s CASCADE;"
+	default:
+		return fmt.Errorf("unsupported database type: %s", site.DBType)
+	}
+
+	output, err := runDatabaseClient(site, nil, listQuery)
+	if err != nil {
+		return fmt.Errorf("failed to list tables: %v", err)
+	}
+
+	var tables []string
+	for _, table := range strings.Fields(output) {
+		if site.DBType == "pgsql" {
+			tables = append(tables, `"`+table+`"`)
+		} else {
+			tables = append(tables, "`"+table+"`")
+		}
+	}
+
+	if len(tables) > 0 {
+		if _, err := runDatabaseClient(site, nil, fmt.Sprintf(dropQuery, strings.Join(tables, ", "))); err != nil {
+			return fmt.Errorf("failed to drop tables: %v", err)
+		}
+	}
+
+	file, err := os.Open(dumpFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read database dump: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := runDatabaseClient(site, reader, ""); err != nil {
+		return fmt.Errorf("failed to import database dump: %v", err)
+	}
+
 	return nil
 }
 
+// runDatabaseClient runs a query, or the SQL read from input when query is
+// empty, with the mysql or psql client and returns its output
+func runDatabaseClient(site *models.MoodleSiteConfig, input io.Reader, query string) (string, error) {
+	var cmd *exec.Cmd
+
+	switch site.DBType {
+	case "mysqli", "mariadb", "auroramysql":
+		args := []string{"-N", "-B", "--default-character-set=utf8mb4", "-h", site.DBHost, "-u", site.DBUser}
+		if site.DBPort > 0 {
+			args = append(args, "-P", strconv.Itoa(site.DBPort))
+		}
+		if site.DBSocket != "" {
+			args = append(args, "-S", site.DBSocket)
+		}
+		if query != "" {
+			args = append(args, "-e", query)
+		}
+		cmd = exec.Command("mysql", append(args, site.DBName)...)
+		cmd.Env = append(os.Environ(), "MYSQL_PWD="+site.DBPass)
+	case "pgsql":
+		args := []string{"-X", "-q", "-A", "-t", "-v", "ON_ERROR_STOP=1", "-h", site.DBHost, "-U", site.DBUser, "-d", site.DBName}
+		if site.DBPort > 0 {
+			args = append(args, "-p", strconv.Itoa(site.DBPort))
+		}
+		if query != "" {
+			args = append(args, "-c", query)
+		}
+		cmd = exec.Command("psql", args...)
+		cmd.Env = append(os.Environ(), "PGPASSWORD="+site.DBPass)
+	default:
+		return "", fmt.Errorf("unsupported database type: %s", site.DBType)
+	}
+
+	var stdout, stderr strings.Builder
+	cmd.Stdin = input
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
 // RestoreMoodle restores Moodle from backup
 func (m *MoodleService) RestoreMoodle(backupFile string) error {
 	if !utils.FileExists(backupFile) {
 		return fmt.Errorf("backup file does not exist: %s", backupFile)
 	}
 
-	// Stop Moodle first
-	if err := m.Stop(); err != nil {
-		utils.Warn("Failed to stop Moodle: %v", err)
-	}
+	// Keep users out until the restored site is back up
+	err := m.withMaintenance("This site is being restored from a backup. Please try again later.", func() error {
+		// Stop Moodle first
+		if err := m.Stop(); err != nil {
+			utils.Warn("Failed to stop Moodle: %v", err)
+		}
 
-	// Remove existing Moodle directory
-	if utils.FileExists(m.config.Path) {
-		if err := os.RemoveAll(m.config.Path); err != nil {
-			return fmt.Errorf("failed to remove existing Moodle directory: %v", err)
+		// Remove existing Moodle directory
+		if utils.FileExists(m.config.Path) {
+			if err := os.RemoveAll(m.config.Path); err != nil {
+				return fmt.Errorf("failed to remove existing Moodle directory: %v", err)
+			}
 		}
-	}
 
-	// Extract backup
-	cmd := exec.Command("tar", "-xzf", backupFile, "-C", filepath.Dir(m.config.Path))
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to extract backup: %v", err)
-	}
+		// Extract backup
+		cmd := exec.Command("tar", "-xzf", backupFile, "-C", filepath.Dir(m.config.Path))
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to extract backup: %v", err)
+		}
 
-	// Start Moodle
-	if err := m.Start(); err != nil {
-		return fmt.Errorf("failed to start Moodle after restore: %v", err)
+		// Start Moodle
+		if err := m.Start(); err != nil {
+			return fmt.Errorf("failed to start Moodle after restore: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	utils.Info("Moodle restored from backup: %s", backupFile)
 	return nil
 }
+
+// runMoodleCLI runs a Moodle CLI script as the web server user and returns its output
+func (m *MoodleService) runMoodleCLI(script string, args ...string) (string, error) {
+	cmd, err := m.moodleCLICommand(script, args...)
+	if err != nil {
+		return "", err
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return string(output), fmt.Errorf("%s failed: %v: %s", script, err, strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
+
+// runMoodleCLIInput runs a Moodle CLI script as the web server user,
+// answering its prompts with input, and returns its output. Secrets passed
+// this way never show in the process list. The script is killed when ctx is
+// done.
+func (m *MoodleService) runMoodleCLIInput(ctx context.Context, input, script string, args ...string) (string, error) {
+	cmd, err := m.moodleCLICommand(script, args...)
+	if err != nil {
+		return "", err
+	}
+
+	var output bytes.Buffer
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := runCommand(ctx, cmd); err != nil {
+		return output.String(), fmt.Errorf("%s failed: %v: %s", script, err, strings.TrimSpace(output.String()))
+	}
+
+	return output.String(), nil
+}
+
+// moodleCLICommand builds the command running a Moodle CLI script as the web server user
+func (m *MoodleService) moodleCLICommand(script string, args ...string) (*exec.Cmd, error) {
+	return m.moodleCLICommandIn(m.config.Path, script, args...)
+}
+
+// moodleCLICommandIn builds the command running a CLI script of the Moodle
+// code tree at root, e.g. a staged upgrade
+func (m *MoodleService) moodleCLICommandIn(root, script string, args ...string) (*exec.Cmd, error) {
+	scriptPath := filepath.Join(root, script)
+	if !utils.FileExists(scriptPath) {
+		return nil, fmt.Errorf("Moodle CLI script not found: %s", script)
+	}
+
+	php := m.phpBinary()
+	phpArgs := append([]string{scriptPath}, args...)
+
+	var cmd *exec.Cmd
+	if m.config.WebUser != "" && os.Geteuid() == 0 {
+		// Never run Moodle as root, it would leave root-owned cache files behind
+		cmd = exec.Command("sudo", append([]string{"-u", m.config.WebUser, php}, phpArgs...)...)
+	} else {
+		cmd = exec.Command(php, phpArgs...)
+	}
+	cmd.Dir = root
+
+	return cmd, nil
+}
+
+// runMoodlePHP runs PHP code as the web server user after bootstrapping
+// Moodle as a CLI script, for core APIs no CLI script or web service
+// exposes. PHP is killed when ctx is done.
+func (m *MoodleService) runMoodlePHP(ctx context.Context, code string) (string, error) {
+	if !utils.FileExists(filepath.Join(m.config.Path, "config.php")) {
+		return "", fmt.Errorf("config.php not found in %s", m.config.Path)
+	}
+
+	script := "define('CLI_SCRIPT', true); require('config.php'); " + code
+
+	var cmd *exec.Cmd
+	if m.config.WebUser != "" && os.Geteuid() == 0 {
+		cmd = exec.Command("sudo", "-u", m.config.WebUser, m.phpBinary(), "-r", script)
+	} else {
+		cmd = exec.Command(m.phpBinary(), "-r", script)
+	}
+	cmd.Dir = m.config.Path
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := runCommand(ctx, cmd); err != nil {
+		return output.String(), fmt.Errorf("PHP failed: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	return output.String(), nil
+}
+
+// runCommand runs a command in its own process group and kills the whole
+// group when the context is done, so PHP started through sudo is stopped too
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return ctx.Err()
+	}
+}
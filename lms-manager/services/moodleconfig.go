@@ -0,0 +1,606 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"lms-manager/models"
+)
+
+// redactedValue replaces secrets in API responses
+const redactedValue = "********"
+
+// phpConstants holds the PHP and Moodle constants commonly used in config.php
+var phpConstants = map[string]int64{
+	"E_ERROR":          1,
+	"E_WARNING":        2,
+	"E_PARSE":          4,
+	"E_NOTICE":         8,
+	"E_STRICT":         2048,
+	"E_DEPRECATED":     8192,
+	"E_ALL":            32767,
+	"DEBUG_NONE":       0,
+	"DEBUG_MINIMAL":    5,
+	"DEBUG_NORMAL":     15,
+	"DEBUG_ALL":        30719,
+	"DEBUG_DEVELOPER":  32767,
+	"NO_DEBUG_DISPLAY": 1,
+	"MATURITY_ALPHA":   50,
+	"MATURITY_BETA":    100,
+	"MATURITY_RC":      150,
+	"MATURITY_STABLE":  200,
+	"PHP_INT_MAX":      9223372036854775807,
+}
+
+// secretSettings lists config.php settings that are always redacted
+var secretSettings = map[string]bool{
+	"dbpass":             true,
+	"passwordsaltmain":   true,
+	"session_redis_auth": true,
+}
+
+// IsSecretSetting reports whether a config.php setting must not be exposed
+func IsSecretSetting(name string) bool {
+	name = strings.ToLower(name)
+	if secretSettings[name] {
+		return true
+	}
+	for _, marker := range []string{"pass", "secret", "salt", "token", "apikey"} {
+		if strings.Contains(name, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMoodleConfig parses the $CFG assignments of a Moodle config.php file
+func ParseMoodleConfig(path string) (*models.MoodleSiteConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config.php: %v", err)
+	}
+
+	settings, err := parsePHPAssignments(string(content), "CFG", filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config.php: %v", err)
+	}
+
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("no $CFG settings found in %s", path)
+	}
+
+	return newMoodleSiteConfig(settings), nil
+}
+
+// RedactMoodleConfig returns a copy of the site config with secrets masked
+func RedactMoodleConfig(site *models.MoodleSiteConfig) *models.MoodleSiteConfig {
+	redacted := *site
+	if redacted.DBPass != "" {
+		redacted.DBPass = redactedValue
+	}
+
+	redacted.Settings = redactSettings(site.Settings)
+	return &redacted
+}
+
+// redactSettings masks secret keys in a settings map, including nested arrays
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			redacted[key] = redactSettings(typed)
+		default:
+			if IsSecretSetting(key) && value != nil && value != "" {
+				redacted[key] = redactedValue
+			} else {
+				redacted[key] = value
+			}
+		}
+	}
+	return redacted
+}
+
+// DebugLevelName returns the Moodle name of a $CFG->debug value
+func DebugLevelName(debug int) string {
+	switch {
+	case debug >= int(phpConstants["DEBUG_DEVELOPER"]):
+		return "developer"
+	case debug >= int(phpConstants["DEBUG_ALL"]):
+		return "all"
+	case debug >= int(phpConstants["DEBUG_NORMAL"]):
+		return "normal"
+	case debug >= int(phpConstants["DEBUG_MINIMAL"]):
+		return "minimal"
+	case debug > 0:
+		return "custom"
+	default:
+		return "none"
+	}
+}
+
+// newMoodleSiteConfig maps raw settings onto the typed site config
+func newMoodleSiteConfig(settings map[string]interface{}) *models.MoodleSiteConfig {
+	site := &models.MoodleSiteConfig{
+		DBType:              phpString(settings["dbtype"]),
+		DBLibrary:           phpString(settings["dblibrary"]),
+		DBHost:              phpString(settings["dbhost"]),
+		DBName:              phpString(settings["dbname"]),
+		DBUser:              phpString(settings["dbuser"]),
+		DBPass:              phpString(settings["dbpass"]),
+		Prefix:              phpString(settings["prefix"]),
+		WWWRoot:             strings.TrimRight(phpString(settings["wwwroot"]), "/"),
+		DataRoot:            phpString(settings["dataroot"]),
+		Admin:               phpString(settings["admin"]),
+		SSLProxy:            phpBool(settings["sslproxy"]),
+		ReverseProxy:        phpBool(settings["reverseproxy"]),
+		Debug:               int(phpInt(settings["debug"])),
+		DebugDisplay:        phpBool(settings["debugdisplay"]),
+		SessionHandlerClass: phpString(settings["session_handler_class"]),
+		Settings:            settings,
+	}
+
+	if site.Admin == "" {
+		site.Admin = "admin"
+	}
+	site.DebugLevel = DebugLevelName(site.Debug)
+
+	if options, ok := settings["dboptions"].(map[string]interface{}); ok {
+		site.DBPort = int(phpInt(options["dbport"]))
+		site.DBSocket = phpString(options["dbsocket"])
+	}
+
+	switch {
+	case strings.Contains(site.SessionHandlerClass, "redis"):
+		host := phpString(settings["session_redis_host"])
+		if port := phpInt(settings["session_redis_port"]); port > 0 {
+			host = fmt.Sprintf("%s:%d", host, port)
+		}
+		site.SessionSavePath = host
+	case strings.Contains(site.SessionHandlerClass, "memcached"):
+		site.SessionSavePath = phpString(settings["session_memcached_save_path"])
+	default:
+		site.SessionSavePath = phpString(settings["session_file_save_path"])
+	}
+
+	return site
+}
+
+// phpString converts a parsed PHP value to a string
+func phpString(value interface{}) string {
+	switch typed := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return typed
+	case bool:
+		if typed {
+			return "1"
+		}
+		return ""
+	case int64:
+		return strconv.FormatInt(typed, 10)
+	case float64:
+		return strconv.FormatFloat(typed, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", typed)
+	}
+}
+
+// phpInt converts a parsed PHP value to an integer
+func phpInt(value interface{}) int64 {
+	switch typed := value.(type) {
+	case int64:
+		return typed
+	case float64:
+		return int64(typed)
+	case bool:
+		if typed {
+			return 1
+		}
+	case string:
+		parsed, _ := strconv.ParseInt(strings.TrimSpace(typed), 10, 64)
+		return parsed
+	}
+	return 0
+}
+
+// phpBool converts a parsed PHP value using PHP truthiness
+func phpBool(value interface{}) bool {
+	switch typed := value.(type) {
+	case bool:
+		return typed
+	case int64:
+		return typed != 0
+	case float64:
+		return typed != 0
+	case string:
+		return typed != "" && typed != "0"
+	case map[string]interface{}:
+		return len(typed) > 0
+	}
+	return false
+}
+
+// phpToken is a lexical token of the PHP subset used in config files
+type phpToken struct {
+	kind  string // var, ident, string, number, op
+	value string
+}
+
+// tokenizePHP splits PHP source into tokens, skipping whitespace and comments
+func tokenizePHP(src string) ([]phpToken, error) {
+	var tokens []phpToken
+	src = strings.TrimPrefix(strings.TrimSpace(src), "<?php")
+
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '#' || (c == '/' && i+1 < len(src) && src[i+1] == '/'):
+			for i < len(src) && src[i] != '\n' {
+				if strings.HasPrefix(src[i:], "?>") {
+					break
+				}
+				i++
+			}
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += end + 4
+		case c == '?' && strings.HasPrefix(src[i:], "?>"):
+			// Anything after the closing tag is output, not code
+			return tokens, nil
+		case c == '\'' || c == '"':
+			value, next, err := readPHPString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, phpToken{kind: "string", value: value})
+			i = next
+		case c == '$':
+			j := i + 1
+			for j < len(src) && isPHPIdentChar(src[j]) {
+				j++
+			}
+			tokens = append(tokens, phpToken{kind: "var", value: src[i+1 : j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (isPHPIdentChar(src[j]) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, phpToken{kind: "number", value: src[i:j]})
+			i = j
+		case isPHPIdentChar(c) || c == '\\':
+			j := i
+			for j < len(src) && (isPHPIdentChar(src[j]) || src[j] == '\\') {
+				j++
+			}
+			tokens = append(tokens, phpToken{kind: "ident", value: src[i:j]})
+			i = j
+		default:
+			op := string(c)
+			for _, candidate := range []string{"->", "=>", "::"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			tokens = append(tokens, phpToken{kind: "op", value: op})
+			i += len(op)
+		}
+	}
+
+	return tokens, nil
+}
+
+// isPHPIdentChar checks if a byte can be part of a PHP identifier
+func isPHPIdentChar(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// readPHPString reads a quoted PHP string starting at src[start]
+func readPHPString(src string, start int) (string, int, error) {
+	quote := src[start]
+	var builder strings.Builder
+
+	for i := start + 1; i < len(src); i++ {
+		c := src[i]
+		if c == quote {
+			return builder.String(), i + 1, nil
+		}
+
+		if c == '\\' && i+1 < len(src) {
+			next := src[i+1]
+			switch {
+			case next == quote || next == '\\':
+				builder.WriteByte(next)
+				i++
+				continue
+			case quote == '"' && next == 'n':
+				builder.WriteByte('\n')
+				i++
+				continue
+			case quote == '"' && next == 't':
+				builder.WriteByte('\t')
+				i++
+				continue
+			case quote == '"' && next == '$':
+				builder.WriteByte('$')
+				i++
+				continue
+			}
+		}
+
+		builder.WriteByte(c)
+	}
+
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// phpParser evaluates literal assignments of a PHP object variable
+type phpParser struct {
+	tokens   []phpToken
+	pos      int
+	dir      string
+	variable string
+	settings map[string]interface{}
+}
+
+// parsePHPAssignments returns the literal values assigned to $variable->name,
+// or to plain $name variables when variable is empty. Anything that is not a
+// simple assignment is skipped token by token, so assignments inside if
+// blocks are picked up as well.
+func parsePHPAssignments(src, variable, dir string) (map[string]interface{}, error) {
+	tokens, err := tokenizePHP(src)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &phpParser{
+		tokens:   tokens,
+		dir:      dir,
+		variable: variable,
+		settings: make(map[string]interface{}),
+	}
+
+	for parser.pos < len(parser.tokens) {
+		start := parser.pos
+		if !parser.parseAssignment() {
+			parser.pos = start + 1
+		}
+	}
+
+	return parser.settings, nil
+}
+
+// parseAssignment parses "$variable->name = value;" or
+// "$variable->name['key'] = value;" at the current position
+func (p *phpParser) parseAssignment() bool {
+	var name phpToken
+	if p.variable == "" {
+		name = p.next()
+		if name.kind != "var" {
+			return false
+		}
+	} else {
+		if !p.accept("var", p.variable) || !p.accept("op", "->") {
+			return false
+		}
+
+		name = p.next()
+		if name.kind != "ident" {
+			return false
+		}
+	}
+
+	key := ""
+	if p.accept("op", "[") {
+		keyToken := p.next()
+		if (keyToken.kind != "string" && keyToken.kind != "number") || !p.accept("op", "]") {
+			return false
+		}
+		key = keyToken.value
+	}
+
+	if !p.accept("op", "=") {
+		return false
+	}
+
+	value, ok := p.parseExpression()
+	if !ok || !p.accept("op", ";") {
+		return false
+	}
+
+	if key == "" {
+		p.settings[name.value] = value
+		return true
+	}
+
+	array, isArray := p.settings[name.value].(map[string]interface{})
+	if !isArray {
+		array = make(map[string]interface{})
+		p.settings[name.value] = array
+	}
+	array[key] = value
+	return true
+}
+
+// parseExpression parses terms joined by ".", "|", "&" or "+"
+func (p *phpParser) parseExpression() (interface{}, bool) {
+	value, ok := p.parseTerm()
+	if !ok {
+		return nil, false
+	}
+
+	for {
+		token := p.peek()
+		if token.kind != "op" || !strings.Contains(".|&+", token.value) {
+			return value, true
+		}
+		p.pos++
+
+		right, ok := p.parseTerm()
+		if !ok {
+			return nil, false
+		}
+
+		switch token.value {
+		case ".":
+			value = phpString(value) + phpString(right)
+		case "|":
+			value = phpInt(value) | phpInt(right)
+		case "&":
+			value = phpInt(value) & phpInt(right)
+		case "+":
+			value = phpInt(value) + phpInt(right)
+		}
+	}
+}
+
+// parseTerm parses a single literal, constant or array
+func (p *phpParser) parseTerm() (interface{}, bool) {
+	token := p.next()
+
+	switch token.kind {
+	case "string":
+		return token.value, true
+	case "number":
+		if integer, err := strconv.ParseInt(token.value, 0, 64); err == nil {
+			return integer, true
+		}
+		if float, err := strconv.ParseFloat(token.value, 64); err == nil {
+			return float, true
+		}
+		return nil, false
+	case "ident":
+		return p.parseIdent(token.value)
+	case "var":
+		// References to settings assigned earlier, e.g. $CFG->dataroot . '/temp'
+		if p.variable == "" {
+			return p.settings[token.value], true
+		}
+		if token.value != p.variable || !p.accept("op", "->") {
+			return nil, false
+		}
+		name := p.next()
+		if name.kind != "ident" {
+			return nil, false
+		}
+		return p.settings[name.value], true
+	case "op":
+		switch token.value {
+		case "~":
+			value, ok := p.parseTerm()
+			return ^phpInt(value), ok
+		case "-":
+			value, ok := p.parseTerm()
+			if float, isFloat := value.(float64); isFloat {
+				return -float, ok
+			}
+			return -phpInt(value), ok
+		case "(":
+			value, ok := p.parseExpression()
+			return value, ok && p.accept("op", ")")
+		case "[":
+			return p.parseArray("]")
+		}
+	}
+
+	return nil, false
+}
+
+// parseIdent resolves keywords, constants and array() literals
+func (p *phpParser) parseIdent(ident string) (interface{}, bool) {
+	switch strings.ToLower(ident) {
+	case "true":
+		return true, true
+	case "false":
+		return false, true
+	case "null":
+		return nil, true
+	case "array":
+		if !p.accept("op", "(") {
+			return nil, false
+		}
+		return p.parseArray(")")
+	case "__dir__":
+		return p.dir, true
+	}
+
+	if value, known := phpConstants[strings.TrimPrefix(ident, "\\")]; known {
+		return value, true
+	}
+
+	// Unknown constants are kept by name
+	return ident, true
+}
+
+// parseArray parses array elements up to the closing token
+func (p *phpParser) parseArray(closing string) (interface{}, bool) {
+	array := make(map[string]interface{})
+	index := 0
+
+	for {
+		if p.accept("op", closing) {
+			return array, true
+		}
+
+		value, ok := p.parseExpression()
+		if !ok {
+			return nil, false
+		}
+
+		if p.accept("op", "=>") {
+			key := phpString(value)
+			value, ok = p.parseExpression()
+			if !ok {
+				return nil, false
+			}
+			array[key] = value
+		} else {
+			array[strconv.Itoa(index)] = value
+			index++
+		}
+
+		if !p.accept("op", ",") {
+			return array, p.accept("op", closing)
+		}
+	}
+}
+
+// peek returns the current token without consuming it
+func (p *phpParser) peek() phpToken {
+	if p.pos >= len(p.tokens) {
+		return phpToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// next consumes and returns the current token
+func (p *phpParser) next() phpToken {
+	token := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the current token if it matches
+func (p *phpParser) accept(kind, value string) bool {
+	token := p.peek()
+	if token.kind == kind && token.value == value {
+		p.pos++
+		return true
+	}
+	return false
+}
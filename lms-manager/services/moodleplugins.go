@@ -0,0 +1,361 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"lms-manager/models"
+)
+
+// defaultPluginTypes maps plugin types to their directories, used when the
+// Moodle tree has no lib/components.json
+var defaultPluginTypes = map[string]string{
+	"antivirus":     "lib/antivirus",
+	"availability":  "availability/condition",
+	"qtype":         "question/type",
+	"mod":           "mod",
+	"auth":          "auth",
+	"calendartype":  "calendar/type",
+	"customfield":   "customfield/field",
+	"enrol":         "enrol",
+	"message":       "message/output",
+	"block":         "blocks",
+	"media":         "media/player",
+	"filter":        "filter",
+	"editor":        "lib/editor",
+	"format":        "course/format",
+	"dataformat":    "dataformat",
+	"profilefield":  "user/profile/field",
+	"report":        "report",
+	"coursereport":  "course/report",
+	"gradeexport":   "grade/export",
+	"gradeimport":   "grade/import",
+	"gradereport":   "grade/report",
+	"gradingform":   "grade/grading/form",
+	"mlbackend":     "lib/mlbackend",
+	"mnetservice":   "mnet/service",
+	"webservice":    "webservice",
+	"repository":    "repository",
+	"portfolio":     "portfolio",
+	"search":        "search/engine",
+	"qbank":         "question/bank",
+	"qbehaviour":    "question/behaviour",
+	"qformat":       "question/format",
+	"plagiarism":    "plagiarism",
+	"tool":          "admin/tool",
+	"cachestore":    "cache/stores",
+	"cachelock":     "cache/locks",
+	"fileconverter": "files/converter",
+	"contenttype":   "contentbank/contenttype",
+	"theme":         "theme",
+	"local":         "local",
+	"h5plib":        "h5p/h5plib",
+	"paygw":         "payment/gateway",
+}
+
+// ParsePluginVersion parses the version.php of a plugin
+func ParsePluginVersion(path string) (*models.MoodlePlugin, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version.php: %v", err)
+	}
+
+	variables, err := parsePHPAssignments(string(content), "plugin", filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse version.php: %v", err)
+	}
+
+	version, ok := variables["version"]
+	if !ok {
+		return nil, fmt.Errorf("version not found in version.php")
+	}
+
+	plugin := &models.MoodlePlugin{
+		Component: phpString(variables["component"]),
+		Version:   phpInt(version),
+		Release:   phpString(variables["release"]),
+	}
+
+	switch requires := variables["requires"].(type) {
+	case float64:
+		plugin.Requires = requires
+	case int64:
+		plugin.Requires = float64(requires)
+	}
+
+	if maturity, ok := variables["maturity"]; ok {
+		plugin.Maturity = MaturityName(phpInt(maturity))
+	}
+
+	return plugin, nil
+}
+
+// ScanMoodlePlugins walks the plugin type directories of a Moodle code tree
+// and parses the version.php of every plugin found. Add-ons are detected
+// against the standard plugin list of lib/classes/plugin_manager.php.
+func ScanMoodlePlugins(root string) (*models.MoodlePluginInventory, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("Moodle directory not found: %s", root)
+	}
+
+	inventory := &models.MoodlePluginInventory{}
+
+	types, err := loadPluginTypes(root)
+	if err != nil {
+		inventory.Warnings = append(inventory.Warnings, fmt.Sprintf("Using built-in plugin types: %v", err))
+		types = make(map[string]string)
+		for pluginType, dir := range defaultPluginTypes {
+			types[pluginType] = dir
+		}
+	}
+
+	standard, err := loadStandardPlugins(root)
+	if err != nil {
+		inventory.Warnings = append(inventory.Warnings, fmt.Sprintf("Add-ons cannot be detected: %v", err))
+	}
+
+	// Subplugin types are declared by the plugins themselves, so plugin
+	// types are scanned until no new ones show up
+	scanned := make(map[string]bool)
+	for len(scanned) < len(types) {
+		for _, pluginType := range sortedKeys(types) {
+			if scanned[pluginType] {
+				continue
+			}
+			scanned[pluginType] = true
+
+			plugins := scanPluginType(root, pluginType, types[pluginType])
+			for _, plugin := range plugins {
+				for subType, subDir := range loadSubpluginTypes(root, plugin.Path) {
+					if _, known := types[subType]; !known {
+						types[subType] = subDir
+					}
+				}
+
+				if standard != nil {
+					plugin.AddOn = !standard[plugin.Type][plugin.Name]
+				}
+				inventory.Plugins = append(inventory.Plugins, plugin)
+			}
+		}
+	}
+
+	sort.Slice(inventory.Plugins, func(i, j int) bool {
+		return inventory.Plugins[i].Component < inventory.Plugins[j].Component
+	})
+
+	for _, plugin := range inventory.Plugins {
+		if plugin.AddOn {
+			inventory.AddOns++
+		}
+	}
+	inventory.Total = len(inventory.Plugins)
+
+	return inventory, nil
+}
+
+// CheckPluginRequirements flags plugins requiring a newer core version
+func CheckPluginRequirements(inventory *models.MoodlePluginInventory, core *models.MoodleVersion) {
+	inventory.CoreVersion = core.Version
+	inventory.Incompatible = 0
+
+	for i := range inventory.Plugins {
+		plugin := &inventory.Plugins[i]
+		plugin.Incompatible = plugin.Requires > core.Number
+		if plugin.Incompatible {
+			inventory.Incompatible++
+		}
+	}
+}
+
+// scanPluginType returns the plugins in the directory of a plugin type
+func scanPluginType(root, pluginType, dir string) []models.MoodlePlugin {
+	entries, err := os.ReadDir(filepath.Join(root, dir))
+	if err != nil {
+		return nil
+	}
+
+	var plugins []models.MoodlePlugin
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		versionFile := filepath.Join(root, dir, entry.Name(), "version.php")
+		if _, err := os.Stat(versionFile); err != nil {
+			// Not a plugin, e.g. blocks/tests or a leftover directory
+			continue
+		}
+
+		component := pluginType + "_" + entry.Name()
+		plugin, err := ParsePluginVersion(versionFile)
+		if err != nil {
+			plugin = &models.MoodlePlugin{Error: err.Error()}
+		} else if plugin.Component != "" && plugin.Component != component {
+			plugin.Error = fmt.Sprintf("version.php declares component %s", plugin.Component)
+		}
+
+		plugin.Component = component
+		plugin.Type = pluginType
+		plugin.Name = entry.Name()
+		plugin.Path = filepath.ToSlash(filepath.Join(dir, entry.Name()))
+		plugins = append(plugins, *plugin)
+	}
+
+	return plugins
+}
+
+// loadPluginTypes reads the plugin types from lib/components.json
+func loadPluginTypes(root string) (map[string]string, error) {
+	content, err := os.ReadFile(filepath.Join(root, "lib", "components.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lib/components.json: %v", err)
+	}
+
+	var components struct {
+		PluginTypes map[string]string `json:"plugintypes"`
+	}
+	if err := json.Unmarshal(content, &components); err != nil {
+		return nil, fmt.Errorf("failed to parse lib/components.json: %v", err)
+	}
+
+	if len(components.PluginTypes) == 0 {
+		return nil, fmt.Errorf("no plugin types in lib/components.json")
+	}
+
+	return components.PluginTypes, nil
+}
+
+// loadSubpluginTypes reads the subplugin types declared in db/subplugins.json
+// of a plugin. Older plugins list paths from the Moodle root under
+// "plugintypes", newer ones paths relative to the plugin under
+// "subplugintypes".
+func loadSubpluginTypes(root, pluginPath string) map[string]string {
+	content, err := os.ReadFile(filepath.Join(root, pluginPath, "db", "subplugins.json"))
+	if err != nil {
+		return nil
+	}
+
+	var subplugins struct {
+		PluginTypes    map[string]string `json:"plugintypes"`
+		SubpluginTypes map[string]string `json:"subplugintypes"`
+	}
+	if err := json.Unmarshal(content, &subplugins); err != nil {
+		return nil
+	}
+
+	types := make(map[string]string)
+	for name, dir := range subplugins.PluginTypes {
+		types[name] = dir
+	}
+	for name, dir := range subplugins.SubpluginTypes {
+		types[name] = filepath.ToSlash(filepath.Join(pluginPath, dir))
+	}
+	return types
+}
+
+// loadStandardPlugins reads the plugins of the standard distribution from
+// core_plugin_manager::standard_plugins_list(), keyed by type and name
+func loadStandardPlugins(root string) (map[string]map[string]bool, error) {
+	content, err := os.ReadFile(filepath.Join(root, "lib", "classes", "plugin_manager.php"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lib/classes/plugin_manager.php: %v", err)
+	}
+
+	literal, err := extractPHPArray(string(content), "$standard_plugins")
+	if err != nil {
+		return nil, err
+	}
+
+	variables, err := parsePHPAssignments("$standard_plugins = "+literal+";", "", root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the standard plugin list: %v", err)
+	}
+
+	types, ok := variables["standard_plugins"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("failed to parse the standard plugin list")
+	}
+
+	standard := make(map[string]map[string]bool)
+	for pluginType, names := range types {
+		standard[pluginType] = make(map[string]bool)
+		if list, ok := names.(map[string]interface{}); ok {
+			for _, name := range list {
+				standard[pluginType][phpString(name)] = true
+			}
+		}
+	}
+
+	return standard, nil
+}
+
+// extractPHPArray returns the array literal assigned to a variable, from the
+// opening array( or [ to its matching closing bracket, skipping strings and
+// comments
+func extractPHPArray(src, variable string) (string, error) {
+	start := strings.Index(src, variable)
+	if start < 0 {
+		return "", fmt.Errorf("%s not found", variable)
+	}
+
+	assign := strings.Index(src[start:], "=")
+	if assign < 0 {
+		return "", fmt.Errorf("%s is not assigned", variable)
+	}
+
+	begin := start + assign + 1
+	open := strings.IndexAny(src[begin:], "([")
+	if open < 0 {
+		return "", fmt.Errorf("%s is not an array", variable)
+	}
+	open += begin
+
+	depth := 0
+	var quote byte
+	for i := open; i < len(src); i++ {
+		c := src[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' || strings.HasPrefix(src[i:], "//"):
+			if end := strings.IndexByte(src[i:], '\n'); end >= 0 {
+				i += end
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			if end := strings.Index(src[i:], "*/"); end >= 0 {
+				i += end + 1
+			}
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+			if depth == 0 {
+				return src[begin : i+1], nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("unterminated array %s", variable)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,448 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Moodle user administration actions, as recorded in user_activities
+const (
+	ActionMoodleUserSuspend             = "moodle_user_suspend"
+	ActionMoodleUserUnsuspend           = "moodle_user_unsuspend"
+	ActionMoodleUserForcePasswordChange = "moodle_user_force_password_change"
+	ActionMoodleUserResetPassword       = "moodle_user_reset_password"
+	ActionMoodleUserKillSessions        = "moodle_user_kill_sessions"
+)
+
+// moodleUserSearchLimit caps the users returned by a search
+const moodleUserSearchLimit = 50
+
+// moodleWebServicePath is the REST server under $CFG->wwwroot
+const moodleWebServicePath = "/webservice/rest/server.php"
+
+// moodlePasswordAlphabet leaves out the characters help desk staff confuse
+// when reading a password out
+const moodlePasswordAlphabet = "abcdefghjkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// Operator is the lms-manager user performing an action, with the request
+// it came from
+type Operator struct {
+	UserID    string
+	Username  string
+	IPAddress string
+	UserAgent string
+}
+
+// MoodleUserService searches the Moodle users read-only in the Moodle
+// database and changes them through the web services and CLI scripts of
+// Moodle, recording every change in user_activities. Killing the sessions of
+// one user is the only change made through a core API.
+type MoodleUserService struct {
+	config config.UserAdminConfig
+	moodle *MoodleService
+	client *http.Client
+	db     *sql.DB
+}
+
+// NewMoodleUserService creates a new Moodle user administration service
+func NewMoodleUserService(cfg config.UserAdminConfig, moodle *MoodleService) *MoodleUserService {
+	return &MoodleUserService{
+		config: cfg,
+		moodle: moodle,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+		},
+	}
+}
+
+// SetDatabase sets the database connection
+func (u *MoodleUserService) SetDatabase(db *sql.DB) {
+	u.db = db
+}
+
+// Enabled reports whether Moodle user administration is enabled
+func (u *MoodleUserService) Enabled() bool {
+	return u.config.Enabled
+}
+
+// Search returns the Moodle users whose username or email contains query,
+// ignoring case
+func (u *MoodleUserService) Search(query string) ([]models.MoodleUser, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, fmt.Errorf("search query is required")
+	}
+
+	conn, site, table, err := u.openUserTable()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+	defer cancel()
+
+	// The query is the only value bound rather than inlined, with the
+	// placeholders of the driver
+	pattern := "%" + escapeLike(strings.ToLower(query)) + "%"
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, username, email, firstname, lastname, auth, suspended, lastaccess
+		FROM %s
+		WHERE deleted = 0 AND (LOWER(username) LIKE %s OR LOWER(email) LIKE %s)
+		ORDER BY username
+		LIMIT %d
+	`, table, placeholder(site, 1), placeholder(site, 2), moodleUserSearchLimit), pattern, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	users := []models.MoodleUser{}
+	for rows.Next() {
+		user, err := scanMoodleUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", table, err)
+		}
+		users = append(users, *user)
+	}
+
+	return users, rows.Err()
+}
+
+// GetUser returns a Moodle user that is not deleted
+func (u *MoodleUserService) GetUser(id int64) (*models.MoodleUser, error) {
+	conn, _, table, err := u.openUserTable()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+	defer cancel()
+
+	user, err := scanMoodleUser(conn.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT id, username, email, firstname, lastname, auth, suspended, lastaccess
+		FROM %s
+		WHERE id = %d AND deleted = 0
+	`, table, id)))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("Moodle user %d not found", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", table, err)
+	}
+
+	return user, nil
+}
+
+// openUserTable opens the Moodle database with the credentials of
+// config.php and returns the name of its user table
+func (u *MoodleUserService) openUserTable() (*sql.DB, *models.MoodleSiteConfig, string, error) {
+	site, err := u.moodle.GetSiteConfig()
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	table, err := moodleTable(site, "user")
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	conn, err := openMoodleDatabase(site)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return conn, site, table, nil
+}
+
+// scanMoodleUser scans a row of the Moodle user table
+func scanMoodleUser(row rowScanner) (*models.MoodleUser, error) {
+	var user models.MoodleUser
+	var suspended int
+	var lastAccess int64
+	if err := row.Scan(&user.ID, &user.Username, &user.Email, &user.FirstName, &user.LastName,
+		&user.Auth, &suspended, &lastAccess); err != nil {
+		return nil, err
+	}
+
+	user.Suspended = suspended != 0
+	if lastAccess > 0 {
+		lastAccessTime := time.Unix(lastAccess, 0)
+		user.LastAccess = &lastAccessTime
+	}
+
+	return &user, nil
+}
+
+// placeholder returns the nth query placeholder of the Moodle database
+// driver
+func placeholder(site *models.MoodleSiteConfig, n int) string {
+	if site.DBType == "pgsql" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// escapeLike escapes the LIKE wildcards of a value. Backslash is the
+// default LIKE escape character of MySQL and PostgreSQL.
+func escapeLike(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `%`, `\%`)
+	return strings.ReplaceAll(value, `_`, `\_`)
+}
+
+// Suspend suspends a Moodle user and kills their sessions
+func (u *MoodleUserService) Suspend(id int64, operator Operator) error {
+	err := u.updateUser(id, url.Values{"users[0][suspended]": {"1"}})
+	if err == nil {
+		// The admin user list kills the sessions of the users it suspends,
+		// the web service does not in every Moodle version
+		if killErr := u.killSessions(id); killErr != nil {
+			err = fmt.Errorf("user suspended but their sessions were not killed: %v", killErr)
+		}
+	}
+
+	u.logActivity(operator, ActionMoodleUserSuspend, id, err)
+	return err
+}
+
+// Unsuspend lifts the suspension of a Moodle user
+func (u *MoodleUserService) Unsuspend(id int64, operator Operator) error {
+	err := u.updateUser(id, url.Values{"users[0][suspended]": {"0"}})
+
+	u.logActivity(operator, ActionMoodleUserUnsuspend, id, err)
+	return err
+}
+
+// ForcePasswordChange makes a Moodle user change their password at their
+// next login
+func (u *MoodleUserService) ForcePasswordChange(id int64, operator Operator) error {
+	err := u.updateUser(id, url.Values{
+		"users[0][preferences][0][type]":  {"auth_forcepasswordchange"},
+		"users[0][preferences][0][value]": {"1"},
+	})
+
+	u.logActivity(operator, ActionMoodleUserForcePasswordChange, id, err)
+	return err
+}
+
+// ResetPassword sets the password of a Moodle user and returns it. A random
+// password is generated when password is empty; it skips the site password
+// policy, which a password chosen by the operator must meet.
+func (u *MoodleUserService) ResetPassword(id int64, password string, operator Operator) (string, error) {
+	password, err := u.resetPassword(id, password)
+
+	u.logActivity(operator, ActionMoodleUserResetPassword, id, err)
+	return password, err
+}
+
+// resetPassword runs admin/cli/reset_password.php, which only resets
+// accounts with manual authentication. The password answers the prompt of
+// the script on its standard input, as --password would show it in the
+// process list.
+func (u *MoodleUserService) resetPassword(id int64, password string) (string, error) {
+	user, err := u.GetUser(id)
+	if err != nil {
+		return "", err
+	}
+	if user.Auth != "manual" {
+		return "", fmt.Errorf("only passwords of manual accounts can be reset, %s uses %s authentication", user.Username, user.Auth)
+	}
+
+	args := []string{"--username=" + user.Username}
+	if password == "" {
+		password, err = generateMoodlePassword()
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "--ignore-password-policy")
+	} else if strings.TrimSpace(password) != password || strings.ContainsAny(password, "\r\n") {
+		// The prompt reads a single line and trims it
+		return "", fmt.Errorf("the password cannot contain line breaks or start or end with spaces")
+	}
+
+	ctx, cancel := u.commandContext()
+	defer cancel()
+
+	if _, err := u.moodle.runMoodleCLIInput(ctx, password+"\n", "admin/cli/reset_password.php", args...); err != nil {
+		return "", err
+	}
+
+	return password, nil
+}
+
+// KillSessions logs a Moodle user out of every session
+func (u *MoodleUserService) KillSessions(id int64, operator Operator) error {
+	err := u.killSessions(id)
+
+	u.logActivity(operator, ActionMoodleUserKillSessions, id, err)
+	return err
+}
+
+// killSessions kills the sessions of a Moodle user with
+// \core\session\manager::kill_user_sessions(). Moodle has no supported way
+// to do this otherwise: admin/cli/kill_all_sessions.php logs out every user
+// and no web service function of Moodle core ends the sessions of another
+// user.
+func (u *MoodleUserService) killSessions(id int64) error {
+	if _, err := u.GetUser(id); err != nil {
+		return err
+	}
+
+	ctx, cancel := u.commandContext()
+	defer cancel()
+
+	_, err := u.moodle.runMoodlePHP(ctx, fmt.Sprintf(`\core\session\manager::kill_user_sessions(%d);`, id))
+	return err
+}
+
+// commandContext limits a Moodle CLI script or PHP run to the configured
+// timeout, so a hung PHP process cannot block the request
+func (u *MoodleUserService) commandContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(u.config.Timeout)*time.Second)
+}
+
+// updateUser calls the core_user_update_users web service function with the
+// fields of the user
+func (u *MoodleUserService) updateUser(id int64, fields url.Values) error {
+	if u.config.WebServiceToken == "" {
+		return fmt.Errorf("no Moodle web service token is configured")
+	}
+
+	endpoint, err := u.webServiceURL()
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{
+		"wstoken":            {u.config.WebServiceToken},
+		"wsfunction":         {"core_user_update_users"},
+		"moodlewsrestformat": {"json"},
+		"users[0][id]":       {strconv.FormatInt(id, 10)},
+	}
+	for name, values := range fields {
+		form[name] = values
+	}
+
+	resp, err := u.client.PostForm(endpoint, form)
+	if err != nil {
+		return fmt.Errorf("web service request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read web service response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("web service returned HTTP %d", resp.StatusCode)
+	}
+
+	return parseWebServiceResponse(body)
+}
+
+// webServiceURL returns the URL of the Moodle REST server
+func (u *MoodleUserService) webServiceURL() (string, error) {
+	if u.config.WebServiceURL != "" {
+		return u.config.WebServiceURL, nil
+	}
+
+	site, err := u.moodle.GetSiteConfig()
+	if err != nil {
+		return "", err
+	}
+	if site.WWWRoot == "" {
+		return "", fmt.Errorf("no wwwroot in config.php")
+	}
+
+	return strings.TrimRight(site.WWWRoot, "/") + moodleWebServicePath, nil
+}
+
+// parseWebServiceResponse turns the exception or warnings of a web service
+// response into an error. core_user_update_users returns null in older
+// Moodle versions.
+func parseWebServiceResponse(body []byte) error {
+	body = []byte(strings.TrimSpace(string(body)))
+	if len(body) == 0 || string(body) == "null" {
+		return nil
+	}
+
+	var response struct {
+		Exception string `json:"exception"`
+		ErrorCode string `json:"errorcode"`
+		Message   string `json:"message"`
+		Warnings  []struct {
+			WarningCode string `json:"warningcode"`
+			Message     string `json:"message"`
+		} `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unexpected web service response: %v", err)
+	}
+
+	if response.Exception != "" {
+		return fmt.Errorf("web service error %s: %s", response.ErrorCode, response.Message)
+	}
+	if len(response.Warnings) > 0 {
+		messages := make([]string, 0, len(response.Warnings))
+		for _, warning := range response.Warnings {
+			messages = append(messages, warning.Message)
+		}
+		return fmt.Errorf("web service warning: %s", strings.Join(messages, "; "))
+	}
+
+	return nil
+}
+
+// logActivity records an action on a Moodle user in user_activities
+func (u *MoodleUserService) logActivity(operator Operator, action string, id int64, actionErr error) {
+	resource := fmt.Sprintf("moodle/%s/user/%d", u.moodle.Name(), id)
+	message := "Performed by " + operator.Username
+	if actionErr != nil {
+		message += ": " + actionErr.Error()
+	}
+
+	_, err := u.db.Exec(`
+		INSERT INTO user_activities (id, user_id, action, resource, ip_address, user_agent, success, message)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, utils.GenerateID(), operator.UserID, action, resource, operator.IPAddress, operator.UserAgent, actionErr == nil, message)
+	if err != nil {
+		utils.Error("Failed to log user activity: %v", err)
+	}
+
+	if actionErr != nil {
+		utils.Warn("%s on %s by %s failed: %v", action, resource, operator.Username, actionErr)
+	} else {
+		utils.Info("%s on %s by %s", action, resource, operator.Username)
+	}
+}
+
+// generateMoodlePassword generates a random 16 character password
+func generateMoodlePassword() (string, error) {
+	alphabetSize := big.NewInt(int64(len(moodlePasswordAlphabet)))
+
+	password := make([]byte, 16)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate password: %v", err)
+		}
+		password[i] = moodlePasswordAlphabet[n.Int64()]
+	}
+	return string(password), nil
+}
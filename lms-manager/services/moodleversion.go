@@ -0,0 +1,132 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"lms-manager/models"
+)
+
+// moodleSupportMatrix lists the support lifecycle of Moodle branches,
+// taken from the Moodle releases page
+var moodleSupportMatrix = []models.MoodleSupport{
+	{Branch: "311", Name: "3.11", Released: supportDate("2021-05-17"), GeneralSupportEnd: supportDate("2022-11-14"), SecuritySupportEnd: supportDate("2023-12-11"), MinPHP: "7.3", MaxPHP: "8.0"},
+	{Branch: "400", Name: "4.0", Released: supportDate("2022-04-19"), GeneralSupportEnd: supportDate("2023-05-08"), SecuritySupportEnd: supportDate("2023-11-13"), MinPHP: "7.3", MaxPHP: "8.0"},
+	{Branch: "401", Name: "4.1", LTS: true, Released: supportDate("2022-11-28"), GeneralSupportEnd: supportDate("2023-12-11"), SecuritySupportEnd: supportDate("2025-12-08"), MinPHP: "7.4", MaxPHP: "8.1"},
+	{Branch: "402", Name: "4.2", Released: supportDate("2023-04-24"), GeneralSupportEnd: supportDate("2024-04-22"), SecuritySupportEnd: supportDate("2024-10-07"), MinPHP: "8.0", MaxPHP: "8.2"},
+	{Branch: "403", Name: "4.3", Released: supportDate("2023-10-09"), GeneralSupportEnd: supportDate("2024-10-07"), SecuritySupportEnd: supportDate("2025-04-21"), MinPHP: "8.0", MaxPHP: "8.2"},
+	{Branch: "404", Name: "4.4", Released: supportDate("2024-04-22"), GeneralSupportEnd: supportDate("2025-04-21"), SecuritySupportEnd: supportDate("2025-10-06"), MinPHP: "8.1", MaxPHP: "8.3"},
+	{Branch: "405", Name: "4.5", LTS: true, Released: supportDate("2024-10-07"), GeneralSupportEnd: supportDate("2025-10-06"), SecuritySupportEnd: supportDate("2027-10-04"), MinPHP: "8.1", MaxPHP: "8.3"},
+	{Branch: "500", Name: "5.0", Released: supportDate("2025-04-14"), GeneralSupportEnd: supportDate("2026-04-20"), SecuritySupportEnd: supportDate("2026-10-05"), MinPHP: "8.2", MaxPHP: "8.4"},
+	{Branch: "501", Name: "5.1", Released: supportDate("2025-10-06"), GeneralSupportEnd: supportDate("2026-10-05"), SecuritySupportEnd: supportDate("2027-04-19"), MinPHP: "8.2", MaxPHP: "8.4"},
+}
+
+// supportDate parses a date of the support matrix
+func supportDate(value string) time.Time {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid support matrix date %s: %v", value, err))
+	}
+	return date
+}
+
+// ParseMoodleVersion parses a Moodle version.php file
+func ParseMoodleVersion(path string) (*models.MoodleVersion, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version.php: %v", err)
+	}
+
+	variables, err := parsePHPAssignments(string(content), "", filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse version.php: %v", err)
+	}
+
+	number, ok := variables["version"]
+	if !ok {
+		return nil, fmt.Errorf("version not found in version.php")
+	}
+
+	version := &models.MoodleVersion{
+		Release:  phpString(variables["release"]),
+		Branch:   phpString(variables["branch"]),
+		Maturity: MaturityName(phpInt(variables["maturity"])),
+	}
+
+	switch typed := number.(type) {
+	case float64:
+		version.Number = typed
+		version.Version = strconv.FormatFloat(typed, 'f', 2, 64)
+	default:
+		version.Number = float64(phpInt(typed))
+		version.Version = phpString(typed)
+	}
+
+	return version, nil
+}
+
+// MaturityName returns the name of a MATURITY_* constant value
+func MaturityName(maturity int64) string {
+	switch maturity {
+	case phpConstants["MATURITY_ALPHA"]:
+		return "alpha"
+	case phpConstants["MATURITY_BETA"]:
+		return "beta"
+	case phpConstants["MATURITY_RC"]:
+		return "rc"
+	case phpConstants["MATURITY_STABLE"]:
+		return "stable"
+	default:
+		return "unknown"
+	}
+}
+
+// LookupMoodleSupport returns the support lifecycle of a branch at the given time
+func LookupMoodleSupport(branch string, now time.Time) *models.MoodleSupport {
+	for _, entry := range moodleSupportMatrix {
+		if entry.Branch != branch {
+			continue
+		}
+
+		support := entry
+		switch {
+		case now.Before(support.GeneralSupportEnd):
+			support.Status = models.SupportGeneral
+		case now.Before(support.SecuritySupportEnd):
+			support.Status = models.SupportSecurity
+		default:
+			support.Status = models.SupportEOL
+		}
+		return &support
+	}
+
+	return &models.MoodleSupport{Branch: branch, Status: models.SupportUnknown}
+}
+
+// MoodleVersionWarnings returns operator warnings for a Moodle version
+func MoodleVersionWarnings(version *models.MoodleVersion) []string {
+	var warnings []string
+
+	if version.Maturity != "stable" {
+		warnings = append(warnings, fmt.Sprintf("Moodle %s is a %s build and should not run in production", version.Release, version.Maturity))
+	}
+
+	support := version.Support
+	if support == nil {
+		return warnings
+	}
+
+	switch support.Status {
+	case models.SupportEOL:
+		warnings = append(warnings, fmt.Sprintf("Moodle %s reached end of life on %s and no longer receives security fixes", support.Name, support.SecuritySupportEnd.Format("2006-01-02")))
+	case models.SupportSecurity:
+		warnings = append(warnings, fmt.Sprintf("Moodle %s only receives security fixes until %s", support.Name, support.SecuritySupportEnd.Format("2006-01-02")))
+	case models.SupportUnknown:
+		warnings = append(warnings, fmt.Sprintf("Moodle branch %s is not in the support matrix", support.Branch))
+	}
+
+	return warnings
+}
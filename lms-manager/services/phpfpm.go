@@ -0,0 +1,228 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// PHP-FPM alert types
+const (
+	AlertPHPFPMSaturated   = "php_fpm_saturated"
+	AlertPHPFPMListenQueue = "php_fpm_listen_queue"
+	AlertPHPFPMUnreachable = "php_fpm_unreachable"
+)
+
+// phpfpmStatus is the JSON status page of a PHP-FPM pool
+type phpfpmStatus struct {
+	Pool               string `json:"pool"`
+	ProcessManager     string `json:"process manager"`
+	StartSince         int64  `json:"start since"`
+	AcceptedConn       int64  `json:"accepted conn"`
+	ListenQueue        int    `json:"listen queue"`
+	MaxListenQueue     int    `json:"max listen queue"`
+	ListenQueueLen     int    `json:"listen queue len"`
+	IdleProcesses      int    `json:"idle processes"`
+	ActiveProcesses    int    `json:"active processes"`
+	TotalProcesses     int    `json:"total processes"`
+	MaxActiveProcesses int    `json:"max active processes"`
+	MaxChildrenReached int64  `json:"max children reached"`
+	SlowRequests       int64  `json:"slow requests"`
+}
+
+// PHPFPMService collects the status page of every PHP-FPM pool directly over
+// FastCGI and hands it to the monitor
+type PHPFPMService struct {
+	config   config.PHPFPMConfig
+	monitor  *MonitorService
+	mu       sync.RWMutex
+	sampleMu sync.Mutex
+	stopChan chan bool
+	running  bool
+
+	pools    []models.PHPFPMPoolStats
+	previous map[string]models.PHPFPMPoolStats
+	sampled  time.Time
+}
+
+// NewPHPFPMService creates a new PHP-FPM status collector
+func NewPHPFPMService(cfg config.PHPFPMConfig, monitor *MonitorService) *PHPFPMService {
+	return &PHPFPMService{
+		config:   cfg,
+		monitor:  monitor,
+		stopChan: make(chan bool),
+		previous: make(map[string]models.PHPFPMPoolStats),
+	}
+}
+
+// Start starts collecting on the configured interval
+func (p *PHPFPMService) Start() {
+	if p.running {
+		return
+	}
+
+	if !p.config.Enabled {
+		utils.Info("PHP-FPM status collector is disabled")
+		return
+	}
+
+	p.running = true
+	go p.collectLoop()
+	utils.Info("PHP-FPM status collector started (%d pools every %ds)", len(p.config.Pools), p.config.Interval)
+}
+
+// Stop stops the collect loop
+func (p *PHPFPMService) Stop() {
+	if !p.running {
+		return
+	}
+
+	p.running = false
+	p.stopChan <- true
+	utils.Info("PHP-FPM status collector stopped")
+}
+
+// collectLoop samples the pools and checks the alerts on every tick
+func (p *PHPFPMService) collectLoop() {
+	ticker := time.NewTicker(time.Duration(p.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	p.collect()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.collect()
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+// collect samples the pools and hands them to the monitor
+func (p *PHPFPMService) collect() {
+	pools := p.Sample()
+	if p.monitor != nil {
+		p.monitor.CheckPHPFPMStats(pools)
+	}
+}
+
+// GetStats returns the latest pool statistics, sampling the pools when they
+// are older than the collect interval
+func (p *PHPFPMService) GetStats() []models.PHPFPMPoolStats {
+	p.mu.RLock()
+	pools, sampled := p.pools, p.sampled
+	p.mu.RUnlock()
+
+	if pools != nil && time.Since(sampled) < time.Duration(p.config.Interval)*time.Second {
+		return pools
+	}
+
+	return p.Sample()
+}
+
+// Sample requests the status page of every pool. Pools that cannot be
+// reached are returned with Error set.
+func (p *PHPFPMService) Sample() []models.PHPFPMPoolStats {
+	p.sampleMu.Lock()
+	defer p.sampleMu.Unlock()
+
+	pools := make([]models.PHPFPMPoolStats, 0, len(p.config.Pools))
+	for _, pool := range p.config.Pools {
+		stats, err := p.samplePool(pool)
+		if err != nil {
+			stats.Error = err.Error()
+		} else {
+			previous, seen := p.previous[pool.Name]
+			restarted := stats.StartSince < previous.StartSince
+			stats.NewMaxChildrenReached = counterIncrease(previous.MaxChildrenReached, stats.MaxChildrenReached, seen, restarted)
+			stats.NewSlowRequests = counterIncrease(previous.SlowRequests, stats.SlowRequests, seen, restarted)
+			p.previous[pool.Name] = stats
+		}
+		pools = append(pools, stats)
+	}
+
+	p.mu.Lock()
+	p.pools = pools
+	p.sampled = time.Now()
+	p.mu.Unlock()
+
+	return pools
+}
+
+// samplePool requests and parses the JSON status page of a pool
+func (p *PHPFPMService) samplePool(pool config.PHPFPMPool) (models.PHPFPMPoolStats, error) {
+	stats := models.PHPFPMPoolStats{
+		Name:        pool.Name,
+		Listen:      pool.Listen,
+		MaxChildren: pool.MaxChildren,
+		Timestamp:   time.Now(),
+	}
+
+	statusPath := pool.StatusPath
+	if statusPath == "" {
+		statusPath = "/status"
+	}
+
+	response, err := fastcgiGet(pool.Listen, map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "lms-manager",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"REQUEST_METHOD":    "GET",
+		"SCRIPT_NAME":       statusPath,
+		"SCRIPT_FILENAME":   statusPath,
+		"REQUEST_URI":       statusPath + "?json",
+		"QUERY_STRING":      "json",
+		"REMOTE_ADDR":       "127.0.0.1",
+	}, time.Duration(p.config.Timeout)*time.Second)
+	if err != nil {
+		return stats, fmt.Errorf("failed to request the status page of pool %s: %v", pool.Name, err)
+	}
+
+	// An unset pm.status_path is passed to PHP, which answers "File not found."
+	if response.StatusCode != 200 {
+		return stats, fmt.Errorf("status page of pool %s returned %d, is pm.status_path set to %s?", pool.Name, response.StatusCode, statusPath)
+	}
+
+	var status phpfpmStatus
+	if err := json.Unmarshal(response.Body, &status); err != nil {
+		return stats, fmt.Errorf("invalid status page of pool %s: %v", pool.Name, err)
+	}
+
+	stats.Pool = status.Pool
+	stats.ProcessManager = status.ProcessManager
+	stats.StartSince = status.StartSince
+	stats.AcceptedConn = status.AcceptedConn
+	stats.ListenQueue = status.ListenQueue
+	stats.MaxListenQueue = status.MaxListenQueue
+	stats.ListenQueueLen = status.ListenQueueLen
+	stats.IdleProcesses = status.IdleProcesses
+	stats.ActiveProcesses = status.ActiveProcesses
+	stats.TotalProcesses = status.TotalProcesses
+	stats.MaxActiveProcesses = status.MaxActiveProcesses
+	stats.MaxChildrenReached = status.MaxChildrenReached
+	stats.SlowRequests = status.SlowRequests
+	if pool.MaxChildren > 0 {
+		stats.ChildrenUsage = float64(status.ActiveProcesses) / float64(pool.MaxChildren) * 100
+	}
+
+	return stats, nil
+}
+
+// counterIncrease returns the increase of a cumulative counter since the
+// previous sample. The first sample has nothing to compare with and after a
+// restart the counter started over from zero.
+func counterIncrease(previous, current int64, seen, restarted bool) int64 {
+	if !seen {
+		return 0
+	}
+	if restarted || current < previous {
+		return current
+	}
+	return current - previous
+}
@@ -0,0 +1,540 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Probe alert types
+const (
+	AlertMoodleDown  = "moodle_down"
+	AlertMoodleSlow  = "moodle_slow"
+	AlertTLSExpiring = "moodle_tls_expiring"
+)
+
+// probeWindow is the period latency percentiles and success rates cover
+const probeWindow = time.Hour
+
+// probeRetention is how long probe results are kept in the database
+const probeRetention = 7 * 24 * time.Hour
+
+// probeBodyLimit is the number of response bytes searched for markers
+const probeBodyLimit = 1 << 20
+
+// probeMinSamples is the number of results needed before slow alerts fire
+const probeMinSamples = 5
+
+// moodleErrorMarkers are printed by PHP and Moodle when a page fails to render
+var moodleErrorMarkers = []string{"Fatal error", "Error reading from database", "Database connection failed"}
+
+// ProbeService requests Moodle pages on a schedule and alerts when the site
+// is down or slow, whatever the state of its processes
+type ProbeService struct {
+	config   config.ProbeConfig
+	moodle   *MoodleService
+	monitor  *MonitorService
+	client   *http.Client
+	db       *sql.DB
+	mu       sync.RWMutex
+	stopChan chan bool
+	running  bool
+
+	probes map[string]*probeState
+	order  []string
+}
+
+// probeState holds the recent results of one probe
+type probeState struct {
+	url      string
+	last     *models.ProbeResult
+	failures int
+	recent   []models.ProbeResult
+}
+
+// NewProbeService creates a new probe service
+func NewProbeService(cfg config.ProbeConfig, moodle *MoodleService, monitor *MonitorService) *ProbeService {
+	return &ProbeService{
+		config:  cfg,
+		moodle:  moodle,
+		monitor: monitor,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+		},
+		stopChan: make(chan bool),
+		probes:   make(map[string]*probeState),
+	}
+}
+
+// SetDatabase sets the database connection
+func (p *ProbeService) SetDatabase(db *sql.DB) {
+	p.db = db
+}
+
+// Start starts probing on the configured interval
+func (p *ProbeService) Start() {
+	if p.running {
+		return
+	}
+
+	if !p.config.Enabled {
+		utils.Info("Moodle HTTP probes are disabled")
+		return
+	}
+
+	p.loadRecent()
+
+	p.running = true
+	go p.probeLoop()
+	utils.Info("Moodle HTTP probes started (every %ds)", p.config.Interval)
+}
+
+// Stop stops the probe loop
+func (p *ProbeService) Stop() {
+	if !p.running {
+		return
+	}
+
+	p.running = false
+	p.stopChan <- true
+	utils.Info("Moodle HTTP probes stopped")
+}
+
+// probeLoop runs the probes on every tick
+func (p *ProbeService) probeLoop() {
+	ticker := time.NewTicker(time.Duration(p.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	p.Run()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.Run()
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+// Run probes every target once, records the results and checks the alerts
+func (p *ProbeService) Run() ([]models.ProbeResult, error) {
+	targets, err := p.targets()
+	if err != nil {
+		utils.Warn("Skipping Moodle HTTP probes: %v", err)
+		return nil, err
+	}
+
+	results := make([]models.ProbeResult, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target config.ProbeTarget) {
+			defer wg.Done()
+			results[i] = p.probe(target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		p.record(result)
+	}
+	p.prune()
+	p.checkAlerts()
+
+	return results, nil
+}
+
+// targets returns the built-in probes of the front and login pages followed
+// by the configured targets, resolved against $CFG->wwwroot
+func (p *ProbeService) targets() ([]config.ProbeTarget, error) {
+	site, err := p.moodle.GetSiteConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := url.Parse(strings.TrimRight(site.WWWRoot, "/") + "/")
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid wwwroot in config.php: %q", site.WWWRoot)
+	}
+
+	targets := []config.ProbeTarget{
+		{Name: "site", URL: "", Contains: []string{"</html>"}, NotContains: moodleErrorMarkers},
+		{Name: "login", URL: "login/index.php", Contains: []string{"</html>"}, NotContains: moodleErrorMarkers},
+	}
+	targets = append(targets, p.config.Targets...)
+
+	resolved := make([]config.ProbeTarget, 0, len(targets))
+	for _, target := range targets {
+		// Leading slashes are relative to wwwroot, which may be a subdirectory
+		ref, err := url.Parse(strings.TrimLeft(target.URL, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid url for probe %s: %v", target.Name, err)
+		}
+		target.URL = base.ResolveReference(ref).String()
+		resolved = append(resolved, target)
+	}
+
+	return resolved, nil
+}
+
+// probe requests a target and checks its status code, body markers and
+// certificate
+func (p *ProbeService) probe(target config.ProbeTarget) models.ProbeResult {
+	result := models.ProbeResult{
+		ID:        utils.GenerateID(),
+		Name:      target.Name,
+		URL:       target.URL,
+		Timestamp: time.Now(),
+	}
+
+	err := p.request(target, &result)
+	result.Latency = time.Since(result.Timestamp).Milliseconds()
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// request performs the request of a probe, filling in the status code and
+// certificate expiry of the result
+func (p *ProbeService) request(target config.ProbeTarget, result *models.ProbeResult) error {
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "lms-manager-probe/1.0")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		expiresAt := resp.TLS.PeerCertificates[0].NotAfter
+		result.TLSExpiresAt = &expiresAt
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, probeBodyLimit))
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+
+	expected := target.ExpectedStatus
+	if expected == 0 {
+		expected = http.StatusOK
+	}
+	if resp.StatusCode != expected {
+		return fmt.Errorf("unexpected status %d, expected %d", resp.StatusCode, expected)
+	}
+
+	for _, marker := range target.Contains {
+		if !strings.Contains(string(body), marker) {
+			return fmt.Errorf("response does not contain %q", marker)
+		}
+	}
+	for _, marker := range target.NotContains {
+		if strings.Contains(string(body), marker) {
+			return fmt.Errorf("response contains %q", marker)
+		}
+	}
+
+	return nil
+}
+
+// record stores a probe result
+func (p *ProbeService) record(result models.ProbeResult) {
+	p.mu.Lock()
+	state, ok := p.probes[result.Name]
+	if !ok {
+		state = &probeState{}
+		p.probes[result.Name] = state
+		p.order = append(p.order, result.Name)
+	}
+
+	state.url = result.URL
+	state.last = &result
+	state.recent = append(state.recent, result)
+	if result.Success {
+		state.failures = 0
+	} else {
+		state.failures++
+	}
+	p.mu.Unlock()
+
+	if !result.Success {
+		utils.Warn("Moodle probe %s failed: %s", result.Name, result.Error)
+	}
+
+	p.saveResult(result)
+}
+
+// prune drops results older than the probe window from memory and older
+// than the retention period from the database
+func (p *ProbeService) prune() {
+	cutoff := time.Now().Add(-probeWindow)
+
+	p.mu.Lock()
+	for _, state := range p.probes {
+		keep := state.recent[:0]
+		for _, result := range state.recent {
+			if result.Timestamp.After(cutoff) {
+				keep = append(keep, result)
+			}
+		}
+		state.recent = keep
+	}
+	p.mu.Unlock()
+
+	if p.db == nil {
+		return
+	}
+
+	if _, err := p.db.Exec(`DELETE FROM probe_results WHERE created_at < ?`, time.Now().Add(-probeRetention)); err != nil {
+		utils.Error("Failed to prune probe results: %v", err)
+	}
+}
+
+// checkAlerts raises or resolves the down, slow and certificate alerts.
+// Down alerts are not raised while Moodle is in maintenance mode.
+func (p *ProbeService) checkAlerts() {
+	if p.monitor == nil {
+		return
+	}
+
+	var down, slow, expiring []string
+	for _, status := range p.GetStatus() {
+		if p.config.FailureThreshold > 0 && status.ConsecutiveFailures >= p.config.FailureThreshold {
+			down = append(down, fmt.Sprintf("%s failed %d times in a row: %s", status.Name, status.ConsecutiveFailures, status.LastResult.Error))
+		}
+
+		if p.config.SlowThreshold > 0 && status.Samples >= probeMinSamples && status.P95 > int64(p.config.SlowThreshold) {
+			slow = append(slow, fmt.Sprintf("%s p95 %dms", status.Name, status.P95))
+		}
+
+		if status.LastResult != nil && status.LastResult.TLSExpiresAt != nil && p.config.TLSExpiryWarning > 0 {
+			left := time.Until(*status.LastResult.TLSExpiresAt)
+			if left < time.Duration(p.config.TLSExpiryWarning)*24*time.Hour {
+				expiring = append(expiring, fmt.Sprintf("%s expires on %s", status.URL, status.LastResult.TLSExpiresAt.Format("2006-01-02")))
+			}
+		}
+	}
+
+	if len(down) > 0 && !p.moodle.GetMaintenanceStatus().Enabled {
+		p.monitor.RaiseAlert(AlertMoodleDown, "critical", "Moodle is down: "+strings.Join(down, "; "))
+	} else if len(down) == 0 {
+		p.monitor.ResolveAlerts(AlertMoodleDown)
+	}
+
+	if len(slow) > 0 {
+		p.monitor.RaiseAlert(AlertMoodleSlow, "warning", "Moodle is slow: "+strings.Join(slow, "; "))
+	} else {
+		p.monitor.ResolveAlerts(AlertMoodleSlow)
+	}
+
+	if len(expiring) > 0 {
+		p.monitor.RaiseAlert(AlertTLSExpiring, "warning", "TLS certificate expiring: "+strings.Join(expiring, "; "))
+	} else {
+		p.monitor.ResolveAlerts(AlertTLSExpiring)
+	}
+}
+
+// GetStatus returns the health and latency percentiles of every probe
+func (p *ProbeService) GetStatus() []models.ProbeStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	statuses := make([]models.ProbeStatus, 0, len(p.order))
+	for _, name := range p.order {
+		state := p.probes[name]
+		status := models.ProbeStatus{
+			Name:                name,
+			URL:                 state.url,
+			LastResult:          state.last,
+			ConsecutiveFailures: state.failures,
+			Samples:             len(state.recent),
+		}
+		if state.last != nil {
+			status.Healthy = state.last.Success
+		}
+
+		latencies := make([]int64, 0, len(state.recent))
+		successes := 0
+		for _, result := range state.recent {
+			latencies = append(latencies, result.Latency)
+			if result.Success {
+				successes++
+			}
+		}
+
+		if len(latencies) > 0 {
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			status.SuccessRate = float64(successes) / float64(len(latencies)) * 100
+			status.P50 = Percentile(latencies, 50)
+			status.P95 = Percentile(latencies, 95)
+			status.P99 = Percentile(latencies, 99)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// Percentile returns the nearest-rank percentile of sorted values
+func Percentile(sorted []int64, percentile float64) int64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(percentile/100*float64(len(sorted)) + 0.999999)
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
+
+// GetHistory returns the most recent probe results, optionally of one probe
+func (p *ProbeService) GetHistory(name string, limit int) ([]models.ProbeResult, error) {
+	if p.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	if limit <= 0 {
+		limit = 100
+	}
+
+	query := `
+		SELECT id, name, url, status_code, success, latency_ms, error, tls_expires_at, created_at
+		FROM probe_results
+		WHERE instance = ?`
+	args := []interface{}{p.moodle.Name()}
+	if name != "" {
+		query += ` AND name = ?`
+		args = append(args, name)
+	}
+	query += ` ORDER BY created_at DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := p.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []models.ProbeResult
+	for rows.Next() {
+		var result models.ProbeResult
+		var resultError sql.NullString
+		var expiresAt sql.NullTime
+
+		err := rows.Scan(
+			&result.ID,
+			&result.Name,
+			&result.URL,
+			&result.StatusCode,
+			&result.Success,
+			&result.Latency,
+			&resultError,
+			&expiresAt,
+			&result.Timestamp,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Error = resultError.String
+		if expiresAt.Valid {
+			result.TLSExpiresAt = &expiresAt.Time
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// saveResult saves a probe result to the database
+func (p *ProbeService) saveResult(result models.ProbeResult) {
+	if p.db == nil {
+		return
+	}
+
+	_, err := p.db.Exec(`
+		INSERT INTO probe_results (id, instance, name, url, status_code, success, latency_ms, error, tls_expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, result.ID, p.moodle.Name(), result.Name, result.URL, result.StatusCode, result.Success, result.Latency, result.Error, result.TLSExpiresAt, result.Timestamp)
+
+	if err != nil {
+		utils.Error("Failed to save probe result: %v", err)
+	}
+}
+
+// loadRecent restores the results of the last probe window from the database
+func (p *ProbeService) loadRecent() {
+	if p.db == nil {
+		return
+	}
+
+	rows, err := p.db.Query(`
+		SELECT name, url, success, latency_ms, error, tls_expires_at, created_at
+		FROM probe_results
+		WHERE instance = ? AND created_at >= ?
+		ORDER BY created_at
+	`, p.moodle.Name(), time.Now().Add(-probeWindow))
+	if err != nil {
+		utils.Error("Failed to load probe results: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for rows.Next() {
+		var result models.ProbeResult
+		var resultError sql.NullString
+		var expiresAt sql.NullTime
+
+		if err := rows.Scan(&result.Name, &result.URL, &result.Success, &result.Latency, &resultError, &expiresAt, &result.Timestamp); err != nil {
+			utils.Error("Failed to load probe results: %v", err)
+			return
+		}
+		result.Error = resultError.String
+		if expiresAt.Valid {
+			result.TLSExpiresAt = &expiresAt.Time
+		}
+
+		state, ok := p.probes[result.Name]
+		if !ok {
+			state = &probeState{}
+			p.probes[result.Name] = state
+			p.order = append(p.order, result.Name)
+		}
+		state.url = result.URL
+		last := result
+		state.last = &last
+		state.recent = append(state.recent, result)
+		if result.Success {
+			state.failures = 0
+		} else {
+			state.failures++
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+)
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat. It
+// is 100 on every architecture Linux exposes to user space.
+const clockTicks = 100
+
+// cronComponent names the Moodle cron scripts in the process report
+const cronComponent = "cron"
+
+// componentProcessNames lists the process names of each component type, used
+// when the service manager does not report the main PID of a unit. A name
+// also matches when followed by a version, as in php-fpm8.1.
+var componentProcessNames = map[string][]string{
+	config.ComponentWeb:      {"nginx", "apache2", "httpd"},
+	config.ComponentPHPFPM:   {"php-fpm"},
+	config.ComponentDatabase: {"mysqld", "mariadbd", "postgres"},
+	config.ComponentCache:    {"redis-server", "memcached"},
+}
+
+// cronScripts are the Moodle CLI scripts reported as cron processes
+var cronScripts = []string{"admin/cli/cron.php", "admin/cli/scheduled_task.php", "admin/cli/adhoc_task.php"}
+
+// SetProcRoot replaces the procfs mount point the processes are read from
+func (m *MoodleService) SetProcRoot(root string) {
+	m.procRoot = root
+}
+
+// GetProcesses reads the master and worker processes of every stack
+// component and of running cron scripts from /proc. A component is the
+// process tree under the main PID of its unit, or the processes with its
+// name when the service manager does not report one.
+func (m *MoodleService) GetProcesses() (*models.ProcessReport, error) {
+	root := m.procRoot
+	if root == "" {
+		root = "/proc"
+	}
+
+	processes, err := readProcesses(root)
+	if err != nil {
+		return nil, err
+	}
+
+	children := make(map[int][]int)
+	for pid, process := range processes {
+		children[process.PPID] = append(children[process.PPID], pid)
+	}
+
+	report := &models.ProcessReport{Timestamp: time.Now()}
+	for _, component := range m.config.Components {
+		entry := models.ComponentProcesses{
+			Name: component.Name,
+			Type: component.Type,
+			Unit: component.Unit,
+		}
+
+		var pids []int
+		status, err := m.manager.Status(component.Unit)
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if err == nil && status.PID > 0 {
+			pids = processTree(status.PID, processes, children)
+		} else {
+			pids = matchProcesses(processes, func(process *models.ProcessStats) bool {
+				return isComponentProcess(component.Type, process.Name)
+			})
+		}
+
+		report.Components = append(report.Components, componentProcesses(entry, pids, processes))
+	}
+
+	cron := matchProcesses(processes, func(process *models.ProcessStats) bool {
+		for _, script := range cronScripts {
+			if strings.Contains(process.Cmdline, script) {
+				return true
+			}
+		}
+		return false
+	})
+	report.Components = append(report.Components, componentProcesses(models.ComponentProcesses{
+		Name: cronComponent,
+		Type: cronComponent,
+	}, cron, processes))
+
+	for _, component := range report.Components {
+		report.RSS += component.RSS
+	}
+
+	return report, nil
+}
+
+// componentProcesses fills in the processes of a component and their
+// totals. Processes whose parent belongs to the component are its workers.
+func componentProcesses(entry models.ComponentProcesses, pids []int, processes map[int]*models.ProcessStats) models.ComponentProcesses {
+	members := make(map[int]bool, len(pids))
+	for _, pid := range pids {
+		members[pid] = true
+	}
+
+	entry.Processes = make([]models.ProcessStats, 0, len(pids))
+	for _, pid := range pids {
+		process := *processes[pid]
+		process.Role = models.ProcessMaster
+		if members[process.PPID] {
+			process.Role = models.ProcessWorker
+		}
+
+		entry.RSS += process.RSS
+		entry.CPUTime += process.CPUTime
+		entry.Threads += process.Threads
+		if process.OpenFDs > 0 {
+			entry.OpenFDs += process.OpenFDs
+		}
+		entry.Processes = append(entry.Processes, process)
+	}
+	entry.Count = len(entry.Processes)
+
+	sort.Slice(entry.Processes, func(i, j int) bool {
+		return entry.Processes[i].RSS > entry.Processes[j].RSS
+	})
+
+	return entry
+}
+
+// processTree returns a process and all of its descendants
+func processTree(pid int, processes map[int]*models.ProcessStats, children map[int][]int) []int {
+	if _, exists := processes[pid]; !exists {
+		return nil
+	}
+
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// matchProcesses returns the processes accepted by match
+func matchProcesses(processes map[int]*models.ProcessStats, match func(*models.ProcessStats) bool) []int {
+	var pids []int
+	for pid, process := range processes {
+		if match(process) {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	return pids
+}
+
+// isComponentProcess reports whether a process name belongs to a component
+// type
+func isComponentProcess(componentType, name string) bool {
+	for _, candidate := range componentProcessNames[componentType] {
+		if name == candidate {
+			return true
+		}
+		if rest := strings.TrimPrefix(name, candidate); rest != name && rest[0] >= '0' && rest[0] <= '9' {
+			return true
+		}
+	}
+	return false
+}
+
+// readProcesses reads every process under a procfs mount. Processes that
+// exit while they are read are skipped.
+func readProcesses(root string) (map[int]*models.ProcessStats, error) {
+	bootTime, err := readBootTime(root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", root, err)
+	}
+
+	processes := make(map[int]*models.ProcessStats)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		process, err := readProcess(filepath.Join(root, entry.Name()), pid, bootTime)
+		if err != nil {
+			continue
+		}
+		processes[pid] = process
+	}
+
+	return processes, nil
+}
+
+// readBootTime reads the boot time from /proc/stat
+func readBootTime(root string) (time.Time, error) {
+	content, err := os.ReadFile(filepath.Join(root, "stat"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read %s/stat: %v", root, err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if value := strings.TrimPrefix(line, "btime "); value != line {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid boot time: %q", line)
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("boot time not found in %s/stat", root)
+}
+
+// readProcess reads the stat, status, cmdline and fd entries of a process
+func readProcess(dir string, pid int, bootTime time.Time) (*models.ProcessStats, error) {
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The name is in parentheses and may itself contain spaces and
+	// parentheses
+	content := string(stat)
+	open, end := strings.IndexByte(content, '('), strings.LastIndexByte(content, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("invalid stat of process %d", pid)
+	}
+	fields := strings.Fields(content[end+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("invalid stat of process %d", pid)
+	}
+
+	process := &models.ProcessStats{
+		PID:     pid,
+		Name:    content[open+1 : end],
+		State:   fields[0],
+		OpenFDs: -1,
+	}
+	process.PPID, _ = strconv.Atoi(fields[1])
+
+	utime, _ := strconv.ParseInt(fields[11], 10, 64)
+	stime, _ := strconv.ParseInt(fields[12], 10, 64)
+	process.CPUTime = float64(utime+stime) / clockTicks
+
+	if started, err := strconv.ParseInt(fields[19], 10, 64); err == nil {
+		process.StartedAt = bootTime.Add(time.Duration(started) * time.Second / clockTicks)
+	}
+
+	if status, err := os.ReadFile(filepath.Join(dir, "status")); err == nil {
+		for _, line := range strings.Split(string(status), "\n") {
+			key, value, found := strings.Cut(line, ":")
+			if !found {
+				continue
+			}
+			switch key {
+			case "VmRSS":
+				kilobytes, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimSpace(value), " kB"), 10, 64)
+				process.RSS = kilobytes * 1024
+			case "Threads":
+				process.Threads, _ = strconv.Atoi(strings.TrimSpace(value))
+			}
+		}
+	}
+
+	if cmdline, err := os.ReadFile(filepath.Join(dir, "cmdline")); err == nil {
+		process.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	}
+
+	// Reading the descriptors of processes of other users requires root
+	if fds, err := os.ReadDir(filepath.Join(dir, "fd")); err == nil {
+		process.OpenFDs = len(fds)
+	}
+
+	return process, nil
+}
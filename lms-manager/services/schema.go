@@ -0,0 +1,203 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// CreateTables creates the database tables of the manager
+func CreateTables(db *sql.DB) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			username TEXT UNIQUE NOT NULL,
+			email TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL,
+			active BOOLEAN DEFAULT 1,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_login DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_sessions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			ip_address TEXT NOT NULL,
+			user_agent TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS user_activities (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			action TEXT NOT NULL,
+			resource TEXT,
+			ip_address TEXT,
+			user_agent TEXT,
+			success BOOLEAN DEFAULT 1,
+			message TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users (id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS security_events (
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			message TEXT NOT NULL,
+			ip_address TEXT,
+			user_agent TEXT,
+			severity TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS alerts (
+			id TEXT PRIMARY KEY,
+			type TEXT NOT NULL,
+			message TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			resolved BOOLEAN DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			resolved_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS system_logs (
+			id TEXT PRIMARY KEY,
+			level TEXT NOT NULL,
+			message TEXT NOT NULL,
+			source TEXT,
+			data TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS cron_runs (
+			id TEXT PRIMARY KEY,
+			instance TEXT NOT NULL DEFAULT 'default',
+			started_at DATETIME NOT NULL,
+			finished_at DATETIME NOT NULL,
+			duration_ms INTEGER NOT NULL,
+			exit_code INTEGER NOT NULL,
+			success BOOLEAN NOT NULL,
+			output TEXT,
+			error TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_cron_runs_started_at ON cron_runs (started_at)`,
+		`CREATE TABLE IF NOT EXISTS jobs (
+			id TEXT PRIMARY KEY,
+			instance TEXT NOT NULL DEFAULT 'default',
+			name TEXT NOT NULL,
+			command TEXT NOT NULL,
+			args TEXT,
+			status TEXT NOT NULL,
+			exit_code INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			output TEXT,
+			user_id TEXT NOT NULL,
+			username TEXT NOT NULL,
+			created_at DATETIME NOT NULL,
+			finished_at DATETIME
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_created_at ON jobs (created_at)`,
+		`CREATE TABLE IF NOT EXISTS probe_results (
+			id TEXT PRIMARY KEY,
+			instance TEXT NOT NULL DEFAULT 'default',
+			name TEXT NOT NULL,
+			url TEXT NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			success BOOLEAN NOT NULL,
+			latency_ms INTEGER NOT NULL,
+			error TEXT,
+			tls_expires_at DATETIME,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_probe_results_created_at ON probe_results (created_at)`,
+		`CREATE TABLE IF NOT EXISTS integrity_runs (
+			id TEXT PRIMARY KEY,
+			instance TEXT NOT NULL DEFAULT 'default',
+			status TEXT NOT NULL,
+			checkpoint TEXT NOT NULL DEFAULT '',
+			files_checked INTEGER NOT NULL DEFAULT 0,
+			bytes_checked INTEGER NOT NULL DEFAULT 0,
+			corrupt_count INTEGER NOT NULL DEFAULT 0,
+			error TEXT,
+			started_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL,
+			finished_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS integrity_corrupt (
+			id TEXT PRIMARY KEY,
+			run_id TEXT NOT NULL,
+			contenthash TEXT NOT NULL,
+			actual_hash TEXT,
+			size INTEGER NOT NULL,
+			error TEXT,
+			detected_at DATETIME NOT NULL,
+			UNIQUE (run_id, contenthash)
+		)`,
+		`CREATE TABLE IF NOT EXISTS error_groups (
+			id TEXT PRIMARY KEY,
+			instance TEXT NOT NULL DEFAULT 'default',
+			level TEXT NOT NULL,
+			message TEXT NOT NULL,
+			file TEXT NOT NULL DEFAULT '',
+			line INTEGER NOT NULL DEFAULT 0,
+			component TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL DEFAULT '',
+			sample TEXT NOT NULL DEFAULT '',
+			count INTEGER NOT NULL DEFAULT 0,
+			first_seen DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			acknowledged BOOLEAN DEFAULT FALSE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_error_groups_last_seen ON error_groups (last_seen)`,
+		`CREATE TABLE IF NOT EXISTS config_versions (
+			id TEXT PRIMARY KEY,
+			instance TEXT NOT NULL DEFAULT 'default',
+			hash TEXT NOT NULL,
+			content TEXT NOT NULL,
+			size INTEGER NOT NULL DEFAULT 0,
+			source TEXT NOT NULL,
+			changed_by TEXT NOT NULL DEFAULT '',
+			debugdisplay BOOLEAN DEFAULT FALSE,
+			secrets_hash TEXT NOT NULL DEFAULT '',
+			secrets_changed BOOLEAN DEFAULT FALSE,
+			acknowledged_by TEXT,
+			acknowledged_at DATETIME,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_config_versions_created_at ON config_versions (created_at)`,
+		`CREATE TABLE IF NOT EXISTS usage_metrics (
+			instance TEXT NOT NULL DEFAULT 'default',
+			bucket DATETIME NOT NULL,
+			active_users INTEGER NOT NULL DEFAULT 0,
+			online_users INTEGER NOT NULL DEFAULT 0,
+			events INTEGER NOT NULL DEFAULT 0,
+			logins INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (instance, bucket)
+		)`,
+		`CREATE TABLE IF NOT EXISTS usage_bucket_users (
+			instance TEXT NOT NULL DEFAULT 'default',
+			bucket DATETIME NOT NULL,
+			userid INTEGER NOT NULL,
+			PRIMARY KEY (instance, bucket, userid)
+		)`,
+		`CREATE TABLE IF NOT EXISTS usage_activity (
+			instance TEXT NOT NULL DEFAULT 'default',
+			hour DATETIME NOT NULL,
+			kind TEXT NOT NULL,
+			object_id INTEGER NOT NULL,
+			name TEXT NOT NULL DEFAULT '',
+			events INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (instance, hour, kind, object_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS usage_state (
+			instance TEXT PRIMARY KEY,
+			last_id INTEGER NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return fmt.Errorf("failed to execute query: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,422 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+)
+
+// ServiceManager controls the init system units of the Moodle stack
+type ServiceManager interface {
+	Name() string
+	Start(unit string) error
+	Stop(unit string) error
+	Restart(unit string) error
+	IsActive(unit string) (bool, error)
+	Status(unit string) (*UnitStatus, error)
+}
+
+// UnitStatus represents the state of a single service unit
+type UnitStatus struct {
+	Unit   string
+	Active bool
+	State  string
+	PID    int
+	Since  time.Time
+}
+
+// NewServiceManager creates the service manager backend of the given kind
+func NewServiceManager(kind string) (ServiceManager, error) {
+	switch kind {
+	case "", config.ServiceManagerSystemd:
+		return NewSystemdManager(), nil
+	case config.ServiceManagerOpenRC:
+		return NewOpenRCManager(), nil
+	case config.ServiceManagerSysV:
+		return NewSysVManager(), nil
+	case config.ServiceManagerSupervisord:
+		return NewSupervisordManager(), nil
+	case config.ServiceManagerFake:
+		return NewFakeServiceManager(), nil
+	default:
+		return nil, fmt.Errorf("unknown service manager: %s", kind)
+	}
+}
+
+// runUnitCommand runs a service manager command and returns its output
+func runUnitCommand(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		message := strings.TrimSpace(string(output))
+		if message == "" {
+			return string(output), fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+		}
+		return string(output), fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, message)
+	}
+	return string(output), nil
+}
+
+// exitCode returns the exit code of a failed command, or -1
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// SystemdManager manages units through systemctl
+type SystemdManager struct{}
+
+// NewSystemdManager creates a new systemd service manager
+func NewSystemdManager() *SystemdManager {
+	return &SystemdManager{}
+}
+
+// Name returns the backend name
+func (s *SystemdManager) Name() string {
+	return config.ServiceManagerSystemd
+}
+
+// Start starts a unit
+func (s *SystemdManager) Start(unit string) error {
+	_, err := runUnitCommand("systemctl", "start", unit)
+	return err
+}
+
+// Stop stops a unit
+func (s *SystemdManager) Stop(unit string) error {
+	_, err := runUnitCommand("systemctl", "stop", unit)
+	return err
+}
+
+// Restart restarts a unit
+func (s *SystemdManager) Restart(unit string) error {
+	_, err := runUnitCommand("systemctl", "restart", unit)
+	return err
+}
+
+// IsActive checks if a unit is active
+func (s *SystemdManager) IsActive(unit string) (bool, error) {
+	output, err := exec.Command("systemctl", "is-active", unit).Output()
+	state := strings.TrimSpace(string(output))
+	if err != nil && state == "" {
+		return false, fmt.Errorf("systemctl is-active %s: %v", unit, err)
+	}
+	return state == "active", nil
+}
+
+// Status returns the state, main PID and start time of a unit
+func (s *SystemdManager) Status(unit string) (*UnitStatus, error) {
+	output, err := runUnitCommand("systemctl", "show", unit, "--property=ActiveState,SubState,MainPID,ActiveEnterTimestamp")
+	if err != nil {
+		return nil, err
+	}
+
+	status := &UnitStatus{Unit: unit}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "ActiveState":
+			status.Active = value == "active"
+			if status.State == "" {
+				status.State = value
+			}
+		case "SubState":
+			status.State = value
+		case "MainPID":
+			status.PID, _ = strconv.Atoi(value)
+		case "ActiveEnterTimestamp":
+			if since, err := time.Parse("Mon 2006-01-02 15:04:05 MST", value); err == nil {
+				status.Since = since
+			}
+		}
+	}
+
+	return status, nil
+}
+
+// InitScriptManager manages units through an init script wrapper
+// such as OpenRC's rc-service or SysV's service command
+type InitScriptManager struct {
+	name    string
+	command string
+}
+
+// NewOpenRCManager creates a new OpenRC service manager
+func NewOpenRCManager() *InitScriptManager {
+	return &InitScriptManager{name: config.ServiceManagerOpenRC, command: "rc-service"}
+}
+
+// NewSysVManager creates a new SysV init service manager
+func NewSysVManager() *InitScriptManager {
+	return &InitScriptManager{name: config.ServiceManagerSysV, command: "service"}
+}
+
+// Name returns the backend name
+func (s *InitScriptManager) Name() string {
+	return s.name
+}
+
+// Start starts a service
+func (s *InitScriptManager) Start(unit string) error {
+	_, err := runUnitCommand(s.command, unit, "start")
+	return err
+}
+
+// Stop stops a service
+func (s *InitScriptManager) Stop(unit string) error {
+	_, err := runUnitCommand(s.command, unit, "stop")
+	return err
+}
+
+// Restart restarts a service
+func (s *InitScriptManager) Restart(unit string) error {
+	_, err := runUnitCommand(s.command, unit, "restart")
+	return err
+}
+
+// IsActive checks if a service is running using the LSB status exit code
+func (s *InitScriptManager) IsActive(unit string) (bool, error) {
+	_, err := runUnitCommand(s.command, unit, "status")
+	if err == nil {
+		return true, nil
+	}
+
+	// Exit codes 1-4 mean the service is not running
+	if code := exitCode(err); code >= 1 && code <= 4 {
+		return false, nil
+	}
+	return false, err
+}
+
+// Status returns the state of a service; init scripts do not expose PIDs
+func (s *InitScriptManager) Status(unit string) (*UnitStatus, error) {
+	active, err := s.IsActive(unit)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &UnitStatus{Unit: unit, Active: active, State: "stopped"}
+	if active {
+		status.State = "running"
+	}
+	return status, nil
+}
+
+// SupervisordManager manages programs through supervisorctl
+type SupervisordManager struct{}
+
+// NewSupervisordManager creates a new supervisord service manager
+func NewSupervisordManager() *SupervisordManager {
+	return &SupervisordManager{}
+}
+
+// supervisorStatusPattern matches "name  RUNNING   pid 123, uptime 1:02:03"
+var supervisorStatusPattern = regexp.MustCompile(`^(\S+)\s+([A-Z]+)\s*(?:pid (\d+), uptime (?:(\d+) days?, )?(\d+):(\d+):(\d+))?`)
+
+// Name returns the backend name
+func (s *SupervisordManager) Name() string {
+	return config.ServiceManagerSupervisord
+}
+
+// Start starts a program
+func (s *SupervisordManager) Start(unit string) error {
+	_, err := runUnitCommand("supervisorctl", "start", unit)
+	return err
+}
+
+// Stop stops a program
+func (s *SupervisordManager) Stop(unit string) error {
+	_, err := runUnitCommand("supervisorctl", "stop", unit)
+	return err
+}
+
+// Restart restarts a program
+func (s *SupervisordManager) Restart(unit string) error {
+	_, err := runUnitCommand("supervisorctl", "restart", unit)
+	return err
+}
+
+// IsActive checks if a program is running
+func (s *SupervisordManager) IsActive(unit string) (bool, error) {
+	status, err := s.Status(unit)
+	if err != nil {
+		return false, err
+	}
+	return status.Active, nil
+}
+
+// Status returns the state, PID and uptime of a program
+func (s *SupervisordManager) Status(unit string) (*UnitStatus, error) {
+	// supervisorctl exits non-zero for stopped programs, so parse the output regardless
+	output, err := runUnitCommand("supervisorctl", "status", unit)
+	return parseSupervisorStatus(unit, output, err)
+}
+
+// parseSupervisorStatus parses a supervisorctl status line
+func parseSupervisorStatus(unit, output string, cmdErr error) (*UnitStatus, error) {
+	match := supervisorStatusPattern.FindStringSubmatch(strings.TrimSpace(output))
+	if match == nil {
+		if cmdErr != nil {
+			return nil, cmdErr
+		}
+		return nil, fmt.Errorf("unexpected supervisorctl output for %s: %s", unit, strings.TrimSpace(output))
+	}
+
+	status := &UnitStatus{
+		Unit:   unit,
+		State:  strings.ToLower(match[2]),
+		Active: match[2] == "RUNNING",
+	}
+
+	if match[3] != "" {
+		status.PID, _ = strconv.Atoi(match[3])
+		days, _ := strconv.Atoi(match[4])
+		hours, _ := strconv.Atoi(match[5])
+		minutes, _ := strconv.Atoi(match[6])
+		seconds, _ := strconv.Atoi(match[7])
+		uptime := time.Duration(days)*24*time.Hour + time.Duration(hours)*time.Hour +
+			time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second
+		status.Since = time.Now().Add(-uptime)
+	}
+
+	return status, nil
+}
+
+// FakeServiceManager is an in-memory service manager for tests and dry runs
+type FakeServiceManager struct {
+	units    map[string]*UnitStatus
+	failures map[string]error
+	calls    []string
+	nextPID  int
+	mu       sync.Mutex
+}
+
+// NewFakeServiceManager creates a new in-memory service manager
+func NewFakeServiceManager() *FakeServiceManager {
+	return &FakeServiceManager{
+		units:    make(map[string]*UnitStatus),
+		failures: make(map[string]error),
+		nextPID:  1000,
+	}
+}
+
+// Name returns the backend name
+func (f *FakeServiceManager) Name() string {
+	return config.ServiceManagerFake
+}
+
+// FailOn makes the given action ("start", "stop", "restart") fail for a unit
+func (f *FakeServiceManager) FailOn(action, unit string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err == nil {
+		delete(f.failures, action+" "+unit)
+		return
+	}
+	f.failures[action+" "+unit] = err
+}
+
+// Calls returns the recorded actions in the form "start nginx"
+func (f *FakeServiceManager) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	calls := make([]string, len(f.calls))
+	copy(calls, f.calls)
+	return calls
+}
+
+// Start starts a unit
+func (f *FakeServiceManager) Start(unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record("start", unit); err != nil {
+		return err
+	}
+	f.setActive(unit, true)
+	return nil
+}
+
+// Stop stops a unit
+func (f *FakeServiceManager) Stop(unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record("stop", unit); err != nil {
+		return err
+	}
+	f.setActive(unit, false)
+	return nil
+}
+
+// Restart restarts a unit
+func (f *FakeServiceManager) Restart(unit string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.record("restart", unit); err != nil {
+		return err
+	}
+	f.setActive(unit, true)
+	return nil
+}
+
+// IsActive checks if a unit is active
+func (f *FakeServiceManager) IsActive(unit string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status, exists := f.units[unit]
+	return exists && status.Active, nil
+}
+
+// Status returns a copy of the unit state
+func (f *FakeServiceManager) Status(unit string) (*UnitStatus, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	status, exists := f.units[unit]
+	if !exists {
+		return &UnitStatus{Unit: unit, State: "inactive"}, nil
+	}
+
+	copied := *status
+	return &copied, nil
+}
+
+// record logs a call and returns the configured failure, if any
+func (f *FakeServiceManager) record(action, unit string) error {
+	f.calls = append(f.calls, action+" "+unit)
+	if err, exists := f.failures[action+" "+unit]; exists {
+		return err
+	}
+	return nil
+}
+
+// setActive updates the in-memory state of a unit
+func (f *FakeServiceManager) setActive(unit string, active bool) {
+	status := &UnitStatus{Unit: unit, Active: active, State: "inactive"}
+	if active {
+		f.nextPID++
+		status.State = "running"
+		status.PID = f.nextPID
+		status.Since = time.Now()
+	}
+	f.units[unit] = status
+}
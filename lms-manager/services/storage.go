@@ -0,0 +1,403 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// moodledataAreas are the moodledata directories reported separately.
+// Everything else in the dataroot is reported as storageOtherArea.
+var moodledataAreas = []string{"filedir", "cache", "localcache", "temp", "trashdir", "sessions", "lock", "muc"}
+
+// storageOtherArea collects the dataroot entries outside moodledataAreas
+const storageOtherArea = "other"
+
+// incrementalAreas hold content-addressed files that are never rewritten in
+// place, so directories whose modification time has not changed since the
+// last scan are not read again
+var incrementalAreas = map[string]bool{
+	"filedir":  true,
+	"trashdir": true,
+}
+
+// cleanableAreas can be cleaned up while Moodle is running, Moodle recreates
+// whatever it still needs
+var cleanableAreas = map[string]bool{
+	"temp":       true,
+	"trashdir":   true,
+	"cache":      true,
+	"localcache": true,
+}
+
+// defaultCleanupAreas are cleaned up when a request names no areas
+var defaultCleanupAreas = []string{"temp", "trashdir"}
+
+// storageCleanupPreview is the number of entries listed in a cleanup result
+const storageCleanupPreview = 200
+
+// storageScanner caches the moodledata breakdown between scans
+type storageScanner struct {
+	mu       sync.Mutex
+	report   *models.StorageReport
+	scanning bool
+	stale    bool
+
+	// scanMu serialises scans and guards dirs
+	scanMu sync.Mutex
+	dirs   map[string]*dirSummary
+}
+
+// dirSummary holds the totals of the files directly in a directory
+type dirSummary struct {
+	modTime time.Time
+	size    int64
+	files   int64
+	oldest  time.Time
+	subdirs []string
+}
+
+// GetStorageReport returns the cached moodledata breakdown. A background scan
+// is started when there is no breakdown yet, it is older than the scan
+// interval or refresh is set; Scanning is set while it runs.
+func (m *MoodleService) GetStorageReport(refresh bool) (*models.StorageReport, error) {
+	dataPath, err := m.storageDataPath()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &m.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.report != nil && s.report.DataPath == dataPath
+	maxAge := time.Duration(m.config.Storage.ScanInterval) * time.Second
+	if !s.scanning && (!current || refresh || s.stale || time.Since(*s.report.ScannedAt) > maxAge) {
+		s.scanning = true
+		go m.scanStorage(dataPath)
+	}
+
+	report := &models.StorageReport{DataPath: dataPath}
+	if current {
+		copied := *s.report
+		report = &copied
+	}
+	report.Scanning = s.scanning
+	return report, nil
+}
+
+// ScanStorage walks moodledata and returns the breakdown
+func (m *MoodleService) ScanStorage() (*models.StorageReport, error) {
+	dataPath, err := m.storageDataPath()
+	if err != nil {
+		return nil, err
+	}
+
+	m.storage.mu.Lock()
+	m.storage.scanning = true
+	m.storage.mu.Unlock()
+
+	return m.scanStorage(dataPath), nil
+}
+
+// storageDataPath returns the moodledata path if it exists
+func (m *MoodleService) storageDataPath() (string, error) {
+	dataPath := m.dataPath()
+	if dataPath == "" {
+		return "", fmt.Errorf("Moodle data path is not configured")
+	}
+
+	if info, err := os.Stat(dataPath); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("Moodle data directory not found: %s", dataPath)
+	}
+
+	return dataPath, nil
+}
+
+// scanStorage walks every area of moodledata and caches the breakdown
+func (m *MoodleService) scanStorage(dataPath string) *models.StorageReport {
+	s := &m.storage
+	s.scanMu.Lock()
+	defer s.scanMu.Unlock()
+
+	started := time.Now()
+	report := &models.StorageReport{DataPath: dataPath}
+	dirs := make(map[string]*dirSummary)
+
+	known := make(map[string]bool)
+	for _, name := range moodledataAreas {
+		known[name] = true
+
+		area := models.StorageArea{Name: name, Path: filepath.Join(dataPath, name)}
+		if info, err := os.Stat(area.Path); err == nil && info.IsDir() {
+			area.Exists = true
+
+			var next map[string]*dirSummary
+			if incrementalAreas[name] {
+				next = dirs
+			}
+			walkStorage(area.Path, &area, s.dirs, next)
+		}
+		report.Areas = append(report.Areas, area)
+	}
+
+	other := models.StorageArea{Name: storageOtherArea, Path: dataPath, Exists: true}
+	entries, err := os.ReadDir(dataPath)
+	if err != nil {
+		other.Error = err.Error()
+	}
+	for _, entry := range entries {
+		if known[entry.Name()] {
+			continue
+		}
+
+		path := filepath.Join(dataPath, entry.Name())
+		if entry.IsDir() {
+			walkStorage(path, &other, nil, nil)
+			continue
+		}
+
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			addStorageFile(&other, info)
+		}
+	}
+	report.Areas = append(report.Areas, other)
+
+	for _, area := range report.Areas {
+		report.Size += area.Size
+		report.Files += area.Files
+	}
+
+	scannedAt := time.Now()
+	report.ScannedAt = &scannedAt
+	report.Duration = scannedAt.Sub(started).Milliseconds()
+	s.dirs = dirs
+
+	s.mu.Lock()
+	s.report = report
+	s.scanning = false
+	s.stale = false
+	s.mu.Unlock()
+
+	utils.Info("Moodle data scanned: %s in %d files (%dms)", utils.FormatBytes(report.Size), report.Files, report.Duration)
+
+	copied := *report
+	return &copied
+}
+
+// walkStorage adds the files below dir to area. Summaries of unchanged
+// directories are taken from previous and every summary is stored in next;
+// a nil next disables the cache. The first error is recorded on the area.
+func walkStorage(dir string, area *models.StorageArea, previous, next map[string]*dirSummary) {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		if area.Error == "" && !os.IsNotExist(err) {
+			area.Error = err.Error()
+		}
+		return
+	}
+
+	summary := previous[dir]
+	if next == nil || summary == nil || !summary.modTime.Equal(info.ModTime()) {
+		summary, err = summarizeDir(dir, info.ModTime())
+		if err != nil {
+			if area.Error == "" {
+				area.Error = err.Error()
+			}
+			return
+		}
+	}
+	if next != nil {
+		next[dir] = summary
+	}
+
+	area.Size += summary.size
+	area.Files += summary.files
+	if summary.files > 0 && (area.OldestFile == nil || summary.oldest.Before(*area.OldestFile)) {
+		oldest := summary.oldest
+		area.OldestFile = &oldest
+	}
+
+	for _, subdir := range summary.subdirs {
+		walkStorage(filepath.Join(dir, subdir), area, previous, next)
+	}
+}
+
+// summarizeDir totals the regular files directly in dir. Symbolic links are
+// not followed.
+func summarizeDir(dir string, modTime time.Time) (*dirSummary, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &dirSummary{modTime: modTime}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			summary.subdirs = append(summary.subdirs, entry.Name())
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		summary.size += info.Size()
+		summary.files++
+		if summary.oldest.IsZero() || info.ModTime().Before(summary.oldest) {
+			summary.oldest = info.ModTime()
+		}
+	}
+
+	return summary, nil
+}
+
+// addStorageFile adds a single file to an area
+func addStorageFile(area *models.StorageArea, info os.FileInfo) {
+	area.Size += info.Size()
+	area.Files++
+	if area.OldestFile == nil || info.ModTime().Before(*area.OldestFile) {
+		modTime := info.ModTime()
+		area.OldestFile = &modTime
+	}
+}
+
+// CleanupStorage deletes the files older than the threshold from cleanable
+// moodledata areas, then the directories left empty. Symbolic links are
+// never followed or deleted. A dry run only lists what would be deleted.
+func (m *MoodleService) CleanupStorage(req models.StorageCleanupRequest) (*models.StorageCleanupResult, error) {
+	dataPath, err := m.storageDataPath()
+	if err != nil {
+		return nil, err
+	}
+
+	areas := req.Areas
+	if len(areas) == 0 {
+		areas = defaultCleanupAreas
+	}
+	for _, area := range areas {
+		if !cleanableAreas[area] {
+			return nil, fmt.Errorf("moodledata area cannot be cleaned up: %s", area)
+		}
+	}
+
+	olderThan := req.OlderThan
+	if olderThan == 0 {
+		olderThan = m.config.Storage.CleanupAge
+	}
+	if olderThan <= 0 {
+		return nil, fmt.Errorf("cleanup age must be positive")
+	}
+
+	result := &models.StorageCleanupResult{
+		DryRun:    req.DryRun,
+		Areas:     areas,
+		OlderThan: olderThan,
+		Entries:   []string{},
+	}
+
+	cleanup := &storageCleanup{
+		dataPath: dataPath,
+		cutoff:   time.Now().Add(-time.Duration(olderThan) * time.Hour),
+		dryRun:   req.DryRun,
+		result:   result,
+	}
+	for _, area := range areas {
+		root := filepath.Join(dataPath, area)
+		if info, err := os.Lstat(root); err != nil || !info.IsDir() {
+			continue
+		}
+		cleanup.clean(root)
+	}
+
+	if !req.DryRun {
+		if result.Files > 0 || result.Directories > 0 {
+			m.storage.mu.Lock()
+			m.storage.stale = true
+			m.storage.mu.Unlock()
+		}
+		utils.Info("Moodle data cleaned up: %d files and %d directories (%s) older than %dh removed", result.Files, result.Directories, utils.FormatBytes(result.Size), olderThan)
+	}
+
+	return result, nil
+}
+
+// storageCleanup holds the state of a cleanup run
+type storageCleanup struct {
+	dataPath string
+	cutoff   time.Time
+	dryRun   bool
+	result   *models.StorageCleanupResult
+}
+
+// clean deletes the old files below dir and reports whether dir is left empty
+func (c *storageCleanup) clean(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		c.result.Errors = append(c.result.Errors, err.Error())
+		return false
+	}
+
+	empty := true
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		// Taken before descending, as deleting files updates the directory
+		info, err := entry.Info()
+		if err != nil {
+			if !os.IsNotExist(err) {
+				empty = false
+				c.result.Errors = append(c.result.Errors, err.Error())
+			}
+			continue
+		}
+
+		switch {
+		case info.IsDir():
+			if !c.clean(path) || !info.ModTime().Before(c.cutoff) {
+				empty = false
+				continue
+			}
+			if c.remove(path) {
+				c.result.Directories++
+			} else {
+				empty = false
+			}
+		case info.Mode().IsRegular() && info.ModTime().Before(c.cutoff):
+			if c.remove(path) {
+				c.result.Files++
+				c.result.Size += info.Size()
+			} else {
+				empty = false
+			}
+		default:
+			empty = false
+		}
+	}
+
+	return empty
+}
+
+// remove deletes a file or empty directory and lists it in the result
+func (c *storageCleanup) remove(path string) bool {
+	if !c.dryRun {
+		if err := os.Remove(path); err != nil {
+			c.result.Errors = append(c.result.Errors, err.Error())
+			return false
+		}
+	}
+
+	if len(c.result.Entries) < storageCleanupPreview {
+		relative, _ := filepath.Rel(c.dataPath, path)
+		c.result.Entries = append(c.result.Entries, filepath.ToSlash(relative))
+	} else {
+		c.result.Truncated = true
+	}
+	return true
+}
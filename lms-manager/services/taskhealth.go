@@ -0,0 +1,316 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// Task health alert types
+const (
+	AlertTaskFailing     = "moodle_task_failing"
+	AlertTaskOverdue     = "moodle_task_overdue"
+	AlertAdhocQueueStuck = "moodle_adhoc_queue_stuck"
+)
+
+// taskAlertListLimit caps the tasks named in an alert message
+const taskAlertListLimit = 5
+
+// TaskHealthService reads the Moodle scheduled and adhoc task tables with
+// the credentials of config.php
+type TaskHealthService struct {
+	config   config.TaskHealthConfig
+	moodle   *MoodleService
+	monitor  *MonitorService
+	mu       sync.RWMutex
+	sampleMu sync.Mutex
+	stopChan chan bool
+	running  bool
+	health   *models.TaskHealth
+	failing  bool
+}
+
+// NewTaskHealthService creates a new task health collector
+func NewTaskHealthService(cfg config.TaskHealthConfig, moodle *MoodleService, monitor *MonitorService) *TaskHealthService {
+	return &TaskHealthService{
+		config:   cfg,
+		moodle:   moodle,
+		monitor:  monitor,
+		stopChan: make(chan bool),
+	}
+}
+
+// Enabled reports whether the task health collector is enabled
+func (t *TaskHealthService) Enabled() bool {
+	return t.config.Enabled
+}
+
+// Start starts reading the task tables on the configured interval
+func (t *TaskHealthService) Start() {
+	if t.running {
+		return
+	}
+
+	if !t.config.Enabled {
+		utils.Info("Task health collector is disabled")
+		return
+	}
+
+	t.running = true
+	go t.collectLoop()
+	utils.Info("Task health collector started (every %ds)", t.config.Interval)
+}
+
+// Stop stops reading the task tables
+func (t *TaskHealthService) Stop() {
+	if !t.running {
+		return
+	}
+
+	t.running = false
+	t.stopChan <- true
+	utils.Info("Task health collector stopped")
+}
+
+// collectLoop samples the task tables and checks the alerts on every tick
+func (t *TaskHealthService) collectLoop() {
+	ticker := time.NewTicker(time.Duration(t.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	t.collect()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.collect()
+		case <-t.stopChan:
+			return
+		}
+	}
+}
+
+// collect takes a sample and hands it to the alert engine
+func (t *TaskHealthService) collect() {
+	health, err := t.Sample()
+
+	t.mu.Lock()
+	changed := t.failing != (err != nil)
+	t.failing = err != nil
+	t.mu.Unlock()
+
+	if err != nil {
+		if changed {
+			utils.Warn("Failed to collect task health: %v", err)
+		}
+		return
+	}
+
+	if t.monitor != nil {
+		t.monitor.CheckTaskHealth(health)
+	}
+}
+
+// GetHealth returns the latest task health, sampling the task tables when it
+// is older than the collection interval
+func (t *TaskHealthService) GetHealth() (*models.TaskHealth, error) {
+	t.mu.RLock()
+	health := t.health
+	t.mu.RUnlock()
+
+	maxAge := time.Duration(t.config.Interval) * time.Second
+	if health != nil && time.Since(health.Timestamp) < maxAge {
+		return health, nil
+	}
+
+	return t.Sample()
+}
+
+// Sample reads the failing and overdue scheduled tasks and the adhoc task
+// queues from the Moodle database
+func (t *TaskHealthService) Sample() (*models.TaskHealth, error) {
+	t.sampleMu.Lock()
+	defer t.sampleMu.Unlock()
+
+	site, err := t.moodle.GetSiteConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	scheduledTable, err := moodleTable(site, "task_scheduled")
+	if err != nil {
+		return nil, err
+	}
+	adhocTable, err := moodleTable(site, "task_adhoc")
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := openMoodleDatabase(site)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+	defer cancel()
+
+	now := time.Now()
+	scheduled, err := queryScheduledTasks(ctx, conn, scheduledTable, now)
+	if err != nil {
+		return nil, err
+	}
+	adhoc, err := queryAdhocTaskQueues(ctx, conn, adhocTable, now)
+	if err != nil {
+		return nil, err
+	}
+
+	health := NewTaskHealth(t.config, scheduled, adhoc, now)
+
+	t.mu.Lock()
+	t.health = health
+	t.mu.Unlock()
+
+	return health, nil
+}
+
+// queryScheduledTasks reads the scheduled tasks that failed or whose next
+// run time has passed. Times are Unix timestamps, inlined as the MySQL and
+// PostgreSQL drivers use different placeholders.
+func queryScheduledTasks(ctx context.Context, conn *sql.DB, table string, now time.Time) ([]models.ScheduledTask, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`
+		SELECT classname, component, lastruntime, nextruntime, faildelay, disabled
+		FROM %s
+		WHERE faildelay > 0 OR (disabled = 0 AND nextruntime < %d)
+	`, table, now.Unix()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var tasks []models.ScheduledTask
+	for rows.Next() {
+		var task models.ScheduledTask
+		var lastRun, nextRun sql.NullInt64
+		var disabled int
+		if err := rows.Scan(&task.Classname, &task.Component, &lastRun, &nextRun, &task.FailDelay, &disabled); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", table, err)
+		}
+		if lastRun.Int64 > 0 {
+			lastRunTime := time.Unix(lastRun.Int64, 0)
+			task.LastRunTime = &lastRunTime
+		}
+		task.NextRunTime = time.Unix(nextRun.Int64, 0)
+		task.Disabled = disabled != 0
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// queryAdhocTaskQueues counts the queued, due and failing adhoc tasks of
+// every class
+func queryAdhocTaskQueues(ctx context.Context, conn *sql.DB, table string, now time.Time) ([]models.AdhocTaskQueue, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`
+		SELECT classname, COUNT(*),
+			SUM(CASE WHEN nextruntime <= %[2]d THEN 1 ELSE 0 END),
+			SUM(CASE WHEN faildelay > 0 THEN 1 ELSE 0 END),
+			MIN(CASE WHEN nextruntime <= %[2]d THEN nextruntime END)
+		FROM %[1]s
+		GROUP BY classname
+	`, table, now.Unix()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var queues []models.AdhocTaskQueue
+	for rows.Next() {
+		var queue models.AdhocTaskQueue
+		var oldestDue sql.NullInt64
+		if err := rows.Scan(&queue.Classname, &queue.Queued, &queue.Due, &queue.Failing, &oldestDue); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", table, err)
+		}
+		if oldestDue.Valid {
+			oldest := time.Unix(oldestDue.Int64, 0)
+			queue.OldestDue = &oldest
+		}
+		queues = append(queues, queue)
+	}
+
+	return queues, rows.Err()
+}
+
+// NewTaskHealth computes the task health from the scheduled tasks and adhoc
+// task queues read at now. Disabled tasks are neither failing nor overdue.
+func NewTaskHealth(cfg config.TaskHealthConfig, scheduled []models.ScheduledTask, adhoc []models.AdhocTaskQueue, now time.Time) *models.TaskHealth {
+	health := &models.TaskHealth{
+		Failing:   []models.ScheduledTask{},
+		Overdue:   []models.ScheduledTask{},
+		Adhoc:     []models.AdhocTaskQueue{},
+		Timestamp: now,
+	}
+
+	overdueAfter := int64(cfg.OverdueAfter) * 60
+	for _, task := range scheduled {
+		if task.Disabled {
+			continue
+		}
+		if task.NextRunTime.Before(now) {
+			task.Overdue = int64(now.Sub(task.NextRunTime).Seconds())
+		}
+
+		if task.FailDelay > 0 {
+			health.Failing = append(health.Failing, task)
+		}
+		if task.Overdue > overdueAfter {
+			health.Overdue = append(health.Overdue, task)
+		}
+	}
+
+	maxAge := int64(cfg.AdhocMaxAge) * 60
+	for _, queue := range adhoc {
+		if queue.OldestDue != nil {
+			queue.OldestAge = int64(now.Sub(*queue.OldestDue).Seconds())
+		}
+		queue.Stuck = queue.OldestAge > maxAge || queue.Due > cfg.AdhocMaxQueued
+
+		health.AdhocQueued += queue.Queued
+		health.AdhocFailing += queue.Failing
+		if queue.OldestAge > health.OldestAdhocAge {
+			health.OldestAdhocAge = queue.OldestAge
+		}
+		health.Adhoc = append(health.Adhoc, queue)
+	}
+
+	sort.Slice(health.Failing, func(i, j int) bool {
+		return health.Failing[i].FailDelay > health.Failing[j].FailDelay
+	})
+	sort.Slice(health.Overdue, func(i, j int) bool {
+		return health.Overdue[i].Overdue > health.Overdue[j].Overdue
+	})
+	sort.Slice(health.Adhoc, func(i, j int) bool {
+		if health.Adhoc[i].Queued != health.Adhoc[j].Queued {
+			return health.Adhoc[i].Queued > health.Adhoc[j].Queued
+		}
+		return health.Adhoc[i].Classname < health.Adhoc[j].Classname
+	})
+
+	return health
+}
+
+// joinTasks joins the tasks named in an alert, listing at most
+// taskAlertListLimit of them
+func joinTasks(tasks []string) string {
+	if len(tasks) <= taskAlertListLimit {
+		return strings.Join(tasks, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(tasks[:taskAlertListLimit], ", "), len(tasks)-taskAlertListLimit)
+}
@@ -0,0 +1,657 @@
+package services
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// upgradeCronWait is how long an upgrade waits for a cron run in progress
+const upgradeCronWait = 5 * time.Minute
+
+// upgradeRun holds the state of a core upgrade, so that a failure can be
+// rolled back from the point it reached
+type upgradeRun struct {
+	m     *MoodleService
+	ctx   context.Context
+	w     io.Writer
+	req   models.UpgradeRequest
+	stamp string
+
+	current  *models.MoodleVersion
+	target   *models.MoodleVersion
+	site     *models.MoodleSiteConfig
+	staging  string
+	staged   string
+	oldPath  string
+	dumpFile string
+
+	maintenance bool
+	swapped     bool
+	upgraded    bool
+}
+
+// Upgrade upgrades Moodle core from a local release archive. The new code is
+// staged next to the current code and checked, maintenance mode is enabled
+// and a backup taken, then the code directories are swapped and
+// admin/cli/upgrade.php is run. Any failure restores the old code and
+// database. Cron is paused until the upgrade or rollback is done, and the
+// upgrade is refused if a cron run does not finish in time. Progress is
+// written to w so the upgrade can run as a job.
+func (m *MoodleService) Upgrade(ctx context.Context, w io.Writer, req models.UpgradeRequest) error {
+	run := &upgradeRun{
+		m:     m,
+		ctx:   ctx,
+		w:     w,
+		req:   req,
+		stamp: time.Now().Format("20060102-150405"),
+	}
+
+	if m.cron != nil {
+		run.logf("Pausing cron")
+		if err := m.cron.Pause(upgradeCronWait); err != nil {
+			return fmt.Errorf("cannot upgrade while cron is running: %v", err)
+		}
+		defer m.cron.Resume()
+	}
+
+	err := run.execute()
+	if err == nil {
+		return nil
+	}
+
+	run.logf("Upgrade failed: %v", err)
+	utils.Error("Moodle upgrade failed: %v", err)
+
+	if rollbackErr := run.rollback(); rollbackErr != nil {
+		run.logf("Rollback failed: %v", rollbackErr)
+		utils.Error("Moodle upgrade rollback failed: %v", rollbackErr)
+		return fmt.Errorf("%w; rollback failed: %v", err, rollbackErr)
+	}
+
+	return err
+}
+
+// execute runs the upgrade steps in order
+func (r *upgradeRun) execute() error {
+	steps := []struct {
+		name string
+		fn   func() error
+	}{
+		{"Staging new code", r.stage},
+		{"Checking requirements", r.check},
+		// Users are locked out before the dump, so the rollback loses no
+		// writes
+		{"Enabling maintenance mode", r.enableMaintenance},
+		{"Backing up code and database", r.backup},
+		{"Swapping code directories", r.swap},
+		{"Running admin/cli/upgrade.php", r.upgrade},
+		{"Verifying the upgrade", r.verify},
+	}
+
+	for i, step := range steps {
+		if err := r.ctx.Err(); err != nil {
+			return err
+		}
+
+		r.logf("[%d/%d] %s", i+1, len(steps), step.name)
+		if err := step.fn(); err != nil {
+			return fmt.Errorf("%s: %w", strings.ToLower(step.name), err)
+		}
+	}
+
+	r.finish()
+	return nil
+}
+
+// stage extracts the archive next to the current code and prepares it with
+// the current config.php and add-on plugins
+func (r *upgradeRun) stage() error {
+	path := r.m.config.Path
+
+	if err := r.m.checkUpgradeArchive(r.req.Archive); err != nil {
+		return err
+	}
+
+	current, err := r.m.GetVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read the current version: %v", err)
+	}
+	r.current = current
+
+	// Staged on the same file system, so the swap is a rename
+	r.staging = filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s-upgrade-%s", filepath.Base(path), r.stamp))
+	if err := os.Mkdir(r.staging, 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+
+	var cmd *exec.Cmd
+	archive := strings.ToLower(r.req.Archive)
+	switch {
+	case strings.HasSuffix(archive, ".tgz"), strings.HasSuffix(archive, ".tar.gz"):
+		cmd = exec.Command("tar", "-xzf", r.req.Archive, "-C", r.staging)
+	case strings.HasSuffix(archive, ".zip"):
+		cmd = exec.Command("unzip", "-q", r.req.Archive, "-d", r.staging)
+	default:
+		return fmt.Errorf("unsupported archive format: %s", r.req.Archive)
+	}
+	cmd.Stdout = r.w
+	cmd.Stderr = r.w
+	if err := runCommand(r.ctx, cmd); err != nil {
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+
+	r.staged, err = findMoodleRoot(r.staging)
+	if err != nil {
+		return err
+	}
+
+	target, err := ParseMoodleVersion(filepath.Join(r.staged, "version.php"))
+	if err != nil {
+		return err
+	}
+	r.target = target
+
+	if target.Number < current.Number {
+		return fmt.Errorf("downgrading Moodle %s to %s is not supported", current.Release, target.Release)
+	}
+	if target.Maturity != "stable" && !r.req.AllowUnstable {
+		return fmt.Errorf("Moodle %s is a %s build", target.Release, target.Maturity)
+	}
+	r.logf("Upgrading Moodle %s to %s", current.Release, target.Release)
+
+	configFile := filepath.Join(path, "config.php")
+	if !utils.FileExists(configFile) {
+		configFile = r.m.config.ConfigPath
+	}
+	if err := copyPreserving(configFile, filepath.Join(r.staged, "config.php")); err != nil {
+		return fmt.Errorf("failed to copy config.php: %v", err)
+	}
+
+	return r.stageAddOns()
+}
+
+// stageAddOns copies the add-on plugins missing from the new code and checks
+// that every plugin supports the new core version
+func (r *upgradeRun) stageAddOns() error {
+	inventory, err := ScanMoodlePlugins(r.m.config.Path)
+	if err != nil {
+		return err
+	}
+	for _, warning := range inventory.Warnings {
+		r.logf("Warning: %s", warning)
+	}
+
+	var addOns []models.MoodlePlugin
+	for _, plugin := range inventory.Plugins {
+		if plugin.AddOn {
+			addOns = append(addOns, plugin)
+		}
+	}
+
+	// Parents first, so subplugins of add-ons come along with them
+	sort.Slice(addOns, func(i, j int) bool {
+		return len(addOns[i].Path) < len(addOns[j].Path)
+	})
+
+	for _, plugin := range addOns {
+		target := filepath.Join(r.staged, filepath.FromSlash(plugin.Path))
+		if utils.FileExists(target) {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", plugin.Component, err)
+		}
+		if err := copyPreserving(filepath.Join(r.m.config.Path, filepath.FromSlash(plugin.Path)), target); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", plugin.Component, err)
+		}
+		r.logf("Copied add-on %s", plugin.Component)
+	}
+
+	staged, err := ScanMoodlePlugins(r.staged)
+	if err != nil {
+		return err
+	}
+	CheckPluginRequirements(staged, r.target)
+
+	var incompatible []string
+	for _, plugin := range staged.Plugins {
+		if plugin.Incompatible {
+			incompatible = append(incompatible, plugin.Component)
+		}
+	}
+	if len(incompatible) > 0 {
+		return fmt.Errorf("plugins require a newer Moodle version: %s", strings.Join(incompatible, ", "))
+	}
+
+	return nil
+}
+
+// check verifies the Moodle and PHP requirements of the new version
+func (r *upgradeRun) check() error {
+	phpVersion, err := r.m.phpVersion()
+	if err != nil {
+		return err
+	}
+	r.logf("PHP %s", phpVersion)
+
+	support := LookupMoodleSupport(r.target.Branch, time.Now())
+	if support.Status == models.SupportUnknown {
+		r.logf("Warning: Moodle branch %s is not in the support matrix", r.target.Branch)
+	} else if support.MaxPHP != "" && compareVersions(phpVersion, support.MaxPHP+".99") > 0 {
+		r.logf("Warning: PHP %s is newer than the PHP %s supported by Moodle %s", phpVersion, support.MaxPHP, support.Name)
+	}
+
+	environment, err := LoadMoodleEnvironment(filepath.Join(r.staged, "admin", "environment.xml"), r.target.Branch)
+	if err != nil {
+		return err
+	}
+
+	currentRelease := releaseNumber(r.current.Release)
+	if environment.Requires != "" && compareVersions(currentRelease, environment.Requires) < 0 {
+		return fmt.Errorf("Moodle %s can only be upgraded from %s or later, this site runs %s", environment.Version, environment.Requires, currentRelease)
+	}
+
+	if environment.PHP.Version != "" && compareVersions(phpVersion, environment.PHP.Version) < 0 {
+		return fmt.Errorf("Moodle %s requires PHP %s or later", environment.Version, environment.PHP.Version)
+	}
+
+	extensions, err := r.m.phpExtensions()
+	if err != nil {
+		return err
+	}
+
+	var missing []string
+	for _, extension := range environment.Extensions {
+		if extensions[strings.ToLower(extension.Name)] {
+			continue
+		}
+		if extension.Level == "required" {
+			missing = append(missing, extension.Name)
+		} else {
+			r.logf("Warning: optional PHP extension %s is not installed", extension.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required PHP extensions: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// backup takes the code and database backup used for the rollback
+func (r *upgradeRun) backup() error {
+	site, err := r.m.GetSiteConfig()
+	if err != nil {
+		return err
+	}
+	r.site = site
+
+	backupFile, dumpFile, err := r.m.backup(r.m.config.Upgrade.BackupPath, true)
+	if err != nil {
+		return err
+	}
+	r.dumpFile = dumpFile
+
+	r.logf("Code backup: %s", backupFile)
+	r.logf("Database backup: %s", dumpFile)
+	return nil
+}
+
+// checkUpgradeArchive checks that an archive exists in the configured archive
+// directory, so that no other file on the host can be installed as Moodle
+func (m *MoodleService) checkUpgradeArchive(archive string) error {
+	if !filepath.IsAbs(archive) || !utils.FileExists(archive) {
+		return fmt.Errorf("archive not found: %s", archive)
+	}
+
+	dir, err := filepath.EvalSymlinks(m.config.Upgrade.ArchivePath)
+	if err != nil {
+		return fmt.Errorf("archive directory not found: %s", m.config.Upgrade.ArchivePath)
+	}
+	resolved, err := filepath.EvalSymlinks(archive)
+	if err != nil {
+		return fmt.Errorf("archive not found: %s", archive)
+	}
+
+	relative, err := filepath.Rel(dir, resolved)
+	if err != nil || relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("archives must be uploaded to %s", m.config.Upgrade.ArchivePath)
+	}
+	return nil
+}
+
+// enableMaintenance keeps users out during the upgrade
+func (r *upgradeRun) enableMaintenance() error {
+	if r.m.GetMaintenanceStatus().Enabled {
+		r.logf("Maintenance mode is already enabled")
+		return nil
+	}
+
+	if err := r.m.EnableMaintenance(models.MaintenanceModeFile, ""); err != nil {
+		return err
+	}
+	r.maintenance = true
+	return nil
+}
+
+// swap moves the staged code into place, keeping the old code for rollback
+func (r *upgradeRun) swap() error {
+	path := r.m.config.Path
+	r.oldPath = fmt.Sprintf("%s.pre-upgrade-%s", path, r.stamp)
+
+	if err := os.Rename(path, r.oldPath); err != nil {
+		return fmt.Errorf("failed to move the current code: %v", err)
+	}
+
+	if err := os.Rename(r.staged, path); err != nil {
+		if restoreErr := os.Rename(r.oldPath, path); restoreErr != nil {
+			return fmt.Errorf("failed to move the new code: %v; failed to restore the old code: %v", err, restoreErr)
+		}
+		return fmt.Errorf("failed to move the new code: %v", err)
+	}
+
+	r.swapped = true
+	r.m.restartPHP(r.w)
+	return nil
+}
+
+// upgrade runs the Moodle database upgrade
+func (r *upgradeRun) upgrade() error {
+	args := []string{"--non-interactive"}
+	if r.req.AllowUnstable {
+		args = append(args, "--allow-unstable")
+	}
+
+	cmd, err := r.m.moodleCLICommand("admin/cli/upgrade.php", args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = r.w
+	cmd.Stderr = r.w
+
+	r.upgraded = true
+	return runCommand(r.ctx, cmd)
+}
+
+// verify checks that the code and database versions match and nothing is
+// left to upgrade
+func (r *upgradeRun) verify() error {
+	version, err := r.m.GetVersion()
+	if err != nil {
+		return err
+	}
+	if version.Version != r.target.Version {
+		return fmt.Errorf("code version is %s, expected %s", version.Version, r.target.Version)
+	}
+
+	output, err := r.m.runMoodleCLI("admin/cli/cfg.php", "--name=version")
+	if err != nil {
+		return err
+	}
+	dbVersion, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+	if err != nil {
+		return fmt.Errorf("unexpected database version %q", strings.TrimSpace(output))
+	}
+	if math.Abs(dbVersion-r.target.Number) > 0.001 {
+		return fmt.Errorf("database version is %s, expected %s", strings.TrimSpace(output), r.target.Version)
+	}
+
+	cmd, err := r.m.moodleCLICommand("admin/cli/upgrade.php", "--is-pending")
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		if exitCode(err) == 2 {
+			return fmt.Errorf("an upgrade is still pending")
+		}
+		return fmt.Errorf("failed to check for pending upgrades: %v", err)
+	}
+
+	r.logf("Moodle %s is installed", version.Release)
+	return nil
+}
+
+// finish removes the old code and takes the site out of maintenance mode
+func (r *upgradeRun) finish() {
+	if err := os.RemoveAll(r.oldPath); err != nil {
+		r.logf("Warning: failed to remove the old code: %v", err)
+	}
+	os.RemoveAll(r.staging)
+
+	if r.maintenance {
+		if err := r.m.DisableMaintenance(); err != nil {
+			r.logf("Warning: failed to disable maintenance mode: %v", err)
+		}
+	}
+
+	r.logf("Upgrade complete")
+	utils.Info("Moodle upgraded from %s to %s", r.current.Release, r.target.Release)
+}
+
+// rollback restores the old code and database. Maintenance mode stays on
+// when the rollback fails.
+func (r *upgradeRun) rollback() error {
+	var errs []string
+	path := r.m.config.Path
+
+	if r.swapped {
+		r.logf("Restoring the previous code")
+		failedPath := fmt.Sprintf("%s.failed-%s", path, r.stamp)
+		if err := os.Rename(path, failedPath); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to move the new code: %v", err))
+		} else if err := os.Rename(r.oldPath, path); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to restore the old code from %s: %v", r.oldPath, err))
+		} else {
+			os.RemoveAll(failedPath)
+			r.m.restartPHP(r.w)
+		}
+	}
+
+	if r.upgraded {
+		r.logf("Restoring the database from %s", r.dumpFile)
+		if err := restoreDatabase(r.site, r.dumpFile); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to restore the database: %v", err))
+		}
+	}
+
+	if r.staging != "" {
+		os.RemoveAll(r.staging)
+	}
+
+	if len(errs) > 0 {
+		r.logf("Leaving maintenance mode enabled")
+		return errors.New(strings.Join(errs, "; "))
+	}
+
+	if r.maintenance {
+		if err := r.m.DisableMaintenance(); err != nil {
+			r.logf("Warning: failed to disable maintenance mode: %v", err)
+		}
+	}
+
+	r.logf("Rollback complete")
+	return nil
+}
+
+// logf writes a progress line to the job output
+func (r *upgradeRun) logf(format string, args ...interface{}) {
+	fmt.Fprintf(r.w, "==> "+format+"\n", args...)
+}
+
+// restartPHP restarts PHP-FPM so that no cached code of the old version is
+// served
+func (m *MoodleService) restartPHP(w io.Writer) {
+	for _, component := range m.config.Components {
+		if component.Type != config.ComponentPHPFPM {
+			continue
+		}
+		if err := m.manager.Restart(component.Unit); err != nil {
+			fmt.Fprintf(w, "==> Warning: failed to restart %s: %v\n", component.Unit, err)
+		}
+	}
+}
+
+// phpVersion returns the version of the configured PHP binary
+func (m *MoodleService) phpVersion() (string, error) {
+	output, err := exec.Command(m.phpBinary(), "-r", "echo PHP_VERSION;").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get PHP version: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// phpExtensions returns the loaded extensions of the configured PHP binary
+func (m *MoodleService) phpExtensions() (map[string]bool, error) {
+	output, err := exec.Command(m.phpBinary(), "-m").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PHP extensions: %v", err)
+	}
+
+	extensions := make(map[string]bool)
+	for _, line := range strings.Split(string(output), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "[") {
+			extensions[strings.ToLower(line)] = true
+		}
+	}
+	return extensions, nil
+}
+
+// phpBinary returns the configured PHP binary
+func (m *MoodleService) phpBinary() string {
+	if m.config.PHPBinary == "" {
+		return "php"
+	}
+	return m.config.PHPBinary
+}
+
+// MoodleEnvironment represents the requirements of a Moodle version from
+// admin/environment.xml
+type MoodleEnvironment struct {
+	Version  string `xml:"version,attr"`
+	Requires string `xml:"requires,attr"`
+	PHP      struct {
+		Version string `xml:"version,attr"`
+	} `xml:"PHP"`
+	Extensions []struct {
+		Name  string `xml:"name,attr"`
+		Level string `xml:"level,attr"`
+	} `xml:"PHP_EXTENSIONS>PHP_EXTENSION"`
+}
+
+// LoadMoodleEnvironment returns the requirements of a branch from an
+// environment.xml file
+func LoadMoodleEnvironment(path, branch string) (*MoodleEnvironment, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment.xml: %v", err)
+	}
+
+	var matrix struct {
+		Moodle []MoodleEnvironment `xml:"MOODLE"`
+	}
+	if err := xml.Unmarshal(content, &matrix); err != nil {
+		return nil, fmt.Errorf("failed to parse environment.xml: %v", err)
+	}
+
+	version := branchVersion(branch)
+	for i := range matrix.Moodle {
+		if matrix.Moodle[i].Version == version {
+			return &matrix.Moodle[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Moodle %s not found in environment.xml", version)
+}
+
+// branchVersion converts a branch such as 401 or 311 to 4.1 or 3.11
+func branchVersion(branch string) string {
+	if len(branch) < 2 {
+		return branch
+	}
+	minor, err := strconv.Atoi(branch[1:])
+	if err != nil {
+		return branch
+	}
+	return fmt.Sprintf("%s.%d", branch[:1], minor)
+}
+
+// releaseNumber returns the leading version number of a release name, e.g.
+// 4.1.3 for "4.1.3 (Build: 20230424)"
+func releaseNumber(release string) string {
+	end := 0
+	for end < len(release) && (release[end] == '.' || (release[end] >= '0' && release[end] <= '9')) {
+		end++
+	}
+	return strings.TrimRight(release[:end], ".")
+}
+
+// compareVersions compares dotted version numbers, treating missing parts as 0
+func compareVersions(a, b string) int {
+	partsA := strings.Split(releaseNumber(a), ".")
+	partsB := strings.Split(releaseNumber(b), ".")
+
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numA, numB int
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+		if numA != numB {
+			if numA < numB {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// findMoodleRoot returns the directory of an extracted archive that holds
+// the Moodle code, either the directory itself or its only subdirectory
+func findMoodleRoot(dir string) (string, error) {
+	if utils.FileExists(filepath.Join(dir, "version.php")) {
+		return dir, nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		root := filepath.Join(dir, entries[0].Name())
+		if utils.FileExists(filepath.Join(root, "version.php")) {
+			return root, nil
+		}
+	}
+
+	return "", fmt.Errorf("archive does not contain a Moodle code tree")
+}
+
+// copyPreserving copies a file or directory keeping its mode and ownership
+func copyPreserving(src, dst string) error {
+	output, err := exec.Command("cp", "-a", src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,597 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// usageBucket is the length of a usage bucket
+const usageBucket = 5 * time.Minute
+
+// usageOpenWindow is how long the users of a bucket are kept to count the
+// events logged late into it. Older buckets keep their count.
+const usageOpenWindow = time.Hour
+
+// usageMaxBatches bounds the batches read in one poll, so a backlog is
+// caught up over several polls
+const usageMaxBatches = 20
+
+// usageTopLimit is the number of courses and modules in a usage report
+const usageTopLimit = 10
+
+// Moodle constants used to classify log events
+const (
+	moodleSiteID        = 1
+	moodleContextModule = 70
+	moodleLoginEvent    = `\core\event\user_loggedin`
+)
+
+// Usage activity kinds
+const (
+	usageKindCourse = "course"
+	usageKindModule = "module"
+)
+
+// UsageEvent is an event of the Moodle standard log store
+type UsageEvent struct {
+	ID                int64
+	EventName         string
+	Component         string
+	ContextLevel      int
+	ContextInstanceID int64
+	UserID            int64
+	CourseID          int64
+	Time              time.Time
+}
+
+// UsageService follows the Moodle standard log store and the sessions table
+// and keeps the LMS usage as 5-minute time series
+type UsageService struct {
+	config    config.UsageConfig
+	moodle    *MoodleService
+	monitor   *MonitorService
+	db        *sql.DB
+	mu        sync.Mutex
+	stopChan  chan bool
+	running   bool
+	lastError string
+}
+
+// NewUsageService creates a new LMS usage collector
+func NewUsageService(cfg config.UsageConfig, moodle *MoodleService, monitor *MonitorService) *UsageService {
+	return &UsageService{
+		config:   cfg,
+		moodle:   moodle,
+		monitor:  monitor,
+		stopChan: make(chan bool),
+	}
+}
+
+// SetDatabase sets the database connection
+func (u *UsageService) SetDatabase(db *sql.DB) {
+	u.db = db
+}
+
+// Enabled reports whether the usage collector is enabled
+func (u *UsageService) Enabled() bool {
+	return u.config.Enabled
+}
+
+// Start starts following the Moodle logs
+func (u *UsageService) Start() {
+	if u.running {
+		return
+	}
+
+	if !u.config.Enabled {
+		utils.Info("Usage collector is disabled")
+		return
+	}
+
+	u.running = true
+	go u.collectLoop()
+	utils.Info("Usage collector started (every %ds)", u.config.Interval)
+}
+
+// Stop stops following the Moodle logs
+func (u *UsageService) Stop() {
+	if !u.running {
+		return
+	}
+
+	u.running = false
+	u.stopChan <- true
+	utils.Info("Usage collector stopped")
+}
+
+// collectLoop reads the new log events on every tick
+func (u *UsageService) collectLoop() {
+	ticker := time.NewTicker(time.Duration(u.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	u.collect()
+
+	for {
+		select {
+		case <-ticker.C:
+			u.collect()
+		case <-u.stopChan:
+			return
+		}
+	}
+}
+
+// collect reads new events, logging a failure once until it changes
+func (u *UsageService) collect() {
+	message := ""
+	if err := u.Poll(); err != nil {
+		message = err.Error()
+	}
+	if message != "" && message != u.lastError {
+		utils.Warn("Failed to collect LMS usage: %s", message)
+	}
+	u.lastError = message
+}
+
+// Poll reads the log events after the last processed id, counts the users
+// with an active session and prunes usage older than the retention. The
+// first poll starts at the end of the log.
+func (u *UsageService) Poll() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	site, err := u.moodle.GetSiteConfig()
+	if err != nil {
+		return err
+	}
+
+	var tables [3]string
+	for i, name := range []string{"logstore_standard_log", "sessions", "course"} {
+		if tables[i], err = moodleTable(site, name); err != nil {
+			return err
+		}
+	}
+	logTable, sessionsTable, courseTable := tables[0], tables[1], tables[2]
+
+	conn, err := openMoodleDatabase(site)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	lastID, found, err := u.LastID()
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+		var maxID sql.NullInt64
+		err := conn.QueryRowContext(ctx, fmt.Sprintf(`SELECT MAX(id) FROM %s`, logTable)).Scan(&maxID)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to query %s: %v", logTable, err)
+		}
+		if err := u.Record(nil, nil, maxID.Int64); err != nil {
+			return err
+		}
+		lastID = maxID.Int64
+	}
+
+	for batch := 0; found && batch < usageMaxBatches; batch++ {
+		ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+		events, err := queryUsageEvents(ctx, conn, logTable, lastID, u.config.BatchSize)
+		if err == nil && len(events) > 0 {
+			var courseNames map[int64]string
+			courseNames, err = queryCourseNames(ctx, conn, courseTable, events)
+			if err == nil {
+				lastID = events[len(events)-1].ID
+				err = u.Record(events, courseNames, lastID)
+			}
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+		if len(events) < u.config.BatchSize {
+			break
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), databaseQueryTimeout)
+	defer cancel()
+
+	now := time.Now()
+	var online int
+	if err := conn.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT COUNT(DISTINCT userid) FROM %s
+		WHERE userid > 0 AND timemodified >= %d
+	`, sessionsTable, now.Add(-usageBucket).Unix())).Scan(&online); err != nil {
+		return fmt.Errorf("failed to query %s: %v", sessionsTable, err)
+	}
+	if err := u.RecordOnline(online, now); err != nil {
+		return err
+	}
+
+	return u.prune(now)
+}
+
+// queryUsageEvents reads up to limit log events after an id. Ids are
+// inlined as the MySQL and PostgreSQL drivers use different placeholders.
+func queryUsageEvents(ctx context.Context, conn *sql.DB, table string, afterID int64, limit int) ([]UsageEvent, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, eventname, component, contextlevel, contextinstanceid, userid, courseid, timecreated
+		FROM %s
+		WHERE id > %d
+		ORDER BY id
+		LIMIT %d
+	`, table, afterID, limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	var events []UsageEvent
+	for rows.Next() {
+		var event UsageEvent
+		var courseID sql.NullInt64
+		var created int64
+		if err := rows.Scan(&event.ID, &event.EventName, &event.Component, &event.ContextLevel,
+			&event.ContextInstanceID, &event.UserID, &courseID, &created); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", table, err)
+		}
+		event.CourseID = courseID.Int64
+		event.Time = time.Unix(created, 0)
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// queryCourseNames returns the short names of the courses of the events
+func queryCourseNames(ctx context.Context, conn *sql.DB, table string, events []UsageEvent) (map[int64]string, error) {
+	seen := make(map[int64]bool)
+	var ids []string
+	for _, event := range events {
+		if event.CourseID > moodleSiteID && !seen[event.CourseID] {
+			seen[event.CourseID] = true
+			ids = append(ids, strconv.FormatInt(event.CourseID, 10))
+		}
+	}
+
+	names := make(map[int64]string)
+	if len(ids) == 0 {
+		return names, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf(`SELECT id, shortname FROM %s WHERE id IN (%s)`, table, strings.Join(ids, ",")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %v", table, err)
+		}
+		names[id] = name
+	}
+
+	return names, rows.Err()
+}
+
+// usageKey identifies the usage of a course or module in an hour
+type usageKey struct {
+	hour time.Time
+	kind string
+	id   int64
+}
+
+// Record adds log events to the usage time series and saves lastID as the
+// last processed event, all in one transaction
+func (u *UsageService) Record(events []UsageEvent, courseNames map[int64]string, lastID int64) error {
+	if u.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	type bucketCounts struct {
+		events, logins int
+		users          map[int64]bool
+	}
+	var buckets []time.Time
+	counts := make(map[time.Time]*bucketCounts)
+	activity := make(map[usageKey]int)
+	names := make(map[usageKey]string)
+
+	for _, event := range events {
+		bucket := event.Time.Truncate(usageBucket)
+		count, exists := counts[bucket]
+		if !exists {
+			count = &bucketCounts{users: make(map[int64]bool)}
+			counts[bucket] = count
+			buckets = append(buckets, bucket)
+		}
+		count.events++
+		if event.EventName == moodleLoginEvent {
+			count.logins++
+		}
+		if event.UserID > 0 {
+			count.users[event.UserID] = true
+		}
+
+		hour := event.Time.Truncate(time.Hour)
+		if event.CourseID > moodleSiteID {
+			key := usageKey{hour, usageKindCourse, event.CourseID}
+			activity[key]++
+			names[key] = courseNames[event.CourseID]
+		}
+		if event.ContextLevel == moodleContextModule {
+			key := usageKey{hour, usageKindModule, event.ContextInstanceID}
+			activity[key]++
+			names[key] = event.Component
+		}
+	}
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	instance := u.moodle.Name()
+	for _, bucket := range buckets {
+		count := counts[bucket]
+		if _, err := tx.Exec(`
+			INSERT INTO usage_metrics (instance, bucket, events, logins) VALUES (?, ?, ?, ?)
+			ON CONFLICT (instance, bucket) DO UPDATE SET events = events + excluded.events, logins = logins + excluded.logins
+		`, instance, bucket, count.events, count.logins); err != nil {
+			return fmt.Errorf("failed to save usage: %v", err)
+		}
+
+		for userID := range count.users {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO usage_bucket_users (instance, bucket, userid) VALUES (?, ?, ?)`,
+				instance, bucket, userID); err != nil {
+				return fmt.Errorf("failed to save active users: %v", err)
+			}
+		}
+
+		// Users of buckets past the open window are gone, so late events
+		// never lower the count
+		if _, err := tx.Exec(`
+			UPDATE usage_metrics SET active_users = MAX(active_users, (
+				SELECT COUNT(*) FROM usage_bucket_users WHERE instance = ? AND bucket = ?
+			))
+			WHERE instance = ? AND bucket = ?
+		`, instance, bucket, instance, bucket); err != nil {
+			return fmt.Errorf("failed to count active users: %v", err)
+		}
+	}
+
+	for key, count := range activity {
+		if _, err := tx.Exec(`
+			INSERT INTO usage_activity (instance, hour, kind, object_id, name, events) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (instance, hour, kind, object_id) DO UPDATE SET events = events + excluded.events, name = excluded.name
+		`, instance, key.hour, key.kind, key.id, names[key], count); err != nil {
+			return fmt.Errorf("failed to save course usage: %v", err)
+		}
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO usage_state (instance, last_id, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (instance) DO UPDATE SET last_id = excluded.last_id, updated_at = excluded.updated_at
+	`, instance, lastID, time.Now()); err != nil {
+		return fmt.Errorf("failed to save the last log id: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit usage: %v", err)
+	}
+	return nil
+}
+
+// RecordOnline records the number of users with an active session, keeping
+// the highest number seen in the bucket
+func (u *UsageService) RecordOnline(online int, now time.Time) error {
+	if u.db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	if _, err := u.db.Exec(`
+		INSERT INTO usage_metrics (instance, bucket, online_users) VALUES (?, ?, ?)
+		ON CONFLICT (instance, bucket) DO UPDATE SET online_users = MAX(online_users, excluded.online_users)
+	`, u.moodle.Name(), now.Truncate(usageBucket), online); err != nil {
+		return fmt.Errorf("failed to save online users: %v", err)
+	}
+	return nil
+}
+
+// LastID returns the id of the last processed log event, and whether the
+// log was read before
+func (u *UsageService) LastID() (int64, bool, error) {
+	if u.db == nil {
+		return 0, false, fmt.Errorf("database not initialized")
+	}
+
+	var lastID int64
+	err := u.db.QueryRow(`SELECT last_id FROM usage_state WHERE instance = ?`, u.moodle.Name()).Scan(&lastID)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to load the last log id: %v", err)
+	}
+	return lastID, true, nil
+}
+
+// prune drops the users of closed buckets and the usage past the retention
+func (u *UsageService) prune(now time.Time) error {
+	retention := now.AddDate(0, 0, -u.config.Retention)
+	for _, query := range []struct {
+		statement string
+		before    time.Time
+	}{
+		{`DELETE FROM usage_bucket_users WHERE instance = ? AND bucket < ?`, now.Add(-usageOpenWindow)},
+		{`DELETE FROM usage_metrics WHERE instance = ? AND bucket < ?`, retention},
+		{`DELETE FROM usage_activity WHERE instance = ? AND hour < ?`, retention},
+	} {
+		if _, err := u.db.Exec(query.statement, u.moodle.Name(), query.before); err != nil {
+			return fmt.Errorf("failed to prune usage: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetUsage returns the usage of the last hours with the host CPU and memory
+// usage of every bucket, the logins per hour and the most active courses
+// and modules
+func (u *UsageService) GetUsage(hours int) (*models.UsageReport, error) {
+	if u.db == nil {
+		return nil, fmt.Errorf("database not initialized")
+	}
+
+	since := time.Now().Add(-time.Duration(hours) * time.Hour).Truncate(usageBucket)
+	instance := u.moodle.Name()
+	report := &models.UsageReport{
+		Hours:         hours,
+		Buckets:       []models.UsageBucket{},
+		LoginsPerHour: []models.UsageHour{},
+	}
+
+	rows, err := u.db.Query(`
+		SELECT bucket, active_users, online_users, events, logins
+		FROM usage_metrics
+		WHERE instance = ? AND bucket >= ?
+		ORDER BY bucket
+	`, instance, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket models.UsageBucket
+		if err := rows.Scan(&bucket.Time, &bucket.ActiveUsers, &bucket.OnlineUsers, &bucket.Events, &bucket.Logins); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %v", err)
+		}
+		report.Buckets = append(report.Buckets, bucket)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if u.monitor != nil {
+		history, err := u.monitor.GetSystemStatsHistory(since)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query system stats: %v", err)
+		}
+		attachSystemLoad(report.Buckets, history)
+	}
+
+	for _, bucket := range report.Buckets {
+		users := bucket.ActiveUsers
+		if bucket.OnlineUsers > users {
+			users = bucket.OnlineUsers
+		}
+		if users > report.PeakUsers {
+			report.PeakUsers = users
+			peak := bucket.Time
+			report.PeakTime = &peak
+		}
+
+		hour := bucket.Time.Truncate(time.Hour)
+		last := len(report.LoginsPerHour) - 1
+		if last < 0 || !report.LoginsPerHour[last].Hour.Equal(hour) {
+			report.LoginsPerHour = append(report.LoginsPerHour, models.UsageHour{Hour: hour})
+			last++
+		}
+		report.LoginsPerHour[last].Logins += bucket.Logins
+		if users > report.LoginsPerHour[last].ActiveUsers {
+			report.LoginsPerHour[last].ActiveUsers = users
+		}
+	}
+
+	if report.TopCourses, err = u.topActivity(usageKindCourse, since); err != nil {
+		return nil, err
+	}
+	if report.TopModules, err = u.topActivity(usageKindModule, since); err != nil {
+		return nil, err
+	}
+
+	report.LastID, _, err = u.LastID()
+	return report, err
+}
+
+// topActivity returns the courses or modules with the most events since a
+// time
+func (u *UsageService) topActivity(kind string, since time.Time) ([]models.UsageActivity, error) {
+	rows, err := u.db.Query(`
+		SELECT object_id, MAX(name), SUM(events) AS total
+		FROM usage_activity
+		WHERE instance = ? AND kind = ? AND hour >= ?
+		GROUP BY object_id
+		ORDER BY total DESC, object_id
+		LIMIT ?
+	`, u.moodle.Name(), kind, since.Truncate(time.Hour), usageTopLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s usage: %v", kind, err)
+	}
+	defer rows.Close()
+
+	activity := []models.UsageActivity{}
+	for rows.Next() {
+		var item models.UsageActivity
+		if err := rows.Scan(&item.ID, &item.Name, &item.Events); err != nil {
+			return nil, fmt.Errorf("failed to scan %s usage: %v", kind, err)
+		}
+		activity = append(activity, item)
+	}
+
+	return activity, rows.Err()
+}
+
+// attachSystemLoad sets the average host CPU and memory usage of every
+// bucket sampled by the monitor
+func attachSystemLoad(buckets []models.UsageBucket, history []models.SystemStats) {
+	type load struct {
+		cpu, memory float64
+		samples     int
+	}
+	loads := make(map[int64]*load)
+	for _, stats := range history {
+		bucket := stats.Timestamp.Truncate(usageBucket).Unix()
+		sum, exists := loads[bucket]
+		if !exists {
+			sum = &load{}
+			loads[bucket] = sum
+		}
+		sum.cpu += stats.CPUUsage
+		sum.memory += stats.MemoryUsage
+		sum.samples++
+	}
+
+	for i := range buckets {
+		sum, exists := loads[buckets[i].Time.Truncate(usageBucket).Unix()]
+		if !exists {
+			continue
+		}
+		cpu := sum.cpu / float64(sum.samples)
+		memory := sum.memory / float64(sum.samples)
+		buckets[i].CPU = &cpu
+		buckets[i].Memory = &memory
+	}
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/utils"
+)
+
+// webStatusBodyLimit caps the status page read from the web server
+const webStatusBodyLimit = 64 * 1024
+
+// WebStatusService scrapes the nginx stub_status or Apache mod_status page
+// of the Moodle web tier and records request rates and connection counts
+type WebStatusService struct {
+	config   config.WebStatusConfig
+	monitor  *MonitorService
+	client   *http.Client
+	mu       sync.RWMutex
+	sampleMu sync.Mutex
+	stopChan chan bool
+	running  bool
+
+	previous *models.PerformanceMetrics
+	failing  bool
+}
+
+// NewWebStatusService creates a new web server status collector
+func NewWebStatusService(cfg config.WebStatusConfig, monitor *MonitorService) *WebStatusService {
+	return &WebStatusService{
+		config:  cfg,
+		monitor: monitor,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.Timeout) * time.Second,
+		},
+		stopChan: make(chan bool),
+	}
+}
+
+// Start starts collecting on the configured interval
+func (w *WebStatusService) Start() {
+	if w.running {
+		return
+	}
+
+	if !w.config.Enabled {
+		utils.Info("Web server status collector is disabled")
+		return
+	}
+
+	w.running = true
+	go w.collectLoop()
+	utils.Info("Web server status collector started (%s every %ds)", w.config.URL, w.config.Interval)
+}
+
+// Stop stops the collect loop
+func (w *WebStatusService) Stop() {
+	if !w.running {
+		return
+	}
+
+	w.running = false
+	w.stopChan <- true
+	utils.Info("Web server status collector stopped")
+}
+
+// collectLoop samples the status page on every tick
+func (w *WebStatusService) collectLoop() {
+	ticker := time.NewTicker(time.Duration(w.config.Interval) * time.Second)
+	defer ticker.Stop()
+
+	w.collect()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.collect()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// collect takes a sample and hands it to the monitor
+func (w *WebStatusService) collect() {
+	metrics, err := w.Sample()
+
+	w.mu.Lock()
+	changed := w.failing != (err != nil)
+	w.failing = err != nil
+	w.mu.Unlock()
+
+	if err != nil {
+		if changed {
+			utils.Warn("Failed to collect web server status: %v", err)
+		}
+		return
+	}
+
+	if changed {
+		utils.Info("Collecting %s status from %s", metrics.Server, w.config.URL)
+	}
+	if w.monitor != nil {
+		w.monitor.RecordWebMetrics(metrics)
+	}
+}
+
+// GetMetrics returns the latest sample, sampling the status page when it is
+// older than the collect interval
+func (w *WebStatusService) GetMetrics() (*models.PerformanceMetrics, error) {
+	w.mu.RLock()
+	previous := w.previous
+	w.mu.RUnlock()
+
+	if previous != nil && time.Since(previous.Timestamp) < time.Duration(w.config.Interval)*time.Second {
+		return previous, nil
+	}
+
+	return w.Sample()
+}
+
+// GetHistory returns the most recent samples recorded by the monitor, newest
+// first
+func (w *WebStatusService) GetHistory(limit int) ([]models.PerformanceMetrics, error) {
+	if w.monitor == nil {
+		return nil, fmt.Errorf("web metrics history not recorded")
+	}
+	return w.monitor.GetWebMetricsHistory(limit)
+}
+
+// Sample reads the status page and computes the request rate since the
+// previous sample
+func (w *WebStatusService) Sample() (*models.PerformanceMetrics, error) {
+	w.sampleMu.Lock()
+	defer w.sampleMu.Unlock()
+
+	resp, err := w.client.Get(w.config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request %s: %v", w.config.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", w.config.URL, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, webStatusBodyLimit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", w.config.URL, err)
+	}
+
+	metrics, err := ParseWebStatus(w.config.Server, string(body))
+	if err != nil {
+		return nil, err
+	}
+	metrics.Timestamp = time.Now()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// A server restart resets the counter, everything since was handled
+	// in the interval
+	if previous := w.previous; previous != nil && previous.Server == metrics.Server {
+		metrics.RequestCount = metrics.TotalRequests - previous.TotalRequests
+		if metrics.RequestCount < 0 {
+			metrics.RequestCount = metrics.TotalRequests
+		}
+		if elapsed := metrics.Timestamp.Sub(previous.Timestamp).Seconds(); elapsed > 0 {
+			metrics.RequestsPerSec = float64(metrics.RequestCount) / elapsed
+		}
+	}
+
+	w.previous = metrics
+	return metrics, nil
+}
+
+// ParseWebStatus parses an nginx stub_status or Apache mod_status?auto page.
+// The server type is detected from the page when server is empty.
+func ParseWebStatus(server, body string) (*models.PerformanceMetrics, error) {
+	if server == "" {
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(body), "Active connections:"):
+			server = config.WebServerNginx
+		case strings.Contains(body, "Total Accesses:") || strings.Contains(body, "Scoreboard:"):
+			server = config.WebServerApache
+		default:
+			return nil, fmt.Errorf("unrecognised web server status page")
+		}
+	}
+
+	switch server {
+	case config.WebServerNginx:
+		return parseNginxStatus(body)
+	case config.WebServerApache:
+		return parseApacheStatus(body)
+	default:
+		return nil, fmt.Errorf("unsupported web server: %s", server)
+	}
+}
+
+// parseNginxStatus parses the stub_status page:
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+func parseNginxStatus(body string) (*models.PerformanceMetrics, error) {
+	metrics := &models.PerformanceMetrics{Server: config.WebServerNginx}
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if len(lines) < 4 {
+		return nil, fmt.Errorf("invalid nginx stub_status page")
+	}
+
+	active, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(lines[0], "Active connections:")))
+	if err != nil {
+		return nil, fmt.Errorf("invalid nginx active connections: %q", lines[0])
+	}
+	metrics.ActiveConnections = active
+
+	counters := strings.Fields(lines[2])
+	if len(counters) != 3 {
+		return nil, fmt.Errorf("invalid nginx request counters: %q", lines[2])
+	}
+	if metrics.TotalRequests, err = strconv.ParseInt(counters[2], 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid nginx request counters: %q", lines[2])
+	}
+
+	fields := strings.Fields(lines[3])
+	for i := 0; i+1 < len(fields); i += 2 {
+		value, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid nginx connection states: %q", lines[3])
+		}
+		switch fields[i] {
+		case "Reading:":
+			metrics.ReadingConnections = value
+		case "Writing:":
+			metrics.WritingConnections = value
+		case "Waiting:":
+			metrics.WaitingConnections = value
+		}
+	}
+
+	return metrics, nil
+}
+
+// parseApacheStatus parses the machine readable mod_status page. Connection
+// states are counted from the scoreboard; the event MPM reports the
+// connections it handles asynchronously separately.
+func parseApacheStatus(body string) (*models.PerformanceMetrics, error) {
+	metrics := &models.PerformanceMetrics{Server: config.WebServerApache}
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ":")
+		if found {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	total, ok := values["Total Accesses"]
+	if !ok {
+		return nil, fmt.Errorf("Apache status page has no Total Accesses, is ExtendedStatus on?")
+	}
+
+	var err error
+	if metrics.TotalRequests, err = strconv.ParseInt(total, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid Apache Total Accesses: %q", total)
+	}
+
+	integer := func(key string) int {
+		n, _ := strconv.Atoi(values[key])
+		return n
+	}
+
+	scoreboard := values["Scoreboard"]
+	metrics.ReadingConnections = strings.Count(scoreboard, "R")
+	metrics.WritingConnections = strings.Count(scoreboard, "W") + integer("ConnsAsyncWriting")
+	metrics.WaitingConnections = strings.Count(scoreboard, "K") + integer("ConnsAsyncKeepAlive")
+
+	if _, ok := values["ConnsTotal"]; ok {
+		metrics.ActiveConnections = integer("ConnsTotal")
+	} else {
+		metrics.ActiveConnections = integer("BusyWorkers")
+	}
+
+	return metrics, nil
+}
@@ -3,6 +3,7 @@
 // Global variables
 let refreshInterval;
 let isLoggedIn = false;
+let currentInstance = localStorage.getItem('moodle_instance') || '';
 
 // Initialize the application
 document.addEventListener('DOMContentLoaded', function() {
@@ -41,7 +42,18 @@ function initializeDashboard() {
     startAutoRefresh();
     
     // Load initial data
+    loadInstances();
     loadDashboardData();
+    refreshMoodleStatus();
+    loadCLIScripts();
+    refreshStorage(false);
+    checkEnvironment();
+    refreshProcesses();
+    refreshAccessLog();
+    refreshErrorGroups();
+    refreshConfigHistory();
+    refreshTaskHealth();
+    refreshUsage();
     
     // Set up event listeners
     setupEventListeners();
@@ -97,7 +109,7 @@ async function handleLogin(e) {
 // Load dashboard data
 async function loadDashboardData() {
     try {
-        const response = await fetch('/api/stats', {
+        const response = await fetch(instanceApi('/stats'), {
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
             }
@@ -141,6 +153,14 @@ function updateDashboard(data) {
     if (data.moodle_status) {
         updateMoodleStatus(data.moodle_status);
     }
+    
+    if (data.php_fpm) {
+        updatePHPFPMList(data.php_fpm);
+    }
+    
+    if (data.web) {
+        updateWebTier(data.web);
+    }
 }
 
 // Update stat card
@@ -186,16 +206,618 @@ function updateMoodleStatus(status) {
         }
     }
     
-    if (versionElement && status.version) {
-        versionElement.textContent = status.version;
+    // Instances share the page, so missing values are cleared
+    if (versionElement) {
+        versionElement.textContent = status.version || '-';
+    }
+    
+    if (uptimeElement) {
+        uptimeElement.textContent = status.uptime ? formatDuration(status.uptime) : '-';
+    }
+    
+    if (pidElement) {
+        pidElement.textContent = status.process_id || '-';
+    }
+    
+    if (status.maintenance) {
+        updateMaintenanceStatus(status.maintenance);
+    }
+    
+    if (status.components) {
+        updateComponentList(status.components);
+    }
+    
+    if (status.probes) {
+        updateProbeList(status.probes);
+    }
+}
+
+// Update maintenance mode status and toggle button
+function updateMaintenanceStatus(maintenance) {
+    const maintenanceElement = document.getElementById('moodle-maintenance');
+    const button = document.getElementById('maintenance-button');
+    const buttonText = document.getElementById('maintenance-button-text');
+    
+    if (maintenanceElement) {
+        maintenanceElement.textContent = maintenance.enabled ? `Enabled (${maintenance.mode})` : 'Disabled';
+    }
+    
+    if (button && buttonText) {
+        button.dataset.enabled = maintenance.enabled ? 'true' : 'false';
+        buttonText.textContent = maintenance.enabled ? 'Disable Maintenance' : 'Enable Maintenance';
+    }
+}
+
+// Update Moodle stack component list
+function updateComponentList(components) {
+    const componentList = document.getElementById('moodle-components');
+    if (!componentList) return;
+    
+    componentList.innerHTML = components.map(component => `
+        <div class="component-item">
+            <span class="status-dot ${component.state === 'running' ? 'running' : ''}"></span>
+            <span class="component-name">${component.name}</span>
+            <span class="component-unit">${component.unit}</span>
+            <span class="component-state">${component.state}${component.uptime ? ' · ' + formatDuration(component.uptime) : ''}</span>
+            ${component.last_error ? `<span class="component-error">${component.last_error}</span>` : ''}
+        </div>
+    `).join('');
+}
+
+// Update HTTP probe list with latency percentiles
+function updateProbeList(probes) {
+    const probeList = document.getElementById('moodle-probes');
+    if (!probeList) return;
+    
+    probeList.innerHTML = probes.map(probe => `
+        <div class="component-item">
+            <span class="status-dot ${probe.healthy ? 'running' : ''}"></span>
+            <span class="component-name">${probe.name}</span>
+            <span class="component-unit">${probe.url}</span>
+            <span class="component-state">p50 ${probe.p50_ms}ms · p95 ${probe.p95_ms}ms · ${probe.success_rate.toFixed(1)}%</span>
+            ${probe.last_result && probe.last_result.error ? `<span class="component-error">${probe.last_result.error}</span>` : ''}
+        </div>
+    `).join('');
+}
+
+// Update PHP-FPM pool list with busy children and queued requests
+function updatePHPFPMList(pools) {
+    const poolList = document.getElementById('php-fpm-pools');
+    if (!poolList) return;
+    
+    poolList.innerHTML = pools.map(pool => `
+        <div class="component-item">
+            <span class="status-dot ${pool.error ? '' : 'running'}"></span>
+            <span class="component-name">php-fpm ${pool.name}</span>
+            <span class="component-unit">${pool.listen}</span>
+            <span class="component-state">${pool.active_processes}/${pool.max_children || pool.total_processes} busy · ${pool.listen_queue} queued · ${pool.max_children_reached} max reached</span>
+            ${pool.error ? `<span class="component-error">${pool.error}</span>` : ''}
+        </div>
+    `).join('');
+}
+
+// Update web tier request rate and connection states
+function updateWebTier(web) {
+    const webTier = document.getElementById('web-tier');
+    if (!webTier) return;
+    
+    webTier.innerHTML = `
+        <div class="component-item">
+            <span class="status-dot running"></span>
+            <span class="component-name">${web.server}</span>
+            <span class="component-unit">${web.requests_per_sec.toFixed(1)} req/s</span>
+            <span class="component-state">${web.active_connections} active · ${web.reading_connections} reading · ${web.writing_connections} writing · ${web.waiting_connections} waiting</span>
+        </div>
+    `;
+}
+
+// Refresh per-component process usage, naming the largest process
+async function refreshProcesses() {
+    const list = document.getElementById('moodle-processes');
+    if (!list) return;
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/processes'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        if (!response.ok) return;
+        
+        const report = await response.json();
+        
+        list.innerHTML = report.components.filter(component => component.count > 0).map(component => {
+            const largest = component.processes[0];
+            return `
+                <div class="component-item">
+                    <span class="component-name">${component.name}</span>
+                    <span class="component-unit">${component.count} processes · ${formatBytes(component.rss)} RSS</span>
+                    <span class="component-state">${formatDuration(Math.round(component.cpu_time))} CPU · ${component.threads} threads · ${component.open_fds} fds</span>
+                    <span class="component-detail">Largest: ${largest.pid} ${largest.cmdline || largest.name} · ${formatBytes(largest.rss)}</span>
+                </div>
+            `;
+        }).join('');
+    } catch (error) {
+        console.error('Failed to load Moodle processes:', error);
+    }
+}
+
+// Refresh the last 15 minutes of traffic from the access log
+async function refreshAccessLog() {
+    const list = document.getElementById('access-log');
+    if (!list) return;
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/access-log?minutes=15'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        // Disabled access log analytics leaves the list empty
+        if (!response.ok) return;
+        
+        const stats = await response.json();
+        
+        list.innerHTML = `
+            <div class="component-item">
+                <span class="status-dot ${stats.last_error ? '' : 'running'}"></span>
+                <span class="component-name">traffic</span>
+                <span class="component-unit">${stats.requests_per_min.toFixed(1)} req/min</span>
+                <span class="component-state">${stats.rate_4xx.toFixed(1)}% 4xx · ${stats.rate_5xx.toFixed(1)}% 5xx${stats.has_latency ? ` · p50 ${stats.p50_ms}ms · p95 ${stats.p95_ms}ms` : ''}</span>
+                ${stats.last_error ? `<span class="component-error">${stats.last_error}</span>` : ''}
+            </div>
+        ` + stats.top_scripts.slice(0, 5).map(script => `
+            <div class="component-item">
+                <span class="component-name">${script.key}</span>
+                <span class="component-unit">${script.requests} requests</span>
+                <span class="component-state">${script.status_4xx} 4xx · ${script.status_5xx} 5xx</span>
+            </div>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load access log statistics:', error);
+    }
+}
+
+// Refresh the PHP error groups that appeared recently
+async function refreshErrorGroups() {
+    const list = document.getElementById('error-groups');
+    const status = document.getElementById('error-groups-status');
+    if (!list) return;
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/errors?new=true&limit=50'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        if (!response.ok) return;
+        
+        const result = await response.json();
+        const pending = result.groups.filter(group => !group.acknowledged);
+        
+        status.textContent = result.enabled ? `${pending.length} unacknowledged` : 'Error log collector is disabled';
+        
+        // Messages come from the logs and are escaped
+        list.innerHTML = result.groups.map(group => `
+            <div class="component-item">
+                <span class="status-dot ${errorGroupDot(group)}"></span>
+                <span class="component-name">${group.component || group.level}</span>
+                <span class="component-unit">${escapeHtml(group.file ? group.file + ':' + group.line : group.source)}</span>
+                <span class="component-state">${group.level} · ${group.count}× · last ${formatTimestamp(group.last_seen)}</span>
+                ${group.acknowledged ? '' : `<button onclick="acknowledgeErrorGroup('${group.id}')" class="btn btn-ghost btn-sm">Acknowledge</button>`}
+                <span class="component-detail">${escapeHtml(group.message)}</span>
+            </div>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load PHP errors:', error);
+    }
+}
+
+// Status dot class of an error group
+function errorGroupDot(group) {
+    if (group.acknowledged) return 'running';
+    if (group.level === 'fatal' || group.level === 'exception') return '';
+    return 'warning';
+}
+
+// Mark an error group as known
+async function acknowledgeErrorGroup(id) {
+    try {
+        const response = await fetch(instanceApi(`/moodle/errors/${id}/acknowledge`), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            showToast(result.details || result.error || 'Failed to acknowledge error', 'error');
+            return;
+        }
+        
+        refreshErrorGroups();
+        refreshAlerts();
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// Refresh the LMS usage of the last day
+async function refreshUsage() {
+    const chart = document.getElementById('usage-chart');
+    const top = document.getElementById('usage-top');
+    const status = document.getElementById('usage-status');
+    if (!chart) return;
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/usage?hours=24'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        if (!response.ok) return;
+        
+        const result = await response.json();
+        const usage = result.usage;
+        
+        if (!result.enabled) {
+            status.textContent = 'Usage collector is disabled';
+        } else if (usage.peak_time) {
+            status.textContent = `Peak ${usage.peak_users} users at ${formatTimestamp(usage.peak_time)}`;
+        } else {
+            status.textContent = 'No usage recorded yet';
+        }
+        
+        chart.innerHTML = renderUsageChart(usage);
+        
+        // Course and module names come from Moodle and are escaped
+        top.innerHTML = [
+            ...usage.top_courses.map(course => ({ name: course.name || `Course ${course.id}`, unit: 'course', events: course.events })),
+            ...usage.top_modules.map(module => ({ name: `${module.name} ${module.id}`, unit: 'module', events: module.events }))
+        ].map(item => `
+            <div class="component-item">
+                <span class="component-name">${escapeHtml(item.name)}</span>
+                <span class="component-unit">${item.unit}</span>
+                <span class="component-state">${item.events} events</span>
+            </div>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load LMS usage:', error);
+    }
+}
+
+// SVG chart of the users per 5-minute bucket and the logins per hour, with
+// the host CPU usage on a 0-100% scale
+function renderUsageChart(usage) {
+    if (!usage.buckets.length) return '';
+    
+    const width = 720, height = 180, bottom = 16;
+    const end = Date.now();
+    const start = end - usage.hours * 3600 * 1000;
+    const x = time => ((new Date(time).getTime() - start) / (end - start)) * width;
+    const users = bucket => Math.max(bucket.active_users, bucket.online_users);
+    const maxUsers = Math.max(1, ...usage.buckets.map(users));
+    const maxLogins = Math.max(1, ...usage.logins_per_hour.map(hour => hour.logins));
+    const y = (value, max) => (height - bottom) * (1 - value / max);
+    
+    const logins = usage.logins_per_hour.map(hour => {
+        const barHeight = (height - bottom) - y(hour.logins, maxLogins);
+        return `<rect class="usage-logins" x="${x(hour.hour)}" y="${height - bottom - barHeight}" width="${width / usage.hours - 2}" height="${barHeight}"><title>${hour.logins} logins</title></rect>`;
+    }).join('');
+    const userPoints = usage.buckets.map(bucket => `${x(bucket.time)},${y(users(bucket), maxUsers)}`).join(' ');
+    const cpuPoints = usage.buckets.filter(bucket => bucket.cpu !== undefined)
+        .map(bucket => `${x(bucket.time)},${y(bucket.cpu, 100)}`).join(' ');
+    
+    return `
+        <svg viewBox="0 0 ${width} ${height}" preserveAspectRatio="none">
+            ${logins}
+            <polyline class="usage-users" points="${userPoints}"></polyline>
+            <polyline class="usage-cpu" points="${cpuPoints}"></polyline>
+            <text x="2" y="10">${maxUsers} users · ${maxLogins} logins/h · CPU dashed</text>
+            <text x="2" y="${height - 2}">${usage.hours}h ago</text>
+            <text x="${width - 24}" y="${height - 2}">now</text>
+        </svg>
+    `;
+}
+
+// Refresh the failing and overdue scheduled tasks and the adhoc task queues
+async function refreshTaskHealth() {
+    const list = document.getElementById('task-health');
+    const status = document.getElementById('task-health-status');
+    if (!list) return;
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/tasks'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            status.textContent = result.details || result.error || 'Task tables unavailable';
+            list.innerHTML = '';
+            return;
+        }
+        
+        const health = result.health;
+        status.textContent = `${health.failing.length} failing · ${health.overdue.length} overdue · ${health.adhoc_queued} adhoc queued` +
+            (health.oldest_adhoc_age ? ` · oldest ${formatDuration(health.oldest_adhoc_age)}` : '');
+        
+        const scheduled = [
+            ...health.failing.map(task => ({ task, dot: '', state: `failing · retry in ${formatDuration(task.faildelay)}` })),
+            ...health.overdue.map(task => ({ task, dot: 'warning', state: `${formatDuration(task.overdue)} overdue` }))
+        ];
+        
+        list.innerHTML = scheduled.map(({ task, dot, state }) => `
+            <div class="component-item">
+                <span class="status-dot ${dot}"></span>
+                <span class="component-name">${escapeHtml(task.classname)}</span>
+                <span class="component-unit">${escapeHtml(task.component)}</span>
+                <span class="component-state">${state}</span>
+            </div>
+        `).join('') + health.adhoc.map(queue => `
+            <div class="component-item">
+                <span class="status-dot ${queue.stuck ? '' : (queue.failing ? 'warning' : 'running')}"></span>
+                <span class="component-name">${escapeHtml(queue.classname)}</span>
+                <span class="component-unit">adhoc · ${queue.queued} queued · ${queue.due} due</span>
+                <span class="component-state">${queue.failing} failing${queue.oldest_age ? ' · oldest ' + formatDuration(queue.oldest_age) : ''}</span>
+            </div>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load task health:', error);
+    }
+}
+
+// Refresh the config.php versions
+async function refreshConfigHistory() {
+    const list = document.getElementById('config-history');
+    const status = document.getElementById('config-history-status');
+    if (!list) return;
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/config/history?limit=20'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        if (!response.ok) return;
+        
+        const result = await response.json();
+        const pending = result.versions.filter(version => version.source === 'external' && !version.acknowledged_at);
+        
+        status.textContent = pending.length ? `${pending.length} changes outside lms-manager` : 'No pending changes';
+        
+        list.innerHTML = result.versions.map(version => `
+            <div class="component-item">
+                <span class="status-dot ${configVersionDot(version)}"></span>
+                <span class="component-name">${formatTimestamp(version.created_at)}</span>
+                <span class="component-unit">${version.source}${version.changed_by ? ' · owner ' + escapeHtml(version.changed_by) : ''}</span>
+                <span class="component-state">${version.acknowledged_by ? 'accepted by ' + escapeHtml(version.acknowledged_by) : formatBytes(version.size)}${version.debugdisplay ? ' · debugdisplay on' : ''}${version.secrets_changed ? ' · secrets changed' : ''}</span>
+                ${version.source === 'initial' ? '' : `<button onclick="showConfigDiff('${version.id}')" class="btn btn-ghost btn-sm">Diff</button>`}
+            </div>
+        `).join('');
+    } catch (error) {
+        console.error('Failed to load config.php history:', error);
     }
+}
+
+// Status dot class of a config.php version
+function configVersionDot(version) {
+    if (version.source !== 'external' || version.acknowledged_at) return 'running';
+    return version.debugdisplay ? '' : 'warning';
+}
+
+// Show the redacted changes of a config.php version against the one before
+async function showConfigDiff(id) {
+    const output = document.getElementById('config-diff');
     
-    if (uptimeElement && status.uptime) {
-        uptimeElement.textContent = formatDuration(status.uptime);
+    try {
+        const response = await fetch(instanceApi(`/moodle/config/history/diff?to=${encodeURIComponent(id)}`), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            showToast(result.details || result.error || 'Failed to load diff', 'error');
+            return;
+        }
+        
+        output.textContent = `+${result.added} -${result.removed}${result.secrets_changed ? ' (secrets changed)' : ''}\n${result.diff || 'No changes'}`;
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// Accept the config.php changes made outside lms-manager
+async function acceptConfigChanges() {
+    try {
+        const response = await fetch(instanceApi('/moodle/config/history/accept'), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            showToast(result.details || result.error || 'Failed to accept changes', 'error');
+            return;
+        }
+        
+        showToast(result.message, 'success');
+        refreshConfigHistory();
+        refreshAlerts();
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
     }
+}
+
+// Search the Moodle users by username or email
+async function searchMoodleUsers() {
+    const list = document.getElementById('moodle-users');
+    const status = document.getElementById('moodle-users-status');
+    if (!list) return;
+    
+    const query = document.getElementById('moodle-user-query').value.trim();
+    if (!query) return;
     
-    if (pidElement && status.process_id) {
-        pidElement.textContent = status.process_id;
+    try {
+        const response = await fetch(instanceApi(`/moodle/users?q=${encodeURIComponent(query)}`), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            status.textContent = result.details || result.error;
+            list.innerHTML = '';
+            return;
+        }
+        
+        status.textContent = `${result.users.length} users found`;
+        
+        list.innerHTML = result.users.map(user => `
+            <div class="component-item">
+                <span class="status-dot ${user.suspended ? 'warning' : 'running'}"></span>
+                <span class="component-name">${escapeHtml(user.username)}</span>
+                <span class="component-unit">${escapeHtml(user.firstname)} ${escapeHtml(user.lastname)} · ${escapeHtml(user.email)} · ${escapeHtml(user.auth)}</span>
+                <span class="component-state">${user.suspended ? 'suspended' : user.last_access ? 'last access ' + formatTimestamp(user.last_access) : 'never logged in'}</span>
+                <button onclick="moodleUserAction(${user.id}, '${user.suspended ? 'unsuspend' : 'suspend'}')" class="btn btn-ghost btn-sm">${user.suspended ? 'Unsuspend' : 'Suspend'}</button>
+                <button onclick="moodleUserAction(${user.id}, 'force-password-change')" class="btn btn-ghost btn-sm">Force Password Change</button>
+                <button onclick="resetMoodlePassword(${user.id})" class="btn btn-ghost btn-sm">Reset Password</button>
+                <button onclick="moodleUserAction(${user.id}, 'kill-sessions')" class="btn btn-ghost btn-sm">Kill Sessions</button>
+            </div>
+        `).join('');
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// Run an action on a Moodle user
+async function moodleUserAction(id, action) {
+    try {
+        const response = await fetch(instanceApi(`/moodle/users/${id}/${action}`), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            showToast(result.details || result.error || 'Action failed', 'error');
+            return;
+        }
+        
+        showToast(result.message, 'success');
+        searchMoodleUsers();
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// Reset the password of a Moodle user to a random one and show it once
+async function resetMoodlePassword(id) {
+    if (!confirm('Are you sure you want to reset the password of this Moodle user?')) {
+        return;
+    }
+    
+    const output = document.getElementById('moodle-user-output');
+    
+    try {
+        const response = await fetch(instanceApi(`/moodle/users/${id}/reset-password`), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            showToast(result.details || result.error || 'Failed to reset password', 'error');
+            return;
+        }
+        
+        showToast(result.message, 'success');
+        output.textContent = `New password: ${result.password}`;
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// URL of an API route of the selected Moodle instance
+function instanceApi(path) {
+    return currentInstance ? `/api/instances/${encodeURIComponent(currentInstance)}${path}` : `/api${path}`;
+}
+
+// Load the managed Moodle instances into the instance selector
+async function loadInstances() {
+    const select = document.getElementById('instance-select');
+    if (!select) return;
+    
+    try {
+        const response = await fetch('/api/instances', {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        if (!response.ok) return;
+        
+        const result = await response.json();
+        
+        // A removed instance falls back to the default one
+        if (currentInstance && !result.instances.some(instance => instance.name === currentInstance)) {
+            selectInstance('');
+            return;
+        }
+        
+        select.innerHTML = result.instances.map(instance => `
+            <option value="${instance.default ? '' : instance.name}" ${(instance.default ? '' : instance.name) === currentInstance ? 'selected' : ''}>
+                ${instance.name}${instance.running ? '' : ' (stopped)'}${instance.maintenance ? ' (maintenance)' : ''}
+            </option>
+        `).join('');
+        select.style.display = result.instances.length > 1 ? '' : 'none';
+    } catch (error) {
+        console.error('Failed to load Moodle instances:', error);
+    }
+}
+
+// Switch the dashboard to another Moodle instance
+function selectInstance(name) {
+    if (name) {
+        localStorage.setItem('moodle_instance', name);
+    } else {
+        localStorage.removeItem('moodle_instance');
+    }
+    window.location.reload();
+}
+
+// Refresh Moodle status
+async function refreshMoodleStatus() {
+    try {
+        const response = await fetch(instanceApi('/moodle/status'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        if (response.ok) {
+            const status = await response.json();
+            updateMoodleStatus(status);
+        }
+    } catch (error) {
+        console.error('Failed to load Moodle status:', error);
     }
 }
 
@@ -204,7 +826,7 @@ async function startMoodle() {
     showLoading();
     
     try {
-        const response = await fetch('/api/moodle/start', {
+        const response = await fetch(instanceApi('/moodle/start'), {
             method: 'POST',
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
@@ -216,7 +838,7 @@ async function startMoodle() {
         if (response.ok) {
             showToast(result.message || 'Moodle started successfully', 'success');
             // Refresh status after a delay
-            setTimeout(loadDashboardData, 2000);
+            setTimeout(refreshMoodleStatus, 2000);
         } else {
             showToast(result.error || 'Failed to start Moodle', 'error');
         }
@@ -236,7 +858,7 @@ async function stopMoodle() {
     showLoading();
     
     try {
-        const response = await fetch('/api/moodle/stop', {
+        const response = await fetch(instanceApi('/moodle/stop'), {
             method: 'POST',
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
@@ -248,7 +870,7 @@ async function stopMoodle() {
         if (response.ok) {
             showToast(result.message || 'Moodle stopped successfully', 'success');
             // Refresh status after a delay
-            setTimeout(loadDashboardData, 2000);
+            setTimeout(refreshMoodleStatus, 2000);
         } else {
             showToast(result.error || 'Failed to stop Moodle', 'error');
         }
@@ -268,7 +890,7 @@ async function restartMoodle() {
     showLoading();
     
     try {
-        const response = await fetch('/api/moodle/restart', {
+        const response = await fetch(instanceApi('/moodle/restart'), {
             method: 'POST',
             headers: {
                 'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
@@ -280,7 +902,7 @@ async function restartMoodle() {
         if (response.ok) {
             showToast(result.message || 'Moodle restarted successfully', 'success');
             // Refresh status after a delay
-            setTimeout(loadDashboardData, 3000);
+            setTimeout(refreshMoodleStatus, 3000);
         } else {
             showToast(result.error || 'Failed to restart Moodle', 'error');
         }
@@ -291,6 +913,338 @@ async function restartMoodle() {
     }
 }
 
+// Toggle Moodle maintenance mode
+async function toggleMaintenance() {
+    const button = document.getElementById('maintenance-button');
+    const enabled = button && button.dataset.enabled === 'true';
+    let body = null;
+    
+    if (!enabled) {
+        const message = prompt('Maintenance message shown to users (leave empty for the default):', '');
+        if (message === null) {
+            return;
+        }
+        body = JSON.stringify({ mode: 'file', message: message });
+    } else if (!confirm('Are you sure you want to disable maintenance mode?')) {
+        return;
+    }
+    
+    showLoading();
+    
+    try {
+        const response = await fetch(instanceApi(`/moodle/maintenance/${enabled ? 'disable' : 'enable'}`), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`,
+                'Content-Type': 'application/json'
+            },
+            body: body
+        });
+        
+        const result = await response.json();
+        
+        if (response.ok) {
+            showToast(result.message, 'success');
+            updateMaintenanceStatus(result.maintenance);
+        } else {
+            showToast(result.error || 'Failed to change maintenance mode', 'error');
+        }
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    } finally {
+        hideLoading();
+    }
+}
+
+// Load the Moodle CLI scripts that can be run as jobs
+async function loadCLIScripts() {
+    const select = document.getElementById('job-script');
+    if (!select) return;
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/cli/scripts'), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        if (response.ok) {
+            const scripts = await response.json();
+            select.innerHTML = scripts.map(script => `
+                <option value="${script.name}" title="${script.description}">${script.script}</option>
+            `).join('');
+        }
+    } catch (error) {
+        console.error('Failed to load CLI scripts:', error);
+    }
+}
+
+// Parse "--name=value --flag" into a job argument map
+function parseJobArgs(text) {
+    const args = {};
+    text.trim().split(/\s+/).filter(part => part !== '').forEach(part => {
+        const match = part.match(/^--([^=]+)(?:=(.*))?$/);
+        if (match) {
+            args[match[1]] = match[2] === undefined ? 'true' : match[2];
+        }
+    });
+    return args;
+}
+
+// Run a Moodle CLI script and stream its output
+async function runJob() {
+    const script = document.getElementById('job-script').value;
+    const args = parseJobArgs(document.getElementById('job-args').value);
+    
+    try {
+        const response = await fetch(instanceApi('/jobs'), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`,
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ script: script, args: args })
+        });
+        
+        const result = await response.json();
+        
+        if (response.ok) {
+            streamJob(result);
+        } else {
+            showToast(result.details || result.error || 'Failed to start job', 'error');
+        }
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// Stream the output of a job into the output panel
+function streamJob(job) {
+    const output = document.getElementById('job-output');
+    const status = document.getElementById('job-status');
+    const cancelButton = document.getElementById('job-cancel-button');
+    
+    output.textContent = '';
+    status.textContent = `${job.command} (running)`;
+    cancelButton.dataset.jobId = job.id;
+    cancelButton.disabled = false;
+    
+    // EventSource cannot send headers, the auth cookie is used instead
+    const source = new EventSource(instanceApi(`/jobs/${job.id}/stream`));
+    
+    source.addEventListener('output', event => {
+        output.textContent += event.data;
+        output.scrollTop = output.scrollHeight;
+    });
+    
+    source.addEventListener('done', event => {
+        const finished = JSON.parse(event.data);
+        status.textContent = `${finished.command} (${finished.status})`;
+        cancelButton.disabled = true;
+        showToast(`Job ${finished.name} ${finished.status}`, finished.status === 'succeeded' ? 'success' : 'error');
+        source.close();
+    });
+    
+    source.onerror = () => {
+        cancelButton.disabled = true;
+        source.close();
+    };
+}
+
+// Upgrade Moodle core from a release archive on the server
+async function upgradeMoodle() {
+    const archive = prompt('Path of the Moodle release archive in the release directory on the server (.tgz or .zip):', '');
+    if (!archive) {
+        return;
+    }
+    
+    if (!confirm('The site will be in maintenance mode during the upgrade. Continue?')) {
+        return;
+    }
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/upgrade'), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`,
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ archive: archive })
+        });
+        
+        const result = await response.json();
+        
+        if (response.ok) {
+            streamJob(result);
+        } else {
+            showToast(result.details || result.error || 'Failed to start upgrade', 'error');
+        }
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// Load the moodledata breakdown, polling while a scan is running
+async function refreshStorage(rescan) {
+    const list = document.getElementById('storage-areas');
+    const status = document.getElementById('storage-status');
+    if (!list) return;
+    
+    try {
+        const response = await fetch(instanceApi(`/moodle/storage${rescan ? '?refresh=true' : ''}`), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const report = await response.json();
+        
+        if (!response.ok) {
+            status.textContent = report.details || report.error;
+            return;
+        }
+        
+        list.innerHTML = (report.areas || []).filter(area => area.exists).map(area => `
+            <div class="component-item">
+                <span class="component-name">${area.name}</span>
+                <span class="component-unit">${formatBytes(area.size)}</span>
+                <span class="component-state">${area.files} files${area.oldest_file ? ' · oldest ' + formatTimestamp(area.oldest_file) : ''}</span>
+                ${area.error ? `<span class="component-error">${area.error}</span>` : ''}
+            </div>
+        `).join('');
+        
+        if (report.scanning) {
+            status.textContent = 'Scanning...';
+            setTimeout(() => refreshStorage(false), 5000);
+        } else if (report.scanned_at) {
+            status.textContent = `${formatBytes(report.size)} · scanned ${formatTimestamp(report.scanned_at)}`;
+        }
+    } catch (error) {
+        console.error('Failed to load Moodle data storage:', error);
+    }
+}
+
+// Check the PHP runtime against the installed and target Moodle versions
+async function checkEnvironment() {
+    const list = document.getElementById('environment-checks');
+    const status = document.getElementById('environment-status');
+    if (!list) return;
+    
+    const target = document.getElementById('environment-target').value.trim();
+    
+    try {
+        const response = await fetch(instanceApi(`/moodle/environment${target ? '?target=' + encodeURIComponent(target) : ''}`), {
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const report = await response.json();
+        
+        if (!response.ok) {
+            status.textContent = report.details || report.error;
+            return;
+        }
+        
+        const results = [report.installed, report.target].filter(result => result);
+        
+        // Passed checks are only listed as part of the summary
+        list.innerHTML = results.map(result => `
+            <div class="component-item">
+                <span class="status-dot ${environmentDot(result.status)}"></span>
+                <span class="component-name">Moodle ${result.name}</span>
+                <span class="component-unit">${result === report.target ? 'target' : 'installed'}</span>
+                <span class="component-state">${result.status} · ${result.checks.filter(check => check.status === 'pass').length}/${result.checks.length} passed</span>
+            </div>
+        ` + result.checks.filter(check => check.status !== 'pass').map(check => `
+            <div class="component-item">
+                <span class="status-dot ${environmentDot(check.status)}"></span>
+                <span class="component-name">${check.name}</span>
+                <span class="component-unit">${check.actual || 'not set'}</span>
+                <span class="component-state">${check.status}${check.expected ? ' · expected ' + check.expected : ''}</span>
+                ${check.message ? `<span class="component-error">${check.message}</span>` : ''}
+            </div>
+        `).join('')).join('') + (report.warnings || []).map(warning => `
+            <div class="component-item">
+                <span class="status-dot warning"></span>
+                <span class="component-error">${warning}</span>
+            </div>
+        `).join('');
+        
+        status.textContent = `PHP ${report.php_version}${report.ini_file ? ' · ' + report.ini_file : ''}`;
+    } catch (error) {
+        console.error('Failed to check the PHP environment:', error);
+    }
+}
+
+// Status dot class of an environment check result
+function environmentDot(status) {
+    if (status === 'pass') return 'running';
+    if (status === 'warn') return 'warning';
+    return '';
+}
+
+// Preview or run the cleanup of old temp and trash entries
+async function cleanupStorage(dryRun) {
+    if (!dryRun && !confirm('Delete temp and trash entries older than the cleanup age?')) {
+        return;
+    }
+    
+    const output = document.getElementById('storage-output');
+    
+    try {
+        const response = await fetch(instanceApi('/moodle/storage/cleanup'), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`,
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ dry_run: dryRun })
+        });
+        
+        const result = await response.json();
+        
+        if (response.ok) {
+            const verb = result.dry_run ? 'Would delete' : 'Deleted';
+            output.textContent = `${verb} ${result.files} files and ${result.directories} directories (${formatBytes(result.size)}) older than ${result.older_than}h\n` +
+                result.entries.join('\n') + (result.truncated ? '\n...' : '');
+            if (!result.dry_run) {
+                showToast(`${verb} ${formatBytes(result.size)}`, 'success');
+                refreshStorage(true);
+            }
+        } else {
+            showToast(result.details || result.error || 'Failed to clean up Moodle data', 'error');
+        }
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
+// Cancel the running job
+async function cancelJob() {
+    const cancelButton = document.getElementById('job-cancel-button');
+    const jobId = cancelButton.dataset.jobId;
+    if (!jobId || !confirm('Are you sure you want to cancel this job?')) {
+        return;
+    }
+    
+    try {
+        const response = await fetch(instanceApi(`/jobs/${jobId}/cancel`), {
+            method: 'POST',
+            headers: {
+                'Authorization': `Bearer ${localStorage.getItem('auth_token')}`
+            }
+        });
+        
+        const result = await response.json();
+        if (!response.ok) {
+            showToast(result.details || result.error || 'Failed to cancel job', 'error');
+        }
+    } catch (error) {
+        showToast('Network error. Please try again.', 'error');
+    }
+}
+
 // Refresh alerts
 async function refreshAlerts() {
     try {
@@ -372,6 +1326,13 @@ function startAutoRefresh() {
     // Refresh every 30 seconds
     refreshInterval = setInterval(() => {
         loadDashboardData();
+        refreshMoodleStatus();
+        refreshProcesses();
+        refreshAccessLog();
+        refreshErrorGroups();
+        refreshConfigHistory();
+        refreshTaskHealth();
+        refreshUsage();
         refreshAlerts();
         refreshLogs();
     }, 30000);
@@ -491,12 +1452,31 @@ function formatDuration(seconds) {
     }
 }
 
+// Format bytes
+function formatBytes(bytes) {
+    const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+    let value = bytes;
+    let unit = 0;
+    while (value >= 1024 && unit < units.length - 1) {
+        value /= 1024;
+        unit++;
+    }
+    return `${unit === 0 ? value : value.toFixed(1)} ${units[unit]}`;
+}
+
 // Format timestamp
 function formatTimestamp(timestamp) {
     const date = new Date(timestamp);
     return date.toLocaleString();
 }
 
+// Escape text for use in HTML
+function escapeHtml(text) {
+    const div = document.createElement('div');
+    div.textContent = text;
+    return div.innerHTML;
+}
+
 // Utility functions
 function debounce(func, wait) {
     let timeout;
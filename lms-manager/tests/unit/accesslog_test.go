@@ -0,0 +1,217 @@
+package unit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/services"
+)
+
+// testTimedLogFormat is the combined format with the request time and the
+// client behind a reverse proxy
+const testTimedLogFormat = `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" "$http_x_forwarded_for" $request_time`
+
+// testLogLine returns an access log line in testTimedLogFormat
+func testLogLine(client, path string, status int, requestTime float64) string {
+	return fmt.Sprintf(`10.0.0.2 - - [%s] "GET %s HTTP/1.1" %d 5120 "https://lms.example.com/" "Mozilla/5.0 (X11; Linux x86_64)" "%s" %.3f`+"\n",
+		time.Now().Format("02/Jan/2006:15:04:05 -0700"), path, status, client, requestTime)
+}
+
+func appendTestLog(t *testing.T, path, content string) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+}
+
+func TestAccessLogFormat_Parse(t *testing.T) {
+	combined, err := services.CompileAccessLogFormat(config.AccessLogCombined)
+	if err != nil {
+		t.Fatalf("Failed to compile the combined format: %v", err)
+	}
+	if combined.HasRequestTime() {
+		t.Error("The combined format has no request time")
+	}
+
+	entry, err := combined.Parse(`203.0.113.7 - - [16/Oct/2026:09:15:02 +0700] "POST /mod/quiz/processattempt.php?cmid=42 HTTP/2.0" 303 0 "-" "Mozilla/5.0 (Windows NT 10.0)"`)
+	if err != nil {
+		t.Fatalf("Failed to parse a combined line: %v", err)
+	}
+	if entry.Client != "203.0.113.7" || entry.Method != "POST" || entry.Path != "/mod/quiz/processattempt.php?cmid=42" || entry.Status != 303 {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if entry.Time.UTC() != time.Date(2026, 10, 16, 2, 15, 2, 0, time.UTC) {
+		t.Errorf("Unexpected time %v", entry.Time)
+	}
+
+	timed, err := services.CompileAccessLogFormat(testTimedLogFormat)
+	if err != nil {
+		t.Fatalf("Failed to compile a custom format: %v", err)
+	}
+	entry, err = timed.Parse(testLogLine("198.51.100.20, 10.0.0.1", "/login/index.php", 200, 0.25))
+	if err != nil {
+		t.Fatalf("Failed to parse a custom line: %v", err)
+	}
+	if entry.Client != "198.51.100.20" || !entry.HasRequestTime || entry.RequestTime != 0.25 || entry.Bytes != 5120 {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+
+	if _, err := timed.Parse("not an access log line"); err == nil {
+		t.Error("Expected an error for a line in another format")
+	}
+	if _, err := services.CompileAccessLogFormat(`$remote_addr "$request"`); err == nil {
+		t.Error("Expected an error for a format without $status")
+	}
+}
+
+func TestMoodleScript(t *testing.T) {
+	tests := map[string]string{
+		"/mod/quiz/attempt.php?attempt=12&cmid=42":           "/mod/quiz/attempt.php",
+		"/pluginfile.php/27/mod_resource/content/1/week.pdf": "/pluginfile.php",
+		"/login/":                      "/login/index.php",
+		"/":                            "/index.php",
+		"/theme/boost/pix/favicon.ico": "/theme/boost/pix/favicon.ico",
+	}
+
+	for path, script := range tests {
+		if got := services.MoodleScript(path); got != script {
+			t.Errorf("MoodleScript(%q) = %q, expected %q", path, got, script)
+		}
+	}
+}
+
+func TestAccessLogService_Poll(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	appendTestLog(t, logPath, testLogLine("198.51.100.1", "/old.php", 500, 9))
+
+	accessLogConfig := config.DefaultAccessLogConfig()
+	accessLogConfig.Path = logPath
+	accessLogConfig.Format = testTimedLogFormat
+	accessLogService := services.NewAccessLogService(accessLogConfig, nil)
+
+	// Traffic from before the analyzer started is not counted
+	if err := accessLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if stats := accessLogService.GetStats(5); stats.Requests != 0 {
+		t.Fatalf("Expected the existing log to be skipped, got %d requests", stats.Requests)
+	}
+
+	for i := 0; i < 6; i++ {
+		appendTestLog(t, logPath, testLogLine("198.51.100.1", "/mod/quiz/attempt.php?attempt=1", 200, 0.1*float64(i+1)))
+	}
+	appendTestLog(t, logPath, testLogLine("198.51.100.2", "/course/view.php?id=2", 404, 0.05))
+	appendTestLog(t, logPath, testLogLine("198.51.100.2", "/course/view.php?id=3", 502, 2))
+
+	// A line still being written is left for the next poll
+	partial := testLogLine("198.51.100.3", "/my/", 200, 0.2)
+	appendTestLog(t, logPath, partial[:20])
+
+	if err := accessLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+
+	stats := accessLogService.GetStats(5)
+	if stats.Requests != 8 || stats.Status4xx != 1 || stats.Status5xx != 1 || stats.ParseErrors != 0 {
+		t.Fatalf("Expected 8 requests with a 404 and a 502, got %+v", stats)
+	}
+	if stats.Rate5xx != 12.5 || !stats.HasLatency || stats.P50 != 300 || stats.P99 != 2000 {
+		t.Errorf("Unexpected rates or latencies %+v", stats)
+	}
+	if len(stats.TopScripts) != 2 || stats.TopScripts[0].Key != "/mod/quiz/attempt.php" || stats.TopScripts[0].Requests != 6 {
+		t.Errorf("Expected the quiz attempts on top, got %+v", stats.TopScripts)
+	}
+	if stats.TopScripts[1].Key != "/course/view.php" || stats.TopScripts[1].Status5xx != 1 {
+		t.Errorf("Expected the course page with its error, got %+v", stats.TopScripts[1])
+	}
+	if len(stats.TopClients) != 2 || stats.TopClients[0].Key != "198.51.100.1" {
+		t.Errorf("Unexpected top clients %+v", stats.TopClients)
+	}
+	if len(stats.Timeline) == 0 {
+		t.Error("Expected a per-minute timeline")
+	}
+
+	// logrotate renames the log, nginx keeps writing to it until reopened
+	appendTestLog(t, logPath, partial[20:])
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatalf("Failed to rotate the log: %v", err)
+	}
+	appendTestLog(t, logPath+".1", testLogLine("198.51.100.3", "/my/", 200, 0.2))
+	appendTestLog(t, logPath, testLogLine("198.51.100.4", "/user/profile.php", 200, 0.2))
+
+	if err := accessLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if stats := accessLogService.GetStats(5); stats.Requests != 11 {
+		t.Errorf("Expected the rest of the rotated log and the new log, got %d requests", stats.Requests)
+	}
+
+	// copytruncate empties the log in place
+	if err := os.Truncate(logPath, 0); err != nil {
+		t.Fatalf("Failed to truncate the log: %v", err)
+	}
+	appendTestLog(t, logPath, testLogLine("198.51.100.4", "/", 200, 0.1))
+
+	if err := accessLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if stats := accessLogService.GetStats(5); stats.Requests != 12 {
+		t.Errorf("Expected the truncated log to be read from its start, got %d requests", stats.Requests)
+	}
+}
+
+func TestMonitorService_CheckAccessLogStats(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	logPath := filepath.Join(t.TempDir(), "access.log")
+	appendTestLog(t, logPath, "")
+
+	accessLogConfig := config.DefaultAccessLogConfig()
+	accessLogConfig.Path = logPath
+	accessLogConfig.Format = testTimedLogFormat
+	accessLogService := services.NewAccessLogService(accessLogConfig, monitorService)
+	accessLogService.Poll()
+
+	// Too few requests to judge
+	appendTestLog(t, logPath, testLogLine("198.51.100.1", "/", 503, 5))
+	accessLogService.Poll()
+	monitorService.CheckAccessLogStats(accessLogService.GetStats(5))
+	if countAlerts(t, db, services.AlertHTTP5xxRate) != 0 {
+		t.Error("No alert expected for a single request")
+	}
+
+	for i := 0; i < 30; i++ {
+		appendTestLog(t, logPath, testLogLine("198.51.100.1", "/mod/quiz/attempt.php", 503, 5))
+	}
+	accessLogService.Poll()
+	monitorService.CheckAccessLogStats(accessLogService.GetStats(5))
+
+	if countAlerts(t, db, services.AlertHTTP5xxRate) != 1 {
+		t.Error("Expected a 5xx rate alert")
+	}
+	if countAlerts(t, db, services.AlertHTTPLatency) != 1 {
+		t.Error("Expected a latency alert")
+	}
+
+	for i := 0; i < 1000; i++ {
+		appendTestLog(t, logPath, testLogLine("198.51.100.1", "/", 200, 0.1))
+	}
+	accessLogService.Poll()
+	monitorService.CheckAccessLogStats(accessLogService.GetStats(5))
+
+	if countAlerts(t, db, services.AlertHTTP5xxRate) != 0 || countAlerts(t, db, services.AlertHTTPLatency) != 0 {
+		t.Error("HTTP alerts should be resolved once the traffic recovers")
+	}
+}
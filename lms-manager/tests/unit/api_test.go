@@ -0,0 +1,168 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/handlers"
+	"lms-manager/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// performAs serves a request to handler as a user with role, like
+// AuthMiddleware would, and returns the response status
+func performAs(role, method, route, path, body string, handler gin.HandlerFunc) int {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("user_id", "user-"+role)
+		c.Set("username", role)
+		c.Set("role", role)
+	})
+	router.Handle(method, route, handler)
+
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder.Code
+}
+
+func TestAPIHandler_UpgradeRequiresPermission(t *testing.T) {
+	fixture, archive := setupTestUpgrade(t, "mysqli")
+
+	db := setupTestDB(t)
+	defer db.Close()
+	jobService := services.NewJobService(fixture.moodle)
+	jobService.SetDatabase(db)
+
+	apiHandler := handlers.NewAPIHandler(nil, fixture.moodle, nil)
+	apiHandler.SetJobService(jobService)
+
+	body := `{"archive":"` + archive + `"}`
+	if code := performAs("viewer", http.MethodPost, "/moodle/upgrade", "/moodle/upgrade", body, apiHandler.UpgradeMoodle); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be forbidden, got %d", code)
+	}
+	if jobs, _ := jobService.ListJobs(10); len(jobs) != 0 {
+		t.Errorf("Expected no upgrade job for a viewer, got %d", len(jobs))
+	}
+
+	// Archives outside the archive directory are refused
+	outside := filepath.Join(filepath.Dir(filepath.Dir(archive)), "moodle.tgz")
+	writeTestFile(t, filepath.Dir(outside), filepath.Base(outside), "")
+	body = `{"archive":"` + outside + `"}`
+	if code := performAs("operator", http.MethodPost, "/moodle/upgrade", "/moodle/upgrade", body, apiHandler.UpgradeMoodle); code != http.StatusBadRequest {
+		t.Errorf("Expected an archive outside the archive directory to be refused, got %d", code)
+	}
+}
+
+func TestAPIHandler_JobsRequirePermission(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: "/var/www/moodle"})
+	jobService := services.NewJobService(moodleService)
+	jobService.SetDatabase(db)
+
+	apiHandler := handlers.NewAPIHandler(nil, moodleService, nil)
+	apiHandler.SetJobService(jobService)
+
+	body := `{"script":"kill_all_sessions"}`
+	if code := performAs("viewer", http.MethodPost, "/jobs", "/jobs", body, apiHandler.RunJob); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused a job, got %d", code)
+	}
+	if code := performAs("viewer", http.MethodPost, "/jobs/:id/cancel", "/jobs/job-1/cancel", "", apiHandler.CancelJob); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused cancelling a job, got %d", code)
+	}
+	if jobs, _ := jobService.ListJobs(10); len(jobs) != 0 {
+		t.Errorf("Expected no job for a viewer, got %d", len(jobs))
+	}
+
+	// An operator gets past the permission check to the allow-list
+	body = `{"script":"not_allow_listed"}`
+	if code := performAs("operator", http.MethodPost, "/jobs", "/jobs", body, apiHandler.RunJob); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown script to be refused for an operator, got %d", code)
+	}
+}
+
+func TestAPIHandler_StorageCleanupRequiresPermission(t *testing.T) {
+	moodleService, dataPath := setupTestStorage(t)
+	apiHandler := handlers.NewAPIHandler(nil, moodleService, nil)
+
+	route := "/moodle/storage/cleanup"
+	if code := performAs("viewer", http.MethodPost, route, route, `{"dry_run":true}`, apiHandler.CleanupStorage); code != http.StatusOK {
+		t.Errorf("Expected a viewer to preview the cleanup, got %d", code)
+	}
+	if code := performAs("viewer", http.MethodPost, route, route, "", apiHandler.CleanupStorage); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused the cleanup, got %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dataPath, "temp", "backup", "old.mbz")); err != nil {
+		t.Error("Nothing should be deleted for a viewer")
+	}
+
+	if code := performAs("operator", http.MethodPost, route, route, "", apiHandler.CleanupStorage); code != http.StatusOK {
+		t.Errorf("Expected an operator to clean up, got %d", code)
+	}
+}
+
+func TestAPIHandler_QuarantineRequiresPermission(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	moodleService, _ := setupTestStorage(t)
+	jobService := services.NewJobService(moodleService)
+	jobService.SetDatabase(db)
+
+	apiHandler := handlers.NewAPIHandler(nil, moodleService, nil)
+	apiHandler.SetJobService(jobService)
+
+	route := "/moodle/files/orphans"
+	if code := performAs("viewer", http.MethodPost, route, route, `{"quarantine":true}`, apiHandler.ScanOrphanedFiles); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused quarantining, got %d", code)
+	}
+	if jobs, _ := jobService.ListJobs(10); len(jobs) != 0 {
+		t.Errorf("Expected no scan job for a viewer, got %d", len(jobs))
+	}
+
+	route = "/moodle/files/quarantine"
+	if code := performAs("viewer", http.MethodDelete, route, route, "", apiHandler.PurgeQuarantine); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused purging the quarantine, got %d", code)
+	}
+	if code := performAs("operator", http.MethodDelete, route, route, "", apiHandler.PurgeQuarantine); code != http.StatusOK {
+		t.Errorf("Expected an operator to purge the quarantine, got %d", code)
+	}
+}
+
+func TestAPIHandler_MaintenanceRequiresPermission(t *testing.T) {
+	moodleService, _ := setupTestMoodle(t, config.DefaultComponents())
+	apiHandler := handlers.NewAPIHandler(nil, moodleService, nil)
+
+	enable := "/moodle/maintenance/enable"
+	disable := "/moodle/maintenance/disable"
+	body := `{"mode":"file","message":"Back soon"}`
+	if code := performAs("viewer", http.MethodPost, enable, enable, body, apiHandler.EnableMaintenance); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused enabling maintenance, got %d", code)
+	}
+	if moodleService.GetMaintenanceStatus().Enabled {
+		t.Fatal("Maintenance mode should not be enabled by a viewer")
+	}
+
+	if code := performAs("operator", http.MethodPost, enable, enable, body, apiHandler.EnableMaintenance); code != http.StatusOK {
+		t.Errorf("Expected an operator to enable maintenance, got %d", code)
+	}
+	if code := performAs("viewer", http.MethodPost, disable, disable, "", apiHandler.DisableMaintenance); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be refused disabling maintenance, got %d", code)
+	}
+	if !moodleService.GetMaintenanceStatus().Enabled {
+		t.Error("Maintenance mode should not be disabled by a viewer")
+	}
+	if code := performAs("operator", http.MethodPost, disable, disable, "", apiHandler.DisableMaintenance); code != http.StatusOK {
+		t.Errorf("Expected an operator to disable maintenance, got %d", code)
+	}
+}
@@ -1,12 +1,11 @@
 package unit
 
 import (
+	"database/sql"
 	"testing"
-	"time"
 
 	"lms-manager/models"
 	"lms-manager/services"
-	"lms-manager/utils"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -20,7 +19,7 @@ func TestAuthService_Login(t *testing.T) {
 	authService := services.NewAuthService("test-secret", db)
 
 	// Create test user
-	user, err := authService.CreateUser(&models.CreateUserRequest{
+	_, err := authService.CreateUser(&models.CreateUserRequest{
 		Username: "testuser",
 		Email:    "test@example.com",
 		Password: "TestPass123!",
@@ -263,55 +262,11 @@ func setupTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("Failed to open test database: %v", err)
 	}
 
-	// Create tables
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			username TEXT UNIQUE NOT NULL,
-			email TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			role TEXT NOT NULL,
-			active BOOLEAN DEFAULT 1,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			last_login DATETIME
-		)`,
-		`CREATE TABLE IF NOT EXISTS user_sessions (
-			id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			ip_address TEXT NOT NULL,
-			user_agent TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			expires_at DATETIME NOT NULL,
-			FOREIGN KEY (user_id) REFERENCES users (id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS user_activities (
-			id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			action TEXT NOT NULL,
-			resource TEXT,
-			ip_address TEXT,
-			user_agent TEXT,
-			success BOOLEAN DEFAULT 1,
-			message TEXT,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users (id)
-		)`,
-		`CREATE TABLE IF NOT EXISTS security_events (
-			id TEXT PRIMARY KEY,
-			type TEXT NOT NULL,
-			message TEXT NOT NULL,
-			ip_address TEXT,
-			user_agent TEXT,
-			severity TEXT NOT NULL,
-			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-		)`,
-	}
+	// Every connection would get its own in-memory database
+	db.SetMaxOpenConns(1)
 
-	for _, query := range queries {
-		if _, err := db.Exec(query); err != nil {
-			t.Fatalf("Failed to create table: %v", err)
-		}
+	if err := services.CreateTables(db); err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
 	}
 
 	return db
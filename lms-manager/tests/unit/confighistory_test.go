@@ -0,0 +1,194 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+func TestRedactConfigSource(t *testing.T) {
+	source := testConfigPHP + `$CFG->alternative_cache = array('redis' => array('password' => "cache-secret", 'server' => 'localhost'));
+`
+	redacted := services.RedactConfigSource(source)
+
+	for _, secret := range []string{"S3cr3t", "pa\\'ss", "redispass", "cache-secret"} {
+		if strings.Contains(redacted, secret) {
+			t.Errorf("Secret %q was not redacted:\n%s", secret, redacted)
+		}
+	}
+	for _, kept := range []string{"$CFG->dbpass    = '********';", "'dbport' => 3307,", "'server' => 'localhost'", "https://lms.example.id/"} {
+		if !strings.Contains(redacted, kept) {
+			t.Errorf("Expected %q in the redacted source:\n%s", kept, redacted)
+		}
+	}
+	if strings.Count(redacted, "\n") != strings.Count(source, "\n") {
+		t.Error("Redaction should keep every line")
+	}
+}
+
+func TestConfigHistoryService_Check(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	// The training override shows debug messages too, start without it
+	production := strings.Replace(testConfigPHP, "$CFG->debugdisplay = 1;", "$CFG->debugdisplay = 0;", 1)
+	configPath := writeTestConfigPHP(t)
+	if err := os.WriteFile(configPath, []byte(production), 0644); err != nil {
+		t.Fatalf("Failed to write config.php: %v", err)
+	}
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: filepath.Dir(configPath), ConfigPath: configPath})
+	historyService := services.NewConfigHistoryService(config.DefaultConfigHistoryConfig(), moodleService, monitorService)
+	historyService.SetDatabase(db)
+
+	// The first snapshot is the baseline, and an unchanged file adds nothing
+	for i := 0; i < 2; i++ {
+		if err := historyService.Check(); err != nil {
+			t.Fatalf("Check failed: %v", err)
+		}
+	}
+	versions, err := historyService.GetVersions(10)
+	if err != nil {
+		t.Fatalf("GetVersions failed: %v", err)
+	}
+	if len(versions) != 1 || versions[0].Source != models.ConfigSourceInitial || versions[0].DebugDisplay {
+		t.Fatalf("Expected the initial version only, got %+v", versions)
+	}
+	if countAlerts(t, db, services.AlertConfigChanged) != 0 {
+		t.Error("The initial snapshot should not raise an alert")
+	}
+
+	// Someone turns on debugging and changes the database password
+	changed := strings.Replace(production, `'S3cr3t;pa\'ss'`, "'N3w-pass'", 1)
+	changed = strings.Replace(changed, "require_once", "$CFG->debug = DEBUG_DEVELOPER;\n$CFG->debugdisplay = 1;\n\nrequire_once", 1)
+	if err := os.WriteFile(configPath, []byte(changed), 0644); err != nil {
+		t.Fatalf("Failed to write config.php: %v", err)
+	}
+
+	if err := historyService.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	versions, _ = historyService.GetVersions(10)
+	if len(versions) != 2 || versions[0].Source != models.ConfigSourceExternal || !versions[0].DebugDisplay ||
+		!versions[0].SecretsChanged || versions[0].ChangedBy == "" {
+		t.Fatalf("Expected an external version with debugdisplay and a changed secret, got %+v", versions)
+	}
+
+	// Only the redacted content is stored
+	rows, err := db.Query("SELECT content FROM config_versions")
+	if err != nil {
+		t.Fatalf("Failed to query config.php versions: %v", err)
+	}
+	for rows.Next() {
+		var content string
+		if err := rows.Scan(&content); err != nil {
+			t.Fatalf("Failed to scan config.php version: %v", err)
+		}
+		for _, secret := range []string{"S3cr3t", "N3w-pass", "redispass"} {
+			if strings.Contains(content, secret) {
+				t.Errorf("Secret %q was stored:\n%s", secret, content)
+			}
+		}
+	}
+	rows.Close()
+	if countAlerts(t, db, services.AlertConfigChanged) != 1 || countAlerts(t, db, services.AlertConfigDebugDisplay) != 1 {
+		t.Error("Expected a change alert and a debugdisplay alert")
+	}
+
+	diff, err := historyService.Diff("", "")
+	if err != nil {
+		t.Fatalf("Diff failed: %v", err)
+	}
+	if diff.From == nil || diff.From.ID != versions[1].ID || diff.To.ID != versions[0].ID {
+		t.Errorf("Expected the latest version against the initial one, got %+v", diff)
+	}
+	if diff.Added != 3 || diff.Removed != 0 || !diff.SecretsChanged {
+		t.Errorf("Expected 3 added lines and a changed secret, got %+v", diff)
+	}
+	if strings.Contains(diff.Diff, "S3cr3t") || strings.Contains(diff.Diff, "N3w-pass") {
+		t.Errorf("The diff should not show the passwords:\n%s", diff.Diff)
+	}
+	if !strings.Contains(diff.Diff, "+$CFG->debugdisplay = 1;\n") {
+		t.Errorf("Expected the debug settings:\n%s", diff.Diff)
+	}
+	if !strings.HasPrefix(diff.Diff, "@@ -38,4 +38,7 @@\n") {
+		t.Errorf("Unexpected hunk header:\n%s", diff.Diff)
+	}
+
+	if _, err := historyService.Diff("missing", ""); err == nil {
+		t.Error("Expected an error for an unknown version")
+	}
+
+	if err := historyService.Accept("admin"); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	versions, _ = historyService.GetVersions(10)
+	if versions[0].AcknowledgedBy != "admin" || versions[0].AcknowledgedAt == nil {
+		t.Errorf("Expected the change to be accepted by admin, got %+v", versions[0])
+	}
+	if countAlerts(t, db, services.AlertConfigChanged) != 0 {
+		t.Error("The change alert should be resolved once the change is accepted")
+	}
+	if countAlerts(t, db, services.AlertConfigDebugDisplay) != 1 {
+		t.Error("Accepting should not resolve the debugdisplay alert while debugdisplay is on")
+	}
+
+	// Turning debugdisplay off again resolves its alert
+	if err := os.WriteFile(configPath, []byte(strings.Replace(changed, "$CFG->debugdisplay = 1;", "$CFG->debugdisplay = 0;", 1)), 0644); err != nil {
+		t.Fatalf("Failed to write config.php: %v", err)
+	}
+	if err := historyService.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if countAlerts(t, db, services.AlertConfigChanged) != 1 || countAlerts(t, db, services.AlertConfigDebugDisplay) != 0 {
+		t.Error("Expected a change alert without the debugdisplay alert")
+	}
+
+	// Versions past the retention are pruned, but not the latest one
+	if err := historyService.Accept("admin"); err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	if _, err := db.Exec("UPDATE config_versions SET created_at = ?", time.Now().AddDate(-2, 0, 0)); err != nil {
+		t.Fatalf("Failed to age config.php versions: %v", err)
+	}
+	if err := historyService.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if versions, _ := historyService.GetVersions(10); len(versions) != 1 || versions[0].SecretsChanged {
+		t.Errorf("Expected only the latest version to be kept, got %+v", versions)
+	}
+
+	// A missing config.php is reported without recording a version
+	os.Remove(configPath)
+	if err := historyService.Check(); err == nil {
+		t.Error("Expected an error for a missing config.php")
+	}
+}
+
+func TestConfigHistoryService_InitialDebugDisplay(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	// The initial snapshot is no change, but debug messages are still shown
+	configPath := writeTestConfigPHP(t)
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: filepath.Dir(configPath), ConfigPath: configPath})
+	historyService := services.NewConfigHistoryService(config.DefaultConfigHistoryConfig(), moodleService, monitorService)
+	historyService.SetDatabase(db)
+
+	if err := historyService.Check(); err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if countAlerts(t, db, services.AlertConfigChanged) != 0 || countAlerts(t, db, services.AlertConfigDebugDisplay) != 1 {
+		t.Error("Expected only the debugdisplay alert for the initial snapshot")
+	}
+}
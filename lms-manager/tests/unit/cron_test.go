@@ -0,0 +1,227 @@
+package unit
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/services"
+)
+
+// fakePHP is a stand-in PHP binary whose exit code and run time are read from
+// files next to it
+const fakePHP = `#!/bin/sh
+dir=$(dirname "$0")
+echo "Execute scheduled task: $1"
+sleep "$(cat "$dir/sleep")"
+exit "$(cat "$dir/exitcode")"
+`
+
+type cronFixture struct {
+	cron *services.CronService
+	db   *sql.DB
+	dir  string
+}
+
+// setupTestCron creates a cron service running a fake PHP binary
+func setupTestCron(t *testing.T, cronConfig config.CronConfig) *cronFixture {
+	dir := t.TempDir()
+	moodlePath := filepath.Join(dir, "moodle")
+	if err := os.MkdirAll(filepath.Join(moodlePath, "admin", "cli"), 0755); err != nil {
+		t.Fatalf("Failed to create moodle dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(moodlePath, "admin", "cli", "cron.php"), []byte("<?php\n"), 0644); err != nil {
+		t.Fatalf("Failed to write cron.php: %v", err)
+	}
+
+	php := filepath.Join(dir, "php")
+	if err := os.WriteFile(php, []byte(fakePHP), 0755); err != nil {
+		t.Fatalf("Failed to write fake php: %v", err)
+	}
+
+	fixture := &cronFixture{db: setupTestDB(t), dir: dir}
+	fixture.setExitCode(t, "0")
+	fixture.setSleep(t, "0")
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{
+		Path:           moodlePath,
+		ConfigPath:     filepath.Join(moodlePath, "config.php"),
+		PHPBinary:      php,
+		ServiceManager: config.ServiceManagerFake,
+		Components:     config.DefaultComponents(),
+	})
+
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(fixture.db)
+
+	fixture.cron = services.NewCronService(cronConfig, moodleService, monitorService)
+	fixture.cron.SetDatabase(fixture.db)
+
+	return fixture
+}
+
+func (f *cronFixture) setExitCode(t *testing.T, code string) {
+	if err := os.WriteFile(filepath.Join(f.dir, "exitcode"), []byte(code), 0644); err != nil {
+		t.Fatalf("Failed to write exit code: %v", err)
+	}
+}
+
+func (f *cronFixture) setSleep(t *testing.T, seconds string) {
+	if err := os.WriteFile(filepath.Join(f.dir, "sleep"), []byte(seconds), 0644); err != nil {
+		t.Fatalf("Failed to write sleep: %v", err)
+	}
+}
+
+func (f *cronFixture) unresolvedAlerts(t *testing.T, alertType string) int {
+	var count int
+	if err := f.db.QueryRow("SELECT COUNT(*) FROM alerts WHERE type = ? AND resolved = 0", alertType).Scan(&count); err != nil {
+		t.Fatalf("Failed to count alerts: %v", err)
+	}
+	return count
+}
+
+func TestCronService_RecordsRuns(t *testing.T) {
+	fixture := setupTestCron(t, config.DefaultCronConfig())
+	defer fixture.db.Close()
+
+	run, err := fixture.cron.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if !run.Success || run.ExitCode != 0 {
+		t.Errorf("Expected a successful run, got exit code %d: %s", run.ExitCode, run.Error)
+	}
+
+	if !strings.Contains(run.Output, "Execute scheduled task") {
+		t.Errorf("Expected cron output to be captured, got %q", run.Output)
+	}
+
+	fixture.setExitCode(t, "3")
+	if run, _ := fixture.cron.Run(); run.Success || run.ExitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", run.ExitCode)
+	}
+
+	history, err := fixture.cron.GetHistory(10)
+	if err != nil {
+		t.Fatalf("GetHistory failed: %v", err)
+	}
+
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 runs in history, got %d", len(history))
+	}
+
+	status := fixture.cron.GetStatus()
+	if status.ConsecutiveFailures != 1 || status.LastSuccess == nil {
+		t.Errorf("Unexpected cron status: %+v", status)
+	}
+}
+
+func TestCronService_FailureAlert(t *testing.T) {
+	fixture := setupTestCron(t, config.DefaultCronConfig())
+	defer fixture.db.Close()
+
+	fixture.setExitCode(t, "1")
+	for i := 0; i < 2; i++ {
+		fixture.cron.Run()
+	}
+
+	if fixture.unresolvedAlerts(t, services.AlertCronFailing) != 0 {
+		t.Error("No alert expected below the failure threshold")
+	}
+
+	fixture.cron.Run()
+	if fixture.unresolvedAlerts(t, services.AlertCronFailing) != 1 {
+		t.Error("Expected a cron failure alert after 3 failures")
+	}
+
+	fixture.setExitCode(t, "0")
+	fixture.cron.Run()
+	if fixture.unresolvedAlerts(t, services.AlertCronFailing) != 0 {
+		t.Error("Cron failure alert should be resolved after a successful run")
+	}
+}
+
+func TestCronService_NoOverlap(t *testing.T) {
+	cronConfig := config.DefaultCronConfig()
+	cronConfig.Timeout = 1
+	fixture := setupTestCron(t, cronConfig)
+	defer fixture.db.Close()
+
+	fixture.setSleep(t, "5")
+	if err := fixture.cron.Trigger(); err != nil {
+		t.Fatalf("Trigger failed: %v", err)
+	}
+
+	if _, err := fixture.cron.Run(); err == nil {
+		t.Error("A second run should be refused while cron is running")
+	}
+
+	// The background run is killed by the timeout
+	deadline := time.Now().Add(5 * time.Second)
+	for fixture.cron.GetStatus().Running && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	status := fixture.cron.GetStatus()
+	if status.Running {
+		t.Fatal("Cron run should have been killed by the timeout")
+	}
+
+	if status.LastRun == nil || status.LastRun.Success || !strings.Contains(status.LastRun.Error, "timed out") {
+		t.Errorf("Expected a timed out run, got %+v", status.LastRun)
+	}
+}
+
+func TestCronService_Pause(t *testing.T) {
+	fixture := setupTestCron(t, config.DefaultCronConfig())
+	defer fixture.db.Close()
+
+	if err := fixture.cron.Pause(time.Second); err != nil {
+		t.Fatalf("Pause failed: %v", err)
+	}
+	if !fixture.cron.GetStatus().Paused {
+		t.Error("Expected cron to be reported as paused")
+	}
+	if _, err := fixture.cron.Run(); err == nil || !strings.Contains(err.Error(), "paused") {
+		t.Errorf("Expected cron to be refused while paused, got %v", err)
+	}
+	if err := fixture.cron.Trigger(); err == nil {
+		t.Error("Expected a triggered run to be refused while paused")
+	}
+
+	fixture.cron.Resume()
+	if run, err := fixture.cron.Run(); err != nil || !run.Success {
+		t.Errorf("Expected cron to run after resuming, got %+v (%v)", run, err)
+	}
+}
+
+func TestCronService_PauseWaitsForRun(t *testing.T) {
+	fixture := setupTestCron(t, config.DefaultCronConfig())
+	defer fixture.db.Close()
+
+	fixture.setSleep(t, "1")
+	if err := fixture.cron.Trigger(); err != nil {
+		t.Fatalf("Trigger failed: %v", err)
+	}
+
+	// Too short to wait for the run, so cron is left running
+	if err := fixture.cron.Pause(50 * time.Millisecond); err == nil {
+		t.Error("Expected Pause to fail while the run is in progress")
+	}
+	if fixture.cron.GetStatus().Paused {
+		t.Error("Cron should not stay paused when Pause fails")
+	}
+
+	if err := fixture.cron.Pause(5 * time.Second); err != nil {
+		t.Fatalf("Expected Pause to wait for the run, got %v", err)
+	}
+	status := fixture.cron.GetStatus()
+	if status.Running || status.LastRun == nil || !status.LastRun.Success {
+		t.Errorf("Expected the run to have finished before the pause, got %+v", status)
+	}
+}
@@ -0,0 +1,158 @@
+package unit
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+func TestDatabaseDSN(t *testing.T) {
+	tests := []struct {
+		name     string
+		site     models.MoodleSiteConfig
+		driver   string
+		contains []string
+	}{
+		{
+			name:     "mysql over tcp",
+			site:     models.MoodleSiteConfig{DBType: "mysqli", DBHost: "db.internal", DBName: "moodle", DBUser: "moodle", DBPass: "secret"},
+			driver:   "mysql",
+			contains: []string{"moodle:secret@tcp(db.internal:3306)/moodle"},
+		},
+		{
+			name:     "mariadb over a socket",
+			site:     models.MoodleSiteConfig{DBType: "mariadb", DBHost: "localhost", DBName: "moodle", DBUser: "moodle", DBSocket: "/run/mysqld/mysqld.sock"},
+			driver:   "mysql",
+			contains: []string{"@unix(/run/mysqld/mysqld.sock)/moodle"},
+		},
+		{
+			name:     "mysql on localhost",
+			site:     models.MoodleSiteConfig{DBType: "mysqli", DBHost: "localhost", DBPort: 3307, DBName: "moodle", DBUser: "moodle"},
+			driver:   "mysql",
+			contains: []string{"@unix(/", "sock)/moodle"},
+		},
+		{
+			name:     "mysql with the default socket",
+			site:     models.MoodleSiteConfig{DBType: "mysqli", DBName: "moodle", DBUser: "moodle", DBSocket: "1"},
+			driver:   "mysql",
+			contains: []string{"@unix(/", "sock)/moodle"},
+		},
+		{
+			name:     "local postgres",
+			site:     models.MoodleSiteConfig{DBType: "pgsql", DBHost: "localhost", DBPort: 5433, DBName: "moodle", DBUser: "moodle", DBPass: "it's"},
+			driver:   "postgres",
+			contains: []string{"host='localhost'", "port=5433", `password='it\'s'`, "sslmode=disable"},
+		},
+		{
+			name:     "remote postgres",
+			site:     models.MoodleSiteConfig{DBType: "pgsql", DBHost: "db.internal", DBName: "moodle", DBUser: "moodle"},
+			driver:   "postgres",
+			contains: []string{"host='db.internal'", "port=5432", "sslmode=require"},
+		},
+		{
+			name:     "postgres socket",
+			site:     models.MoodleSiteConfig{DBType: "pgsql", DBName: "moodle", DBUser: "moodle"},
+			driver:   "postgres",
+			contains: []string{"host='/var/run/postgresql'", "sslmode=disable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			driver, dsn, err := services.DatabaseDSN(&tt.site)
+			if err != nil {
+				t.Fatalf("DatabaseDSN failed: %v", err)
+			}
+			if driver != tt.driver {
+				t.Errorf("Expected driver %s, got %s", tt.driver, driver)
+			}
+			for _, part := range tt.contains {
+				if !strings.Contains(dsn, part) {
+					t.Errorf("Expected %q in DSN %q", part, dsn)
+				}
+			}
+		})
+	}
+
+	if _, _, err := services.DatabaseDSN(&models.MoodleSiteConfig{DBType: "sqlsrv"}); err == nil {
+		t.Error("Expected an error for an unsupported database type")
+	}
+}
+
+func TestNewDatabaseStats(t *testing.T) {
+	now := time.Now()
+	first := &services.DatabaseSample{
+		Type:           "mysqli",
+		Connections:    40,
+		MaxConnections: 200,
+		Queries:        10000,
+		SlowQueries:    50,
+		Uptime:         1000,
+		Timestamp:      now,
+	}
+
+	stats := services.NewDatabaseStats(nil, first)
+	if stats.QueriesPerSec != 10 || stats.SlowQueriesPerMin != 3 {
+		t.Errorf("Expected rates averaged over the uptime, got %f qps and %f slow/min", stats.QueriesPerSec, stats.SlowQueriesPerMin)
+	}
+	if stats.ConnectionUsage != 20 {
+		t.Errorf("Expected 20%% connection usage, got %f", stats.ConnectionUsage)
+	}
+
+	second := *first
+	second.Queries = 13000
+	second.SlowQueries = 60
+	second.Uptime = 1030
+	second.Timestamp = now.Add(30 * time.Second)
+
+	stats = services.NewDatabaseStats(first, &second)
+	if stats.QueriesPerSec != 100 || stats.SlowQueriesPerMin != 20 {
+		t.Errorf("Expected rates between samples, got %f qps and %f slow/min", stats.QueriesPerSec, stats.SlowQueriesPerMin)
+	}
+
+	// A restarted server resets its counters
+	restarted := second
+	restarted.Queries = 600
+	restarted.SlowQueries = 0
+	restarted.Uptime = 60
+	restarted.Timestamp = now.Add(60 * time.Second)
+
+	stats = services.NewDatabaseStats(&second, &restarted)
+	if math.Abs(stats.QueriesPerSec-10) > 0.001 || stats.SlowQueriesPerMin != 0 {
+		t.Errorf("Expected rates since the restart, got %f qps and %f slow/min", stats.QueriesPerSec, stats.SlowQueriesPerMin)
+	}
+}
+
+func TestMonitorService_CheckDatabaseStats(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	unresolved := func(alertType string) int {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM alerts WHERE type = ? AND resolved = 0", alertType).Scan(&count); err != nil {
+			t.Fatalf("Failed to count alerts: %v", err)
+		}
+		return count
+	}
+
+	monitorService.CheckDatabaseStats(&models.DatabaseStats{Connections: 190, MaxConnections: 200, ConnectionUsage: 95, SlowQueriesPerMin: 30})
+	monitorService.CheckDatabaseStats(&models.DatabaseStats{Connections: 190, MaxConnections: 200, ConnectionUsage: 95, SlowQueriesPerMin: 30})
+
+	if unresolved(services.AlertDBConnectionsHigh) != 1 || unresolved(services.AlertDBSlowQueries) != 1 {
+		t.Error("Expected one connection and one slow query alert")
+	}
+
+	monitorService.CheckDatabaseStats(&models.DatabaseStats{Connections: 20, MaxConnections: 200, ConnectionUsage: 10})
+
+	if unresolved(services.AlertDBConnectionsHigh) != 0 || unresolved(services.AlertDBSlowQueries) != 0 {
+		t.Error("Database alerts should be resolved once the values drop")
+	}
+}
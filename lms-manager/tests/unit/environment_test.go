@@ -0,0 +1,137 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// fakeInspectPHP prints the runtime information stored next to it
+const fakeInspectPHP = `#!/bin/sh
+cat "$(dirname "$0")/runtime.json"
+`
+
+// testPHPRuntime is a PHP 8.1 runtime without redis and sodium and with the
+// default max_input_vars
+const testPHPRuntime = `{"version":"8.1.2","sapi":"cli","ini_file":"/etc/php/8.1/cli/php.ini",
+"extensions":["Core","ctype","curl","dom","fileinfo","gd","iconv","intl","json","mbstring","openssl","pcre",
+"SimpleXML","SPL","tokenizer","xml","xmlreader","xmlwriter","zip","zlib","mysqli","bcmath","exif","ftp",
+"gettext","imagick","ldap","soap","Zend OPcache"],
+"ini":{"memory_limit":"-1","max_input_vars":"1000","upload_max_filesize":"2M","post_max_size":"8M",
+"max_execution_time":"0","opcache.enable":"1","opcache.enable_cli":"0","opcache.memory_consumption":"128",
+"opcache.max_accelerated_files":"10000"}}`
+
+// setupTestEnvironment creates a Moodle 4.1.3 site checked with a fake PHP
+// binary reporting testPHPRuntime
+func setupTestEnvironment(t *testing.T) *services.MoodleService {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+
+	writeTestFile(t, bin, "php", fakeInspectPHP)
+	writeTestFile(t, bin, "runtime.json", testPHPRuntime)
+	if err := os.Chmod(filepath.Join(bin, "php"), 0755); err != nil {
+		t.Fatalf("Failed to make php executable: %v", err)
+	}
+
+	site := filepath.Join(dir, "moodle")
+	writeTestFile(t, site, "version.php", testVersionPHP)
+	writeTestFile(t, site, "config.php", testUpgradeConfigPHP)
+
+	return services.NewMoodleService(config.MoodleConfig{
+		Path:       site,
+		ConfigPath: filepath.Join(site, "config.php"),
+		PHPBinary:  filepath.Join(bin, "php"),
+	})
+}
+
+func findEnvironmentCheck(result *models.EnvironmentResult, name string) models.EnvironmentCheck {
+	for _, check := range result.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	return models.EnvironmentCheck{}
+}
+
+func TestMoodleService_CheckEnvironment(t *testing.T) {
+	moodleService := setupTestEnvironment(t)
+
+	report, err := moodleService.CheckEnvironment("")
+	if err != nil {
+		t.Fatalf("CheckEnvironment failed: %v", err)
+	}
+
+	if report.PHPVersion != "8.1.2" || report.Settings["max_input_vars"] != "1000" || report.Target != nil {
+		t.Errorf("Unexpected PHP runtime %+v", report)
+	}
+	if len(report.Warnings) != 0 {
+		t.Errorf("Unexpected warnings %v", report.Warnings)
+	}
+
+	installed := report.Installed
+	if installed == nil || installed.Branch != "401" || installed.Status != models.EnvironmentFail {
+		t.Fatalf("Expected Moodle 4.1 to fail on max_input_vars, got %+v", installed)
+	}
+
+	expected := map[string]string{
+		"PHP version":                models.EnvironmentPass,
+		"mysqli":                     models.EnvironmentPass,
+		"opcache":                    models.EnvironmentPass,
+		"redis":                      models.EnvironmentWarn,
+		"max_input_vars":             models.EnvironmentFail,
+		"memory_limit":               models.EnvironmentPass,
+		"upload_max_filesize":        models.EnvironmentWarn,
+		"opcache.memory_consumption": models.EnvironmentWarn,
+	}
+	for name, status := range expected {
+		if check := findEnvironmentCheck(installed, name); check.Status != status {
+			t.Errorf("Expected %s to %s, got %+v", name, status, check)
+		}
+	}
+}
+
+func TestMoodleService_CheckEnvironmentTarget(t *testing.T) {
+	moodleService := setupTestEnvironment(t)
+
+	report, err := moodleService.CheckEnvironment("5.0")
+	if err != nil {
+		t.Fatalf("CheckEnvironment failed: %v", err)
+	}
+
+	target := report.Target
+	if target == nil || target.Branch != "500" || target.Status != models.EnvironmentFail {
+		t.Fatalf("Expected Moodle 5.0 to fail, got %+v", target)
+	}
+	if check := findEnvironmentCheck(target, "PHP version"); check.Status != models.EnvironmentFail {
+		t.Errorf("Expected PHP 8.1 to be too old for Moodle 5.0, got %+v", check)
+	}
+	if check := findEnvironmentCheck(target, "sodium"); check.Status != models.EnvironmentFail {
+		t.Errorf("Expected sodium to be required by Moodle 5.0, got %+v", check)
+	}
+
+	if _, err := moodleService.CheckEnvironment("2.7"); err == nil {
+		t.Error("Expected an error for a version that is not in the matrix")
+	}
+}
+
+func TestMoodleBranch(t *testing.T) {
+	tests := map[string]string{
+		"405":                     "405",
+		"4.5":                     "405",
+		"3.11":                    "311",
+		"4.1.3 (Build: 20230424)": "401",
+		"5.0.1":                   "500",
+		"4.9":                     "",
+		"":                        "",
+	}
+
+	for version, branch := range tests {
+		if got := services.MoodleBranch(version); got != branch {
+			t.Errorf("MoodleBranch(%q) = %q, expected %q", version, got, branch)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package unit
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// testPHPErrorLog has a fatal error with its stack trace, a warning and a
+// Moodle exception, as written to the PHP error_log
+const testPHPErrorLog = `[16-Oct-2026 09:15:02 Asia/Jakarta] PHP Fatal error:  Uncaught Error: Call to undefined function local_report_sum() in /var/www/moodle/local/report/lib.php:42
+Stack trace:
+#0 /var/www/moodle/local/report/index.php(12): local_report_build()
+#1 {main}
+  thrown in /var/www/moodle/local/report/lib.php on line 42
+[16-Oct-2026 09:15:03 Asia/Jakarta] PHP Warning:  Undefined array key "grade" in /var/www/moodle/mod/quiz/locallib.php on line 1204
+[16-Oct-2026 09:15:04 Asia/Jakarta] Default exception handler: Invalid course module ID Debug:
+Error code: invalidcoursemodule
+* line 33 of /mod/assign/view.php: moodle_exception thrown
+* line 12 of /lib/setuplib.php: call to require_login()
+`
+
+// testFPMErrorLog has PHP messages passed through PHP-FPM and messages of
+// PHP-FPM itself
+const testFPMErrorLog = `[16-Oct-2026 09:20:00.123456] NOTICE: fpm is running, pid 812
+[16-Oct-2026 09:20:01] WARNING: [pool www] child 1201 said into stderr: "NOTICE: PHP message: PHP Fatal error:  Allowed memory size of 134217728 bytes exhausted (tried to allocate 20480 bytes) in /var/www/moodle/lib/dml/moodle_database.php on line 1120"
+[16-Oct-2026 09:20:02] WARNING: [pool www] server reached pm.max_children setting (5), consider raising it
+[16-Oct-2026 09:20:03] WARNING: [pool www] child 1207 exited on signal 11 (SIGSEGV - core dumped) after 12.5 seconds from start
+`
+
+func TestParseErrorLog(t *testing.T) {
+	entries := services.ParseErrorLog(testPHPErrorLog)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 errors, got %+v", entries)
+	}
+
+	fatal := entries[0]
+	if fatal.Level != models.ErrorLevelFatal || fatal.Message != "Uncaught Error: Call to undefined function local_report_sum()" ||
+		fatal.File != "/var/www/moodle/local/report/lib.php" || fatal.Line != 42 {
+		t.Errorf("Unexpected fatal error %+v", fatal)
+	}
+	if fatal.Time.UTC() != time.Date(2026, 10, 16, 2, 15, 2, 0, time.UTC) {
+		t.Errorf("Unexpected time %v", fatal.Time)
+	}
+
+	if warning := entries[1]; warning.Level != models.ErrorLevelWarning || warning.Message != `Undefined array key "grade"` || warning.Line != 1204 {
+		t.Errorf("Unexpected warning %+v", warning)
+	}
+
+	// The first backtrace line locates a Moodle exception
+	if exception := entries[2]; exception.Level != models.ErrorLevelException || exception.File != "/mod/assign/view.php" || exception.Line != 33 {
+		t.Errorf("Unexpected exception %+v", exception)
+	}
+
+	entries = services.ParseErrorLog(testFPMErrorLog)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 errors without the notice, got %+v", entries)
+	}
+	if memory := entries[0]; memory.Level != models.ErrorLevelFatal || memory.File != "/var/www/moodle/lib/dml/moodle_database.php" || memory.Line != 1120 {
+		t.Errorf("Unexpected worker error %+v", memory)
+	}
+	if entries[1].Level != models.ErrorLevelWarning || entries[2].Level != models.ErrorLevelFatal {
+		t.Errorf("Expected a max_children warning and a fatal segfault, got %+v", entries[1:])
+	}
+}
+
+func TestErrorLogEntry_Fingerprint(t *testing.T) {
+	first := services.ParseErrorLog(`[16-Oct-2026 09:20:01] PHP Fatal error:  Allowed memory size of 134217728 bytes exhausted (tried to allocate 20480 bytes) in /var/www/moodle/lib/filelib.php on line 88`)
+	second := services.ParseErrorLog(`[16-Oct-2026 10:41:19] PHP Fatal error:  Allowed memory size of 268435456 bytes exhausted (tried to allocate 65536 bytes) in /var/www/moodle/lib/filelib.php on line 88`)
+	other := services.ParseErrorLog(`[16-Oct-2026 10:41:19] PHP Fatal error:  Allowed memory size of 268435456 bytes exhausted (tried to allocate 65536 bytes) in /var/www/moodle/lib/filelib.php on line 90`)
+
+	if first[0].Fingerprint() != second[0].Fingerprint() {
+		t.Error("Expected errors differing only in numbers to share a group")
+	}
+	if first[0].Fingerprint() == other[0].Fingerprint() {
+		t.Error("Expected errors on different lines to be grouped apart")
+	}
+}
+
+func TestErrorLogService_Poll(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	dir := t.TempDir()
+	phpLog := filepath.Join(dir, "php_errors.log")
+	fpmLog := filepath.Join(dir, "php-fpm.log")
+	appendTestLog(t, phpLog, testPHPErrorLog)
+
+	errorLogConfig := config.DefaultErrorLogConfig()
+	errorLogConfig.Paths = []string{phpLog, fpmLog}
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: "/var/www/moodle"})
+	errorLogService := services.NewErrorLogService(errorLogConfig, moodleService, monitorService)
+	errorLogService.SetDatabase(db)
+
+	// Errors from before the collector started are not recorded, and a
+	// missing log does not stop the others
+	if err := errorLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if groups, _ := errorLogService.GetGroups(false, "", 100); len(groups) != 0 {
+		t.Fatalf("Expected the existing log to be skipped, got %+v", groups)
+	}
+
+	now := time.Now().Format("02-Jan-2006 15:04:05")
+	for _, size := range []string{"20480", "65536"} {
+		appendTestLog(t, phpLog, "["+now+"] PHP Fatal error:  Allowed memory size of 134217728 bytes exhausted (tried to allocate "+size+" bytes) in /var/www/moodle/mod/quiz/report/overview/report.php on line 210\n")
+	}
+	appendTestLog(t, phpLog, "["+now+"] PHP Deprecated:  Creation of dynamic property is deprecated in /var/www/moodle/theme/boost/classes/output/core_renderer.php on line 8\n")
+
+	if err := errorLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+
+	groups, err := errorLogService.GetGroups(true, "", 100)
+	if err != nil {
+		t.Fatalf("GetGroups failed: %v", err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("Expected a fatal and a deprecation group, got %+v", groups)
+	}
+
+	fatal, err := errorLogService.GetGroups(true, models.ErrorLevelFatal, 100)
+	if err != nil || len(fatal) != 1 {
+		t.Fatalf("Expected one fatal group, got %+v (%v)", fatal, err)
+	}
+	group := fatal[0]
+	if group.Count != 2 || group.Component != "mod_quiz" || group.Line != 210 || !group.New || group.Source != phpLog {
+		t.Errorf("Unexpected fatal group %+v", group)
+	}
+	if countAlerts(t, db, services.AlertPHPFatalError+":"+group.ID) != 1 {
+		t.Error("Expected an alert for the new fatal error")
+	}
+
+	// Recurrences count into the group
+	appendTestLog(t, fpmLog, "")
+	errorLogService.Poll()
+	appendTestLog(t, fpmLog, "["+now+"] WARNING: [pool www] child 1201 said into stderr: \"NOTICE: PHP message: PHP Fatal error:  Allowed memory size of 134217728 bytes exhausted (tried to allocate 8192 bytes) in /var/www/moodle/mod/quiz/report/overview/report.php on line 210\"\n")
+	if err := errorLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if fatal, _ := errorLogService.GetGroups(false, models.ErrorLevelFatal, 100); len(fatal) != 1 || fatal[0].Count != 3 {
+		t.Errorf("Expected the worker error in the same group, got %+v", fatal)
+	}
+
+	// A fatal error elsewhere gets its own alert while the first is open
+	appendTestLog(t, phpLog, "["+now+"] PHP Fatal error:  Uncaught Error: Call to undefined function block_news_items() in /var/www/moodle/blocks/news_items/block_news_items.php on line 42\n")
+	if err := errorLogService.Poll(); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	fatal, err = errorLogService.GetGroups(true, models.ErrorLevelFatal, 100)
+	if err != nil || len(fatal) != 2 {
+		t.Fatalf("Expected two fatal groups, got %+v (%v)", fatal, err)
+	}
+	for _, other := range fatal {
+		if countAlerts(t, db, services.AlertPHPFatalError+":"+other.ID) != 1 {
+			t.Errorf("Expected an alert for fatal group %s", other.Message)
+		}
+	}
+
+	if err := errorLogService.Acknowledge(group.ID); err != nil {
+		t.Fatalf("Acknowledge failed: %v", err)
+	}
+	for _, other := range fatal {
+		expected := 1
+		if other.ID == group.ID {
+			expected = 0
+		}
+		if countAlerts(t, db, services.AlertPHPFatalError+":"+other.ID) != expected {
+			t.Errorf("Expected only the alert of the acknowledged group to be resolved, group %s", other.Message)
+		}
+	}
+	if err := errorLogService.Acknowledge("missing"); err == nil {
+		t.Error("Expected an error for an unknown group")
+	}
+}
@@ -0,0 +1,183 @@
+package unit
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lms-manager/services"
+)
+
+const (
+	referencedHash = "1111111111111111111111111111111111111111"
+	orphanedHash   = "2222222222222222222222222222222222222222"
+	recentHash     = "3333333333333333333333333333333333333333"
+	missingHash    = "4444444444444444444444444444444444444444"
+	referenceHash  = "5555555555555555555555555555555555555555"
+	directoryHash  = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+)
+
+// blobPath returns the pool path of a content hash
+func blobPath(hash string) string {
+	return hash[:2] + "/" + hash[2:4] + "/" + hash
+}
+
+// setupTestFiledir creates a files table and a moodledata pool with a
+// referenced, an orphaned, a recent and a missing blob
+func setupTestFiledir(t *testing.T) (*sql.DB, string) {
+	dir := t.TempDir()
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "moodle.db"))
+	if err != nil {
+		t.Fatalf("Failed to open test database: %v", err)
+	}
+	db.SetMaxOpenConns(2)
+	t.Cleanup(func() { db.Close() })
+
+	queries := []string{
+		`CREATE TABLE mdl_files (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			contenthash TEXT NOT NULL,
+			filesize INTEGER NOT NULL,
+			referencefileid INTEGER
+		)`,
+		`INSERT INTO mdl_files (contenthash, filesize, referencefileid) VALUES
+			('` + referencedHash + `', 10, NULL),
+			('` + referencedHash + `', 10, NULL),
+			('` + missingHash + `', 7, NULL),
+			('` + referenceHash + `', 0, 1),
+			('` + directoryHash + `', 0, NULL)`,
+	}
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("Failed to set up files table: %v", err)
+		}
+	}
+
+	dataPath := filepath.Join(dir, "moodledata")
+	writeTestFile(t, dataPath, "filedir/"+blobPath(referencedHash), "referenced")
+	writeTestFile(t, dataPath, "filedir/"+blobPath(orphanedHash), "orphaned")
+	writeTestFile(t, dataPath, "filedir/"+blobPath(recentHash), "recent")
+	writeTestFile(t, dataPath, "filedir/warning.txt", "Do not touch")
+	writeTestFile(t, dataPath, "filedir/stray.txt", "stray")
+	writeTestFile(t, dataPath, "trashdir/"+blobPath(missingHash), "missing")
+
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dataPath, "filedir", blobPath(orphanedHash)), old, old); err != nil {
+		t.Fatalf("Failed to age the orphaned blob: %v", err)
+	}
+
+	return db, dataPath
+}
+
+// queryTestHashes returns the content hashes of the files table
+func queryTestHashes(t *testing.T, db *sql.DB, order string) *sql.Rows {
+	rows, err := db.Query(`
+		SELECT contenthash, MAX(filesize), SUM(CASE WHEN referencefileid IS NULL THEN 1 ELSE 0 END)
+		FROM mdl_files
+		GROUP BY contenthash
+		ORDER BY contenthash ` + order)
+	if err != nil {
+		t.Fatalf("Failed to query the files table: %v", err)
+	}
+	t.Cleanup(func() { rows.Close() })
+	return rows
+}
+
+func TestFiledirScan_Run(t *testing.T) {
+	db, dataPath := setupTestFiledir(t)
+
+	var output strings.Builder
+	scan := &services.FiledirScan{
+		Filedir:  filepath.Join(dataPath, "filedir"),
+		Trashdir: filepath.Join(dataPath, "trashdir"),
+		Hashes:   queryTestHashes(t, db, "ASC"),
+		Output:   &output,
+	}
+
+	report, err := scan.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if report.Blobs != 3 || report.Referenced != 1 || report.Recent != 1 {
+		t.Errorf("Expected 3 blobs with 1 referenced and 1 recent, got %+v", report)
+	}
+
+	if report.OrphanCount != 1 || report.OrphanSize != int64(len("orphaned")) || report.Orphans[0].ContentHash != orphanedHash {
+		t.Errorf("Expected the old unreferenced blob to be orphaned, got %+v", report.Orphans)
+	}
+
+	// References and directory records have no blob of their own
+	if report.MissingCount != 1 || report.Missing[0].ContentHash != missingHash || !report.Missing[0].InTrash {
+		t.Errorf("Expected the trashed blob to be missing, got %+v", report.Missing)
+	}
+
+	if len(report.Unexpected) != 1 || report.Unexpected[0] != "stray.txt" {
+		t.Errorf("Expected only stray.txt to be unexpected, got %v", report.Unexpected)
+	}
+
+	if !strings.Contains(output.String(), "orphan "+orphanedHash) {
+		t.Errorf("Expected the orphan in the output, got %q", output.String())
+	}
+
+	if report.Quarantined != 0 {
+		t.Error("Nothing should be quarantined without a quarantine directory")
+	}
+}
+
+func TestFiledirScan_Quarantine(t *testing.T) {
+	db, dataPath := setupTestFiledir(t)
+	quarantine := filepath.Join(dataPath, "quarantine", "batch")
+
+	scan := &services.FiledirScan{
+		Filedir:    filepath.Join(dataPath, "filedir"),
+		Trashdir:   filepath.Join(dataPath, "trashdir"),
+		Hashes:     queryTestHashes(t, db, "ASC"),
+		Quarantine: quarantine,
+		Referenced: func(hash string) (bool, error) {
+			var count int
+			err := db.QueryRow("SELECT COUNT(1) FROM mdl_files WHERE contenthash = ?", hash).Scan(&count)
+			return count > 0, err
+		},
+	}
+
+	report, err := scan.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if report.Quarantined != 1 || len(report.Errors) != 0 {
+		t.Fatalf("Expected one quarantined blob, got %+v", report)
+	}
+
+	if _, err := os.Stat(filepath.Join(dataPath, "filedir", blobPath(orphanedHash))); !os.IsNotExist(err) {
+		t.Error("Expected the orphan to be moved out of filedir")
+	}
+	if _, err := os.Stat(filepath.Join(quarantine, blobPath(orphanedHash))); err != nil {
+		t.Errorf("Expected the orphan in the quarantine: %v", err)
+	}
+	for _, hash := range []string{referencedHash, recentHash} {
+		if _, err := os.Stat(filepath.Join(dataPath, "filedir", blobPath(hash))); err != nil {
+			t.Errorf("Expected %s to be kept: %v", hash, err)
+		}
+	}
+}
+
+func TestFiledirScan_Unsorted(t *testing.T) {
+	db, dataPath := setupTestFiledir(t)
+
+	scan := &services.FiledirScan{
+		Filedir:  filepath.Join(dataPath, "filedir"),
+		Trashdir: filepath.Join(dataPath, "trashdir"),
+		Hashes:   queryTestHashes(t, db, "DESC"),
+	}
+
+	if _, err := scan.Run(context.Background()); err == nil {
+		t.Error("Expected unsorted content hashes to be rejected")
+	}
+}
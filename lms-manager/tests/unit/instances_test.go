@@ -0,0 +1,198 @@
+package unit
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/handlers"
+	"lms-manager/models"
+	"lms-manager/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testInstances returns a config with a production and a training site
+func testInstances() *config.Config {
+	cfg := config.DefaultConfig()
+	cfg.Security.JWTSecret = "test-secret"
+
+	production := cfg.Moodle
+	production.Name = "production"
+
+	training := cfg.Moodle
+	training.Name = "training"
+	training.Path = "/var/www/training"
+	training.ConfigPath = "/var/www/training/config.php"
+	training.DataPath = "/var/www/trainingdata"
+
+	cfg.Instances = []config.MoodleConfig{production, training}
+	return cfg
+}
+
+func TestConfig_MoodleInstances(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Security.JWTSecret = "test-secret"
+
+	// Single-instance configs manage their site as the default instance
+	instances := cfg.MoodleInstances()
+	if len(instances) != 1 || instances[0].Name != config.DefaultInstanceName || instances[0].Path != cfg.Moodle.Path {
+		t.Fatalf("Expected the moodle section as the default instance, got %+v", instances)
+	}
+
+	cfg = testInstances()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Two instances should be valid: %v", err)
+	}
+	if instances := cfg.MoodleInstances(); len(instances) != 2 || instances[1].Name != "training" {
+		t.Errorf("Expected the configured instances, got %+v", instances)
+	}
+
+	cfg.Instances[1].Name = "production"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Duplicate instance names should be rejected")
+	}
+
+	cfg.Instances[1].Name = "Training Site"
+	if err := cfg.Validate(); err == nil {
+		t.Error("Instance names that do not fit in a URL should be rejected")
+	}
+
+	cfg = testInstances()
+	cfg.Instances[1].Path = cfg.Instances[0].Path
+	if err := cfg.Validate(); err == nil {
+		t.Error("Instances sharing a Moodle path should be rejected")
+	}
+
+	cfg = testInstances()
+	cfg.Instances[1].Components = nil
+	if err := cfg.Validate(); err == nil {
+		t.Error("Every instance should be validated")
+	}
+}
+
+func TestMonitorService_ForInstance(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	production := monitorService.ForInstance("production")
+	training := monitorService.ForInstance("training")
+
+	production.RaiseAlert(services.AlertMoodleDown, "critical", "Moodle is down")
+	training.RaiseAlert(services.AlertMoodleDown, "critical", "Moodle is down")
+
+	alerts, err := monitorService.GetAlerts()
+	if err != nil {
+		t.Fatalf("GetAlerts failed: %v", err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("Expected an alert per instance, got %+v", alerts)
+	}
+
+	if err := training.ResolveAlerts(services.AlertMoodleDown); err != nil {
+		t.Fatalf("ResolveAlerts failed: %v", err)
+	}
+	alerts, _ = monitorService.GetAlerts()
+	if len(alerts) != 1 || alerts[0].Type != "production:"+services.AlertMoodleDown || alerts[0].Message != "[production] Moodle is down" {
+		t.Errorf("Expected only the production alert to remain, got %+v", alerts)
+	}
+}
+
+func TestNewInstances(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	// A single instance reports to the monitor as before
+	single := services.NewInstances(config.DefaultConfig().MoodleInstances(), monitorService)
+	if len(single) != 1 || single[0].Name != config.DefaultInstanceName || single[0].Monitor != monitorService {
+		t.Fatalf("Expected the default instance on the shared monitor, got %+v", single)
+	}
+
+	cfg := testInstances()
+	dir := t.TempDir()
+	for i := range cfg.Instances {
+		cfg.Instances[i].ErrorLog.Paths = []string{filepath.Join(dir, cfg.Instances[i].Name+".log")}
+		appendTestLog(t, cfg.Instances[i].ErrorLog.Paths[0], "")
+	}
+
+	instances := services.NewInstances(cfg.MoodleInstances(), monitorService)
+	for _, instance := range instances {
+		instance.SetDatabase(db)
+		instance.ErrorLog.Poll()
+	}
+
+	// The same error in both sites is kept apart
+	now := time.Now().Format("02-Jan-2006 15:04:05")
+	for _, instance := range instances {
+		appendTestLog(t, filepath.Join(dir, instance.Name+".log"), "["+now+"] PHP Fatal error:  Maximum execution time of 30 seconds exceeded in /var/www/moodle/lib/dml/moodle_database.php on line 10\n")
+		if err := instance.ErrorLog.Poll(); err != nil {
+			t.Fatalf("Poll failed: %v", err)
+		}
+	}
+
+	for _, instance := range instances {
+		groups, err := instance.ErrorLog.GetGroups(false, "", 100)
+		if err != nil {
+			t.Fatalf("GetGroups failed: %v", err)
+		}
+		if len(groups) != 1 || groups[0].Count != 1 {
+			t.Fatalf("Expected one group of %s, got %+v", instance.Name, groups)
+		}
+		if countAlerts(t, db, instance.Name+":"+services.AlertPHPFatalError+":"+groups[0].ID) != 1 {
+			t.Errorf("Expected a fatal error alert for %s", instance.Name)
+		}
+	}
+}
+
+func TestNewInstances_StatsPerInstance(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	instances := services.NewInstances(testInstances().MoodleInstances(), monitorService)
+	production, training := instances[0], instances[1]
+
+	// The instance monitors are never started, their collectors report to them
+	production.Monitor.CheckPHPFPMStats([]models.PHPFPMPoolStats{{Name: "production", MaxChildren: 10}})
+	training.Monitor.CheckPHPFPMStats([]models.PHPFPMPoolStats{{Name: "training", MaxChildren: 5}})
+	training.Monitor.RecordWebMetrics(&models.PerformanceMetrics{RequestCount: 100, Timestamp: time.Now()})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	for _, instance := range instances {
+		apiHandler := handlers.NewAPIHandler(monitorService, instance.Moodle, nil)
+		apiHandler.SetInstance(instance)
+		router.GET("/instances/"+instance.Name+"/stats", apiHandler.GetStats)
+	}
+
+	stats := func(name string) models.SystemStats {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/instances/"+name+"/stats", nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected the stats of %s, got %d", name, recorder.Code)
+		}
+
+		var stats models.SystemStats
+		if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("Failed to decode the stats of %s: %v", name, err)
+		}
+		return stats
+	}
+
+	if productionStats := stats("production"); len(productionStats.PHPFPM) != 1 || productionStats.PHPFPM[0].Name != "production" || productionStats.Web != nil {
+		t.Errorf("Expected only the production pool, got %+v", productionStats)
+	}
+	if trainingStats := stats("training"); len(trainingStats.PHPFPM) != 1 || trainingStats.PHPFPM[0].Name != "training" ||
+		trainingStats.Web == nil || trainingStats.Web.RequestCount != 100 {
+		t.Errorf("Expected the training pool and web metrics, got %+v", trainingStats)
+	}
+}
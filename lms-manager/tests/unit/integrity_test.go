@@ -0,0 +1,183 @@
+package unit
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/services"
+)
+
+// writeTestBlob stores content in filedir under its SHA-1 and returns the hash
+func writeTestBlob(t *testing.T, dataPath, content string) string {
+	sum := sha1.Sum([]byte(content))
+	hash := hex.EncodeToString(sum[:])
+	writeTestFile(t, dataPath, "filedir/"+blobPath(hash), content)
+	return hash
+}
+
+// setupTestIntegrity creates a filedir with three intact blobs and one whose
+// content was damaged, and returns the damaged hash
+func setupTestIntegrity(t *testing.T) (*sql.DB, *services.MoodleService, *services.MonitorService, string) {
+	db := setupTestDB(t)
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "moodledata")
+
+	writeTestBlob(t, dataPath, strings.Repeat("a", 2048))
+	writeTestBlob(t, dataPath, "course file")
+	writeTestBlob(t, dataPath, "another course file")
+
+	damaged := writeTestBlob(t, dataPath, "original content")
+	writeTestFile(t, dataPath, "filedir/"+blobPath(damaged), "damaged content")
+	writeTestFile(t, dataPath, "filedir/warning.txt", "Do not touch")
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{
+		Path:           filepath.Join(dir, "moodle"),
+		ConfigPath:     filepath.Join(dir, "moodle", "config.php"),
+		DataPath:       dataPath,
+		ServiceManager: config.ServiceManagerFake,
+		Components:     config.DefaultComponents(),
+	})
+
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	return db, moodleService, monitorService, damaged
+}
+
+func newTestIntegrityService(db *sql.DB, moodleService *services.MoodleService, monitorService *services.MonitorService, rateLimit int) *services.IntegrityService {
+	integrityConfig := config.DefaultIntegrityConfig()
+	integrityConfig.RateLimit = rateLimit
+
+	integrityService := services.NewIntegrityService(integrityConfig, moodleService, monitorService)
+	integrityService.SetDatabase(db)
+	return integrityService
+}
+
+func TestIntegrityService_Verify(t *testing.T) {
+	db, moodleService, monitorService, damaged := setupTestIntegrity(t)
+	defer db.Close()
+
+	integrityService := newTestIntegrityService(db, moodleService, monitorService, 0)
+
+	run, err := integrityService.Verify(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	if run.Status != services.IntegrityCompleted || run.FilesChecked != 4 || run.CorruptCount != 1 {
+		t.Errorf("Expected a completed pass over 4 files with 1 corrupt, got %+v", run)
+	}
+
+	report, err := integrityService.GetReport()
+	if err != nil {
+		t.Fatalf("GetReport failed: %v", err)
+	}
+
+	if report.Running || report.LastCompleted == nil || report.LastCompleted.ID != run.ID {
+		t.Errorf("Expected the pass to be reported as completed, got %+v", report)
+	}
+
+	sum := sha1.Sum([]byte("damaged content"))
+	if len(report.Corrupt) != 1 || report.Corrupt[0].ContentHash != damaged || report.Corrupt[0].ActualHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("Expected the damaged blob in the report, got %+v", report.Corrupt)
+	}
+
+	var alerts int
+	db.QueryRow("SELECT COUNT(*) FROM alerts WHERE type = ? AND resolved = 0", services.AlertFiledirCorrupt).Scan(&alerts)
+	if alerts != 1 {
+		t.Errorf("Expected a corrupt filedir alert, got %d", alerts)
+	}
+}
+
+func TestIntegrityService_Resume(t *testing.T) {
+	db, moodleService, monitorService, _ := setupTestIntegrity(t)
+	defer db.Close()
+
+	// At 1 KB/s the verifier reads the first blob, then waits before the next
+	slow := newTestIntegrityService(db, moodleService, monitorService, 1)
+	if err := slow.Trigger(false); err != nil {
+		t.Fatalf("Trigger failed: %v", err)
+	}
+	if err := slow.Trigger(false); err == nil {
+		t.Error("Expected a second pass to be refused")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if err := slow.Cancel(); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+
+	first, _ := slow.GetReport()
+	deadline := time.Now().Add(5 * time.Second)
+	for first.Running && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		first, _ = slow.GetReport()
+	}
+
+	if first.Running || first.Run.Status != services.IntegrityInterrupted || first.Run.Checkpoint == "" {
+		t.Fatalf("Expected an interrupted pass with a checkpoint, got %+v", first.Run)
+	}
+
+	// A new service resumes the pass from the checkpoint
+	fast := newTestIntegrityService(db, moodleService, monitorService, 0)
+	run, err := fast.Verify(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	if run.ID != first.Run.ID || run.Status != services.IntegrityCompleted || run.FilesChecked != 4 {
+		t.Errorf("Expected the pass to resume and check each file once, got %+v after %+v", run, first.Run)
+	}
+
+	// Restarting starts over
+	restarted, err := fast.Verify(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if restarted.ID == run.ID || restarted.FilesChecked != 4 {
+		t.Errorf("Expected a new pass over every file, got %+v", restarted)
+	}
+}
+
+func TestIntegrityService_ResumeAfterCrash(t *testing.T) {
+	db, moodleService, monitorService, damaged := setupTestIntegrity(t)
+	defer db.Close()
+
+	integrityService := newTestIntegrityService(db, moodleService, monitorService, 0)
+	run, err := integrityService.Verify(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+
+	// A crash before the checkpoint was saved leaves the corrupt blob
+	// recorded but the pass still at its start
+	if _, err := db.Exec(`
+		UPDATE integrity_runs SET status = ?, checkpoint = '', files_checked = 0, bytes_checked = 0, corrupt_count = 0, finished_at = NULL
+		WHERE id = ?
+	`, services.IntegrityRunning, run.ID); err != nil {
+		t.Fatalf("Failed to reset integrity run: %v", err)
+	}
+
+	resumed, err := newTestIntegrityService(db, moodleService, monitorService, 0).Verify(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if resumed.ID != run.ID || resumed.CorruptCount != 1 {
+		t.Errorf("Expected the pass to resume with 1 corrupt blob, got %+v", resumed)
+	}
+
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM integrity_corrupt WHERE run_id = ? AND contenthash = ?", run.ID, damaged).Scan(&rows); err != nil {
+		t.Fatalf("Failed to count corrupt files: %v", err)
+	}
+	if rows != 1 {
+		t.Errorf("Expected the corrupt blob to be recorded once, got %d rows", rows)
+	}
+}
@@ -0,0 +1,212 @@
+package unit
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// fakeCLIPHP is a stand-in PHP binary that prints its arguments and the
+// first line of its input and exits with the code read from a file next to it
+const fakeCLIPHP = `#!/bin/sh
+dir=$(dirname "$0")
+echo "args: $*"
+read -r input && echo "input: $input"
+exit "$(cat "$dir/exitcode")"
+`
+
+// setupTestJobs creates a job service running a fake PHP binary
+func setupTestJobs(t *testing.T) (*services.JobService, *sql.DB, string) {
+	dir := t.TempDir()
+	moodlePath := filepath.Join(dir, "moodle")
+	if err := os.MkdirAll(filepath.Join(moodlePath, "admin", "cli"), 0755); err != nil {
+		t.Fatalf("Failed to create moodle dir: %v", err)
+	}
+	for _, script := range []string{"purge_caches.php", "fix_course_sequence.php", "reset_password.php"} {
+		if err := os.WriteFile(filepath.Join(moodlePath, "admin", "cli", script), []byte("<?php\n"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", script, err)
+		}
+	}
+
+	php := filepath.Join(dir, "php")
+	if err := os.WriteFile(php, []byte(fakeCLIPHP), 0755); err != nil {
+		t.Fatalf("Failed to write fake php: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "exitcode"), []byte("0"), 0644); err != nil {
+		t.Fatalf("Failed to write exit code: %v", err)
+	}
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{
+		Path:           moodlePath,
+		ConfigPath:     filepath.Join(moodlePath, "config.php"),
+		PHPBinary:      php,
+		ServiceManager: config.ServiceManagerFake,
+		Components:     config.DefaultComponents(),
+	})
+
+	db := setupTestDB(t)
+	jobService := services.NewJobService(moodleService)
+	jobService.SetDatabase(db)
+
+	return jobService, db, dir
+}
+
+// waitForJob streams a job until it finishes and returns its output and result
+func waitForJob(t *testing.T, jobService *services.JobService, id string) (string, *models.Job) {
+	stream, err := jobService.Subscribe(id)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer stream.Close()
+
+	var output strings.Builder
+	for chunk := range stream.Output {
+		output.WriteString(chunk)
+	}
+
+	job, err := stream.Job()
+	if err != nil {
+		t.Fatalf("Failed to get job: %v", err)
+	}
+	return output.String(), job
+}
+
+func TestJobService_RunScript(t *testing.T) {
+	jobService, db, _ := setupTestJobs(t)
+	defer db.Close()
+
+	job, err := jobService.RunScript("purge_caches", map[string]string{"theme": "true"}, "user-1", "admin")
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	output, finished := waitForJob(t, jobService, job.ID)
+	if !strings.Contains(output, "--theme") {
+		t.Errorf("Expected streamed output to contain the arguments, got %q", output)
+	}
+
+	if finished.Status != models.JobSucceeded {
+		t.Errorf("Expected job to succeed, got %s: %s", finished.Status, finished.Error)
+	}
+
+	if finished.Username != "admin" || finished.UserID != "user-1" {
+		t.Errorf("Job should be attributed to its user, got %s (%s)", finished.Username, finished.UserID)
+	}
+
+	if !strings.Contains(finished.Output, "--theme") {
+		t.Errorf("Expected output to be stored, got %q", finished.Output)
+	}
+
+	jobs, err := jobService.ListJobs(10)
+	if err != nil {
+		t.Fatalf("ListJobs failed: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].Output != "" {
+		t.Errorf("Expected 1 job without output, got %+v", jobs)
+	}
+}
+
+func TestJobService_FailedScript(t *testing.T) {
+	jobService, db, dir := setupTestJobs(t)
+	defer db.Close()
+
+	if err := os.WriteFile(filepath.Join(dir, "exitcode"), []byte("2"), 0644); err != nil {
+		t.Fatalf("Failed to write exit code: %v", err)
+	}
+
+	job, err := jobService.RunScript("purge_caches", nil, "user-1", "admin")
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	_, finished := waitForJob(t, jobService, job.ID)
+	if finished.Status != models.JobFailed || finished.ExitCode != 2 {
+		t.Errorf("Expected job to fail with exit code 2, got %s (%d)", finished.Status, finished.ExitCode)
+	}
+}
+
+func TestJobService_ValidatesArguments(t *testing.T) {
+	jobService, db, _ := setupTestJobs(t)
+	defer db.Close()
+
+	tests := []struct {
+		name   string
+		script string
+		args   map[string]string
+	}{
+		{"script not allowed", "../../../bin/sh", nil},
+		{"unknown argument", "purge_caches", map[string]string{"all": "true"}},
+		{"flag with value", "purge_caches", map[string]string{"theme": "x"}},
+		{"missing required argument", "fix_course_sequence", map[string]string{"fix": "true"}},
+		{"invalid value", "fix_course_sequence", map[string]string{"courses": "1 --other"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := jobService.RunScript(tt.script, tt.args, "user-1", "admin"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestJobService_PasswordOnStdin(t *testing.T) {
+	jobService, db, _ := setupTestJobs(t)
+	defer db.Close()
+
+	job, err := jobService.RunScript("reset_password", map[string]string{
+		"username": "student1",
+		"password": "Secret#123",
+	}, "user-1", "admin")
+	if err != nil {
+		t.Fatalf("RunScript failed: %v", err)
+	}
+
+	output, finished := waitForJob(t, jobService, job.ID)
+	if !strings.Contains(output, "args: ") || !strings.Contains(output, "--username=student1") {
+		t.Errorf("Expected the username on the command line, got:\n%s", output)
+	}
+	if !strings.Contains(output, "input: Secret#123") || strings.Contains(output, "--password") {
+		t.Errorf("Expected the password on stdin only, got:\n%s", output)
+	}
+	if strings.Contains(finished.Command, "Secret#123") || finished.Args["password"] != "" {
+		t.Errorf("The password should not be recorded, got %q %v", finished.Command, finished.Args)
+	}
+}
+
+func TestJobService_StartMarksInterruptedJobs(t *testing.T) {
+	jobService, db, _ := setupTestJobs(t)
+	defer db.Close()
+
+	// Jobs left running by a previous process, one of another instance
+	for _, job := range []struct{ id, instance string }{{"stale", "default"}, {"other", "training"}} {
+		if _, err := db.Exec(`
+			INSERT INTO jobs (id, instance, name, command, args, status, exit_code, user_id, username, created_at)
+			VALUES (?, ?, 'purge_caches', 'admin/cli/purge_caches.php', '{}', ?, 0, 'user-1', 'admin', ?)
+		`, job.id, job.instance, models.JobRunning, time.Now()); err != nil {
+			t.Fatalf("Failed to insert job: %v", err)
+		}
+	}
+
+	jobService.Start()
+
+	job, err := jobService.GetJob("stale")
+	if err != nil {
+		t.Fatalf("GetJob failed: %v", err)
+	}
+	if job.Status != models.JobFailed || job.FinishedAt == nil || job.Error == "" {
+		t.Errorf("Expected the stale job to be marked failed, got %+v", job)
+	}
+
+	var status string
+	if err := db.QueryRow("SELECT status FROM jobs WHERE id = 'other'").Scan(&status); err != nil || status != models.JobRunning {
+		t.Errorf("The job of another instance should be left alone, got %q (%v)", status, err)
+	}
+}
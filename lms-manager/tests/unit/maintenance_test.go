@@ -0,0 +1,108 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+func TestMoodleService_FileMaintenance(t *testing.T) {
+	moodleService, _ := setupTestMoodle(t, config.DefaultComponents())
+
+	info, err := moodleService.GetMoodleInfo()
+	if err != nil {
+		t.Fatalf("GetMoodleInfo failed: %v", err)
+	}
+	dataPath := info["data_path"].(string)
+
+	if moodleService.GetMaintenanceStatus().Enabled {
+		t.Fatal("Maintenance mode should be disabled initially")
+	}
+
+	if err := moodleService.EnableMaintenance(models.MaintenanceModeFile, "Back at <b>10:00</b>"); err != nil {
+		t.Fatalf("EnableMaintenance failed: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dataPath, "climaintenance.html"))
+	if err != nil {
+		t.Fatalf("climaintenance.html was not written: %v", err)
+	}
+
+	if !strings.Contains(string(content), "Back at &lt;b&gt;10:00&lt;/b&gt;") {
+		t.Errorf("Maintenance message should be escaped in the page, got:\n%s", content)
+	}
+
+	status := moodleService.GetStatus().Maintenance
+	if !status.Enabled || status.Mode != models.MaintenanceModeFile {
+		t.Errorf("Expected file maintenance in status, got %+v", status)
+	}
+
+	if err := moodleService.DisableMaintenance(); err != nil {
+		t.Fatalf("DisableMaintenance failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dataPath, "climaintenance.html")); !os.IsNotExist(err) {
+		t.Error("climaintenance.html should be removed")
+	}
+
+	if moodleService.GetMaintenanceStatus().Enabled {
+		t.Error("Maintenance mode should be disabled")
+	}
+}
+
+func TestMoodleService_InvalidMaintenanceMode(t *testing.T) {
+	moodleService, _ := setupTestMoodle(t, config.DefaultComponents())
+
+	if err := moodleService.EnableMaintenance("banner", ""); err == nil {
+		t.Error("Expected an error for an invalid maintenance mode")
+	}
+}
+
+func TestMoodleService_RefreshKeepsFileMaintenance(t *testing.T) {
+	dir := t.TempDir()
+	moodlePath := filepath.Join(dir, "moodle")
+	dataPath := filepath.Join(dir, "moodledata")
+	writeTestFile(t, moodlePath, "admin/cli/maintenance.php", "<?php\n")
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		t.Fatalf("Failed to create moodledata dir: %v", err)
+	}
+
+	// maintenance.php reports climaintenance.html as enabled too
+	php := filepath.Join(dir, "php")
+	writeTestFile(t, dir, "php", "#!/bin/sh\necho \"$@\" >> \""+filepath.Join(dir, "calls")+"\"\necho 'Status: enabled'\n")
+	if err := os.Chmod(php, 0755); err != nil {
+		t.Fatalf("Failed to make fake php executable: %v", err)
+	}
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{
+		Path:           moodlePath,
+		DataPath:       dataPath,
+		PHPBinary:      php,
+		ServiceManager: config.ServiceManagerFake,
+	})
+
+	if err := moodleService.EnableMaintenance(models.MaintenanceModeFile, "Back at 10:00"); err != nil {
+		t.Fatalf("EnableMaintenance failed: %v", err)
+	}
+
+	status, err := moodleService.RefreshMaintenanceStatus()
+	if err != nil {
+		t.Fatalf("RefreshMaintenanceStatus failed: %v", err)
+	}
+	if status.Mode != models.MaintenanceModeFile || status.Message != "Back at 10:00" {
+		t.Errorf("Expected file maintenance with its message, got %+v", status)
+	}
+
+	if err := moodleService.DisableMaintenance(); err != nil {
+		t.Fatalf("DisableMaintenance failed: %v", err)
+	}
+	calls, _ := os.ReadFile(filepath.Join(dir, "calls"))
+	if strings.Contains(string(calls), "--disable") {
+		t.Errorf("maintenance.php --disable should not run for file maintenance, got calls:\n%s", calls)
+	}
+}
@@ -0,0 +1,234 @@
+package unit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// setupTestMoodle creates a Moodle service backed by a fake service manager
+func setupTestMoodle(t *testing.T, components []config.ComponentConfig) (*services.MoodleService, *services.FakeServiceManager) {
+	dir := t.TempDir()
+	moodlePath := filepath.Join(dir, "moodle")
+	if err := os.MkdirAll(moodlePath, 0755); err != nil {
+		t.Fatalf("Failed to create moodle dir: %v", err)
+	}
+
+	dataPath := filepath.Join(dir, "moodledata")
+	if err := os.MkdirAll(dataPath, 0755); err != nil {
+		t.Fatalf("Failed to create moodledata dir: %v", err)
+	}
+
+	configPath := filepath.Join(moodlePath, "config.php")
+	if err := os.WriteFile(configPath, []byte("<?php\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config.php: %v", err)
+	}
+
+	cfg := config.MoodleConfig{
+		Path:           moodlePath,
+		ConfigPath:     configPath,
+		DataPath:       dataPath,
+		ServiceManager: config.ServiceManagerFake,
+		Components:     components,
+	}
+
+	manager := services.NewFakeServiceManager()
+	moodleService := services.NewMoodleService(cfg)
+	moodleService.SetServiceManager(manager)
+
+	return moodleService, manager
+}
+
+func apacheStack() []config.ComponentConfig {
+	return []config.ComponentConfig{
+		{Name: "web", Type: config.ComponentWeb, Unit: "apache2", Order: 30},
+		{Name: "database", Type: config.ComponentDatabase, Unit: "mariadb", Order: 10},
+		{Name: "php-fpm", Type: config.ComponentPHPFPM, Unit: "php8.2-fpm", Order: 20},
+	}
+}
+
+func TestMoodleService_StartStopOrder(t *testing.T) {
+	moodleService, manager := setupTestMoodle(t, apacheStack())
+
+	if err := moodleService.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	status := moodleService.GetStatus()
+	if !status.Running {
+		t.Errorf("Moodle should be running, error: %s", status.Error)
+	}
+
+	if err := moodleService.Stop(); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	expected := []string{
+		"start mariadb", "start php8.2-fpm", "start apache2",
+		"stop apache2", "stop php8.2-fpm", "stop mariadb",
+	}
+	if calls := manager.Calls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+
+	if moodleService.GetStatus().Running {
+		t.Error("Moodle should not be running after stop")
+	}
+}
+
+func TestMoodleService_StartRollback(t *testing.T) {
+	moodleService, manager := setupTestMoodle(t, apacheStack())
+	manager.FailOn("start", "php8.2-fpm", fmt.Errorf("unit not found"))
+
+	if err := moodleService.Start(); err == nil {
+		t.Error("Start should fail when PHP-FPM fails to start")
+	}
+
+	expected := []string{"start mariadb", "start php8.2-fpm", "stop mariadb"}
+	if calls := manager.Calls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, calls)
+	}
+
+	status := moodleService.GetStatus()
+	if status.Running {
+		t.Error("Moodle should not be running after a failed start")
+	}
+
+	states := make(map[string]string)
+	for _, component := range status.Components {
+		states[component.Name] = component.State
+	}
+
+	if states["php-fpm"] != models.ComponentFailed {
+		t.Errorf("Expected php-fpm to be failed, got %s", states["php-fpm"])
+	}
+	if states["database"] != models.ComponentStopped {
+		t.Errorf("Expected database to be rolled back, got %s", states["database"])
+	}
+}
+
+func TestMoodleService_ComponentStatus(t *testing.T) {
+	moodleService, _ := setupTestMoodle(t, apacheStack())
+
+	if err := moodleService.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	status := moodleService.GetStatus()
+	if len(status.Components) != 3 {
+		t.Fatalf("Expected 3 components, got %d", len(status.Components))
+	}
+
+	for _, component := range status.Components {
+		if component.State != models.ComponentRunning {
+			t.Errorf("Expected %s to be running, got %s", component.Name, component.State)
+		}
+		if component.PID == 0 {
+			t.Errorf("Expected %s to report a PID", component.Name)
+		}
+	}
+
+	if status.ProcessID == 0 {
+		t.Error("Moodle status should report the web server PID")
+	}
+}
+
+func TestMoodleService_StopKeepsDependencies(t *testing.T) {
+	moodleService, manager := setupTestMoodle(t, apacheStack())
+
+	if err := moodleService.Start(); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	manager.FailOn("stop", "php8.2-fpm", fmt.Errorf("timeout"))
+	if err := moodleService.Stop(); err == nil {
+		t.Error("Stop should report the PHP-FPM failure")
+	}
+
+	if active, _ := manager.IsActive("mariadb"); !active {
+		t.Error("Database should keep running while PHP-FPM is still up")
+	}
+}
+
+func TestStartOrder(t *testing.T) {
+	cfg := config.MoodleConfig{
+		Components: []config.ComponentConfig{
+			{Name: "web", Type: config.ComponentWeb, Unit: "nginx"},
+			{Name: "php-fpm", Type: config.ComponentPHPFPM, Unit: "php8.2-fpm"},
+			{Name: "redis", Type: config.ComponentCache, Unit: "redis-server"},
+			{Name: "database", Type: config.ComponentDatabase, Unit: "postgresql"},
+		},
+	}
+
+	ordered, err := cfg.StartOrder()
+	if err != nil {
+		t.Fatalf("StartOrder failed: %v", err)
+	}
+
+	var names []string
+	for _, component := range ordered {
+		names = append(names, component.Name)
+	}
+
+	expected := []string{"database", "redis", "php-fpm", "web"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected order %v, got %v", expected, names)
+	}
+
+	cfg.Components[3].DependsOn = []string{"web"}
+	if _, err := cfg.StartOrder(); err == nil {
+		t.Error("StartOrder should detect dependency cycles")
+	}
+}
+
+func TestNewServiceManager(t *testing.T) {
+	kinds := []string{
+		config.ServiceManagerSystemd,
+		config.ServiceManagerOpenRC,
+		config.ServiceManagerSysV,
+		config.ServiceManagerSupervisord,
+		config.ServiceManagerFake,
+	}
+
+	for _, kind := range kinds {
+		manager, err := services.NewServiceManager(kind)
+		if err != nil {
+			t.Errorf("NewServiceManager(%s) failed: %v", kind, err)
+			continue
+		}
+		if manager.Name() != kind {
+			t.Errorf("Expected backend %s, got %s", kind, manager.Name())
+		}
+	}
+
+	if _, err := services.NewServiceManager("upstart"); err == nil {
+		t.Error("NewServiceManager should reject unknown backends")
+	}
+}
+
+func TestConfigValidateComponents(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.Security.JWTSecret = "test-secret"
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Default config should be valid: %v", err)
+	}
+
+	cfg.Moodle.Components = append(cfg.Moodle.Components, config.ComponentConfig{
+		Name: "web", Type: config.ComponentWeb, Unit: "apache2",
+	})
+	if err := cfg.Validate(); err == nil {
+		t.Error("Duplicate component names should be rejected")
+	}
+
+	cfg.Moodle.Components = []config.ComponentConfig{{Name: "redis", Type: "queue", Unit: "redis-server"}}
+	if err := cfg.Validate(); err == nil {
+		t.Error("Unknown component types should be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lms-manager/services"
+)
+
+const testConfigPHP = `<?php  // Moodle configuration file
+
+unset($CFG);
+global $CFG;
+$CFG = new stdClass();
+
+$CFG->dbtype    = 'mariadb';
+$CFG->dblibrary = 'native';
+$CFG->dbhost    = 'localhost';
+$CFG->dbname    = 'moodle';
+$CFG->dbuser    = 'moodleuser';
+$CFG->dbpass    = 'S3cr3t;pa\'ss';
+$CFG->prefix    = 'mdl_';
+$CFG->dboptions = array (
+  'dbpersist' => 0,
+  'dbport' => 3307,
+  'dbsocket' => '',
+  'dbcollation' => 'utf8mb4_unicode_ci',
+);
+
+$CFG->wwwroot   = 'https://lms.example.id/';
+$CFG->dataroot  = '/var/www/moodledata';
+$CFG->tempdir   = $CFG->dataroot . '/temp';
+$CFG->admin     = 'admin';
+$CFG->sslproxy  = true;
+
+# $CFG->debug = 0;
+/* $CFG->debugdisplay = 0; */
+if (!empty($_SERVER['TRAINING'])) {
+    $CFG->debug = (E_ALL | E_STRICT);
+    $CFG->debugdisplay = 1;
+}
+
+$CFG->session_handler_class = '\core\session\redis';
+$CFG->session_redis_host = '127.0.0.1';
+$CFG->session_redis_port = 6379;
+$CFG->session_redis_auth = 'redispass';
+
+$CFG->directorypermissions = 0777;
+
+require_once(__DIR__ . '/lib/setup.php');
+`
+
+func writeTestConfigPHP(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "config.php")
+	if err := os.WriteFile(path, []byte(testConfigPHP), 0644); err != nil {
+		t.Fatalf("Failed to write config.php: %v", err)
+	}
+	return path
+}
+
+func TestParseMoodleConfig(t *testing.T) {
+	site, err := services.ParseMoodleConfig(writeTestConfigPHP(t))
+	if err != nil {
+		t.Fatalf("ParseMoodleConfig failed: %v", err)
+	}
+
+	checks := map[string][2]string{
+		"dbtype":   {site.DBType, "mariadb"},
+		"dbhost":   {site.DBHost, "localhost"},
+		"dbname":   {site.DBName, "moodle"},
+		"dbpass":   {site.DBPass, "S3cr3t;pa'ss"},
+		"prefix":   {site.Prefix, "mdl_"},
+		"wwwroot":  {site.WWWRoot, "https://lms.example.id"},
+		"dataroot": {site.DataRoot, "/var/www/moodledata"},
+		"session":  {site.SessionSavePath, "127.0.0.1:6379"},
+		"tempdir":  {site.Settings["tempdir"].(string), "/var/www/moodledata/temp"},
+	}
+	for name, check := range checks {
+		if check[0] != check[1] {
+			t.Errorf("Expected %s '%s', got '%s'", name, check[1], check[0])
+		}
+	}
+
+	if site.DBPort != 3307 {
+		t.Errorf("Expected dbport 3307, got %d", site.DBPort)
+	}
+
+	if !site.SSLProxy {
+		t.Error("Expected sslproxy to be enabled")
+	}
+
+	if site.DebugLevel != "developer" || !site.DebugDisplay {
+		t.Errorf("Expected developer debugging with display, got %s/%v", site.DebugLevel, site.DebugDisplay)
+	}
+
+	if site.Settings["directorypermissions"] != int64(0777) {
+		t.Errorf("Expected octal directorypermissions, got %v", site.Settings["directorypermissions"])
+	}
+}
+
+func TestRedactMoodleConfig(t *testing.T) {
+	site, err := services.ParseMoodleConfig(writeTestConfigPHP(t))
+	if err != nil {
+		t.Fatalf("ParseMoodleConfig failed: %v", err)
+	}
+
+	redacted := services.RedactMoodleConfig(site)
+	if redacted.DBPass == site.DBPass {
+		t.Error("dbpass should be redacted")
+	}
+
+	for _, key := range []string{"dbpass", "session_redis_auth"} {
+		if redacted.Settings[key] == site.Settings[key] {
+			t.Errorf("%s should be redacted in settings", key)
+		}
+	}
+
+	if site.DBPass != "S3cr3t;pa'ss" {
+		t.Error("Redacting should not modify the original config")
+	}
+
+	if redacted.Settings["dbname"] != "moodle" {
+		t.Error("Non-secret settings should be kept")
+	}
+}
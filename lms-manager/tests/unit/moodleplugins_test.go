@@ -0,0 +1,191 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+const testPluginManagerPHP = `<?php
+class core_plugin_manager {
+    public static function standard_plugins_list($type) {
+        static $standard_plugins = array(
+            // Comments with (brackets) and quotes don't matter.
+            'mod' => array(
+                'assign', 'forum', 'quiz'
+            ),
+            'block' => array(
+                'html'
+            ),
+            'assignsubmission' => array(
+                'file', 'onlinetext'
+            ),
+        );
+
+        if (isset($standard_plugins[$type])) {
+            return $standard_plugins[$type];
+        }
+        return false;
+    }
+}
+`
+
+// writeTestFile writes a file below dir, creating its parent directories
+func writeTestFile(t *testing.T, dir, name, content string) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create %s: %v", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+// setupTestPluginTree creates a Moodle code tree with a few plugins
+func setupTestPluginTree(t *testing.T) string {
+	root := t.TempDir()
+
+	writeTestFile(t, root, "version.php", testVersionPHP)
+	writeTestFile(t, root, "lib/components.json", `{"plugintypes": {"mod": "mod", "block": "blocks", "local": "local"}}`)
+	writeTestFile(t, root, "lib/classes/plugin_manager.php", testPluginManagerPHP)
+
+	writeTestFile(t, root, "mod/forum/version.php", `<?php
+$plugin->version   = 2022112800;
+$plugin->requires  = 2022111800;
+$plugin->component = 'mod_forum';
+`)
+	writeTestFile(t, root, "mod/assign/version.php", `<?php
+$plugin->component = 'mod_assign';
+$plugin->version  = 2022112800;
+$plugin->requires = 2022111800;
+`)
+	writeTestFile(t, root, "mod/assign/db/subplugins.json", `{"subplugintypes": {"assignsubmission": "submission"}}`)
+	writeTestFile(t, root, "mod/assign/submission/file/version.php", `<?php
+$plugin->version   = 2022112800;
+$plugin->component = 'assignsubmission_file';
+`)
+	writeTestFile(t, root, "mod/assign/submission/pdf/version.php", `<?php
+$plugin->version   = 2023010100;
+$plugin->component = 'assignsubmission_pdf';
+`)
+	writeTestFile(t, root, "blocks/html/version.php", `<?php
+$plugin->version   = 2022112800;
+$plugin->component = 'block_html';
+`)
+	writeTestFile(t, root, "local/reports/version.php", `<?php
+defined('MOODLE_INTERNAL') || die();
+
+$plugin->component = 'local_reports';
+$plugin->version   = 2024050100;
+$plugin->requires  = 2024042200.00; // Moodle 4.4
+$plugin->maturity  = MATURITY_BETA;
+$plugin->release   = '1.2.0';
+`)
+	// Directories without version.php are not plugins
+	if err := os.MkdirAll(filepath.Join(root, "blocks", "tests"), 0755); err != nil {
+		t.Fatalf("Failed to create blocks/tests: %v", err)
+	}
+
+	return root
+}
+
+func TestParsePluginVersion(t *testing.T) {
+	root := setupTestPluginTree(t)
+
+	plugin, err := services.ParsePluginVersion(filepath.Join(root, "local", "reports", "version.php"))
+	if err != nil {
+		t.Fatalf("ParsePluginVersion failed: %v", err)
+	}
+
+	if plugin.Component != "local_reports" || plugin.Version != 2024050100 {
+		t.Errorf("Unexpected plugin %s version %d", plugin.Component, plugin.Version)
+	}
+
+	if plugin.Requires != 2024042200 || plugin.Maturity != "beta" || plugin.Release != "1.2.0" {
+		t.Errorf("Unexpected requires %f, maturity %s, release %s", plugin.Requires, plugin.Maturity, plugin.Release)
+	}
+}
+
+func TestScanMoodlePlugins(t *testing.T) {
+	root := setupTestPluginTree(t)
+
+	inventory, err := services.ScanMoodlePlugins(root)
+	if err != nil {
+		t.Fatalf("ScanMoodlePlugins failed: %v", err)
+	}
+
+	if len(inventory.Warnings) != 0 {
+		t.Errorf("Unexpected warnings: %v", inventory.Warnings)
+	}
+
+	plugins := make(map[string]models.MoodlePlugin)
+	for _, plugin := range inventory.Plugins {
+		plugins[plugin.Component] = plugin
+	}
+
+	expected := map[string]bool{
+		"mod_forum":             false,
+		"mod_assign":            false,
+		"assignsubmission_file": false,
+		"assignsubmission_pdf":  true,
+		"block_html":            false,
+		"local_reports":         true,
+	}
+
+	if inventory.Total != len(expected) || len(plugins) != len(expected) {
+		t.Fatalf("Expected %d plugins, got %d: %v", len(expected), inventory.Total, inventory.Plugins)
+	}
+
+	for component, addOn := range expected {
+		plugin, ok := plugins[component]
+		if !ok {
+			t.Errorf("Plugin %s not found", component)
+			continue
+		}
+		if plugin.AddOn != addOn {
+			t.Errorf("Expected %s add-on to be %v", component, addOn)
+		}
+	}
+
+	if inventory.AddOns != 2 {
+		t.Errorf("Expected 2 add-ons, got %d", inventory.AddOns)
+	}
+
+	if path := plugins["assignsubmission_pdf"].Path; path != "mod/assign/submission/pdf" {
+		t.Errorf("Unexpected subplugin path %s", path)
+	}
+}
+
+func TestMoodleService_GetPlugins(t *testing.T) {
+	root := setupTestPluginTree(t)
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{
+		Path:           root,
+		ConfigPath:     filepath.Join(root, "config.php"),
+		ServiceManager: config.ServiceManagerFake,
+		Components:     config.DefaultComponents(),
+	})
+
+	inventory, err := moodleService.GetPlugins()
+	if err != nil {
+		t.Fatalf("GetPlugins failed: %v", err)
+	}
+
+	if inventory.CoreVersion != "2022112803.00" {
+		t.Errorf("Unexpected core version %s", inventory.CoreVersion)
+	}
+
+	if inventory.Incompatible != 1 {
+		t.Errorf("Expected 1 incompatible plugin, got %d", inventory.Incompatible)
+	}
+
+	for _, plugin := range inventory.Plugins {
+		if plugin.Incompatible != (plugin.Component == "local_reports") {
+			t.Errorf("Unexpected incompatible flag for %s", plugin.Component)
+		}
+	}
+}
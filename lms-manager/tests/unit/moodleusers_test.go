@@ -0,0 +1,182 @@
+package unit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/handlers"
+	"lms-manager/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestMoodleUserService_WebServiceActions(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse web service request: %v", err)
+		}
+		requests = append(requests, r.PostForm)
+
+		if r.PostForm.Get("users[0][id]") == "2" {
+			w.Write([]byte(`{"exception":"moodle_exception","errorcode":"nopermissions","message":"Sorry, but you do not currently have permissions to do that"}`))
+			return
+		}
+		w.Write([]byte(`{"warnings":[]}`))
+	}))
+	defer server.Close()
+
+	cfg := config.DefaultUserAdminConfig()
+	cfg.WebServiceURL = server.URL
+	cfg.WebServiceToken = "helpdesk-token"
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: "/var/www/moodle"})
+	userService := services.NewMoodleUserService(cfg, moodleService)
+	userService.SetDatabase(db)
+
+	operator := services.Operator{UserID: "operator-1", Username: "helpdesk", IPAddress: "192.168.1.20"}
+	if err := userService.Unsuspend(42, operator); err != nil {
+		t.Fatalf("Unsuspend failed: %v", err)
+	}
+	if err := userService.ForcePasswordChange(42, operator); err != nil {
+		t.Fatalf("ForcePasswordChange failed: %v", err)
+	}
+
+	// The main admin cannot be changed by the web service user
+	err := userService.Unsuspend(2, operator)
+	if err == nil || !strings.Contains(err.Error(), "nopermissions") {
+		t.Errorf("Expected the web service exception, got %v", err)
+	}
+
+	if len(requests) != 3 {
+		t.Fatalf("Expected 3 web service requests, got %d", len(requests))
+	}
+	unsuspend := requests[0]
+	if unsuspend.Get("wstoken") != "helpdesk-token" || unsuspend.Get("wsfunction") != "core_user_update_users" ||
+		unsuspend.Get("users[0][id]") != "42" || unsuspend.Get("users[0][suspended]") != "0" {
+		t.Errorf("Unexpected unsuspend request %v", unsuspend)
+	}
+	if force := requests[1]; force.Get("users[0][preferences][0][type]") != "auth_forcepasswordchange" ||
+		force.Get("users[0][preferences][0][value]") != "1" || force.Get("users[0][suspended]") != "" {
+		t.Errorf("Unexpected force password change request %v", force)
+	}
+
+	rows, err := db.Query(`
+		SELECT user_id, action, resource, ip_address, success, message
+		FROM user_activities ORDER BY rowid
+	`)
+	if err != nil {
+		t.Fatalf("Failed to query user activities: %v", err)
+	}
+	defer rows.Close()
+
+	expected := []struct {
+		action  string
+		success bool
+	}{
+		{services.ActionMoodleUserUnsuspend, true},
+		{services.ActionMoodleUserForcePasswordChange, true},
+		{services.ActionMoodleUserUnsuspend, false},
+	}
+	count := 0
+	for rows.Next() {
+		var userID, action, resource, ip, message string
+		var success bool
+		if err := rows.Scan(&userID, &action, &resource, &ip, &success, &message); err != nil {
+			t.Fatalf("Failed to scan user activity: %v", err)
+		}
+		if count < len(expected) && (action != expected[count].action || success != expected[count].success) {
+			t.Errorf("Expected activity %d to be %+v, got %s %v", count, expected[count], action, success)
+		}
+		if userID != "operator-1" || ip != "192.168.1.20" || !strings.Contains(message, "helpdesk") {
+			t.Errorf("Expected the operator to be recorded, got %s %s %q", userID, ip, message)
+		}
+		if !strings.HasSuffix(resource, "/user/42") && !strings.HasSuffix(resource, "/user/2") {
+			t.Errorf("Unexpected resource %s", resource)
+		}
+		count++
+	}
+	if count != len(expected) {
+		t.Errorf("Expected %d recorded activities, got %d", len(expected), count)
+	}
+}
+
+func TestMoodleUserService_RequiresToken(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: "/var/www/moodle"})
+	userService := services.NewMoodleUserService(config.DefaultUserAdminConfig(), moodleService)
+	userService.SetDatabase(db)
+
+	operator := services.Operator{UserID: "operator-1", Username: "helpdesk"}
+	if err := userService.Suspend(42, operator); err == nil {
+		t.Fatal("Expected suspending without a web service token to fail")
+	}
+
+	// Failed attempts are recorded too
+	var success bool
+	if err := db.QueryRow(`SELECT success FROM user_activities WHERE action = ?`, services.ActionMoodleUserSuspend).Scan(&success); err != nil {
+		t.Fatalf("Expected the failed suspension to be recorded: %v", err)
+	}
+	if success {
+		t.Error("Expected the failed suspension to be recorded as unsuccessful")
+	}
+}
+
+func TestAPIHandler_MoodleUserActionsRequirePermission(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte(`{"warnings":[]}`))
+	}))
+	defer server.Close()
+
+	cfg := config.DefaultUserAdminConfig()
+	cfg.WebServiceURL = server.URL
+	cfg.WebServiceToken = "helpdesk-token"
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: "/var/www/moodle"})
+	userService := services.NewMoodleUserService(cfg, moodleService)
+	userService.SetDatabase(db)
+
+	apiHandler := handlers.NewAPIHandler(nil, moodleService, nil)
+	apiHandler.SetMoodleUserService(userService)
+
+	gin.SetMode(gin.TestMode)
+	unsuspend := func(role string) int {
+		router := gin.New()
+		router.Use(func(c *gin.Context) {
+			c.Set("user_id", "user-"+role)
+			c.Set("username", role)
+			c.Set("role", role)
+		})
+		router.POST("/moodle/users/:id/unsuspend", apiHandler.UnsuspendMoodleUser)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/moodle/users/42/unsuspend", nil))
+		return recorder.Code
+	}
+
+	if code := unsuspend("viewer"); code != http.StatusForbidden {
+		t.Errorf("Expected a viewer to be forbidden, got %d", code)
+	}
+	if calls != 0 {
+		t.Errorf("Expected no web service call for a viewer, got %d", calls)
+	}
+
+	if code := unsuspend("operator"); code != http.StatusOK {
+		t.Errorf("Expected an operator to unsuspend the user, got %d", code)
+	}
+	if calls != 1 {
+		t.Errorf("Expected one web service call for the operator, got %d", calls)
+	}
+}
@@ -0,0 +1,88 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+const testVersionPHP = `<?php
+defined('MOODLE_INTERNAL') || die();
+
+$version  = 2022112803.00;              // 20221128      = branching date YYYYMMDD - do not modify!
+                                        //         RR    = release increments - 00 in DEV branches.
+                                        //           .XX = incremental changes.
+$release  = '4.1.3 (Build: 20230424)'; // Human-friendly version name
+$branch   = '401';                     // This version's branch.
+$maturity = MATURITY_STABLE;           // This version's maturity level.
+`
+
+func TestParseMoodleVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "version.php")
+	if err := os.WriteFile(path, []byte(testVersionPHP), 0644); err != nil {
+		t.Fatalf("Failed to write version.php: %v", err)
+	}
+
+	version, err := services.ParseMoodleVersion(path)
+	if err != nil {
+		t.Fatalf("ParseMoodleVersion failed: %v", err)
+	}
+
+	if version.Version != "2022112803.00" {
+		t.Errorf("Expected version '2022112803.00', got '%s'", version.Version)
+	}
+
+	if version.Number != 2022112803 {
+		t.Errorf("Expected number 2022112803, got %f", version.Number)
+	}
+
+	if version.Release != "4.1.3 (Build: 20230424)" {
+		t.Errorf("Unexpected release '%s'", version.Release)
+	}
+
+	if version.Branch != "401" || version.Maturity != "stable" {
+		t.Errorf("Expected stable branch 401, got %s branch %s", version.Maturity, version.Branch)
+	}
+}
+
+func TestLookupMoodleSupport(t *testing.T) {
+	tests := []struct {
+		branch string
+		now    string
+		status string
+	}{
+		{"401", "2023-06-01", models.SupportGeneral},
+		{"401", "2025-01-01", models.SupportSecurity},
+		{"401", "2026-01-01", models.SupportEOL},
+		{"311", "2024-01-01", models.SupportEOL},
+		{"399", "2024-01-01", models.SupportUnknown},
+	}
+
+	for _, test := range tests {
+		now, _ := time.Parse("2006-01-02", test.now)
+		support := services.LookupMoodleSupport(test.branch, now)
+		if support.Status != test.status {
+			t.Errorf("Branch %s on %s: expected %s, got %s", test.branch, test.now, test.status, support.Status)
+		}
+	}
+}
+
+func TestMoodleVersionWarnings(t *testing.T) {
+	now, _ := time.Parse("2006-01-02", "2024-06-01")
+
+	stable := &models.MoodleVersion{Release: "4.5", Branch: "405", Maturity: "stable"}
+	stable.Support = services.LookupMoodleSupport(stable.Branch, now)
+	if warnings := services.MoodleVersionWarnings(stable); len(warnings) != 0 {
+		t.Errorf("Expected no warnings for a supported stable build, got %v", warnings)
+	}
+
+	beta := &models.MoodleVersion{Release: "4.0beta", Branch: "400", Maturity: "beta"}
+	beta.Support = services.LookupMoodleSupport(beta.Branch, now)
+	if warnings := services.MoodleVersionWarnings(beta); len(warnings) != 2 {
+		t.Errorf("Expected maturity and end-of-life warnings, got %v", warnings)
+	}
+}
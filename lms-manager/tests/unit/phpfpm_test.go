@@ -0,0 +1,170 @@
+package unit
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/services"
+)
+
+// fakePHPFPM answers the FastCGI status requests of a pool like PHP-FPM
+type fakePHPFPM struct {
+	listen  string
+	active  int64
+	queue   int64
+	reached int64
+}
+
+// startFakePHPFPM serves the status page of a pool on listener
+func startFakePHPFPM(t *testing.T, listener net.Listener, listen string) *fakePHPFPM {
+	pool := &fakePHPFPM{listen: listen}
+
+	go fcgi.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status" || !r.URL.Query().Has("json") {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, "File not found.")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"pool":"www","process manager":"dynamic","start time":1700000000,"start since":3600,`+
+			`"accepted conn":1200,"listen queue":%d,"max listen queue":4,"listen queue len":511,`+
+			`"idle processes":%d,"active processes":%d,"total processes":10,"max active processes":9,`+
+			`"max children reached":%d,"slow requests":2}`,
+			atomic.LoadInt64(&pool.queue), 10-atomic.LoadInt64(&pool.active), atomic.LoadInt64(&pool.active), atomic.LoadInt64(&pool.reached))
+	}))
+	t.Cleanup(func() { listener.Close() })
+
+	return pool
+}
+
+// setupTestPHPFPM starts a pool on a unix socket and another on TCP
+func setupTestPHPFPM(t *testing.T) (*sql.DB, *services.PHPFPMService, *services.MonitorService, *fakePHPFPM) {
+	socket := filepath.Join(t.TempDir(), "php-fpm.sock")
+	unixListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+	unixPool := startFakePHPFPM(t, unixListener, socket)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	tcpPool := startFakePHPFPM(t, tcpListener, tcpListener.Addr().String())
+
+	phpfpmConfig := config.DefaultPHPFPMConfig()
+	phpfpmConfig.Pools = []config.PHPFPMPool{
+		{Name: "moodle", Listen: "unix:" + unixPool.listen, StatusPath: "/status", MaxChildren: 10},
+		{Name: "api", Listen: tcpPool.listen, StatusPath: "/status"},
+	}
+
+	db := setupTestDB(t)
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	return db, services.NewPHPFPMService(phpfpmConfig, monitorService), monitorService, unixPool
+}
+
+func countAlerts(t *testing.T, db *sql.DB, alertType string) int {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM alerts WHERE type = ? AND resolved = 0", alertType).Scan(&count); err != nil {
+		t.Fatalf("Failed to count alerts: %v", err)
+	}
+	return count
+}
+
+func TestPHPFPMService_Sample(t *testing.T) {
+	db, phpfpmService, _, pool := setupTestPHPFPM(t)
+	defer db.Close()
+
+	atomic.StoreInt64(&pool.active, 4)
+	atomic.StoreInt64(&pool.reached, 3)
+
+	pools := phpfpmService.Sample()
+	if len(pools) != 2 {
+		t.Fatalf("Expected 2 pools, got %+v", pools)
+	}
+
+	for _, stats := range pools {
+		if stats.Error != "" {
+			t.Fatalf("Failed to sample pool %s: %s", stats.Name, stats.Error)
+		}
+		if stats.Pool != "www" || stats.ProcessManager != "dynamic" || stats.TotalProcesses != 10 || stats.SlowRequests != 2 {
+			t.Errorf("Unexpected status of pool %s: %+v", stats.Name, stats)
+		}
+	}
+
+	moodle := pools[0]
+	if moodle.ActiveProcesses != 4 || moodle.IdleProcesses != 6 || moodle.ChildrenUsage != 40 {
+		t.Errorf("Expected 4 of 10 children busy, got %+v", moodle)
+	}
+
+	// Counters from before the first sample are not new
+	if moodle.MaxChildrenReached != 3 || moodle.NewMaxChildrenReached != 0 {
+		t.Errorf("Expected no new max children reached on the first sample, got %+v", moodle)
+	}
+
+	atomic.StoreInt64(&pool.reached, 5)
+	if moodle = phpfpmService.Sample()[0]; moodle.NewMaxChildrenReached != 2 {
+		t.Errorf("Expected 2 new max children reached, got %d", moodle.NewMaxChildrenReached)
+	}
+}
+
+func TestPHPFPMService_StatusPathNotSet(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen on TCP: %v", err)
+	}
+	pool := startFakePHPFPM(t, listener, listener.Addr().String())
+
+	phpfpmConfig := config.DefaultPHPFPMConfig()
+	phpfpmConfig.Pools = []config.PHPFPMPool{{Name: "www", Listen: pool.listen, StatusPath: "/fpm-status"}}
+
+	pools := services.NewPHPFPMService(phpfpmConfig, nil).Sample()
+	if len(pools) != 1 || pools[0].Error == "" {
+		t.Errorf("Expected an error for a status path PHP-FPM does not serve, got %+v", pools)
+	}
+}
+
+func TestMonitorService_CheckPHPFPMStats(t *testing.T) {
+	db, phpfpmService, monitorService, pool := setupTestPHPFPM(t)
+	defer db.Close()
+
+	atomic.StoreInt64(&pool.active, 2)
+	monitorService.CheckPHPFPMStats(phpfpmService.Sample())
+
+	if countAlerts(t, db, services.AlertPHPFPMSaturated) != 0 || countAlerts(t, db, services.AlertPHPFPMListenQueue) != 0 {
+		t.Error("No PHP-FPM alert expected for an idle pool")
+	}
+	if stats := monitorService.GetStats(); len(stats.PHPFPM) != 2 {
+		t.Errorf("Expected the pools in the system stats, got %+v", stats.PHPFPM)
+	}
+
+	// Exam traffic: every child busy and requests waiting
+	atomic.StoreInt64(&pool.active, 10)
+	atomic.StoreInt64(&pool.queue, 25)
+	monitorService.CheckPHPFPMStats(phpfpmService.Sample())
+
+	if countAlerts(t, db, services.AlertPHPFPMSaturated) != 1 {
+		t.Error("Expected a saturation alert")
+	}
+	if countAlerts(t, db, services.AlertPHPFPMListenQueue) != 1 {
+		t.Error("Expected a listen queue alert")
+	}
+
+	atomic.StoreInt64(&pool.active, 2)
+	atomic.StoreInt64(&pool.queue, 0)
+	monitorService.CheckPHPFPMStats(phpfpmService.Sample())
+
+	if countAlerts(t, db, services.AlertPHPFPMSaturated) != 0 || countAlerts(t, db, services.AlertPHPFPMListenQueue) != 0 {
+		t.Error("PHP-FPM alerts should be resolved once the pool recovers")
+	}
+}
@@ -0,0 +1,195 @@
+package unit
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/services"
+)
+
+const testMoodlePage = `<!DOCTYPE html><html><body><form><input name="username"></form></body></html>`
+
+type probeFixture struct {
+	probes *services.ProbeService
+	db     *sql.DB
+	broken atomic.Value
+	delay  int64
+	server *httptest.Server
+}
+
+// setupTestProbes creates a probe service for a Moodle site served by a test
+// server under /moodle. The site renders a white screen while broken is set
+// and answers after delay milliseconds.
+func setupTestProbes(t *testing.T, probeConfig config.ProbeConfig) *probeFixture {
+	fixture := &probeFixture{db: setupTestDB(t)}
+	fixture.broken.Store(false)
+
+	fixture.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(atomic.LoadInt64(&fixture.delay)) * time.Millisecond)
+
+		switch r.URL.Path {
+		case "/moodle/", "/moodle/login/index.php":
+			if fixture.broken.Load().(bool) {
+				return
+			}
+			w.Write([]byte(testMoodlePage))
+		case "/moodle/admin/":
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(fixture.server.Close)
+
+	dir := t.TempDir()
+	writeTestFile(t, dir, "config.php", strings.Replace(testUpgradeConfigPHP, "https://lms.example.com", fixture.server.URL+"/moodle", 1))
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{
+		Path:           dir,
+		ConfigPath:     filepath.Join(dir, "config.php"),
+		DataPath:       filepath.Join(dir, "moodledata"),
+		ServiceManager: config.ServiceManagerFake,
+		Components:     config.DefaultComponents(),
+	})
+
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(fixture.db)
+
+	fixture.probes = services.NewProbeService(probeConfig, moodleService, monitorService)
+	fixture.probes.SetDatabase(fixture.db)
+
+	return fixture
+}
+
+func (f *probeFixture) unresolvedAlerts(t *testing.T, alertType string) int {
+	var count int
+	if err := f.db.QueryRow("SELECT COUNT(*) FROM alerts WHERE type = ? AND resolved = 0", alertType).Scan(&count); err != nil {
+		t.Fatalf("Failed to count alerts: %v", err)
+	}
+	return count
+}
+
+func TestProbeService_Run(t *testing.T) {
+	probeConfig := config.DefaultProbeConfig()
+	probeConfig.Targets = []config.ProbeTarget{
+		{Name: "admin", URL: "/admin/", ExpectedStatus: http.StatusForbidden},
+	}
+	fixture := setupTestProbes(t, probeConfig)
+	defer fixture.db.Close()
+
+	results, err := fixture.probes.Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"site":  fixture.server.URL + "/moodle/",
+		"login": fixture.server.URL + "/moodle/login/index.php",
+		"admin": fixture.server.URL + "/moodle/admin/",
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("Expected %d results, got %+v", len(expected), results)
+	}
+
+	for _, result := range results {
+		if result.URL != expected[result.Name] {
+			t.Errorf("Unexpected URL %s for probe %s", result.URL, result.Name)
+		}
+		if !result.Success {
+			t.Errorf("Expected probe %s to succeed: %s", result.Name, result.Error)
+		}
+	}
+
+	statuses := fixture.probes.GetStatus()
+	if len(statuses) != 3 || !statuses[0].Healthy || statuses[0].Samples != 1 || statuses[0].SuccessRate != 100 {
+		t.Errorf("Unexpected probe status %+v", statuses)
+	}
+
+	history, err := fixture.probes.GetHistory("login", 10)
+	if err != nil {
+		t.Fatalf("GetHistory failed: %v", err)
+	}
+	if len(history) != 1 || history[0].StatusCode != http.StatusOK {
+		t.Errorf("Expected one stored login result, got %+v", history)
+	}
+}
+
+func TestProbeService_DownAlert(t *testing.T) {
+	fixture := setupTestProbes(t, config.DefaultProbeConfig())
+	defer fixture.db.Close()
+
+	// A white screen still answers 200
+	fixture.broken.Store(true)
+	for i := 0; i < 2; i++ {
+		fixture.probes.Run()
+	}
+
+	if fixture.unresolvedAlerts(t, services.AlertMoodleDown) != 0 {
+		t.Error("No alert expected below the failure threshold")
+	}
+
+	results, _ := fixture.probes.Run()
+	for _, result := range results {
+		if result.Success || result.StatusCode != http.StatusOK || !strings.Contains(result.Error, "</html>") {
+			t.Errorf("Expected the white screen to fail the marker check, got %+v", result)
+		}
+	}
+
+	if fixture.unresolvedAlerts(t, services.AlertMoodleDown) != 1 {
+		t.Error("Expected a down alert after 3 failures")
+	}
+
+	fixture.broken.Store(false)
+	fixture.probes.Run()
+
+	if fixture.unresolvedAlerts(t, services.AlertMoodleDown) != 0 {
+		t.Error("Down alert should be resolved once the site responds")
+	}
+}
+
+func TestProbeService_SlowAlert(t *testing.T) {
+	probeConfig := config.DefaultProbeConfig()
+	probeConfig.SlowThreshold = 1
+	fixture := setupTestProbes(t, probeConfig)
+	defer fixture.db.Close()
+
+	atomic.StoreInt64(&fixture.delay, 5)
+	for i := 0; i < 5; i++ {
+		fixture.probes.Run()
+	}
+
+	if fixture.unresolvedAlerts(t, services.AlertMoodleSlow) != 1 {
+		t.Errorf("Expected a slow alert, got statuses %+v", fixture.probes.GetStatus())
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	latencies := []int64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}
+
+	tests := []struct {
+		percentile float64
+		expected   int64
+	}{
+		{50, 50},
+		{95, 100},
+		{99, 100},
+		{10, 10},
+	}
+
+	for _, tt := range tests {
+		if got := services.Percentile(latencies, tt.percentile); got != tt.expected {
+			t.Errorf("Percentile(%v) = %d, expected %d", tt.percentile, got, tt.expected)
+		}
+	}
+
+	if services.Percentile(nil, 95) != 0 {
+		t.Error("Expected 0 for no values")
+	}
+}
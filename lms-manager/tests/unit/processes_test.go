@@ -0,0 +1,127 @@
+package unit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// writeTestProcess writes the procfs entries of a process. CPU times and the
+// start time are in clock ticks.
+func writeTestProcess(t *testing.T, root string, pid, ppid int, name, cmdline string, rssKB, utime, stime, fds int) {
+	dir := fmt.Sprintf("%d", pid)
+	writeTestFile(t, root, dir+"/stat", fmt.Sprintf("%d (%s) S %d %d %d 0 -1 4194560 100 0 0 0 %d %d 0 0 20 0 1 0 500 12345678 %d\n",
+		pid, name, ppid, pid, pid, utime, stime, rssKB/4))
+	writeTestFile(t, root, dir+"/status", fmt.Sprintf("Name:\t%s\nState:\tS (sleeping)\nPPid:\t%d\nVmRSS:\t  %d kB\nThreads:\t2\n", name, ppid, rssKB))
+	writeTestFile(t, root, dir+"/cmdline", strings.ReplaceAll(cmdline, " ", "\x00")+"\x00")
+	for i := 0; i < fds; i++ {
+		writeTestFile(t, root, fmt.Sprintf("%s/fd/%d", dir, i), "")
+	}
+}
+
+// setupTestProcFS writes a procfs tree with the Moodle stack: MariaDB, a
+// PHP-FPM master with two workers, an nginx master with a worker, a Redis
+// server started outside the service manager and a cron run
+func setupTestProcFS(t *testing.T) string {
+	root := t.TempDir()
+	writeTestFile(t, root, "stat", "cpu  1 2 3 4\nbtime 1700000000\n")
+
+	writeTestProcess(t, root, 1, 0, "systemd", "/sbin/init", 12000, 100, 100, 0)
+	writeTestProcess(t, root, 1001, 1, "mariadbd", "/usr/sbin/mariadbd", 800000, 30000, 5000, 40)
+	writeTestProcess(t, root, 1002, 1, "php-fpm8.1", "php-fpm: master process (/etc/php/8.1/fpm/php-fpm.conf)", 20000, 100, 50, 10)
+	writeTestProcess(t, root, 1010, 1002, "php-fpm8.1", "php-fpm: pool www", 90000, 2000, 300, 8)
+	writeTestProcess(t, root, 1011, 1002, "php-fpm8.1", "php-fpm: pool www", 420000, 9000, 700, 8)
+	writeTestProcess(t, root, 1003, 1, "nginx", "nginx: master process /usr/sbin/nginx", 4000, 10, 10, 6)
+	writeTestProcess(t, root, 1020, 1003, "nginx", "nginx: worker process", 8000, 400, 200, 30)
+	writeTestProcess(t, root, 1030, 1, "redis-server", "/usr/bin/redis-server 127.0.0.1:6379", 30000, 100, 100, 12)
+	writeTestProcess(t, root, 1100, 1, "php", "/usr/bin/php /var/www/moodle/admin/cli/cron.php", 150000, 500, 100, 5)
+
+	return root
+}
+
+func TestMoodleService_GetProcesses(t *testing.T) {
+	manager := services.NewFakeServiceManager()
+	for _, unit := range []string{"mariadb", "php8.1-fpm", "nginx"} {
+		manager.Start(unit)
+	}
+
+	components := append(config.DefaultComponents(), config.ComponentConfig{Name: "cache", Type: config.ComponentCache, Unit: "redis", Order: 15})
+	moodleService := services.NewMoodleService(config.MoodleConfig{Components: components})
+	moodleService.SetServiceManager(manager)
+	moodleService.SetProcRoot(setupTestProcFS(t))
+
+	report, err := moodleService.GetProcesses()
+	if err != nil {
+		t.Fatalf("GetProcesses failed: %v", err)
+	}
+
+	byName := make(map[string]models.ComponentProcesses)
+	for _, component := range report.Components {
+		byName[component.Name] = component
+	}
+
+	phpfpm := byName["php-fpm"]
+	if phpfpm.Count != 3 || phpfpm.RSS != (20000+90000+420000)*1024 || phpfpm.Threads != 6 || phpfpm.OpenFDs != 26 {
+		t.Fatalf("Expected the PHP-FPM master and both workers, got %+v", phpfpm)
+	}
+	if phpfpm.CPUTime != float64(100+50+2000+300+9000+700)/100 {
+		t.Errorf("Unexpected PHP-FPM CPU time %f", phpfpm.CPUTime)
+	}
+
+	// The worker eating memory comes first
+	largest := phpfpm.Processes[0]
+	if largest.PID != 1011 || largest.Role != models.ProcessWorker || largest.Cmdline != "php-fpm: pool www" {
+		t.Errorf("Expected worker 1011 first, got %+v", largest)
+	}
+	if master := phpfpm.Processes[2]; master.PID != 1002 || master.Role != models.ProcessMaster {
+		t.Errorf("Expected the master last, got %+v", master)
+	}
+	if largest.StartedAt.Unix() != 1700000005 {
+		t.Errorf("Expected the start time 5s after boot, got %v", largest.StartedAt)
+	}
+
+	if web := byName["web"]; web.Count != 2 || web.Processes[0].PID != 1020 {
+		t.Errorf("Expected the nginx master and worker, got %+v", web)
+	}
+	if database := byName["database"]; database.Count != 1 || database.Processes[0].Name != "mariadbd" {
+		t.Errorf("Expected MariaDB, got %+v", database)
+	}
+
+	// Redis is not running under the service manager and is found by name
+	if cache := byName["cache"]; cache.Count != 1 || cache.Processes[0].PID != 1030 {
+		t.Errorf("Expected Redis to be found by name, got %+v", cache)
+	}
+	if cron := byName["cron"]; cron.Count != 1 || cron.Processes[0].PID != 1100 {
+		t.Errorf("Expected the cron run, got %+v", cron)
+	}
+}
+
+func TestMoodleService_GetProcessesUnreadableFDs(t *testing.T) {
+	root := setupTestProcFS(t)
+	if err := os.RemoveAll(filepath.Join(root, "1003", "fd")); err != nil {
+		t.Fatalf("Failed to remove fd directory: %v", err)
+	}
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{Components: config.DefaultComponents(), ServiceManager: config.ServiceManagerFake})
+	moodleService.SetProcRoot(root)
+
+	report, err := moodleService.GetProcesses()
+	if err != nil {
+		t.Fatalf("GetProcesses failed: %v", err)
+	}
+
+	for _, component := range report.Components {
+		if component.Name != "web" {
+			continue
+		}
+		if component.OpenFDs != 30 || component.Processes[1].OpenFDs != -1 {
+			t.Errorf("Expected unknown descriptors of the master to be left out, got %+v", component)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package unit
+
+import (
+	"testing"
+
+	"lms-manager/services"
+)
+
+func TestCreateTables_KeepsExistingData(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	if _, err := db.Exec(`INSERT INTO alerts (id, type, severity, message) VALUES ('alert-1', 'cpu_high', 'warning', 'CPU usage is high')`); err != nil {
+		t.Fatalf("Failed to insert alert: %v", err)
+	}
+
+	// Tables are created on every start
+	if err := services.CreateTables(db); err != nil {
+		t.Fatalf("CreateTables failed on an existing database: %v", err)
+	}
+
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM alerts`).Scan(&count); err != nil || count != 1 {
+		t.Errorf("Expected the existing alert to be kept, got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,153 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// setupTestStorage creates a moodledata tree with old and new files
+func setupTestStorage(t *testing.T) (*services.MoodleService, string) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "moodledata")
+
+	writeTestFile(t, dataPath, "filedir/da/39/da39a3ee5e6b4b0d3255bfef95601890afd80709", "12345")
+	writeTestFile(t, dataPath, "filedir/2a/ae/2aae6c35c94fcfb415dbe95f408b9ce91ee846ed", "1234567890")
+	writeTestFile(t, dataPath, "temp/backup/old.mbz", "old backup")
+	writeTestFile(t, dataPath, "temp/new.tmp", "new")
+	writeTestFile(t, dataPath, "trashdir/00/11/0011aa", "trash")
+	writeTestFile(t, dataPath, "cache/core/cache.php", "<?php")
+	writeTestFile(t, dataPath, "lang/de/langconfig.php", "<?php")
+	writeTestFile(t, dataPath, "climaintenance.html", "<html>")
+
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	for _, path := range []string{"temp/backup/old.mbz", "temp/backup", "trashdir/00/11/0011aa", "trashdir/00/11", "trashdir/00"} {
+		if err := os.Chtimes(filepath.Join(dataPath, path), old, old); err != nil {
+			t.Fatalf("Failed to age %s: %v", path, err)
+		}
+	}
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{
+		Path:           filepath.Join(dir, "moodle"),
+		ConfigPath:     filepath.Join(dir, "moodle", "config.php"),
+		DataPath:       dataPath,
+		ServiceManager: config.ServiceManagerFake,
+		Components:     config.DefaultComponents(),
+		Storage:        config.DefaultStorageConfig(),
+	})
+
+	return moodleService, dataPath
+}
+
+// storageAreas indexes the areas of a report by name
+func storageAreas(report *models.StorageReport) map[string]models.StorageArea {
+	areas := make(map[string]models.StorageArea)
+	for _, area := range report.Areas {
+		areas[area.Name] = area
+	}
+	return areas
+}
+
+func TestMoodleService_ScanStorage(t *testing.T) {
+	moodleService, dataPath := setupTestStorage(t)
+
+	report, err := moodleService.ScanStorage()
+	if err != nil {
+		t.Fatalf("ScanStorage failed: %v", err)
+	}
+
+	areas := storageAreas(report)
+	if filedir := areas["filedir"]; filedir.Size != 15 || filedir.Files != 2 {
+		t.Errorf("Unexpected filedir usage %d bytes in %d files", filedir.Size, filedir.Files)
+	}
+
+	temp := areas["temp"]
+	if temp.Files != 2 || temp.OldestFile == nil || time.Since(*temp.OldestFile) < 9*24*time.Hour {
+		t.Errorf("Expected 2 temp files with a 10 day old oldest file, got %+v", temp)
+	}
+
+	if areas["sessions"].Exists || areas["muc"].Exists {
+		t.Error("Missing areas should be reported as not existing")
+	}
+
+	if other := areas["other"]; other.Files != 2 {
+		t.Errorf("Expected lang and climaintenance.html in other, got %d files", other.Files)
+	}
+
+	if report.Files != 8 || report.ScannedAt == nil {
+		t.Errorf("Expected 8 files in total, got %d", report.Files)
+	}
+
+	// New content is picked up by the incremental scan
+	writeTestFile(t, dataPath, "filedir/da/39/da39a3ee5e6b4b0d3255bfef95601890afd80710", "123")
+	report, _ = moodleService.ScanStorage()
+	if filedir := storageAreas(report)["filedir"]; filedir.Size != 18 || filedir.Files != 3 {
+		t.Errorf("Expected the rescan to find the new file, got %d bytes in %d files", filedir.Size, filedir.Files)
+	}
+}
+
+func TestMoodleService_GetStorageReport(t *testing.T) {
+	moodleService, _ := setupTestStorage(t)
+
+	report, err := moodleService.GetStorageReport(false)
+	if err != nil {
+		t.Fatalf("GetStorageReport failed: %v", err)
+	}
+	if !report.Scanning || report.ScannedAt != nil {
+		t.Fatalf("Expected a background scan to start, got %+v", report)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for report.Scanning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		report, _ = moodleService.GetStorageReport(false)
+	}
+
+	if report.Scanning || report.Files != 8 {
+		t.Errorf("Expected the cached breakdown, got %+v", report)
+	}
+}
+
+func TestMoodleService_CleanupStorage(t *testing.T) {
+	moodleService, dataPath := setupTestStorage(t)
+
+	preview, err := moodleService.CleanupStorage(models.StorageCleanupRequest{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+
+	if preview.Files != 2 || preview.Size != int64(len("old backup")+len("trash")) {
+		t.Errorf("Expected 2 old files in the preview, got %+v", preview)
+	}
+	if _, err := os.Stat(filepath.Join(dataPath, "temp", "backup", "old.mbz")); err != nil {
+		t.Error("A dry run should not delete anything")
+	}
+
+	result, err := moodleService.CleanupStorage(models.StorageCleanupRequest{})
+	if err != nil {
+		t.Fatalf("CleanupStorage failed: %v", err)
+	}
+	if result.Files != preview.Files || result.Directories != preview.Directories {
+		t.Errorf("Cleanup %+v should match the preview %+v", result, preview)
+	}
+
+	for _, path := range []string{"temp/backup/old.mbz", "trashdir/00"} {
+		if _, err := os.Stat(filepath.Join(dataPath, path)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be deleted", path)
+		}
+	}
+	for _, path := range []string{"temp/new.tmp", "temp", "trashdir", "filedir/da/39"} {
+		if _, err := os.Stat(filepath.Join(dataPath, path)); err != nil {
+			t.Errorf("Expected %s to be kept: %v", path, err)
+		}
+	}
+
+	if _, err := moodleService.CleanupStorage(models.StorageCleanupRequest{Areas: []string{"filedir"}}); err == nil {
+		t.Error("filedir must not be cleaned up")
+	}
+}
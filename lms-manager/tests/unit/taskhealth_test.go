@@ -0,0 +1,77 @@
+package unit
+
+import (
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// testTaskHealth returns the task health of a site whose notifications are
+// stuck behind a failing mail server
+func testTaskHealth(now time.Time) *models.TaskHealth {
+	scheduled := []models.ScheduledTask{
+		{Classname: `\core\task\messaging_cleanup_task`, Component: "moodle", NextRunTime: now.Add(-5 * time.Minute)},
+		{Classname: `\mod_forum\task\cron_task`, Component: "mod_forum", NextRunTime: now.Add(time.Minute), FailDelay: 240},
+		{Classname: `\core\task\backup_cleanup_task`, Component: "moodle", NextRunTime: now.Add(-3 * time.Hour)},
+		{Classname: `\tool_legacy\task\sync_task`, Component: "tool_legacy", NextRunTime: now.Add(-72 * time.Hour), FailDelay: 86400, Disabled: true},
+	}
+
+	oldest := now.Add(-2 * time.Hour)
+	recent := now.Add(-time.Minute)
+	adhoc := []models.AdhocTaskQueue{
+		{Classname: `\core\task\send_email_task`, Queued: 340, Due: 338, Failing: 2, OldestDue: &oldest},
+		{Classname: `\core\task\course_backup_task`, Queued: 3, Due: 1, OldestDue: &recent},
+	}
+
+	return services.NewTaskHealth(config.DefaultTaskHealthConfig(), scheduled, adhoc, now)
+}
+
+func TestNewTaskHealth(t *testing.T) {
+	now := time.Now()
+	health := testTaskHealth(now)
+
+	if len(health.Failing) != 1 || health.Failing[0].Classname != `\mod_forum\task\cron_task` {
+		t.Errorf("Expected the forum task failing and the disabled task ignored, got %+v", health.Failing)
+	}
+	if len(health.Overdue) != 1 || health.Overdue[0].Classname != `\core\task\backup_cleanup_task` || health.Overdue[0].Overdue != 3*3600 {
+		t.Errorf("Expected only the task 3 hours late to be overdue, got %+v", health.Overdue)
+	}
+
+	if health.AdhocQueued != 343 || health.AdhocFailing != 2 || health.OldestAdhocAge != 2*3600 {
+		t.Errorf("Unexpected adhoc totals %+v", health)
+	}
+	if len(health.Adhoc) != 2 || health.Adhoc[0].Classname != `\core\task\send_email_task` || !health.Adhoc[0].Stuck {
+		t.Errorf("Expected the mail queue on top and stuck, got %+v", health.Adhoc)
+	}
+	if health.Adhoc[1].Stuck || health.Adhoc[1].OldestAge != 60 {
+		t.Errorf("A queue with a task due for a minute is not stuck, got %+v", health.Adhoc[1])
+	}
+}
+
+func TestMonitorService_CheckTaskHealth(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	now := time.Now()
+	monitorService.CheckTaskHealth(testTaskHealth(now))
+
+	for _, alertType := range []string{services.AlertTaskFailing, services.AlertTaskOverdue, services.AlertAdhocQueueStuck} {
+		if countAlerts(t, db, alertType) != 1 {
+			t.Errorf("Expected a %s alert", alertType)
+		}
+	}
+
+	healthy := services.NewTaskHealth(config.DefaultTaskHealthConfig(), nil, nil, now)
+	monitorService.CheckTaskHealth(healthy)
+
+	for _, alertType := range []string{services.AlertTaskFailing, services.AlertTaskOverdue, services.AlertAdhocQueueStuck} {
+		if countAlerts(t, db, alertType) != 0 {
+			t.Errorf("Expected the %s alert to be resolved", alertType)
+		}
+	}
+}
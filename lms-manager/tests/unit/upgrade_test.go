@@ -0,0 +1,298 @@
+package unit
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// fakeUpgradePHP is a stand-in PHP binary. upgrade.php exits with the code
+// read from a file next to it and cfg.php reports the code version as the
+// database version.
+const fakeUpgradePHP = `#!/bin/sh
+dir=$(dirname "$0")
+case "$1" in
+-r) echo "8.1.2" ;;
+-m) printf '[PHP Modules]\niconv\nmysqli\n' ;;
+*/upgrade.php)
+    [ "$2" = "--is-pending" ] && exit 0
+    echo "Upgrading Moodle"
+    exit "$(cat "$dir/exitcode")" ;;
+*/cfg.php) sed -n 's/^\$version *= *\([0-9.]*\);.*/\1/p' "$(dirname "$1")/../../version.php" ;;
+esac
+`
+
+// fakeMysql lists one table, records drops and stores imported dumps
+const fakeMysql = `#!/bin/sh
+dir=$(dirname "$0")
+for arg; do
+    case "$arg" in
+    "SELECT "*) echo mdl_config; exit 0 ;;
+    "SET "*) echo "$arg" > "$dir/dropped"; exit 0 ;;
+    esac
+done
+cat > "$dir/restored"
+`
+
+const fakeMysqldump = `#!/bin/sh
+echo "-- moodle dump"
+`
+
+const testUpgradeConfigPHP = `<?php
+$CFG = new stdClass();
+$CFG->dbtype    = 'mysqli';
+$CFG->dbhost    = 'localhost';
+$CFG->dbname    = 'moodle';
+$CFG->dbuser    = 'moodle';
+$CFG->dbpass    = 'secret';
+$CFG->prefix    = 'mdl_';
+$CFG->wwwroot   = 'https://lms.example.com';
+$CFG->dataroot  = '/var/www/moodledata';
+require_once(__DIR__ . '/lib/setup.php');
+`
+
+const testEnvironmentXML = `<?xml version="1.0" encoding="UTF-8" ?>
+<COMPATIBILITY_MATRIX>
+  <MOODLE version="4.0" requires="3.6">
+    <PHP version="7.3.0" level="required" />
+  </MOODLE>
+  <MOODLE version="4.1" requires="3.11.8">
+    <PHP version="7.4.0" level="required" />
+    <PHP_EXTENSIONS>
+      <PHP_EXTENSION name="iconv" level="required" />
+      <PHP_EXTENSION name="%s" level="required" />
+      <PHP_EXTENSION name="opcache" level="optional" />
+    </PHP_EXTENSIONS>
+  </MOODLE>
+</COMPATIBILITY_MATRIX>
+`
+
+type upgradeFixture struct {
+	moodle *services.MoodleService
+	cron   *services.CronService
+	config config.MoodleConfig
+	dir    string
+	bin    string
+}
+
+// writeTestCodeTree writes a minimal Moodle code tree
+func writeTestCodeTree(t *testing.T, root, versionPHP string) {
+	writeTestFile(t, root, "version.php", versionPHP)
+	writeTestFile(t, root, "admin/cli/upgrade.php", "<?php\n")
+	writeTestFile(t, root, "admin/cli/cfg.php", "<?php\n")
+	writeTestFile(t, root, "lib/components.json", `{"plugintypes": {"mod": "mod", "local": "local"}}`)
+	writeTestFile(t, root, "lib/classes/plugin_manager.php", testPluginManagerPHP)
+	writeTestFile(t, root, "mod/forum/version.php", "<?php\n$plugin->version = 2022112800;\n$plugin->component = 'mod_forum';\n")
+}
+
+// setupTestUpgrade creates a Moodle 4.1.3 site and a 4.1.5 release archive
+// whose environment.xml requires the given PHP extension
+func setupTestUpgrade(t *testing.T, requiredExtension string) (*upgradeFixture, string) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+
+	writeTestFile(t, bin, "php", fakeUpgradePHP)
+	writeTestFile(t, bin, "mysql", fakeMysql)
+	writeTestFile(t, bin, "mysqldump", fakeMysqldump)
+	writeTestFile(t, bin, "exitcode", "0")
+	for _, name := range []string{"php", "mysql", "mysqldump"} {
+		if err := os.Chmod(filepath.Join(bin, name), 0755); err != nil {
+			t.Fatalf("Failed to make %s executable: %v", name, err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	site := filepath.Join(dir, "www", "moodle")
+	writeTestCodeTree(t, site, testVersionPHP)
+	writeTestFile(t, site, "config.php", testUpgradeConfigPHP)
+	writeTestFile(t, site, "local/reports/version.php", "<?php\n$plugin->version = 2024050100;\n$plugin->requires = 2022112800;\n$plugin->component = 'local_reports';\n")
+
+	release := filepath.Join(dir, "release", "moodle")
+	writeTestCodeTree(t, release, strings.Replace(strings.Replace(testVersionPHP, "2022112803.00", "2022112805.00", 1), "4.1.3", "4.1.5", 1))
+	writeTestFile(t, release, "admin/environment.xml", strings.Replace(testEnvironmentXML, "%s", requiredExtension, 1))
+
+	archive := filepath.Join(dir, "releases", "moodle-4.1.5.tgz")
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		t.Fatalf("Failed to create release directory: %v", err)
+	}
+	if output, err := exec.Command("tar", "-czf", archive, "-C", filepath.Join(dir, "release"), "moodle").CombinedOutput(); err != nil {
+		t.Fatalf("Failed to create archive: %v: %s", err, output)
+	}
+
+	moodleConfig := config.MoodleConfig{
+		Path:           site,
+		ConfigPath:     filepath.Join(site, "config.php"),
+		DataPath:       filepath.Join(dir, "moodledata"),
+		PHPBinary:      filepath.Join(bin, "php"),
+		ServiceManager: config.ServiceManagerFake,
+		Components:     config.DefaultComponents(),
+		Upgrade: config.UpgradeConfig{
+			ArchivePath: filepath.Dir(archive),
+			BackupPath:  filepath.Join(dir, "backups"),
+			Timeout:     60,
+		},
+	}
+	if err := os.MkdirAll(moodleConfig.DataPath, 0755); err != nil {
+		t.Fatalf("Failed to create moodledata: %v", err)
+	}
+
+	fixture := &upgradeFixture{
+		moodle: services.NewMoodleService(moodleConfig),
+		config: moodleConfig,
+		dir:    dir,
+		bin:    bin,
+	}
+	fixture.cron = services.NewCronService(config.DefaultCronConfig(), fixture.moodle, nil)
+	fixture.moodle.SetCronService(fixture.cron)
+	return fixture, archive
+}
+
+func (f *upgradeFixture) codeVersion(t *testing.T) string {
+	version, err := services.ParseMoodleVersion(filepath.Join(f.config.Path, "version.php"))
+	if err != nil {
+		t.Fatalf("Failed to parse version.php: %v", err)
+	}
+	return version.Version
+}
+
+// leftovers returns the staging and old code directories next to the site
+func (f *upgradeFixture) leftovers(t *testing.T) []string {
+	entries, err := os.ReadDir(filepath.Dir(f.config.Path))
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", filepath.Dir(f.config.Path), err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != "moodle" {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+func TestMoodleService_Upgrade(t *testing.T) {
+	fixture, archive := setupTestUpgrade(t, "mysqli")
+
+	db := setupTestDB(t)
+	defer db.Close()
+	jobService := services.NewJobService(fixture.moodle)
+	jobService.SetDatabase(db)
+
+	job, err := jobService.RunUpgrade(models.UpgradeRequest{Archive: archive}, "user-1", "admin")
+	if err != nil {
+		t.Fatalf("RunUpgrade failed: %v", err)
+	}
+
+	output, finished := waitForJob(t, jobService, job.ID)
+	if finished.Status != models.JobSucceeded {
+		t.Fatalf("Expected upgrade to succeed, got %s: %s\n%s", finished.Status, finished.Error, output)
+	}
+
+	if !strings.Contains(output, "[7/7] Verifying the upgrade") || !strings.Contains(output, "Upgrading Moodle") {
+		t.Errorf("Expected upgrade progress in the job output, got:\n%s", output)
+	}
+
+	// The site is locked before the backup is taken
+	if !strings.Contains(output, "[3/7] Enabling maintenance mode") || !strings.Contains(output, "[4/7] Backing up code and database") {
+		t.Errorf("Expected maintenance mode to be enabled before the backup, got:\n%s", output)
+	}
+
+	if version := fixture.codeVersion(t); version != "2022112805.00" {
+		t.Errorf("Expected the new code to be installed, got version %s", version)
+	}
+
+	for _, file := range []string{"config.php", "local/reports/version.php"} {
+		if _, err := os.Stat(filepath.Join(fixture.config.Path, file)); err != nil {
+			t.Errorf("Expected %s to be carried over: %v", file, err)
+		}
+	}
+
+	if leftovers := fixture.leftovers(t); len(leftovers) != 0 {
+		t.Errorf("Expected staging and old code to be removed, found %v", leftovers)
+	}
+
+	if fixture.moodle.GetMaintenanceStatus().Enabled {
+		t.Error("Maintenance mode should be disabled after the upgrade")
+	}
+
+	if fixture.cron.GetStatus().Paused {
+		t.Error("Cron should be resumed after the upgrade")
+	}
+
+	backups, _ := filepath.Glob(filepath.Join(fixture.config.Upgrade.BackupPath, "moodle-db-*.sql.gz"))
+	if len(backups) != 1 {
+		t.Errorf("Expected a database backup, found %v", backups)
+	}
+}
+
+func TestMoodleService_UpgradeRollback(t *testing.T) {
+	fixture, archive := setupTestUpgrade(t, "mysqli")
+	writeTestFile(t, fixture.bin, "exitcode", "1")
+
+	var output bytes.Buffer
+	err := fixture.moodle.Upgrade(context.Background(), &output, models.UpgradeRequest{Archive: archive})
+	if err == nil {
+		t.Fatal("Expected the upgrade to fail")
+	}
+
+	if version := fixture.codeVersion(t); version != "2022112803.00" {
+		t.Errorf("Expected the old code to be restored, got version %s", version)
+	}
+
+	restored, err := os.ReadFile(filepath.Join(fixture.bin, "restored"))
+	if err != nil || !strings.Contains(string(restored), "-- moodle dump") {
+		t.Errorf("Expected the database dump to be restored, got %q (%v)", restored, err)
+	}
+
+	dropped, _ := os.ReadFile(filepath.Join(fixture.bin, "dropped"))
+	if !strings.Contains(string(dropped), "`mdl_config`") {
+		t.Errorf("Expected Moodle tables to be dropped before the restore, got %q", dropped)
+	}
+
+	if leftovers := fixture.leftovers(t); len(leftovers) != 0 {
+		t.Errorf("Expected staging and failed code to be removed, found %v", leftovers)
+	}
+
+	if fixture.moodle.GetMaintenanceStatus().Enabled {
+		t.Error("Maintenance mode should be disabled after a successful rollback")
+	}
+
+	if fixture.cron.GetStatus().Paused {
+		t.Error("Cron should be resumed after the rollback")
+	}
+
+	if !strings.Contains(output.String(), "Rollback complete") {
+		t.Errorf("Expected rollback progress in the output, got:\n%s", output.String())
+	}
+}
+
+func TestMoodleService_UpgradeRequirements(t *testing.T) {
+	fixture, archive := setupTestUpgrade(t, "sodium")
+
+	var output bytes.Buffer
+	err := fixture.moodle.Upgrade(context.Background(), &output, models.UpgradeRequest{Archive: archive})
+	if err == nil || !strings.Contains(err.Error(), "sodium") {
+		t.Fatalf("Expected a missing extension error, got %v", err)
+	}
+
+	if version := fixture.codeVersion(t); version != "2022112803.00" {
+		t.Errorf("The code should not be touched, got version %s", version)
+	}
+
+	if _, err := os.Stat(fixture.config.Upgrade.BackupPath); !os.IsNotExist(err) {
+		t.Error("No backup should be taken when the requirements are not met")
+	}
+
+	if leftovers := fixture.leftovers(t); len(leftovers) != 0 {
+		t.Errorf("Expected the staging directory to be removed, found %v", leftovers)
+	}
+}
@@ -0,0 +1,127 @@
+package unit
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/models"
+	"lms-manager/services"
+)
+
+// testUsageEvent returns a standard log event. Module events are logged in
+// the course of the module.
+func testUsageEvent(id, userID, courseID, cmid int64, eventName string, created time.Time) services.UsageEvent {
+	event := services.UsageEvent{
+		ID:        id,
+		EventName: eventName,
+		Component: "core",
+		UserID:    userID,
+		CourseID:  courseID,
+		Time:      created,
+	}
+	if cmid > 0 {
+		event.Component = "mod_quiz"
+		event.ContextLevel = 70
+		event.ContextInstanceID = cmid
+	}
+	return event
+}
+
+func TestUsageService_Record(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	moodleService := services.NewMoodleService(config.MoodleConfig{Path: "/var/www/moodle"})
+	usageService := services.NewUsageService(config.DefaultUsageConfig(), moodleService, monitorService)
+	usageService.SetDatabase(db)
+
+	if _, found, err := usageService.LastID(); err != nil || found {
+		t.Fatalf("Expected no processed events yet, got %v", err)
+	}
+
+	// An exam starts: three students log in and attempt a quiz
+	exam := time.Now().Add(-30 * time.Minute).Truncate(5 * time.Minute)
+	login := `\core\event\user_loggedin`
+	viewed := `\mod_quiz\event\course_module_viewed`
+	events := []services.UsageEvent{
+		testUsageEvent(101, 5, 0, 0, login, exam),
+		testUsageEvent(102, 6, 0, 0, login, exam.Add(time.Minute)),
+		testUsageEvent(103, 5, 12, 42, viewed, exam.Add(2*time.Minute)),
+		testUsageEvent(104, 6, 12, 42, viewed, exam.Add(2*time.Minute)),
+		testUsageEvent(105, 0, 1, 0, `\core\event\course_viewed`, exam.Add(3*time.Minute)),
+	}
+	if err := usageService.Record(events, map[int64]string{12: "MATH101"}, 105); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	// The next batch adds a late login to the same bucket, one student seen
+	// before and a forum post in another course
+	events = []services.UsageEvent{
+		testUsageEvent(106, 7, 0, 0, login, exam.Add(4*time.Minute)),
+		testUsageEvent(107, 5, 12, 42, viewed, exam.Add(4*time.Minute)),
+		testUsageEvent(108, 8, 15, 0, `\mod_forum\event\post_created`, exam.Add(10*time.Minute)),
+	}
+	if err := usageService.Record(events, map[int64]string{12: "MATH101", 15: "HIST200"}, 108); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if err := usageService.RecordOnline(9, exam.Add(3*time.Minute)); err != nil {
+		t.Fatalf("RecordOnline failed: %v", err)
+	}
+	if err := usageService.RecordOnline(4, exam.Add(4*time.Minute)); err != nil {
+		t.Fatalf("RecordOnline failed: %v", err)
+	}
+
+	// The host was busy during the exam
+	stats, _ := json.Marshal(models.SystemStats{CPUUsage: 80, MemoryUsage: 60})
+	if _, err := db.Exec(`
+		INSERT INTO system_logs (id, level, message, source, data, created_at)
+		VALUES ('stats-1', 'INFO', 'System stats updated', 'monitor', ?, ?)
+	`, string(stats), exam.Add(90*time.Second)); err != nil {
+		t.Fatalf("Failed to log system stats: %v", err)
+	}
+
+	report, err := usageService.GetUsage(24)
+	if err != nil {
+		t.Fatalf("GetUsage failed: %v", err)
+	}
+
+	if len(report.Buckets) != 2 {
+		t.Fatalf("Expected two 5-minute buckets, got %+v", report.Buckets)
+	}
+	first := report.Buckets[0]
+	if first.ActiveUsers != 3 || first.OnlineUsers != 9 || first.Events != 7 || first.Logins != 3 {
+		t.Errorf("Unexpected exam bucket %+v", first)
+	}
+	if first.CPU == nil || *first.CPU != 80 || first.Memory == nil || *first.Memory != 60 {
+		t.Errorf("Expected the host load of the exam bucket, got %+v", first)
+	}
+	if second := report.Buckets[1]; second.ActiveUsers != 1 || second.Events != 1 || second.CPU != nil {
+		t.Errorf("Unexpected second bucket %+v", second)
+	}
+
+	if report.PeakUsers != 9 || report.PeakTime == nil || !report.PeakTime.Equal(exam) {
+		t.Errorf("Expected the peak at the start of the exam, got %d at %v", report.PeakUsers, report.PeakTime)
+	}
+	logins := 0
+	for _, hour := range report.LoginsPerHour {
+		logins += hour.Logins
+	}
+	if logins != 3 {
+		t.Errorf("Expected 3 logins, got %+v", report.LoginsPerHour)
+	}
+
+	if len(report.TopCourses) != 2 || report.TopCourses[0].Name != "MATH101" || report.TopCourses[0].Events != 3 {
+		t.Errorf("Expected the exam course on top without the site course, got %+v", report.TopCourses)
+	}
+	if len(report.TopModules) != 1 || report.TopModules[0].ID != 42 || report.TopModules[0].Name != "mod_quiz" {
+		t.Errorf("Expected the quiz as the only module, got %+v", report.TopModules)
+	}
+
+	if lastID, found, _ := usageService.LastID(); !found || lastID != 108 || report.LastID != 108 {
+		t.Errorf("Expected the last processed id to be 108, got %d", lastID)
+	}
+}
@@ -0,0 +1,126 @@
+package unit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"lms-manager/config"
+	"lms-manager/services"
+)
+
+const testNginxStatus = `Active connections: 291
+server accepts handled requests
+ 16630948 16630948 31070465
+Reading: 6 Writing: 179 Waiting: 106
+`
+
+const testApacheStatus = `localhost
+ServerVersion: Apache/2.4.57 (Debian)
+ServerMPM: event
+Total Accesses: 5120
+Total kBytes: 88012
+Uptime: 86400
+ReqPerSec: .0592593
+BusyWorkers: 3
+IdleWorkers: 72
+ConnsTotal: 14
+ConnsAsyncWriting: 1
+ConnsAsyncKeepAlive: 9
+ConnsAsyncClosing: 0
+Scoreboard: __RW_K____W_______........
+`
+
+func TestParseWebStatus(t *testing.T) {
+	nginx, err := services.ParseWebStatus("", testNginxStatus)
+	if err != nil {
+		t.Fatalf("Failed to parse nginx status: %v", err)
+	}
+	if nginx.Server != config.WebServerNginx || nginx.ActiveConnections != 291 || nginx.TotalRequests != 31070465 {
+		t.Errorf("Unexpected nginx metrics %+v", nginx)
+	}
+	if nginx.ReadingConnections != 6 || nginx.WritingConnections != 179 || nginx.WaitingConnections != 106 {
+		t.Errorf("Unexpected nginx connection states %+v", nginx)
+	}
+
+	apache, err := services.ParseWebStatus("", testApacheStatus)
+	if err != nil {
+		t.Fatalf("Failed to parse Apache status: %v", err)
+	}
+	if apache.Server != config.WebServerApache || apache.ActiveConnections != 14 || apache.TotalRequests != 5120 {
+		t.Errorf("Unexpected Apache metrics %+v", apache)
+	}
+	if apache.ReadingConnections != 1 || apache.WritingConnections != 3 || apache.WaitingConnections != 10 {
+		t.Errorf("Unexpected Apache connection states %+v", apache)
+	}
+
+	if _, err := services.ParseWebStatus("", "<html>It works!</html>"); err == nil {
+		t.Error("Expected an error for a page that is not a status page")
+	}
+	if _, err := services.ParseWebStatus(config.WebServerApache, "Scoreboard: ___"); err == nil {
+		t.Error("Expected an error for an Apache page without ExtendedStatus")
+	}
+}
+
+func TestWebStatusService_Sample(t *testing.T) {
+	var requests int64 = 1000
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nginx_status" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "Active connections: 12\nserver accepts handled requests\n 500 500 %d\nReading: 1 Writing: 3 Waiting: 8\n", atomic.LoadInt64(&requests))
+	}))
+	defer server.Close()
+
+	db := setupTestDB(t)
+	defer db.Close()
+	monitorService := services.NewMonitorService(config.DefaultConfig().Monitoring)
+	monitorService.SetDatabase(db)
+
+	webConfig := config.DefaultWebStatusConfig()
+	webConfig.URL = server.URL + "/nginx_status"
+	webService := services.NewWebStatusService(webConfig, monitorService)
+
+	first, err := webService.Sample()
+	if err != nil {
+		t.Fatalf("Sample failed: %v", err)
+	}
+	if first.RequestCount != 0 || first.RequestsPerSec != 0 || first.ActiveConnections != 12 {
+		t.Errorf("Expected connections but no rate on the first sample, got %+v", first)
+	}
+	monitorService.RecordWebMetrics(first)
+
+	time.Sleep(50 * time.Millisecond)
+	atomic.StoreInt64(&requests, 1100)
+
+	second, err := webService.Sample()
+	if err != nil {
+		t.Fatalf("Sample failed: %v", err)
+	}
+	if second.RequestCount != 100 || second.RequestsPerSec <= 0 || second.RequestsPerSec > 2000 {
+		t.Errorf("Expected 100 requests since the first sample, got %+v", second)
+	}
+	monitorService.RecordWebMetrics(second)
+
+	// A reload of nginx resets the counter
+	atomic.StoreInt64(&requests, 40)
+	if third, _ := webService.Sample(); third.RequestCount != 40 {
+		t.Errorf("Expected the requests since the reset, got %d", third.RequestCount)
+	}
+
+	if stats := monitorService.GetStats(); stats.Web == nil || stats.Web.RequestCount != 100 {
+		t.Errorf("Expected the web tier in the system stats, got %+v", stats.Web)
+	}
+
+	history, err := monitorService.GetWebMetricsHistory(10)
+	if err != nil {
+		t.Fatalf("GetWebMetricsHistory failed: %v", err)
+	}
+	if len(history) != 2 || history[0].RequestCount != 100 || history[0].Server != config.WebServerNginx {
+		t.Errorf("Expected both samples in the history, newest first, got %+v", history)
+	}
+}
@@ -236,9 +236,10 @@ func IsProcessRunning(processName string) (bool, error) {
 	return true, nil
 }
 
-// GetProcessPID returns the PID of a process
+// GetProcessPID returns the PID of the oldest process with the given name,
+// the master of daemons that fork workers
 func GetProcessPID(processName string) (int, error) {
-	cmd := exec.Command("pgrep", processName)
+	cmd := exec.Command("pgrep", "-o", processName)
 	output, err := cmd.Output()
 	if err != nil {
 		return 0, err